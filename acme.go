@@ -0,0 +1,437 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+const (
+	// Certificates are renewed this long before they expire, and checked for renewal every interval
+	acmeRenewBefore     = 30 * 24 * time.Hour
+	acmeRenewalInterval = 12 * time.Hour
+	acmeOrderTimeout    = 5 * time.Minute
+
+	defaultACMECache = "acme-cache"
+	acmeAccountKey   = "acme-account.key"
+)
+
+// acmeManager obtains and renews the TLS certificates of the gateway's hostnames from an ACME CA (RFC
+// 8555), such as Let's Encrypt, answering its tls-alpn-01 challenges (RFC 8737) on the TLS listener
+// itself. The account key and certificates are stored in a cache, so that restarts do not request new
+// certificates.
+type acmeManager struct {
+	client    *acme.Client
+	email     string
+	hostnames []string
+	cache     certificateCache
+	now       func() time.Time
+
+	mu         sync.Mutex
+	certs      map[string]*tls.Certificate
+	challenges map[string]*tls.Certificate
+
+	// orders serializes certificate orders, and registered is only accessed with it held
+	orders     sync.Mutex
+	registered bool
+}
+
+// acmeManagerFromEnvironment returns the manager of the ACME_HOSTNAMES certificates, or nil if it is not
+// set.
+func acmeManagerFromEnvironment() (*acmeManager, error) {
+	hostnames := []string{}
+	for _, hostname := range splitList(os.Getenv(acmeHostnamesVariable)) {
+		hostnames = append(hostnames, strings.ToLower(strings.TrimSuffix(hostname, ".")))
+	}
+	if len(hostnames) == 0 {
+		return nil, nil
+	}
+	directoryURL := os.Getenv(acmeDirectoryURLVariable)
+	if directoryURL == "" {
+		directoryURL = acme.LetsEncryptURL
+	}
+	location := os.Getenv(acmeCacheVariable)
+	if location == "" {
+		location = defaultACMECache
+	}
+	cache, err := certificateCacheFromLocation(location)
+	if err != nil {
+		return nil, err
+	}
+	return newACMEManager(&acme.Client{DirectoryURL: directoryURL}, os.Getenv(acmeEmailVariable), hostnames, cache), nil
+}
+
+func newACMEManager(client *acme.Client, email string, hostnames []string, cache certificateCache) *acmeManager {
+	return &acmeManager{
+		client:     client,
+		email:      email,
+		hostnames:  hostnames,
+		cache:      cache,
+		now:        time.Now,
+		certs:      map[string]*tls.Certificate{},
+		challenges: map[string]*tls.Certificate{},
+	}
+}
+
+// tlsConfig returns the config of TLS listeners that serve the managed certificates.
+func (m *acmeManager) tlsConfig() *tls.Config {
+	return &tls.Config{GetCertificate: m.getCertificate, NextProtos: []string{acme.ALPNProto}}
+}
+
+func (m *acmeManager) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if name == "" {
+		name = m.hostnames[0]
+	}
+	if len(hello.SupportedProtos) == 1 && hello.SupportedProtos[0] == acme.ALPNProto {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if cert, ok := m.challenges[name]; ok {
+			return cert, nil
+		}
+		return nil, fmt.Errorf("No pending ACME challenge for %s", name)
+	}
+	for _, hostname := range m.hostnames {
+		if name == hostname {
+			return m.certificate(name)
+		}
+	}
+	return nil, fmt.Errorf("No certificate for server name %q", name)
+}
+
+func (m *acmeManager) renewalDue(cert *tls.Certificate) bool {
+	return m.now().Add(acmeRenewBefore).After(cert.Leaf.NotAfter)
+}
+
+// certificate returns the certificate of hostname, loading it from the cache or ordering it if there is
+// none that is not due for renewal. A certificate that failed to renew is served until it expires.
+func (m *acmeManager) certificate(hostname string) (*tls.Certificate, error) {
+	m.mu.Lock()
+	cert, ok := m.certs[hostname]
+	m.mu.Unlock()
+	if ok && !m.renewalDue(cert) {
+		return cert, nil
+	}
+
+	m.orders.Lock()
+	defer m.orders.Unlock()
+	m.mu.Lock()
+	cert, ok = m.certs[hostname]
+	m.mu.Unlock()
+	if ok && !m.renewalDue(cert) {
+		return cert, nil
+	}
+	if !ok {
+		if cached, err := m.load(hostname); err == nil && !m.renewalDue(cached) {
+			m.store(hostname, cached)
+			return cached, nil
+		} else if err == nil {
+			cert, ok = cached, true
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), acmeOrderTimeout)
+	defer cancel()
+	renewed, err := m.order(ctx, hostname)
+	if err != nil {
+		if ok && m.now().Before(cert.Leaf.NotAfter) {
+			log.Printf("Failed to renew the certificate of %s: %s", hostname, err)
+			m.store(hostname, cert)
+			return cert, nil
+		}
+		return nil, fmt.Errorf("Failed to obtain a certificate for %s: %s", hostname, err)
+	}
+	m.store(hostname, renewed)
+	log.Printf("Obtained a certificate for %s, valid until %s", hostname, renewed.Leaf.NotAfter)
+	return renewed, nil
+}
+
+func (m *acmeManager) store(hostname string, cert *tls.Certificate) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.certs[hostname] = cert
+}
+
+// run obtains the certificates of all hostnames, and renews them when they are due.
+func (m *acmeManager) run() {
+	for {
+		for _, hostname := range m.hostnames {
+			if _, err := m.certificate(hostname); err != nil {
+				log.Printf("%s", err)
+			}
+		}
+		time.Sleep(acmeRenewalInterval)
+	}
+}
+
+// load returns the cached certificate of hostname, stored as the PEM private key followed by the PEM
+// certificate chain.
+func (m *acmeManager) load(hostname string) (*tls.Certificate, error) {
+	data, err := m.cache.get(hostname)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := tls.X509KeyPair(data, data)
+	if err != nil {
+		return nil, err
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
+
+// register creates the ACME account, or finds the existing account of the cached account key.
+func (m *acmeManager) register(ctx context.Context) error {
+	if m.registered {
+		return nil
+	}
+	var key *ecdsa.PrivateKey
+	data, err := m.cache.get(acmeAccountKey)
+	if err == errCertificateCacheMiss {
+		if key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+			return err
+		}
+		if data, err = marshalECPrivateKey(key); err != nil {
+			return err
+		}
+		if err := m.cache.put(acmeAccountKey, data); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	} else {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return fmt.Errorf("Invalid ACME account key")
+		}
+		if key, err = x509.ParseECPrivateKey(block.Bytes); err != nil {
+			return err
+		}
+	}
+
+	m.client.Key = key
+	account := &acme.Account{}
+	if m.email != "" {
+		account.Contact = []string{"mailto:" + m.email}
+	}
+	if _, err := m.client.Register(ctx, account, acme.AcceptTOS); err != nil && err != acme.ErrAccountAlreadyExists {
+		return err
+	}
+	m.registered = true
+	return nil
+}
+
+// order orders a new certificate for hostname, and stores it in the cache.
+func (m *acmeManager) order(ctx context.Context, hostname string) (*tls.Certificate, error) {
+	if err := m.register(ctx); err != nil {
+		return nil, fmt.Errorf("ACME registration failed: %s", err)
+	}
+	order, err := m.client.AuthorizeOrder(ctx, acme.DomainIDs(hostname))
+	if err != nil {
+		return nil, err
+	}
+	for _, authzURL := range order.AuthzURLs {
+		if err := m.authorize(ctx, hostname, authzURL); err != nil {
+			return nil, err
+		}
+	}
+	if order, err = m.client.WaitOrder(ctx, order.URI); err != nil {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{DNSNames: []string{hostname}}, key)
+	if err != nil {
+		return nil, err
+	}
+	chain, _, err := m.client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := marshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	for _, der := range chain {
+		data = append(data, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	if err := m.cache.put(hostname, data); err != nil {
+		return nil, err
+	}
+	return m.load(hostname)
+}
+
+// authorize fulfills the tls-alpn-01 challenge of a pending authorization.
+func (m *acmeManager) authorize(ctx context.Context, hostname, authzURL string) error {
+	authz, err := m.client.GetAuthorization(ctx, authzURL)
+	if err != nil {
+		return err
+	}
+	if authz.Status != acme.StatusPending {
+		return nil
+	}
+	var challenge *acme.Challenge
+	for _, c := range authz.Challenges {
+		if c.Type == "tls-alpn-01" {
+			challenge = c
+		}
+	}
+	if challenge == nil {
+		return fmt.Errorf("The ACME CA offers no tls-alpn-01 challenge for %s", hostname)
+	}
+	cert, err := m.client.TLSALPN01ChallengeCert(challenge.Token, hostname)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	m.challenges[hostname] = &cert
+	m.mu.Unlock()
+	defer func() {
+		m.mu.Lock()
+		delete(m.challenges, hostname)
+		m.mu.Unlock()
+	}()
+
+	if _, err := m.client.Accept(ctx, challenge); err != nil {
+		return err
+	}
+	_, err = m.client.WaitAuthorization(ctx, authz.URI)
+	return err
+}
+
+func marshalECPrivateKey(key *ecdsa.PrivateKey) ([]byte, error) {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+}
+
+var errCertificateCacheMiss = errors.New("Not in the certificate cache")
+
+// certificateCache stores the ACME account key and certificates by name.
+type certificateCache interface {
+	// get returns the data stored under name, or errCertificateCacheMiss.
+	get(name string) ([]byte, error)
+	put(name string, data []byte) error
+}
+
+// certificateCacheFromLocation builds the certificate cache of a location of the form s3://<bucket>/<prefix>,
+// or of a directory path.
+func certificateCacheFromLocation(location string) (certificateCache, error) {
+	if !strings.HasPrefix(location, "s3://") {
+		return dirCertificateCache(location), nil
+	}
+	cacheURL, err := url.Parse(location)
+	if err != nil || cacheURL.Host == "" {
+		return nil, fmt.Errorf("Invalid certificate cache location %q", location)
+	}
+	region, err := awsRegion()
+	if err != nil {
+		return nil, err
+	}
+	prefix := strings.TrimPrefix(cacheURL.Path, "/")
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	return &s3CertificateCache{
+		endpoint:    fmt.Sprintf("https://%s.s3.%s.amazonaws.com", cacheURL.Host, region),
+		prefix:      prefix,
+		region:      region,
+		credentials: newAWSCredentialChain(),
+		client:      keyProviderHTTPClient,
+	}, nil
+}
+
+// dirCertificateCache stores each entry in a file of the directory, readable only by the gateway.
+type dirCertificateCache string
+
+func (d dirCertificateCache) get(name string) ([]byte, error) {
+	data, err := ioutil.ReadFile(filepath.Join(string(d), name))
+	if os.IsNotExist(err) {
+		return nil, errCertificateCacheMiss
+	}
+	return data, err
+}
+
+func (d dirCertificateCache) put(name string, data []byte) error {
+	if err := os.MkdirAll(string(d), 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(string(d), name), data, 0600)
+}
+
+// s3CertificateCache stores each entry in an S3 object under a key prefix, using the AWS credential chain.
+type s3CertificateCache struct {
+	endpoint    string
+	prefix      string
+	region      string
+	credentials *awsCredentialChain
+	client      *http.Client
+}
+
+func (c *s3CertificateCache) do(method, name string, payload []byte) (*http.Response, error) {
+	creds, err := c.credentials.Retrieve()
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(method, c.endpoint+"/"+awsURIEncode(c.prefix+name, false), bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	signAWSRequest(req, payload, creds, c.region, "s3", time.Now())
+	return c.client.Do(req)
+}
+
+func (c *s3CertificateCache) get(name string) ([]byte, error) {
+	resp, err := c.do(http.MethodGet, name, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, errCertificateCacheMiss
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("S3 certificate cache read of %s failed with status %d", name, resp.StatusCode)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+func (c *s3CertificateCache) put(name string, data []byte) error {
+	resp, err := c.do(http.MethodPut, name, data)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("S3 certificate cache write of %s failed with status %d", name, resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,255 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+// acmeIdentifierOID is the certificate extension of tls-alpn-01 challenge certificates (RFC 8737).
+var acmeIdentifierOID = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 31}
+
+// fakeACMEServer is an ACME CA that validates tls-alpn-01 challenges by asking the manager for the
+// challenge certificate, and issues certificates for every CSR.
+type fakeACMEServer struct {
+	*httptest.Server
+	t       *testing.T
+	manager *acmeManager
+
+	mu          sync.Mutex
+	orders      int
+	validated   bool
+	orderStatus string
+	leaf        []byte
+	caKey       *ecdsa.PrivateKey
+	ca          *x509.Certificate
+}
+
+func startFakeACMEServer(t *testing.T) *fakeACMEServer {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Fake ACME CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, _ := x509.ParseCertificate(der)
+	s := &fakeACMEServer{t: t, caKey: caKey, ca: ca}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *fakeACMEServer) order(w http.ResponseWriter, status int) {
+	w.Header().Set("Location", s.URL+"/order/1")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":         s.orderStatus,
+		"identifiers":    []map[string]string{{"type": "dns", "value": "gateway.example"}},
+		"authorizations": []string{s.URL + "/authz/1"},
+		"finalize":       s.URL + "/finalize/1",
+		"certificate":    s.URL + "/cert/1",
+	})
+}
+
+func (s *fakeACMEServer) serve(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	w.Header().Set("Replay-Nonce", fmt.Sprintf("nonce-%d", time.Now().UnixNano()))
+	switch r.URL.Path {
+	case "/directory":
+		json.NewEncoder(w).Encode(map[string]string{
+			"newNonce":   s.URL + "/nonce",
+			"newAccount": s.URL + "/account",
+			"newOrder":   s.URL + "/order",
+			"revokeCert": s.URL + "/revoke",
+			"keyChange":  s.URL + "/key-change",
+		})
+	case "/nonce":
+	case "/account":
+		w.Header().Set("Location", s.URL+"/account/1")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"status": "valid"}`))
+	case "/order":
+		s.orders++
+		s.validated = false
+		s.orderStatus = "pending"
+		s.order(w, http.StatusCreated)
+	case "/order/1":
+		s.order(w, http.StatusOK)
+	case "/authz/1":
+		status := "pending"
+		if s.validated {
+			status = "valid"
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":     status,
+			"identifier": map[string]string{"type": "dns", "value": "gateway.example"},
+			"challenges": []map[string]string{{"type": "tls-alpn-01", "url": s.URL + "/challenge/1", "token": "token-1", "status": status}},
+		})
+	case "/challenge/1":
+		cert, err := s.manager.getCertificate(&tls.ClientHelloInfo{ServerName: "gateway.example", SupportedProtos: []string{acme.ALPNProto}})
+		if err != nil {
+			s.t.Errorf("Challenge certificate was not served: %s", err)
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+		for _, extension := range leaf.Extensions {
+			if extension.Id.Equal(acmeIdentifierOID) {
+				s.validated = true
+				s.orderStatus = "ready"
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]string{"type": "tls-alpn-01", "url": s.URL + "/challenge/1", "token": "token-1", "status": "valid"})
+	case "/finalize/1":
+		var jws struct{ Payload string }
+		json.NewDecoder(r.Body).Decode(&jws)
+		payload, _ := base64.RawURLEncoding.DecodeString(jws.Payload)
+		var finalize struct{ CSR string }
+		json.Unmarshal(payload, &finalize)
+		der, _ := base64.RawURLEncoding.DecodeString(finalize.CSR)
+		csr, err := x509.ParseCertificateRequest(der)
+		if err != nil || s.orderStatus != "ready" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(time.Now().UnixNano()),
+			DNSNames:     csr.DNSNames,
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		}
+		if s.leaf, err = x509.CreateCertificate(rand.Reader, template, s.ca, csr.PublicKey, s.caKey); err != nil {
+			s.t.Error(err)
+		}
+		s.orderStatus = "valid"
+		s.order(w, http.StatusOK)
+	case "/cert/1":
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: s.leaf})
+		pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: s.ca.Raw})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestACMEManager(t *testing.T) {
+	server := startFakeACMEServer(t)
+	cache := dirCertificateCache(t.TempDir())
+	manager := newACMEManager(&acme.Client{DirectoryURL: server.URL + "/directory"}, "ops@gateway.example", []string{"gateway.example"}, cache)
+	server.manager = manager
+
+	cert, err := manager.getCertificate(&tls.ClientHelloInfo{ServerName: "Gateway.Example"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cert.Leaf.VerifyHostname("gateway.example"); err != nil || len(cert.Certificate) != 2 || !server.validated {
+		t.Fatalf("Unexpected certificate for %v (%v)", cert.Leaf.DNSNames, err)
+	}
+	if again, _ := manager.getCertificate(&tls.ClientHelloInfo{ServerName: "gateway.example"}); again != cert || server.orders != 1 {
+		t.Fatalf("Expected the certificate to be reused, got %d orders", server.orders)
+	}
+	if _, err := manager.getCertificate(&tls.ClientHelloInfo{ServerName: "other.example"}); err == nil {
+		t.Fatal("Expected a certificate for another server name to be refused")
+	}
+	if _, err := manager.getCertificate(&tls.ClientHelloInfo{ServerName: "gateway.example", SupportedProtos: []string{acme.ALPNProto}}); err == nil {
+		t.Fatal("Expected no challenge certificate without a pending challenge")
+	}
+	if _, err := cache.get(acmeAccountKey); err != nil {
+		t.Fatalf("Account key was not cached: %s", err)
+	}
+
+	// A restarted gateway serves the cached certificate without ordering it again
+	restarted := newACMEManager(&acme.Client{DirectoryURL: server.URL + "/directory"}, "", []string{"gateway.example"}, cache)
+	cached, err := restarted.getCertificate(&tls.ClientHelloInfo{ServerName: "gateway.example"})
+	if err != nil || !cached.Leaf.Equal(cert.Leaf) || server.orders != 1 {
+		t.Fatalf("Cached certificate was not served (%v), got %d orders", err, server.orders)
+	}
+
+	// Certificates are renewed when due, but still served if the renewal fails
+	server.manager = restarted
+	restarted.now = func() time.Time { return time.Now().Add(70 * 24 * time.Hour) }
+	if renewed, err := restarted.getCertificate(&tls.ClientHelloInfo{ServerName: "gateway.example"}); err != nil || renewed.Leaf.Equal(cert.Leaf) || server.orders != 2 {
+		t.Fatalf("Certificate was not renewed (%v), got %d orders", err, server.orders)
+	}
+	server.Close()
+	restarted.now = func() time.Time { return time.Now().Add(75 * 24 * time.Hour) }
+	restarted.certs["gateway.example"] = cert
+	if served, err := restarted.getCertificate(&tls.ClientHelloInfo{ServerName: "gateway.example"}); err != nil || served != cert {
+		t.Fatalf("Expected the certificate to be served after a failed renewal, got %v", err)
+	}
+}
+
+func TestS3CertificateCache(t *testing.T) {
+	objects := map[string][]byte{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/") || !strings.HasPrefix(r.URL.Path, "/certs/") {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		switch r.Method {
+		case http.MethodPut:
+			objects[r.URL.Path], _ = ioutil.ReadAll(r.Body)
+		case http.MethodGet:
+			if data, ok := objects[r.URL.Path]; ok {
+				w.Write(data)
+			} else {
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}
+	}))
+	defer server.Close()
+
+	t.Setenv(awsRegionVariable, "us-east-1")
+	t.Setenv(awsAccessKeyIDVariable, "AKIDEXAMPLE")
+	t.Setenv(awsSecretAccessKeyVariable, "secret")
+	cache, err := certificateCacheFromLocation("s3://bucket/certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s3 := cache.(*s3CertificateCache)
+	s3.endpoint = server.URL
+
+	if _, err := s3.get("gateway.example"); err != errCertificateCacheMiss {
+		t.Fatalf("Expected a cache miss, got %v", err)
+	}
+	if err := s3.put("gateway.example", []byte("pem")); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := s3.get("gateway.example"); err != nil || string(data) != "pem" {
+		t.Fatalf("Unexpected cached data %q (%v)", data, err)
+	}
+}
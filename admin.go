@@ -0,0 +1,129 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	adminRotateKeyEndpoint = "/admin/rotate-key"
+	adminRevokeKeyEndpoint = "/admin/revoke-key"
+)
+
+// adminServer serves operator endpoints on a listener separate from the public gateway endpoints.
+// Every request must carry the configured bearer token.
+type adminServer struct {
+	token   string
+	keyring *RotatingKeyring
+
+	// targetSwitches are the switchable targets of handlers by path
+	targetSwitches map[string]*targetSwitch
+	// metrics, if not nil, serves the metrics of the gateway
+	metrics http.Handler
+}
+
+func (s adminServer) mux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc(adminRotateKeyEndpoint, s.authenticated(s.rotateKeyHandler))
+	mux.HandleFunc(adminRevokeKeyEndpoint, s.authenticated(s.revokeKeyHandler))
+	mux.HandleFunc(adminSwitchTargetEndpoint, s.authenticated(s.switchTargetHandler))
+	mux.HandleFunc(adminRollbackTargetEndpoint, s.authenticated(s.rollbackTargetHandler))
+	if s.metrics != nil {
+		mux.HandleFunc(adminMetricsEndpoint, s.authenticated(s.metrics.ServeHTTP))
+	}
+	return mux
+}
+
+func (s adminServer) authenticated(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		authorization := r.Header.Get("Authorization")
+		token := strings.TrimPrefix(authorization, "Bearer ")
+		if token == authorization || subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) != 1 {
+			log.Printf("Rejected unauthenticated admin request %s %s", r.Method, r.URL.Path)
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(value)
+}
+
+// rotateKeyHandler generates a new key pair and makes it current. The previous key is retired after
+// the keyring's overlap window, or after the duration given by the optional overlap query parameter;
+// overlap=0s retires it immediately, e.g. after a suspected compromise.
+func (s adminServer) rotateKeyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	overlap := s.keyring.overlap
+	if value := r.URL.Query().Get("overlap"); value != "" {
+		var err error
+		if overlap, err = time.ParseDuration(value); err != nil || overlap < 0 {
+			http.Error(w, fmt.Sprintf("Invalid overlap: %s", value), http.StatusBadRequest)
+			return
+		}
+	}
+
+	previous := s.keyring.Current()
+	config, err := s.keyring.RotateWithOverlap(overlap)
+	if err != nil {
+		log.Printf("Admin key rotation failed: %s", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Rotated gateway key from admin endpoint, current key ID is now %d", config.ID)
+
+	writeJSON(w, map[string]interface{}{
+		"key_id":                  config.ID,
+		"previous_key_id":         previous.ID,
+		"previous_key_retired_at": time.Now().Add(overlap).UTC().Format(time.RFC3339),
+	})
+}
+
+// revokeKeyHandler revokes the key given by the key_id query parameter. The key stops being served
+// and requests encapsulated to it are rejected immediately.
+func (s adminServer) revokeKeyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	keyID, err := strconv.ParseUint(r.URL.Query().Get("key_id"), 10, 8)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid key_id: %s", r.URL.Query().Get("key_id")), http.StatusBadRequest)
+		return
+	}
+
+	if err := s.keyring.Revoke(uint8(keyID)); err == errUnknownKeyID {
+		http.Error(w, fmt.Sprintf("Unknown key_id: %d", keyID), http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("Admin key revocation failed: %s", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Revoked gateway key %d from admin endpoint", keyID)
+
+	writeJSON(w, map[string]interface{}{
+		"revoked_key_id": keyID,
+		"key_id":         s.keyring.Current().ID,
+	})
+}
@@ -0,0 +1,135 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+)
+
+func TestAdminRotateKey(t *testing.T) {
+	keyring := createKeyring(t)
+	admin := adminServer{
+		token:   "admin-token",
+		keyring: keyring,
+	}
+	handler := admin.mux()
+
+	for _, authorization := range []string{"", "admin-token", "Bearer wrong-token"} {
+		request := httptest.NewRequest(http.MethodPost, adminRotateKeyEndpoint, nil)
+		if authorization != "" {
+			request.Header.Set("Authorization", authorization)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, request)
+		if rr.Code != http.StatusUnauthorized {
+			t.Fatalf("Admin request with Authorization %q yielded %d", authorization, rr.Code)
+		}
+	}
+	if keyring.Current().ID != FIXED_KEY_ID {
+		t.Fatal("Unauthenticated request rotated the key")
+	}
+
+	request := httptest.NewRequest(http.MethodPost, adminRotateKeyEndpoint+"?overlap=0s", nil)
+	request.Header.Set("Authorization", "Bearer admin-token")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, request)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Admin rotation yielded %d", rr.Code)
+	}
+
+	if keyring.Current().ID == FIXED_KEY_ID {
+		t.Fatal("Admin rotation did not switch the current key")
+	}
+	if _, ok := keyring.Gateway(FIXED_KEY_ID); ok {
+		t.Fatal("Previous key still valid after rotation with zero overlap")
+	}
+}
+
+func TestAdminRevokeKey(t *testing.T) {
+	keyring := createKeyring(t)
+	admin := adminServer{
+		token:   "admin-token",
+		keyring: keyring,
+	}
+	handler := admin.mux()
+
+	for _, query := range []string{"", "?key_id=256", "?key_id=abc"} {
+		request := httptest.NewRequest(http.MethodPost, adminRevokeKeyEndpoint+query, nil)
+		request.Header.Set("Authorization", "Bearer admin-token")
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, request)
+		if rr.Code != http.StatusBadRequest {
+			t.Fatalf("Revocation with query %q yielded %d", query, rr.Code)
+		}
+	}
+
+	request := httptest.NewRequest(http.MethodPost, adminRevokeKeyEndpoint+"?key_id="+strconv.Itoa(int(FIXED_KEY_ID)), nil)
+	request.Header.Set("Authorization", "Bearer admin-token")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, request)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Admin revocation yielded %d", rr.Code)
+	}
+	if !keyring.Revoked(FIXED_KEY_ID) {
+		t.Fatal("Admin revocation did not revoke the key")
+	}
+
+	request = httptest.NewRequest(http.MethodPost, adminRevokeKeyEndpoint+"?key_id="+strconv.Itoa(int(FIXED_KEY_ID+100)), nil)
+	request.Header.Set("Authorization", "Bearer admin-token")
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, request)
+	if rr.Code != http.StatusNotFound {
+		t.Fatalf("Revocation of an unknown key yielded %d", rr.Code)
+	}
+}
+
+func TestAdminSwitchTarget(t *testing.T) {
+	blue, _ := url.Parse("https://blue.internal")
+	blueGreen := newTargetSwitch(blue)
+	admin := adminServer{
+		token:          "admin-token",
+		keyring:        createKeyring(t),
+		targetSwitches: map[string]*targetSwitch{"/gateway-app": blueGreen},
+	}
+	handler := admin.mux()
+	post := func(endpoint string) int {
+		request := httptest.NewRequest(http.MethodPost, endpoint, nil)
+		request.Header.Set("Authorization", "Bearer admin-token")
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, request)
+		return rr.Code
+	}
+
+	if code := post(adminRollbackTargetEndpoint + "?path=/gateway-app"); code != http.StatusConflict {
+		t.Fatalf("Rollback without a previous target yielded %d", code)
+	}
+	for _, query := range []string{"?path=/other&target=https://green.internal", "?path=/gateway-app&target=ftp://green.internal"} {
+		if code := post(adminSwitchTargetEndpoint + query); code != http.StatusNotFound && code != http.StatusBadRequest {
+			t.Fatalf("Invalid switch %s yielded %d", query, code)
+		}
+	}
+	if blueGreen.current() != blue {
+		t.Fatal("Invalid switch changed the target")
+	}
+
+	if code := post(adminSwitchTargetEndpoint + "?path=/gateway-app&target=https://green.internal"); code != http.StatusOK {
+		t.Fatalf("Switch yielded %d", code)
+	}
+	request := httptest.NewRequest(http.MethodGet, "https://client.example/path", nil)
+	FixedTargetHttpRequestHandler{target: blueGreen, httpHandler: ForbiddenCheckHttpRequestHandler{forbidden: "green.internal"}}.Handle(request, &MockMetrics{resultLabels: map[string]bool{}, tags: map[string]string{}})
+	if request.Host != "green.internal" {
+		t.Fatalf("Request sent to %s after the switch", request.Host)
+	}
+
+	if code := post(adminRollbackTargetEndpoint + "?path=/gateway-app"); code != http.StatusOK {
+		t.Fatalf("Rollback yielded %d", code)
+	}
+	if blueGreen.current() != blue {
+		t.Fatalf("Rollback switched to %s", blueGreen.current())
+	}
+}
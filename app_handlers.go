@@ -0,0 +1,105 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"plugin"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AppHandlerFactory creates a custom AppContentHandler, which can resolve HTTP requests with httpHandler.
+type AppHandlerFactory func(httpHandler HttpRequestHandler) AppContentHandler
+
+var appHandlers = struct {
+	sync.Mutex
+	factories map[string]AppHandlerFactory
+}{factories: make(map[string]AppHandlerFactory)}
+
+// RegisterAppHandler makes a custom AppContentHandler available to handler configs under name. It panics
+// if name is already registered.
+func RegisterAppHandler(name string, factory AppHandlerFactory) {
+	appHandlers.Lock()
+	defer appHandlers.Unlock()
+	if _, ok := appHandlers.factories[name]; ok {
+		panic(fmt.Sprintf("App handler %q registered twice", name))
+	}
+	appHandlers.factories[name] = factory
+}
+
+func lookupAppHandler(name string) (AppHandlerFactory, bool) {
+	appHandlers.Lock()
+	defer appHandlers.Unlock()
+	factory, ok := appHandlers.factories[name]
+	return factory, ok
+}
+
+// Plugins can not refer to the types of the gateway, so their handler is a function of standard library
+// types only: it takes the application request and a function that sends HTTP requests to the target.
+const appHandlerPluginSymbol = "HandleAppContent"
+
+type appHandlerPluginFunc = func(binaryRequest []byte, send func(*http.Request) (*http.Response, error)) ([]byte, error)
+
+// PluginAppHandler is an AppContentHandler that passes the application request to the handler of a Go plugin.
+type PluginAppHandler struct {
+	handle      appHandlerPluginFunc
+	httpHandler HttpRequestHandler
+}
+
+// Handle returns the response of the plugin handler, which sends its HTTP requests with the HttpRequestHandler.
+func (h PluginAppHandler) Handle(binaryRequest []byte, metrics Metrics) ([]byte, error) {
+	return h.HandleContext(context.Background(), binaryRequest, metrics)
+}
+
+// HandleContext is Handle with the HTTP requests of the plugin handler bound to ctx.
+func (h PluginAppHandler) HandleContext(ctx context.Context, binaryRequest []byte, metrics Metrics) ([]byte, error) {
+	binaryResponse, err := h.handle(binaryRequest, func(req *http.Request) (*http.Response, error) {
+		started := time.Now()
+		defer func() { metrics.Duration(metricsStageTargetFetch, time.Since(started)) }()
+		return h.httpHandler.Handle(req.WithContext(ctx), metrics)
+	})
+	if err != nil {
+		metrics.Fire(metricsResultContentDecodingFailed)
+		return nil, PayloadMarshallingError
+	}
+	metrics.Size(metricsSizeTargetResponse, len(binaryResponse))
+	metrics.Fire(metricsResultSuccess)
+	return binaryResponse, nil
+}
+
+// loadAppHandlerPlugins opens each of the comma-separated Go plugin paths, and registers its handler under
+// the plugin file name without extension.
+func loadAppHandlerPlugins(paths string) error {
+	for _, path := range strings.Split(paths, ",") {
+		path = strings.TrimSpace(path)
+		if path == "" {
+			continue
+		}
+		p, err := plugin.Open(path)
+		if err != nil {
+			return err
+		}
+		symbol, err := p.Lookup(appHandlerPluginSymbol)
+		if err != nil {
+			return err
+		}
+		handle, ok := symbol.(appHandlerPluginFunc)
+		if !ok {
+			return fmt.Errorf("Plugin %s: %s has type %T", path, appHandlerPluginSymbol, symbol)
+		}
+		name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+		if _, ok := lookupAppHandler(name); ok {
+			return fmt.Errorf("Plugin %s: app handler %q is already registered", path, name)
+		}
+		RegisterAppHandler(name, func(httpHandler HttpRequestHandler) AppContentHandler {
+			return PluginAppHandler{handle: handle, httpHandler: httpHandler}
+		})
+	}
+	return nil
+}
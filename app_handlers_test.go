@@ -0,0 +1,68 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"testing"
+)
+
+type upperCaseAppHandler struct{}
+
+func (h upperCaseAppHandler) Handle(binaryRequest []byte, metrics Metrics) ([]byte, error) {
+	metrics.Fire(metricsResultSuccess)
+	return bytes.ToUpper(binaryRequest), nil
+}
+
+func TestRegisterAppHandler(t *testing.T) {
+	RegisterAppHandler("test-upper", func(httpHandler HttpRequestHandler) AppContentHandler {
+		return upperCaseAppHandler{}
+	})
+	defer func() {
+		if recover() == nil {
+			t.Fatal("Expected a second registration to panic")
+		}
+	}()
+
+	factory := handlerFactory{keyring: createKeyring(t)}
+	handler, err := factory.build(handlerConfig{Path: "/gateway-upper", Type: handlerTypeTarget, AppHandler: "test-upper"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := handler.(DefaultEncapsulationHandler).appHandler.(upperCaseAppHandler); !ok {
+		t.Fatal("Expected the registered app handler")
+	}
+	if _, err := factory.build(handlerConfig{Path: "/gateway-upper", Type: handlerTypeTarget, AppHandler: "missing"}); err == nil {
+		t.Fatal("Expected an unknown app handler to be rejected")
+	}
+
+	RegisterAppHandler("test-upper", func(httpHandler HttpRequestHandler) AppContentHandler {
+		return upperCaseAppHandler{}
+	})
+}
+
+func TestPluginAppHandler(t *testing.T) {
+	handler := PluginAppHandler{
+		handle: func(binaryRequest []byte, send func(*http.Request) (*http.Response, error)) ([]byte, error) {
+			if len(binaryRequest) == 0 {
+				return nil, errors.New("empty request")
+			}
+			return append([]byte("plugin "), binaryRequest...), nil
+		},
+	}
+
+	metrics := &MockMetricsFactory{}
+	response, err := handler.Handle([]byte("request"), metrics.Create(metricsEventGatewayRequest))
+	if err != nil || !bytes.Equal(response, []byte("plugin request")) {
+		t.Fatalf("Unexpected plugin response %s: %v", response, err)
+	}
+	if _, err := handler.Handle(nil, metrics.Create(metricsEventGatewayRequest)); err != PayloadMarshallingError {
+		t.Fatalf("Expected %v, got %v", PayloadMarshallingError, err)
+	}
+	if err := loadAppHandlerPlugins("/nonexistent/handler.so"); err == nil {
+		t.Fatal("Expected a missing plugin to fail to load")
+	}
+}
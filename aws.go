@@ -0,0 +1,385 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Standard AWS environment variables
+	awsRegionVariable                    = "AWS_REGION"
+	awsDefaultRegionVariable             = "AWS_DEFAULT_REGION"
+	awsAccessKeyIDVariable               = "AWS_ACCESS_KEY_ID"
+	awsSecretAccessKeyVariable           = "AWS_SECRET_ACCESS_KEY"
+	awsSessionTokenVariable              = "AWS_SESSION_TOKEN"
+	awsWebIdentityTokenFileVariable      = "AWS_WEB_IDENTITY_TOKEN_FILE"
+	awsRoleARNVariable                   = "AWS_ROLE_ARN"
+	awsRoleSessionNameVariable           = "AWS_ROLE_SESSION_NAME"
+	awsContainerCredentialsRelativeURI   = "AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"
+	awsContainerCredentialsFullURI       = "AWS_CONTAINER_CREDENTIALS_FULL_URI"
+	awsContainerAuthorizationTokenHeader = "AWS_CONTAINER_AUTHORIZATION_TOKEN"
+
+	awsContainerCredentialsHost = "http://169.254.170.2"
+	awsInstanceMetadataHost     = "http://169.254.169.254"
+	awsDefaultRoleSessionName   = "ohttp-gateway"
+
+	// Credentials are refreshed this long before they expire
+	awsCredentialsExpiryWindow = 5 * time.Minute
+
+	awsSigningAlgorithm = "AWS4-HMAC-SHA256"
+	awsTimeFormat       = "20060102T150405Z"
+	awsDateFormat       = "20060102"
+)
+
+// awsCredentials is a set of (possibly temporary) AWS credentials.
+type awsCredentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	// Expiration is zero for long-lived credentials.
+	Expiration time.Time
+}
+
+// awsCredentialChain resolves AWS credentials the same way the AWS SDKs do: static credentials from
+// the environment, then a web identity token (e.g. IAM roles for Kubernetes service accounts), then
+// the ECS container credentials endpoint, and finally the EC2 instance role via IMDSv2. Temporary
+// credentials are cached until shortly before they expire.
+type awsCredentialChain struct {
+	mu     sync.Mutex
+	cached awsCredentials
+	client *http.Client
+}
+
+func newAWSCredentialChain() *awsCredentialChain {
+	return &awsCredentialChain{
+		client: keyProviderHTTPClient,
+	}
+}
+
+// awsRegion returns the configured AWS region.
+func awsRegion() (string, error) {
+	if region := os.Getenv(awsRegionVariable); region != "" {
+		return region, nil
+	}
+	if region := os.Getenv(awsDefaultRegionVariable); region != "" {
+		return region, nil
+	}
+	return "", fmt.Errorf("%s must be set to use AWS services", awsRegionVariable)
+}
+
+// Retrieve returns valid credentials, fetching new ones if the cached credentials are missing or
+// about to expire.
+func (c *awsCredentialChain) Retrieve() (awsCredentials, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.cached.AccessKeyID != "" && (c.cached.Expiration.IsZero() || time.Until(c.cached.Expiration) > awsCredentialsExpiryWindow) {
+		return c.cached, nil
+	}
+
+	creds, err := c.fetch()
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	c.cached = creds
+	return creds, nil
+}
+
+func (c *awsCredentialChain) fetch() (awsCredentials, error) {
+	if accessKeyID := os.Getenv(awsAccessKeyIDVariable); accessKeyID != "" {
+		return awsCredentials{
+			AccessKeyID:     accessKeyID,
+			SecretAccessKey: os.Getenv(awsSecretAccessKeyVariable),
+			SessionToken:    os.Getenv(awsSessionTokenVariable),
+		}, nil
+	}
+	if tokenFile := os.Getenv(awsWebIdentityTokenFileVariable); tokenFile != "" {
+		return c.fetchWebIdentity(tokenFile)
+	}
+	if relativeURI := os.Getenv(awsContainerCredentialsRelativeURI); relativeURI != "" {
+		return c.fetchContainer(awsContainerCredentialsHost + relativeURI)
+	}
+	if fullURI := os.Getenv(awsContainerCredentialsFullURI); fullURI != "" {
+		return c.fetchContainer(fullURI)
+	}
+	return c.fetchInstanceRole()
+}
+
+// awsTemporaryCredentials is the JSON encoding of credentials served by the ECS and EC2 endpoints.
+type awsTemporaryCredentials struct {
+	AccessKeyID     string    `json:"AccessKeyId"`
+	SecretAccessKey string    `json:"SecretAccessKey"`
+	Token           string    `json:"Token"`
+	Expiration      time.Time `json:"Expiration"`
+}
+
+func (t awsTemporaryCredentials) credentials() awsCredentials {
+	return awsCredentials{
+		AccessKeyID:     t.AccessKeyID,
+		SecretAccessKey: t.SecretAccessKey,
+		SessionToken:    t.Token,
+		Expiration:      t.Expiration,
+	}
+}
+
+func (c *awsCredentialChain) fetchWebIdentity(tokenFile string) (awsCredentials, error) {
+	token, err := ioutil.ReadFile(tokenFile)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	region, err := awsRegion()
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	sessionName := os.Getenv(awsRoleSessionNameVariable)
+	if sessionName == "" {
+		sessionName = awsDefaultRoleSessionName
+	}
+
+	query := url.Values{}
+	query.Set("Action", "AssumeRoleWithWebIdentity")
+	query.Set("Version", "2011-06-15")
+	query.Set("RoleArn", os.Getenv(awsRoleARNVariable))
+	query.Set("RoleSessionName", sessionName)
+	query.Set("WebIdentityToken", strings.TrimSpace(string(token)))
+
+	resp, err := c.client.Get(fmt.Sprintf("https://sts.%s.amazonaws.com/?%s", region, query.Encode()))
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return awsCredentials{}, fmt.Errorf("AssumeRoleWithWebIdentity failed with status %d", resp.StatusCode)
+	}
+
+	var result struct {
+		Credentials struct {
+			AccessKeyID     string    `xml:"AccessKeyId"`
+			SecretAccessKey string    `xml:"SecretAccessKey"`
+			SessionToken    string    `xml:"SessionToken"`
+			Expiration      time.Time `xml:"Expiration"`
+		} `xml:"AssumeRoleWithWebIdentityResult>Credentials"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return awsCredentials{}, err
+	}
+	return awsCredentials{
+		AccessKeyID:     result.Credentials.AccessKeyID,
+		SecretAccessKey: result.Credentials.SecretAccessKey,
+		SessionToken:    result.Credentials.SessionToken,
+		Expiration:      result.Credentials.Expiration,
+	}, nil
+}
+
+func (c *awsCredentialChain) fetchContainer(endpoint string) (awsCredentials, error) {
+	req, err := http.NewRequest(http.MethodGet, endpoint, nil)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	if token := os.Getenv(awsContainerAuthorizationTokenHeader); token != "" {
+		req.Header.Set("Authorization", token)
+	}
+
+	var creds awsTemporaryCredentials
+	if err := c.getJSON(req, &creds); err != nil {
+		return awsCredentials{}, err
+	}
+	return creds.credentials(), nil
+}
+
+func (c *awsCredentialChain) fetchInstanceRole() (awsCredentials, error) {
+	tokenReq, err := http.NewRequest(http.MethodPut, awsInstanceMetadataHost+"/latest/api/token", nil)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	tokenReq.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "21600")
+	resp, err := c.client.Do(tokenReq)
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("No AWS credentials found: %s", err)
+	}
+	defer resp.Body.Close()
+	token, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return awsCredentials{}, fmt.Errorf("IMDS token request failed with status %d", resp.StatusCode)
+	}
+
+	roleReq, err := http.NewRequest(http.MethodGet, awsInstanceMetadataHost+"/latest/meta-data/iam/security-credentials/", nil)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	roleReq.Header.Set("X-aws-ec2-metadata-token", string(token))
+	roleResp, err := c.client.Do(roleReq)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	defer roleResp.Body.Close()
+	role, err := ioutil.ReadAll(roleResp.Body)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	if roleResp.StatusCode != http.StatusOK {
+		return awsCredentials{}, fmt.Errorf("No IAM role attached to the instance (status %d)", roleResp.StatusCode)
+	}
+
+	credsReq, err := http.NewRequest(http.MethodGet, awsInstanceMetadataHost+"/latest/meta-data/iam/security-credentials/"+strings.TrimSpace(string(role)), nil)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	credsReq.Header.Set("X-aws-ec2-metadata-token", string(token))
+
+	var creds awsTemporaryCredentials
+	if err := c.getJSON(credsReq, &creds); err != nil {
+		return awsCredentials{}, err
+	}
+	return creds.credentials(), nil
+}
+
+func (c *awsCredentialChain) getJSON(req *http.Request, result interface{}) error {
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s %s failed with status %d", req.Method, req.URL, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	digest := sha256.Sum256(data)
+	return hex.EncodeToString(digest[:])
+}
+
+// awsURIEncode percent-encodes s as required by Signature Version 4, leaving only the RFC 3986
+// unreserved characters (and, if encodeSlash is false, '/') as-is.
+func awsURIEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !encodeSlash) {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// signAWSRequest signs req in place using AWS Signature Version 4. The payload must be the exact
+// request body. All headers already set on req, plus Host, are included in the signature.
+func signAWSRequest(req *http.Request, payload []byte, creds awsCredentials, region, service string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format(awsTimeFormat)
+	payloadHash := sha256Hex(payload)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	if service == "s3" {
+		req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	}
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for name, values := range req.Header {
+		if strings.EqualFold(name, "Authorization") {
+			continue
+		}
+		trimmed := make([]string, len(values))
+		for i, value := range values {
+			trimmed[i] = strings.Join(strings.Fields(value), " ")
+		}
+		headers[strings.ToLower(name)] = strings.Join(trimmed, ",")
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	query := req.URL.Query()
+	queryKeys := make([]string, 0, len(query))
+	for key := range query {
+		queryKeys = append(queryKeys, key)
+	}
+	sort.Strings(queryKeys)
+	queryParts := []string{}
+	for _, key := range queryKeys {
+		values := query[key]
+		sort.Strings(values)
+		for _, value := range values {
+			queryParts = append(queryParts, awsURIEncode(key, true)+"="+awsURIEncode(value, true))
+		}
+	}
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	if service != "s3" {
+		path = awsURIEncode(path, false)
+	}
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		strings.Join(queryParts, "&"),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	date := now.Format(awsDateFormat)
+	scope := strings.Join([]string{date, region, service, "aws4_request"}, "/")
+	stringToSign := strings.Join([]string{
+		awsSigningAlgorithm,
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	signingKey := hmacSHA256([]byte("AWS4"+creds.SecretAccessKey), date)
+	signingKey = hmacSHA256(signingKey, region)
+	signingKey = hmacSHA256(signingKey, service)
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		awsSigningAlgorithm, creds.AccessKeyID, scope, signedHeaders, signature))
+}
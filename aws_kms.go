@@ -0,0 +1,132 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// awsKMSClient calls the AWS KMS JSON API.
+type awsKMSClient struct {
+	region      string
+	credentials *awsCredentialChain
+	client      *http.Client
+}
+
+func newAWSKMSClient(region string) *awsKMSClient {
+	return &awsKMSClient{
+		region:      region,
+		credentials: newAWSCredentialChain(),
+		client:      keyProviderHTTPClient,
+	}
+}
+
+func (c *awsKMSClient) call(operation string, request, result interface{}) error {
+	creds, err := c.credentials.Retrieve()
+	if err != nil {
+		return err
+	}
+
+	payload, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("https://kms.%s.amazonaws.com/", c.region), bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "TrentService."+operation)
+	signAWSRequest(req, payload, creds, c.region, "kms", time.Now())
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("KMS %s failed with status %d", operation, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+// Decrypt decrypts a ciphertext blob produced by KMS Encrypt.
+func (c *awsKMSClient) Decrypt(blob []byte) ([]byte, error) {
+	var result struct {
+		Plaintext []byte `json:"Plaintext"`
+	}
+	if err := c.call("Decrypt", map[string][]byte{"CiphertextBlob": blob}, &result); err != nil {
+		return nil, err
+	}
+	return result.Plaintext, nil
+}
+
+// Encrypt encrypts plaintext under the KMS key identified by keyID (a key ID, ARN, or alias).
+func (c *awsKMSClient) Encrypt(keyID string, plaintext []byte) ([]byte, error) {
+	request := map[string]interface{}{
+		"KeyId":     keyID,
+		"Plaintext": plaintext,
+	}
+	var result struct {
+		CiphertextBlob []byte `json:"CiphertextBlob"`
+	}
+	if err := c.call("Encrypt", request, &result); err != nil {
+		return nil, err
+	}
+	return result.CiphertextBlob, nil
+}
+
+// AWSKMSKeyProvider is a KeyProvider that decrypts a KMS-encrypted seed blob, so the plaintext seed
+// only ever exists in process memory.
+type AWSKMSKeyProvider struct {
+	blobPath string
+	kms      *awsKMSClient
+}
+
+// newAWSKMSKeyProvider builds an AWSKMSKeyProvider from a key source of the form
+// aws-kms:///path/to/seed.enc?region=<region>. The file holds the ciphertext blob returned by
+// `aws kms encrypt`, either raw or base64-encoded. The region defaults to AWS_REGION, and
+// credentials are resolved from the environment, a web identity token, or the attached IAM role.
+func newAWSKMSKeyProvider(source *url.URL) (*AWSKMSKeyProvider, error) {
+	if source.Path == "" {
+		return nil, fmt.Errorf("AWS KMS key source is missing the encrypted seed path")
+	}
+
+	region := source.Query().Get("region")
+	if region == "" {
+		var err error
+		if region, err = awsRegion(); err != nil {
+			return nil, err
+		}
+	}
+
+	return &AWSKMSKeyProvider{
+		blobPath: source.Path,
+		kms:      newAWSKMSClient(region),
+	}, nil
+}
+
+func (p *AWSKMSKeyProvider) Name() string {
+	return "aws-kms"
+}
+
+// Seed reads the encrypted seed blob and decrypts it with KMS.
+func (p *AWSKMSKeyProvider) Seed() ([]byte, error) {
+	blob, err := ioutil.ReadFile(p.blobPath)
+	if err != nil {
+		return nil, err
+	}
+	if decoded, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(blob))); err == nil {
+		blob = decoded
+	}
+
+	return p.kms.Decrypt(blob)
+}
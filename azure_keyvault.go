@@ -0,0 +1,194 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Standard Azure identity environment variables
+	azureClientIDVariable           = "AZURE_CLIENT_ID"
+	azureTenantIDVariable           = "AZURE_TENANT_ID"
+	azureFederatedTokenFileVariable = "AZURE_FEDERATED_TOKEN_FILE"
+	azureAuthorityHostVariable      = "AZURE_AUTHORITY_HOST"
+
+	azureInstanceMetadataTokenURL = "http://169.254.169.254/metadata/identity/oauth2/token"
+	azureDefaultAuthorityHost     = "https://login.microsoftonline.com/"
+	azureKeyVaultResource         = "https://vault.azure.net"
+	azureKeyVaultAPIVersion       = "7.4"
+	azureTokenExpiryWindow        = 5 * time.Minute
+)
+
+// azureTokenSource fetches and caches Azure AD access tokens for Key Vault. On AKS with workload
+// identity it exchanges the projected service account token; otherwise it uses the managed identity
+// of the VM or node pool through the instance metadata service.
+type azureTokenSource struct {
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+	// metadataURL is the managed identity token endpoint of the instance metadata service.
+	metadataURL string
+	client      *http.Client
+}
+
+type azureTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	// ExpiresIn is a number from Azure AD but a string from the instance metadata service.
+	ExpiresIn json.Number `json:"expires_in"`
+}
+
+func (s *azureTokenSource) Token() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.token != "" && time.Until(s.expires) > azureTokenExpiryWindow {
+		return s.token, nil
+	}
+
+	var req *http.Request
+	var err error
+	if tokenFile := os.Getenv(azureFederatedTokenFileVariable); tokenFile != "" {
+		req, err = s.workloadIdentityRequest(tokenFile)
+	} else {
+		req, err = s.managedIdentityRequest()
+	}
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Azure token request failed with status %d", resp.StatusCode)
+	}
+
+	var result azureTokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", err
+	}
+	expiresIn, err := strconv.Atoi(result.ExpiresIn.String())
+	if err != nil {
+		return "", err
+	}
+	s.token = result.AccessToken
+	s.expires = time.Now().Add(time.Duration(expiresIn) * time.Second)
+	return s.token, nil
+}
+
+func (s *azureTokenSource) managedIdentityRequest() (*http.Request, error) {
+	query := url.Values{}
+	query.Set("api-version", "2018-02-01")
+	query.Set("resource", azureKeyVaultResource)
+	if clientID := os.Getenv(azureClientIDVariable); clientID != "" {
+		// Selects a user-assigned identity when several are attached
+		query.Set("client_id", clientID)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, s.metadataURL+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Metadata", "true")
+	return req, nil
+}
+
+func (s *azureTokenSource) workloadIdentityRequest(tokenFile string) (*http.Request, error) {
+	assertion, err := ioutil.ReadFile(tokenFile)
+	if err != nil {
+		return nil, err
+	}
+	authority := os.Getenv(azureAuthorityHostVariable)
+	if authority == "" {
+		authority = azureDefaultAuthorityHost
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "client_credentials")
+	form.Set("client_id", os.Getenv(azureClientIDVariable))
+	form.Set("client_assertion_type", "urn:ietf:params:oauth:client-assertion-type:jwt-bearer")
+	form.Set("client_assertion", strings.TrimSpace(string(assertion)))
+	form.Set("scope", azureKeyVaultResource+"/.default")
+
+	endpoint := fmt.Sprintf("%s/%s/oauth2/v2.0/token", strings.TrimSuffix(authority, "/"), os.Getenv(azureTenantIDVariable))
+	req, err := http.NewRequest(http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return req, nil
+}
+
+// AzureKeyVaultKeyProvider is a KeyProvider that reads the seed from an Azure Key Vault secret.
+type AzureKeyVaultKeyProvider struct {
+	secretURL string
+	tokens    *azureTokenSource
+	client    *http.Client
+}
+
+// newAzureKeyVaultKeyProvider builds an AzureKeyVaultKeyProvider from a key source of the form
+// azure-keyvault://<vault>.vault.azure.net/secrets/<name>[/<version>]. Without a version the
+// current version of the secret is read.
+func newAzureKeyVaultKeyProvider(source *url.URL) (*AzureKeyVaultKeyProvider, error) {
+	parts := strings.Split(strings.Trim(source.Path, "/"), "/")
+	if source.Host == "" || len(parts) < 2 || len(parts) > 3 || parts[0] != "secrets" {
+		return nil, fmt.Errorf("Invalid Azure Key Vault secret, expected azure-keyvault://<vault>.vault.azure.net/secrets/<name>[/<version>]")
+	}
+
+	return &AzureKeyVaultKeyProvider{
+		secretURL: fmt.Sprintf("https://%s/%s", source.Host, strings.Join(parts, "/")),
+		tokens:    &azureTokenSource{metadataURL: azureInstanceMetadataTokenURL, client: keyProviderHTTPClient},
+		client:    keyProviderHTTPClient,
+	}, nil
+}
+
+func (p *AzureKeyVaultKeyProvider) Name() string {
+	return "azure-keyvault"
+}
+
+// Seed reads the secret value. The value may hold either the raw seed bytes or their hex encoding.
+func (p *AzureKeyVaultKeyProvider) Seed() ([]byte, error) {
+	token, err := p.tokens.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodGet, p.secretURL+"?api-version="+azureKeyVaultAPIVersion, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Reading Key Vault secret failed with status %d", resp.StatusCode)
+	}
+
+	var secret struct {
+		Value string `json:"value"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&secret); err != nil {
+		return nil, err
+	}
+	if seed, err := hex.DecodeString(strings.TrimSpace(secret.Value)); err == nil {
+		return seed, nil
+	}
+	return []byte(secret.Value), nil
+}
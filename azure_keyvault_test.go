@@ -0,0 +1,123 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func newTestAzureKeyVaultKeyProvider(t *testing.T, serverURL string) *AzureKeyVaultKeyProvider {
+	sourceURL, err := url.Parse("azure-keyvault://gateway.vault.azure.net/secrets/seed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider, err := newAzureKeyVaultKeyProvider(sourceURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider.secretURL = serverURL + "/secrets/seed"
+	provider.tokens.metadataURL = serverURL + "/metadata/identity/oauth2/token"
+	return provider
+}
+
+func TestAzureKeyVaultKeyProviderSeed(t *testing.T) {
+	t.Setenv(azureFederatedTokenFileVariable, "")
+	t.Setenv(azureClientIDVariable, "")
+
+	value := "cafe"
+	tokenRequests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/metadata/identity/oauth2/token":
+			if r.Header.Get("Metadata") != "true" || r.URL.Query().Get("resource") != azureKeyVaultResource {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			tokenRequests++
+			// The instance metadata service reports expires_in as a string
+			fmt.Fprint(w, `{"access_token": "test-token", "expires_in": "3600"}`)
+		case "/secrets/seed":
+			if r.Header.Get("Authorization") != "Bearer test-token" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			if r.URL.Query().Get("api-version") != azureKeyVaultAPIVersion {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			fmt.Fprintf(w, `{"value": %q}`, value)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	provider := newTestAzureKeyVaultKeyProvider(t, server.URL)
+
+	seed, err := provider.Seed()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(seed, []byte{0xCA, 0xFE}) {
+		t.Fatalf("Unexpected hex-decoded seed %x", seed)
+	}
+
+	value = "raw seed"
+	seed, err = provider.Seed()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(seed, []byte("raw seed")) {
+		t.Fatalf("Unexpected raw seed %q", seed)
+	}
+
+	if tokenRequests != 1 {
+		t.Fatalf("Expected the managed identity token to be cached, got %d token requests", tokenRequests)
+	}
+}
+
+func TestAzureKeyVaultKeyProviderErrorStatus(t *testing.T) {
+	t.Setenv(azureFederatedTokenFileVariable, "")
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer server.Close()
+
+	// Token request rejected by the instance metadata service
+	provider := newTestAzureKeyVaultKeyProvider(t, server.URL)
+	if _, err := provider.Seed(); err == nil {
+		t.Fatal("Seed succeeded without a managed identity token")
+	}
+
+	// Secret request rejected by Key Vault
+	provider = newTestAzureKeyVaultKeyProvider(t, server.URL)
+	provider.tokens = &azureTokenSource{token: "test-token", expires: time.Now().Add(time.Hour)}
+	if _, err := provider.Seed(); err == nil {
+		t.Fatal("Seed succeeded although Key Vault rejected the request")
+	}
+}
+
+func TestAzureKeyVaultKeyProviderRejectsInvalidSources(t *testing.T) {
+	for _, source := range []string{
+		"azure-keyvault:///secrets/seed",
+		"azure-keyvault://gateway.vault.azure.net/keys/seed",
+		"azure-keyvault://gateway.vault.azure.net/secrets",
+		"azure-keyvault://gateway.vault.azure.net/secrets/seed/1/2",
+	} {
+		sourceURL, err := url.Parse(source)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := newAzureKeyVaultKeyProvider(sourceURL); err == nil {
+			t.Fatalf("Accepted invalid key source %s", source)
+		}
+	}
+}
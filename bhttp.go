@@ -0,0 +1,240 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/chris-wood/ohttp-go"
+)
+
+// The binary HTTP codec (RFC 9292) of ohttp-go neither decodes nor encodes trailer field sections, so the
+// gateway reads the trailers of requests and appends those of responses itself.
+
+// Trailer fields that would change how the target frames or routes the request are dropped, in addition
+// to the hop-by-hop headers.
+var disallowedTrailerFields = []string{"Content-Length", "Content-Encoding", "Content-Type", "Host", "Authorization"}
+
+func readBinarySlice(r *bytes.Reader) ([]byte, error) {
+	length, err := ohttp.Read(r)
+	if err != nil {
+		return nil, err
+	}
+	if length > uint64(r.Len()) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	data := make([]byte, length)
+	r.Read(data)
+	return data, nil
+}
+
+// unpadBinaryRequest returns a known-length binary HTTP request without the zeros that clients may pad it
+// with after its trailer field section (RFC 9292, Section 3.8), and fails if the padding is not zero.
+func unpadBinaryRequest(binaryRequest []byte) ([]byte, error) {
+	r := bytes.NewReader(binaryRequest)
+	indicator, err := ohttp.Read(r)
+	if err != nil {
+		return nil, err
+	}
+	if indicator != 0 {
+		return binaryRequest, nil
+	}
+	// Request control data, header fields, content, and trailer fields
+	for i := 0; i < 7 && r.Len() > 0; i++ {
+		if _, err := readBinarySlice(r); err != nil {
+			return nil, fmt.Errorf("Truncated binary HTTP request: %s", err)
+		}
+	}
+	length := len(binaryRequest) - r.Len()
+	for _, b := range binaryRequest[length:] {
+		if b != 0 {
+			return nil, fmt.Errorf("Binary HTTP request padding is not zero")
+		}
+	}
+	return binaryRequest[:length], nil
+}
+
+// binaryRequestTrailer returns the trailer fields of a known-length binary HTTP request (RFC 9292, Section
+// 3.8), which are empty if the request ends with its content.
+func binaryRequestTrailer(binaryRequest []byte) (http.Header, error) {
+	r := bytes.NewReader(binaryRequest)
+	indicator, err := ohttp.Read(r)
+	if err != nil {
+		return nil, err
+	}
+	if indicator != 0 {
+		return nil, nil
+	}
+	// Request control data, header fields, and content
+	for i := 0; i < 6; i++ {
+		if _, err := readBinarySlice(r); err != nil {
+			return nil, fmt.Errorf("Truncated binary HTTP request: %s", err)
+		}
+	}
+	if r.Len() == 0 {
+		return nil, nil
+	}
+	fields, err := readBinarySlice(r)
+	if err != nil {
+		return nil, fmt.Errorf("Truncated trailer fields: %s", err)
+	}
+
+	trailer := http.Header{}
+	f := bytes.NewReader(fields)
+	for f.Len() > 0 {
+		name, err := readBinarySlice(f)
+		if err != nil {
+			return nil, fmt.Errorf("Truncated trailer field: %s", err)
+		}
+		value, err := readBinarySlice(f)
+		if err != nil {
+			return nil, fmt.Errorf("Truncated trailer field %q: %s", name, err)
+		}
+		trailer.Add(string(name), string(value))
+	}
+	for _, name := range append(append([]string{}, hopByHopHeaders...), disallowedTrailerFields...) {
+		trailer.Del(name)
+	}
+	return trailer, nil
+}
+
+// informationalResponse is an interim 1xx response of the target, such as 103 (Early Hints).
+type informationalResponse struct {
+	status int
+	header http.Header
+}
+
+// informationalResponses collects the informational responses of the target requests of an application
+// request, which may be received concurrently by hedged attempts.
+type informationalResponses struct {
+	mu        sync.Mutex
+	responses []informationalResponse
+}
+
+type informationalResponsesKey struct{}
+
+// withInformationalResponses returns a context in which the handlers collect the informational responses
+// of their target requests.
+func withInformationalResponses(ctx context.Context) (context.Context, *informationalResponses) {
+	responses := &informationalResponses{}
+	return context.WithValue(ctx, informationalResponsesKey{}, responses), responses
+}
+
+// traceInformationalResponses returns req with a trace that collects its informational responses,
+// scrubbed alike the final response, if its context collects them. 100 (Continue) only concerns the
+// connection to the target and is never collected.
+func traceInformationalResponses(req *http.Request, scrubber headerScrubber) *http.Request {
+	responses, ok := req.Context().Value(informationalResponsesKey{}).(*informationalResponses)
+	if !ok {
+		return req
+	}
+	trace := &httptrace.ClientTrace{
+		Got1xxResponse: func(status int, header textproto.MIMEHeader) error {
+			if status == http.StatusContinue {
+				return nil
+			}
+			interim := &http.Response{Header: http.Header(header).Clone()}
+			scrubber.scrubResponse(interim)
+			responses.mu.Lock()
+			responses.responses = append(responses.responses, informationalResponse{status: status, header: interim.Header})
+			responses.mu.Unlock()
+			return nil
+		},
+	}
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+}
+
+// insert inserts the known-length informational responses (RFC 9292, Section 3.5.1) before the final
+// response control data of a known-length binary HTTP response.
+func (r *informationalResponses) insert(binaryResponse []byte) []byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.responses) == 0 || len(binaryResponse) == 0 {
+		return binaryResponse
+	}
+	// The framing indicator of a known-length response is a single byte
+	b := bytes.NewBuffer(append([]byte{}, binaryResponse[:1]...))
+	for _, response := range r.responses {
+		ohttp.Write(b, uint64(response.status))
+		fields := marshalFieldSection(response.header)
+		ohttp.Write(b, uint64(len(fields)))
+		b.Write(fields)
+	}
+	b.Write(binaryResponse[1:])
+	return b.Bytes()
+}
+
+func marshalFieldSection(header http.Header) []byte {
+	fields := new(bytes.Buffer)
+	for name, values := range header {
+		for _, value := range values {
+			ohttp.Write(fields, uint64(len(name)))
+			fields.WriteString(strings.ToLower(name))
+			ohttp.Write(fields, uint64(len(value)))
+			fields.WriteString(value)
+		}
+	}
+	return fields.Bytes()
+}
+
+// appendTrailerFields appends the known-length trailer field section (RFC 9292, Section 3.8) to a binary
+// HTTP response marshalled without one, so that trailers such as grpc-status reach the client.
+func appendTrailerFields(binaryResponse []byte, trailer http.Header) []byte {
+	fields := marshalFieldSection(trailer)
+	b := bytes.NewBuffer(binaryResponse)
+	ohttp.Write(b, uint64(len(fields)))
+	b.Write(fields)
+	return b.Bytes()
+}
+
+// responsePadding pads binary HTTP responses with zeros (RFC 9292, Section 3.8) before they are
+// encapsulated, so that the length of an encapsulated response only reveals the size bucket of the
+// response. The zero value does not pad.
+type responsePadding struct {
+	// powerOfTwo pads responses to the next power of two, instead of the next multiple of blockSize
+	powerOfTwo bool
+	blockSize  int
+}
+
+// parseResponsePadding parses "pow2", which pads responses to powers of two, or a number of bytes that
+// the length of responses is padded to a multiple of. An empty value or "none" disables padding.
+func parseResponsePadding(value string) (responsePadding, error) {
+	switch value = strings.ToLower(strings.TrimSpace(value)); value {
+	case "", "none":
+		return responsePadding{}, nil
+	case "pow2":
+		return responsePadding{powerOfTwo: true}, nil
+	}
+	blockSize, err := strconv.Atoi(value)
+	if err != nil || blockSize <= 0 {
+		return responsePadding{}, fmt.Errorf("Invalid response padding %q", value)
+	}
+	return responsePadding{blockSize: blockSize}, nil
+}
+
+// pad appends the padding of binaryResponse. A response without a trailer field section reads the first
+// zero as an empty one, which the padding may follow.
+func (p responsePadding) pad(binaryResponse []byte) []byte {
+	size, padded := len(binaryResponse), 1
+	switch {
+	case p.powerOfTwo:
+		for padded < size {
+			padded <<= 1
+		}
+	case p.blockSize > 0:
+		padded = (size + p.blockSize - 1) / p.blockSize * p.blockSize
+	default:
+		return binaryResponse
+	}
+	return append(binaryResponse, make([]byte, padded-size)...)
+}
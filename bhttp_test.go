@@ -0,0 +1,254 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/chris-wood/ohttp-go"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestBinaryHTTPTrailerRoundTrip(t *testing.T) {
+	// The target returns the request trailers it received as response trailers
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("Trailer", "Upload-Checksum, Upload-Host")
+		w.Write(body)
+		w.Header().Set("Upload-Checksum", r.Trailer.Get("Checksum"))
+		w.Header().Set("Upload-Host", r.Trailer.Get("Host"))
+	}))
+	defer target.Close()
+
+	req, err := http.NewRequest(http.MethodPost, target.URL+"/upload", bytes.NewReader([]byte("chunked upload")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	binaryRequest, err := (*ohttp.BinaryRequest)(req).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Replace the empty trailer field section of the marshalled request
+	withoutTrailer := append([]byte{}, binaryRequest[:len(binaryRequest)-1]...)
+	binaryRequest = appendTrailerFields(append([]byte{}, withoutTrailer...), http.Header{
+		"Checksum": []string{"sha-256=abc"},
+		"Host":     []string{"other.example"},
+	})
+	trailer, err := binaryRequestTrailer(binaryRequest)
+	if err != nil || trailer.Get("Checksum") != "sha-256=abc" || trailer.Get("Host") != "" {
+		t.Fatalf("Unexpected request trailer %v (%v)", trailer, err)
+	}
+
+	handler := BinaryHTTPAppHandler{httpHandler: FilteredHttpRequestHandler{client: target.Client()}}
+	metrics := &MockMetricsFactory{}
+	binaryResponse, err := handler.Handle(binaryRequest, metrics.Create(metricsEventGatewayRequest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, content, responseTrailer := readBinaryResponseTrailer(t, binaryResponse)
+	if status != http.StatusOK || string(content) != "chunked upload" {
+		t.Fatalf("Unexpected response %d %s", status, content)
+	}
+	if responseTrailer["upload-checksum"] != "sha-256=abc" || responseTrailer["upload-host"] != "" {
+		t.Fatalf("Request trailer did not reach the target, got %v", responseTrailer)
+	}
+
+	// A request without a trailer field section has no trailers, and a truncated one is rejected
+	if trailer, err := binaryRequestTrailer(withoutTrailer); err != nil || len(trailer) > 0 {
+		t.Fatalf("Unexpected trailer %v (%v) of a request without trailer fields", trailer, err)
+	}
+	if _, err := binaryRequestTrailer(binaryRequest[:len(binaryRequest)-2]); err == nil {
+		t.Fatal("Expected a truncated trailer field section to be rejected")
+	}
+}
+
+// startEarlyHintsTarget serves every connection a 100 (Continue) and a 103 (Early Hints) response before
+// the final response.
+func startEarlyHintsTarget(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if _, err := http.ReadRequest(bufio.NewReader(conn)); err != nil {
+					return
+				}
+				conn.Write([]byte("HTTP/1.1 100 Continue\r\n\r\n" +
+					"HTTP/1.1 103 Early Hints\r\nLink: </style.css>; rel=preload\r\nServer: origin-7\r\n\r\n" +
+					"HTTP/1.1 200 OK\r\nContent-Length: 5\r\nConnection: close\r\n\r\nhello"))
+			}()
+		}
+	}()
+	return "http://" + listener.Addr().String()
+}
+
+func TestBinaryHTTPInformationalResponses(t *testing.T) {
+	targetURL := startEarlyHintsTarget(t)
+	req, err := http.NewRequest(http.MethodGet, targetURL+"/page", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	binaryRequest, err := (*ohttp.BinaryRequest)(req).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpHandler := FilteredHttpRequestHandler{client: &http.Client{}}
+	metrics := &MockMetricsFactory{}
+
+	// Informational responses are stripped by default
+	binaryResponse, err := BinaryHTTPAppHandler{httpHandler: httpHandler}.Handle(binaryRequest, metrics.Create(metricsEventGatewayRequest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, content, _ := readBinaryResponseTrailer(t, binaryResponse); status != http.StatusOK || string(content) != "hello" {
+		t.Fatalf("Unexpected response %d %s", status, content)
+	}
+
+	binaryResponse, err = BinaryHTTPAppHandler{httpHandler: httpHandler, forwardInformational: true}.Handle(binaryRequest, metrics.Create(metricsEventGatewayRequest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(bytes.NewReader(binaryResponse))
+	if indicator, _ := ohttp.Read(r); indicator != 1 {
+		t.Fatalf("Unexpected framing indicator %d", indicator)
+	}
+	if status, _ := ohttp.Read(r); status != http.StatusEarlyHints {
+		t.Fatalf("Expected an early hints response, got status %d", status)
+	}
+	fields := bufio.NewReader(bytes.NewReader(readVarintBytes(t, r)))
+	hints := map[string]string{}
+	for {
+		if _, err := fields.Peek(1); err != nil {
+			break
+		}
+		name := readVarintBytes(t, fields)
+		hints[string(name)] = string(readVarintBytes(t, fields))
+	}
+	if len(hints) != 1 || hints["link"] != "</style.css>; rel=preload" {
+		t.Fatalf("Unexpected early hints %v", hints)
+	}
+	rest, _ := ioutil.ReadAll(r)
+	if status, content, _ := readBinaryResponseTrailer(t, append([]byte{1}, rest...)); status != http.StatusOK || string(content) != "hello" {
+		t.Fatalf("Unexpected final response %d %s", status, content)
+	}
+}
+
+func TestResponsePadding(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strings.TrimPrefix(r.URL.Path, "/")))
+	}))
+	defer target.Close()
+	metrics := &MockMetricsFactory{}
+
+	for value, bucket := range map[string]func(int) bool{
+		"pow2": func(n int) bool { return n&(n-1) == 0 },
+		"128":  func(n int) bool { return n%128 == 0 },
+	} {
+		padding, err := parseResponsePadding(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		handler := BinaryHTTPAppHandler{httpHandler: FilteredHttpRequestHandler{client: target.Client()}, padding: padding}
+		for _, body := range []string{"", "hello", strings.Repeat("a", 300)} {
+			req, _ := http.NewRequest(http.MethodGet, target.URL+"/"+body, nil)
+			binaryRequest, err := (*ohttp.BinaryRequest)(req).Marshal()
+			if err != nil {
+				t.Fatal(err)
+			}
+			binaryResponse, err := handler.Handle(binaryRequest, metrics.Create(metricsEventGatewayRequest))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bucket(len(binaryResponse)) {
+				t.Fatalf("Response of %d bytes was not padded to %s", len(binaryResponse), value)
+			}
+			if status, content, _ := readBinaryResponseTrailer(t, binaryResponse); status != http.StatusOK || string(content) != body {
+				t.Fatalf("Unexpected padded response %d %q", status, content)
+			}
+		}
+
+		// Error responses are padded as well
+		binaryResponse, err := handler.Handle([]byte{0xff}, metrics.Create(metricsEventGatewayRequest))
+		if err != nil || !bucket(len(binaryResponse)) {
+			t.Fatalf("Error response of %d bytes was not padded to %s (%v)", len(binaryResponse), value, err)
+		}
+
+		for size := 0; size < 600; size += 7 {
+			response := &Response{StatusCode: http.StatusOK, Body: make([]byte, size)}
+			padProtoResponse(response, padding)
+			if marshalled, err := proto.Marshal(response); err != nil || !bucket(len(marshalled)) {
+				t.Fatalf("Protobuf response of %d bytes was not padded to %s (%v)", len(marshalled), value, err)
+			}
+		}
+	}
+
+	if padding, err := parseResponsePadding(""); err != nil || len(padding.pad([]byte("hello"))) != 5 {
+		t.Fatal("Expected responses not to be padded by default")
+	}
+	if _, err := parseResponsePadding("0"); err == nil {
+		t.Fatal("Expected an invalid response padding to be rejected")
+	}
+}
+
+func TestBinaryHTTPRequestPadding(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write(body)
+	}))
+	defer target.Close()
+	req, err := http.NewRequest(http.MethodPost, target.URL+"/upload", bytes.NewReader([]byte("padded upload")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	binaryRequest, err := (*ohttp.BinaryRequest)(req).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	padded := append(append([]byte{}, binaryRequest...), make([]byte, 256)...)
+	if unpadded, err := unpadBinaryRequest(padded); err != nil || !bytes.Equal(unpadded, binaryRequest) {
+		t.Fatalf("Padding was not stripped (%v)", err)
+	}
+
+	handler := BinaryHTTPAppHandler{httpHandler: FilteredHttpRequestHandler{client: target.Client()}, minRequestSize: 256}
+	metrics := &MockMetricsFactory{}
+	binaryResponse, err := handler.Handle(padded, metrics.Create(metricsEventGatewayRequest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, content, _ := readBinaryResponseTrailer(t, binaryResponse); status != http.StatusOK || string(content) != "padded upload" {
+		t.Fatalf("Unexpected response %d %s", status, content)
+	}
+
+	// Unpadded requests are rejected, as are those with padding that is not zero
+	binaryResponse, err = handler.Handle(binaryRequest, metrics.Create(metricsEventGatewayRequest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, content, _ := readBinaryResponseTrailer(t, binaryResponse); status != http.StatusBadRequest || string(content) != PayloadTooSmallError.Error() {
+		t.Fatalf("Expected the unpadded request to be rejected, got %d %s", status, content)
+	}
+	padded[len(padded)-1] = 1
+	binaryResponse, err = handler.Handle(padded, metrics.Create(metricsEventGatewayRequest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, _, _ := readBinaryResponseTrailer(t, binaryResponse); status != http.StatusBadRequest {
+		t.Fatalf("Expected the request with non-zero padding to be rejected, got %d", status)
+	}
+}
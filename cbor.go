@@ -0,0 +1,141 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Minimal CBOR (RFC 8949) support for the messages exchanged with the Nitro Secure Module. Only definite
+// lengths are supported.
+
+const (
+	cborUnsigned = 0
+	cborNegative = 1
+	cborBytes    = 2
+	cborText     = 3
+	cborArray    = 4
+	cborMap      = 5
+	cborTag      = 6
+	cborSimple   = 7
+
+	cborNull = 0xf6
+)
+
+func appendCBORHead(b []byte, major byte, n uint64) []byte {
+	switch {
+	case n < 24:
+		return append(b, major<<5|byte(n))
+	case n <= 0xff:
+		return append(b, major<<5|24, byte(n))
+	case n <= 0xffff:
+		return append(append(b, major<<5|25), byte(n>>8), byte(n))
+	case n <= 0xffffffff:
+		buf := make([]byte, 4)
+		binary.BigEndian.PutUint32(buf, uint32(n))
+		return append(append(b, major<<5|26), buf...)
+	default:
+		buf := make([]byte, 8)
+		binary.BigEndian.PutUint64(buf, n)
+		return append(append(b, major<<5|27), buf...)
+	}
+}
+
+func appendCBORText(b []byte, s string) []byte {
+	return append(appendCBORHead(b, cborText, uint64(len(s))), s...)
+}
+
+// appendCBORBytes appends data as a byte string, or null if data is nil.
+func appendCBORBytes(b []byte, data []byte) []byte {
+	if data == nil {
+		return append(b, cborNull)
+	}
+	return append(appendCBORHead(b, cborBytes, uint64(len(data))), data...)
+}
+
+// decodeCBOR decodes a single data item. Byte strings decode to []byte, text strings to string,
+// integers to uint64 or int64, arrays to []interface{}, maps with text keys to map[string]interface{},
+// and null to nil. Tags are skipped.
+func decodeCBOR(data []byte) (interface{}, []byte, error) {
+	if len(data) == 0 {
+		return nil, nil, fmt.Errorf("Truncated CBOR data")
+	}
+	major, info := data[0]>>5, data[0]&0x1f
+	data = data[1:]
+
+	var n uint64
+	switch {
+	case info < 24:
+		n = uint64(info)
+	case info <= 27:
+		size := 1 << (info - 24)
+		if len(data) < size {
+			return nil, nil, fmt.Errorf("Truncated CBOR data")
+		}
+		for _, b := range data[:size] {
+			n = n<<8 | uint64(b)
+		}
+		data = data[size:]
+	default:
+		return nil, nil, fmt.Errorf("Unsupported CBOR additional information %d", info)
+	}
+
+	switch major {
+	case cborUnsigned:
+		return n, data, nil
+	case cborNegative:
+		return -1 - int64(n), data, nil
+	case cborBytes, cborText:
+		if uint64(len(data)) < n {
+			return nil, nil, fmt.Errorf("Truncated CBOR data")
+		}
+		if major == cborText {
+			return string(data[:n]), data[n:], nil
+		}
+		return data[:n], data[n:], nil
+	case cborArray:
+		items := []interface{}{}
+		for i := uint64(0); i < n; i++ {
+			var item interface{}
+			var err error
+			if item, data, err = decodeCBOR(data); err != nil {
+				return nil, nil, err
+			}
+			items = append(items, item)
+		}
+		return items, data, nil
+	case cborMap:
+		items := map[string]interface{}{}
+		for i := uint64(0); i < n; i++ {
+			var key, value interface{}
+			var err error
+			if key, data, err = decodeCBOR(data); err != nil {
+				return nil, nil, err
+			}
+			if value, data, err = decodeCBOR(data); err != nil {
+				return nil, nil, err
+			}
+			name, ok := key.(string)
+			if !ok {
+				return nil, nil, fmt.Errorf("Unsupported CBOR map key %v", key)
+			}
+			items[name] = value
+		}
+		return items, data, nil
+	case cborTag:
+		return decodeCBOR(data)
+	default:
+		switch n {
+		case 20:
+			return false, data, nil
+		case 21:
+			return true, data, nil
+		case 22, 23:
+			return nil, data, nil
+		default:
+			return nil, nil, fmt.Errorf("Unsupported CBOR simple value %d", n)
+		}
+	}
+}
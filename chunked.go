@@ -0,0 +1,354 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/chris-wood/ohttp-go"
+	"github.com/cisco/go-hpke"
+)
+
+// Chunked OHTTP (draft-ietf-ohai-chunked-ohttp) splits the encapsulated request and response into
+// individually sealed chunks, so that neither has to be buffered in full.
+const (
+	ohttpChunkedRequestContentType  = "message/ohttp-chunked-req"
+	ohttpChunkedResponseContentType = "message/ohttp-chunked-res"
+
+	chunkedRequestLabel  = "message/bhttp chunked request"
+	chunkedResponseLabel = "message/bhttp chunked response"
+	chunkedFinalAAD      = "final"
+
+	// Maximum plaintext length of a response chunk, and maximum ciphertext length of a request chunk
+	chunkedResponseChunkSize = 16384
+	chunkedMaxChunkLength    = 1 << 20
+)
+
+// ChunkedAppHandler is an AppContentHandler that also processes application content incrementally. Chunked
+// requests to an AppContentHandler that does not implement it are buffered in full, up to the size that
+// non-chunked requests are bounded by.
+type ChunkedAppHandler interface {
+	// HandleChunked reads the application request from request and writes the response to response.
+	HandleChunked(request io.Reader, response io.Writer, metrics Metrics) error
+}
+
+// ChunkedEncapsulationHandler is an EncapsulationHandler that also handles chunked OHTTP requests.
+type ChunkedEncapsulationHandler interface {
+	// HandleChunked decapsulates the chunked request read from body and writes the chunked response to w.
+	// Decapsulated requests that are buffered are bounded by maxBufferedSize, unless it is 0. An error is
+	// only returned if nothing was written to w yet.
+	HandleChunked(outerRequest *http.Request, body io.Reader, w http.ResponseWriter, maxBufferedSize int64, metrics Metrics) error
+}
+
+// HandleChunked returns the input request as the response, one chunk at a time.
+func (h EchoAppHandler) HandleChunked(request io.Reader, response io.Writer, metrics Metrics) error {
+	if _, err := io.Copy(response, request); err != nil {
+		return err
+	}
+	metrics.Fire(metricsResultSuccess)
+	return nil
+}
+
+// chunkedRequestHeader is the header of a chunked request, which is the HPKE info of the request context.
+type chunkedRequestHeader struct {
+	keyID  uint8
+	kemID  hpke.KEMID
+	kdfID  hpke.KDFID
+	aeadID hpke.AEADID
+}
+
+func (h chunkedRequestHeader) marshal() []byte {
+	header := make([]byte, 7)
+	header[0] = h.keyID
+	binary.BigEndian.PutUint16(header[1:], uint16(h.kemID))
+	binary.BigEndian.PutUint16(header[3:], uint16(h.kdfID))
+	binary.BigEndian.PutUint16(header[5:], uint16(h.aeadID))
+	return header
+}
+
+func (h chunkedRequestHeader) info() []byte {
+	return append(append([]byte(chunkedRequestLabel), 0x00), h.marshal()...)
+}
+
+// advertisedBy reports whether config advertises the KEM of the header and its pair of KDF and AEAD.
+func (h chunkedRequestHeader) advertisedBy(config ohttp.PublicConfig) bool {
+	if h.kemID != config.KEMID {
+		return false
+	}
+	for _, suite := range config.Suites {
+		if suite.KDFID == h.kdfID && suite.AEADID == h.aeadID {
+			return true
+		}
+	}
+	return false
+}
+
+func readChunkedRequestHeader(r io.Reader) (chunkedRequestHeader, error) {
+	header := make([]byte, 7)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return chunkedRequestHeader{}, err
+	}
+	return chunkedRequestHeader{
+		keyID:  header[0],
+		kemID:  hpke.KEMID(binary.BigEndian.Uint16(header[1:])),
+		kdfID:  hpke.KDFID(binary.BigEndian.Uint16(header[3:])),
+		aeadID: hpke.AEADID(binary.BigEndian.Uint16(header[5:])),
+	}, nil
+}
+
+// chunkedRequestReader decrypts the chunks of a request as they are read. Each chunk is prefixed with its
+// length, except for the final chunk, which is prefixed with a zero length and extends to the end of the
+// request.
+type chunkedRequestReader struct {
+	r        *bufio.Reader
+	context  *hpke.ReceiverContext
+	maxChunk int64
+	buffer   []byte
+	final    bool
+}
+
+func (c *chunkedRequestReader) readChunk() error {
+	length, err := ohttp.Read(c.r)
+	if err != nil {
+		return fmt.Errorf("Missing final chunk: %s", err)
+	}
+	var ct []byte
+	aad := []byte{}
+	if length == 0 {
+		if ct, err = ioutil.ReadAll(io.LimitReader(c.r, c.maxChunk+1)); err != nil {
+			return err
+		}
+		aad = []byte(chunkedFinalAAD)
+		c.final = true
+	} else {
+		if int64(length) > c.maxChunk {
+			return fmt.Errorf("Chunk of %d bytes exceeds the maximum of %d", length, c.maxChunk)
+		}
+		ct = make([]byte, length)
+		if _, err = io.ReadFull(c.r, ct); err != nil {
+			return err
+		}
+	}
+	if int64(len(ct)) > c.maxChunk {
+		return fmt.Errorf("Final chunk exceeds the maximum of %d bytes", c.maxChunk)
+	}
+	if c.buffer, err = c.context.Open(aad, ct); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (c *chunkedRequestReader) Read(p []byte) (int, error) {
+	for len(c.buffer) == 0 {
+		if c.final {
+			return 0, io.EOF
+		}
+		if err := c.readChunk(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, c.buffer)
+	c.buffer = c.buffer[n:]
+	return n, nil
+}
+
+// chunkedResponseWriter encrypts a response one chunk at a time, flushing every chunk to the client. The
+// response headers and nonce are written with the first chunk, and Close writes the final chunk.
+type chunkedResponseWriter struct {
+	w       http.ResponseWriter
+	header  []byte
+	aead    cipher.AEAD
+	nonce   []byte
+	counter uint64
+	started bool
+}
+
+func newChunkedResponseWriter(w http.ResponseWriter, context *hpke.ReceiverContext, suite hpke.CipherSuite, enc []byte) (*chunkedResponseWriter, error) {
+	nonceLength := suite.AEAD.NonceSize()
+	if suite.AEAD.KeySize() > nonceLength {
+		nonceLength = suite.AEAD.KeySize()
+	}
+	responseNonce := make([]byte, nonceLength)
+	if _, err := rand.Read(responseNonce); err != nil {
+		return nil, err
+	}
+
+	// Derived as for non-chunked responses (RFC 9458, Section 4.4), with the chunked response label
+	secret := context.Export([]byte(chunkedResponseLabel), nonceLength)
+	salt := append(append([]byte{}, enc...), responseNonce...)
+	prk := suite.KDF.Extract(salt, secret)
+	key := suite.KDF.Expand(prk, []byte("key"), suite.AEAD.KeySize())
+	aead, err := suite.AEAD.New(key)
+	if err != nil {
+		return nil, err
+	}
+	return &chunkedResponseWriter{
+		w:      w,
+		header: responseNonce,
+		aead:   aead,
+		nonce:  suite.KDF.Expand(prk, []byte("nonce"), suite.AEAD.NonceSize()),
+	}, nil
+}
+
+// chunkNonce is the AEAD nonce XORed with the chunk counter, encoded in network byte order.
+func (c *chunkedResponseWriter) chunkNonce() []byte {
+	nonce := append([]byte{}, c.nonce...)
+	counter := make([]byte, 8)
+	binary.BigEndian.PutUint64(counter, c.counter)
+	for i := range counter {
+		nonce[len(nonce)-8+i] ^= counter[i]
+	}
+	c.counter++
+	return nonce
+}
+
+func (c *chunkedResponseWriter) writeChunk(pt []byte, final bool) error {
+	chunk := new(bytes.Buffer)
+	if !c.started {
+		c.w.Header().Set("Content-Type", ohttpChunkedResponseContentType)
+		c.w.Header().Set("Connection", "Keep-Alive")
+		c.w.Header().Set("Incremental", "?1")
+		c.w.WriteHeader(http.StatusOK)
+		chunk.Write(c.header)
+		c.started = true
+	}
+	if final {
+		ohttp.Write(chunk, 0)
+		chunk.Write(c.aead.Seal(nil, c.chunkNonce(), pt, []byte(chunkedFinalAAD)))
+	} else {
+		ct := c.aead.Seal(nil, c.chunkNonce(), pt, nil)
+		ohttp.Write(chunk, uint64(len(ct)))
+		chunk.Write(ct)
+	}
+	if _, err := c.w.Write(chunk.Bytes()); err != nil {
+		return err
+	}
+	if flusher, ok := c.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return nil
+}
+
+func (c *chunkedResponseWriter) Write(p []byte) (int, error) {
+	for written := 0; written < len(p); {
+		n := len(p) - written
+		if n > chunkedResponseChunkSize {
+			n = chunkedResponseChunkSize
+		}
+		if err := c.writeChunk(p[written:written+n], false); err != nil {
+			return written, err
+		}
+		written += n
+	}
+	return len(p), nil
+}
+
+func (c *chunkedResponseWriter) Close() error {
+	return c.writeChunk(nil, true)
+}
+
+// HandleChunked decapsulates a chunked request and passes the application content to the handler's
+// AppContentHandler, incrementally if it is a ChunkedAppHandler, and encapsulates its response in chunks.
+func (h DefaultEncapsulationHandler) HandleChunked(outerRequest *http.Request, body io.Reader, w http.ResponseWriter, maxBufferedSize int64, metrics Metrics) error {
+	r := bufio.NewReader(body)
+	header, err := readChunkedRequestHeader(r)
+	if err != nil {
+		metrics.Fire(metricsResultInvalidContent)
+		return EncapsulationError
+	}
+	metrics.Tag(metricsTagKeyID, strconv.Itoa(int(header.keyID)))
+
+	if h.keyring.Revoked(header.keyID) {
+		metrics.Fire(metricsResultKeyRevoked)
+		return KeyRevokedError
+	}
+	config, ok := h.keyring.PrivateConfig(header.keyID)
+	if !ok {
+		metrics.Fire(metricsResultConfigurationMismatch)
+		return ConfigMismatchError
+	}
+	if h.keyring.DecryptOnly(header.keyID) {
+		metrics.Fire(metricsResultDecryptOnlyKey)
+	}
+
+	suite, err := hpke.AssembleCipherSuite(header.kemID, header.kdfID, header.aeadID)
+	if err != nil || !header.advertisedBy(config.Config()) {
+		metrics.Fire(metricsResultDecapsulationFailed)
+		return EncapsulationError
+	}
+	enc := make([]byte, suite.KEM.PublicKeySize())
+	if _, err := io.ReadFull(r, enc); err != nil {
+		metrics.Fire(metricsResultDecapsulationFailed)
+		return EncapsulationError
+	}
+	context, err := hpke.SetupBaseR(suite, config.PrivateKey(), enc, header.info())
+	if err != nil {
+		metrics.Fire(metricsResultDecapsulationFailed)
+		return EncapsulationError
+	}
+
+	// The header of chunked requests carries no extensions either
+	extensions, err := checkOHTTPExtensions(nil)
+	if err != nil {
+		metrics.Fire(metricsResultExtensionRejected)
+		return EncapsulationError
+	}
+	outerRequest = outerRequest.WithContext(withOHTTPExtensions(outerRequest.Context(), extensions))
+
+	request := &chunkedRequestReader{r: r, context: context, maxChunk: chunkedMaxChunkLength}
+	response, err := newChunkedResponseWriter(w, context, suite, enc)
+	if err != nil {
+		metrics.Fire(metricsResultEncapsulationFailed)
+		return EncapsulationError
+	}
+
+	if chunkedHandler, ok := h.appHandler.(ChunkedAppHandler); ok {
+		err = chunkedHandler.HandleChunked(request, response, metrics)
+	} else {
+		var binaryRequest, binaryResponse []byte
+		var buffered io.Reader = request
+		if maxBufferedSize > 0 {
+			buffered = io.LimitReader(request, maxBufferedSize+1)
+		}
+		if binaryRequest, err = ioutil.ReadAll(buffered); err == nil {
+			if maxBufferedSize > 0 && int64(len(binaryRequest)) > maxBufferedSize {
+				metrics.Fire(metricsResultRequestTooLarge)
+				return RequestTooLargeError
+			}
+			metrics.Size(metricsSizeInnerRequest, len(binaryRequest))
+			started := time.Now()
+			binaryResponse, err = h.handleApp(outerRequest, binaryRequest, metrics)
+			metrics.Duration(metricsStageAppContent, time.Since(started))
+			if err == nil {
+				_, err = response.Write(binaryResponse)
+			}
+		}
+	}
+	if err == nil {
+		err = response.Close()
+	}
+	if err != nil {
+		if !response.started {
+			if err == PayloadMarshallingError {
+				return err
+			}
+			metrics.Fire(metricsResultDecapsulationFailed)
+			return EncapsulationError
+		}
+		// The response was already started, so the client detects the failure by the missing final chunk
+		log.Printf("Chunked response failed: %s", err)
+	}
+	return nil
+}
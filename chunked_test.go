@@ -0,0 +1,296 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/chris-wood/ohttp-go"
+	"github.com/cisco/go-hpke"
+)
+
+// encapsulateChunked encapsulates each of chunks as a chunked request to config, and returns the request
+// with everything needed to decapsulate the chunked response.
+func encapsulateChunked(t *testing.T, config ohttp.PublicConfig, chunks [][]byte) ([]byte, *hpke.SenderContext, hpke.CipherSuite, []byte) {
+	header := chunkedRequestHeader{keyID: config.ID, kemID: config.KEMID, kdfID: config.Suites[0].KDFID, aeadID: config.Suites[0].AEADID}
+	suite, err := hpke.AssembleCipherSuite(header.kemID, header.kdfID, header.aeadID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkR, err := suite.KEM.DeserializePublicKey(config.PublicKeyBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc, context, err := hpke.SetupBaseS(suite, rand.Reader, pkR, header.info())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request := new(bytes.Buffer)
+	request.Write(header.marshal())
+	request.Write(enc)
+	for i, chunk := range chunks {
+		if i == len(chunks)-1 {
+			ohttp.Write(request, 0)
+			request.Write(context.Seal([]byte(chunkedFinalAAD), chunk))
+		} else {
+			ct := context.Seal(nil, chunk)
+			ohttp.Write(request, uint64(len(ct)))
+			request.Write(ct)
+		}
+	}
+	return request.Bytes(), context, suite, enc
+}
+
+func decapsulateChunked(t *testing.T, response []byte, context *hpke.SenderContext, suite hpke.CipherSuite, enc []byte) []byte {
+	nonceLength := suite.AEAD.NonceSize()
+	if suite.AEAD.KeySize() > nonceLength {
+		nonceLength = suite.AEAD.KeySize()
+	}
+	secret := context.Export([]byte(chunkedResponseLabel), nonceLength)
+	prk := suite.KDF.Extract(append(append([]byte{}, enc...), response[:nonceLength]...), secret)
+	aead, err := suite.AEAD.New(suite.KDF.Expand(prk, []byte("key"), suite.AEAD.KeySize()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	baseNonce := suite.KDF.Expand(prk, []byte("nonce"), suite.AEAD.NonceSize())
+
+	r := bufio.NewReader(bytes.NewReader(response[nonceLength:]))
+	plaintext := []byte{}
+	for counter := uint64(0); ; counter++ {
+		nonce := append([]byte{}, baseNonce...)
+		encoded := make([]byte, 8)
+		binary.BigEndian.PutUint64(encoded, counter)
+		for i := range encoded {
+			nonce[len(nonce)-8+i] ^= encoded[i]
+		}
+
+		length, err := ohttp.Read(r)
+		if err != nil {
+			t.Fatalf("Missing final chunk: %s", err)
+		}
+		if length == 0 {
+			ct, _ := ioutil.ReadAll(r)
+			pt, err := aead.Open(nil, nonce, ct, []byte(chunkedFinalAAD))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return append(plaintext, pt...)
+		}
+		ct := make([]byte, length)
+		if _, err := io.ReadFull(r, ct); err != nil {
+			t.Fatal(err)
+		}
+		pt, err := aead.Open(nil, nonce, ct, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		plaintext = append(plaintext, pt...)
+	}
+}
+
+func TestGatewayHandlerChunked(t *testing.T) {
+	target := createMockEchoGatewayServer(t)
+	// Chunked requests are not bounded by the limit of buffered requests
+	target.maxRequestSize = 1024
+
+	message := make([]byte, 2*chunkedResponseChunkSize+10)
+	rand.Read(message)
+	chunks := [][]byte{message[:100], message[100:5000], message[5000:]}
+	body, context, suite, enc := encapsulateChunked(t, target.keyring.Current(), chunks)
+
+	request, err := http.NewRequest(http.MethodPost, echoEndpoint, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Header.Add("Content-Type", ohttpChunkedRequestContentType)
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(target.gatewayHandler).ServeHTTP(rr, request)
+
+	if status := rr.Result().StatusCode; status != http.StatusOK {
+		t.Fatalf("Result did not yield %d, got %d instead", http.StatusOK, status)
+	}
+	if contentType := rr.Result().Header.Get("Content-Type"); contentType != ohttpChunkedResponseContentType {
+		t.Fatalf("Unexpected content type %s", contentType)
+	}
+	if response := decapsulateChunked(t, rr.Body.Bytes(), context, suite, enc); !bytes.Equal(response, message) {
+		t.Fatal("Chunked response does not match the chunked request")
+	}
+}
+
+func TestGatewayHandlerChunkedWithOversizedRequest(t *testing.T) {
+	target := createMockEchoGatewayServer(t)
+	target.maxChunkedRequestSize = 1024
+	body, _, _, _ := encapsulateChunked(t, target.keyring.Current(), [][]byte{make([]byte, 2048), nil})
+
+	request, err := http.NewRequest(http.MethodPost, echoEndpoint, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Header.Add("Content-Type", ohttpChunkedRequestContentType)
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(target.gatewayHandler).ServeHTTP(rr, request)
+
+	if status := rr.Result().StatusCode; status != http.StatusRequestEntityTooLarge {
+		t.Fatalf("Result did not yield %d, got %d instead", http.StatusRequestEntityTooLarge, status)
+	}
+	testMetricsContainsResult(t, mustGetMetricsFactory(t, target), metricsEventGatewayRequest, metricsResultRequestTooLarge)
+}
+
+func TestGatewayHandlerChunkedWithOversizedBufferedRequest(t *testing.T) {
+	target := createMockEchoGatewayServer(t)
+	// The target handler is not a ChunkedAppHandler, so its decapsulated requests are buffered
+	target.maxRequestSize = 1024
+	body, _, _, _ := encapsulateChunked(t, target.keyring.Current(), [][]byte{make([]byte, 2048), nil})
+
+	request, err := http.NewRequest(http.MethodPost, gatewayEndpoint, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Header.Add("Content-Type", ohttpChunkedRequestContentType)
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(target.gatewayHandler).ServeHTTP(rr, request)
+
+	if status := rr.Result().StatusCode; status != http.StatusRequestEntityTooLarge {
+		t.Fatalf("Result did not yield %d, got %d instead", http.StatusRequestEntityTooLarge, status)
+	}
+	testMetricsContainsResult(t, mustGetMetricsFactory(t, target), metricsEventGatewayRequest, metricsResultRequestTooLarge)
+}
+
+func TestGatewayHandlerChunkedWithUnadvertisedSuite(t *testing.T) {
+	target := createMockEchoGatewayServer(t)
+
+	// The key is only advertised with AES-128-GCM
+	config := target.keyring.Current()
+	config.Suites = []ohttp.ConfigCipherSuite{{KDFID: config.Suites[0].KDFID, AEADID: hpke.AEAD_CHACHA20POLY1305}}
+	body, _, _, _ := encapsulateChunked(t, config, [][]byte{[]byte("only")})
+
+	request, err := http.NewRequest(http.MethodPost, echoEndpoint, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Header.Add("Content-Type", ohttpChunkedRequestContentType)
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(target.gatewayHandler).ServeHTTP(rr, request)
+
+	if status := rr.Result().StatusCode; status != http.StatusBadRequest {
+		t.Fatalf("Result did not yield %d, got %d instead", http.StatusBadRequest, status)
+	}
+	testMetricsContainsResult(t, mustGetMetricsFactory(t, target), metricsEventGatewayRequest, metricsResultDecapsulationFailed)
+}
+
+func TestGatewayHandlerChunkedWithCorruptContent(t *testing.T) {
+	target := createMockEchoGatewayServer(t)
+
+	// A corrupt final chunk is detected before the response starts
+	body, _, _, _ := encapsulateChunked(t, target.keyring.Current(), [][]byte{[]byte("only")})
+	body[len(body)-1] ^= 0xFF
+
+	request, err := http.NewRequest(http.MethodPost, echoEndpoint, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Header.Add("Content-Type", ohttpChunkedRequestContentType)
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(target.gatewayHandler).ServeHTTP(rr, request)
+
+	if status := rr.Result().StatusCode; status != http.StatusBadRequest {
+		t.Fatalf("Result did not yield %d, got %d instead", http.StatusBadRequest, status)
+	}
+	testMetricsContainsResult(t, mustGetMetricsFactory(t, target), metricsEventGatewayRequest, metricsResultDecapsulationFailed)
+}
+
+func TestGatewayHandlerChunkedUnsupported(t *testing.T) {
+	target := createMockEchoGatewayServer(t)
+	target.encapsulationHandlers[metadataEndpoint] = MetadataEncapsulationHandler{keyring: target.keyring}
+
+	body, _, _, _ := encapsulateChunked(t, target.keyring.Current(), [][]byte{[]byte("only")})
+	request, err := http.NewRequest(http.MethodPost, metadataEndpoint, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Header.Add("Content-Type", ohttpChunkedRequestContentType)
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(target.gatewayHandler).ServeHTTP(rr, request)
+
+	if status := rr.Result().StatusCode; status != http.StatusUnsupportedMediaType {
+		t.Fatalf("Result did not yield %d, got %d instead", http.StatusUnsupportedMediaType, status)
+	}
+	if acceptPost := rr.Header().Get("Accept-Post"); acceptPost != ohttpRequestContentType {
+		t.Fatalf("Unexpected Accept-Post header %q", acceptPost)
+	}
+	testMetricsContainsResult(t, mustGetMetricsFactory(t, target), metricsEventGatewayRequest, metricsResultUnsupportedMediaType)
+}
+
+func TestGatewayHandlerContentNegotiation(t *testing.T) {
+	target := createMockEchoGatewayServer(t)
+	handler := http.HandlerFunc(target.gatewayHandler)
+
+	post := func(chunked bool, accept string) *httptest.ResponseRecorder {
+		var body []byte
+		contentType := ohttpRequestContentType
+		if chunked {
+			body, _, _, _ = encapsulateChunked(t, target.keyring.Current(), [][]byte{[]byte("hello")})
+			contentType = ohttpChunkedRequestContentType
+		} else {
+			req, _, err := ohttp.NewDefaultClient(target.keyring.Current()).EncapsulateRequest([]byte("hello"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			body = req.Marshal()
+		}
+		request := httptest.NewRequest(http.MethodPost, echoEndpoint, bytes.NewReader(body))
+		request.Header.Set("Content-Type", contentType)
+		if accept != "" {
+			request.Header.Set("Accept", accept)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, request)
+		return rr
+	}
+
+	// The same endpoint answers each request with the framing of the request
+	both := ohttpResponseContentType + ", " + ohttpChunkedResponseContentType
+	for _, chunked := range []bool{false, true} {
+		expected := ohttpResponseContentType
+		if chunked {
+			expected = ohttpChunkedResponseContentType
+		}
+		for _, accept := range []string{"", both, expected, "message/*"} {
+			rr := post(chunked, accept)
+			if rr.Code != http.StatusOK || rr.Header().Get("Content-Type") != expected {
+				t.Fatalf("Unexpected response %d %q to Accept %q", rr.Code, rr.Header().Get("Content-Type"), accept)
+			}
+		}
+	}
+
+	mustGetMetricsFactory(t, target).metrics = nil
+	if rr := post(true, ohttpResponseContentType); rr.Code != http.StatusNotAcceptable {
+		t.Fatalf("Expected a chunked request that does not accept a chunked response to be refused, got %d", rr.Code)
+	}
+	if rr := post(false, ohttpChunkedResponseContentType+", "+ohttpResponseContentType+";q=0"); rr.Code != http.StatusNotAcceptable {
+		t.Fatalf("Expected a request that refuses the response framing to be refused, got %d", rr.Code)
+	}
+	testMetricsContainsResult(t, mustGetMetricsFactory(t, target), metricsEventGatewayRequest, metricsResultNotAcceptable)
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodOptions, echoEndpoint, nil))
+	if acceptPost := rr.Header().Get("Accept-Post"); acceptPost != ohttpRequestContentType+", "+ohttpChunkedRequestContentType {
+		t.Fatalf("Unexpected Accept-Post header %q", acceptPost)
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const defaultCircuitBreakerCooldown = 30 * time.Second
+
+// circuitBreaker tracks consecutive failures of each target host. Once a host reaches the threshold, its
+// circuit opens and requests to it fail fast for the cooldown, instead of piling up against a dead target.
+// After the cooldown, requests are let through again, and the first failure reopens the circuit while the
+// first success closes it. A nil circuitBreaker lets every request through.
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+
+	mu      sync.Mutex
+	targets map[string]*circuitState
+}
+
+type circuitState struct {
+	failures  int
+	openUntil time.Time
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	if threshold <= 0 {
+		return nil
+	}
+	return &circuitBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		now:       time.Now,
+		targets:   map[string]*circuitState{},
+	}
+}
+
+func (b *circuitBreaker) allow(host string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	state, ok := b.targets[host]
+	return !ok || !b.now().Before(state.openUntil)
+}
+
+func (b *circuitBreaker) record(host string, failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !failed {
+		delete(b.targets, host)
+		return
+	}
+	state, ok := b.targets[host]
+	if !ok {
+		state = &circuitState{}
+		b.targets[host] = state
+	}
+	if state.failures++; state.failures >= b.threshold {
+		state.openUntil = b.now().Add(b.cooldown)
+	}
+}
+
+// do sends req with send unless the circuit of its host is open, in which case it fails with
+// GatewayTargetUnavailableError. Network errors and 5xx responses count as failures.
+func (b *circuitBreaker) do(req *http.Request, metrics Metrics, send func() (*http.Response, error)) (*http.Response, error) {
+	if b == nil {
+		return send()
+	}
+	host := req.URL.Host
+	if !b.allow(host) {
+		metrics.Fire(metricsResultTargetCircuitOpen)
+		return nil, GatewayTargetUnavailableError
+	}
+	resp, err := send()
+	if errors.Is(err, targetAddressForbiddenError) {
+		// The target was not reached, so its health is unknown
+		return resp, err
+	}
+	b.record(host, err != nil || resp.StatusCode/100 == 5)
+	return resp, err
+}
@@ -0,0 +1,58 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Unix(0, 0)
+	breaker := newCircuitBreaker(2, time.Minute)
+	breaker.now = func() time.Time { return now }
+
+	sent := 0
+	failing := func() (*http.Response, error) {
+		sent++
+		return nil, errors.New("connection refused")
+	}
+	succeeding := func() (*http.Response, error) {
+		sent++
+		return &http.Response{StatusCode: http.StatusOK}, nil
+	}
+	req, _ := http.NewRequest(http.MethodGet, "https://dead.example/", nil)
+	send := func(f func() (*http.Response, error)) error {
+		_, err := breaker.do(req, &MockMetrics{resultLabels: map[string]bool{}, tags: map[string]string{}}, f)
+		return err
+	}
+
+	send(failing)
+	send(failing)
+	if err := send(failing); err != GatewayTargetUnavailableError || sent != 2 {
+		t.Fatalf("Expected the circuit to open after 2 failures, got %v after %d requests", err, sent)
+	}
+
+	other, _ := http.NewRequest(http.MethodGet, "https://alive.example/", nil)
+	if _, err := breaker.do(other, &MockMetrics{resultLabels: map[string]bool{}}, succeeding); err != nil {
+		t.Fatalf("Expected other targets to be unaffected, got %v", err)
+	}
+
+	// After the cooldown, a single failure reopens the circuit, and a success closes it
+	now = now.Add(time.Minute)
+	send(failing)
+	if err := send(succeeding); err != GatewayTargetUnavailableError {
+		t.Fatalf("Expected the circuit to reopen, got %v", err)
+	}
+	now = now.Add(time.Minute)
+	if err := send(succeeding); err != nil {
+		t.Fatal(err)
+	}
+	send(failing)
+	if err := send(succeeding); err != nil {
+		t.Fatalf("Expected the circuit to be closed after a success, got %v", err)
+	}
+}
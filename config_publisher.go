@@ -0,0 +1,166 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const gcsUploadURL = "https://storage.googleapis.com/upload/storage/v1"
+
+// ConfigPublisher uploads key configs, encoded as application/ohttp-keys, to a location from which a
+// CDN-fronted discovery endpoint serves them without reaching the gateway.
+type ConfigPublisher interface {
+	// Name identifies the publisher in logs.
+	Name() string
+
+	// Publish uploads configs, replacing the previously published ones.
+	Publish(configs []byte) error
+}
+
+// configPublisherFromLocation builds a ConfigPublisher for a location of the form s3://<bucket>/<key>,
+// gs://<bucket>/<object>, or an http:// or https:// webhook URL.
+func configPublisherFromLocation(location string) (ConfigPublisher, error) {
+	publishURL, err := url.Parse(location)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid config publish location %q: %s", location, err)
+	}
+
+	switch publishURL.Scheme {
+	case "s3", "gs":
+		object := strings.TrimPrefix(publishURL.Path, "/")
+		if publishURL.Host == "" || object == "" {
+			return nil, fmt.Errorf("Config publish location %q must name a bucket and an object", location)
+		}
+		if publishURL.Scheme == "gs" {
+			return &GCSConfigPublisher{
+				bucket:  publishURL.Host,
+				object:  object,
+				baseURL: gcsUploadURL,
+				tokens:  &gcpTokenSource{client: keyProviderHTTPClient},
+				client:  keyProviderHTTPClient,
+			}, nil
+		}
+		region, err := awsRegion()
+		if err != nil {
+			return nil, err
+		}
+		return &S3ConfigPublisher{
+			endpoint:    fmt.Sprintf("https://%s.s3.%s.amazonaws.com", publishURL.Host, region),
+			key:         object,
+			region:      region,
+			credentials: newAWSCredentialChain(),
+			client:      keyProviderHTTPClient,
+		}, nil
+	case "http", "https":
+		return &WebhookConfigPublisher{url: location, client: keyProviderHTTPClient}, nil
+	default:
+		return nil, fmt.Errorf("Unsupported config publish location %q", location)
+	}
+}
+
+// S3ConfigPublisher uploads configs to an S3 object, using the AWS credential chain.
+type S3ConfigPublisher struct {
+	endpoint    string
+	key         string
+	region      string
+	credentials *awsCredentialChain
+	client      *http.Client
+}
+
+func (p *S3ConfigPublisher) Name() string {
+	return "s3"
+}
+
+func (p *S3ConfigPublisher) Publish(configs []byte) error {
+	creds, err := p.credentials.Retrieve()
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPut, p.endpoint+"/"+awsURIEncode(p.key, false), bytes.NewReader(configs))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", ohttpKeysContentType)
+	signAWSRequest(req, configs, creds, p.region, "s3", time.Now())
+	return doPublishRequest(p.client, req)
+}
+
+// GCSConfigPublisher uploads configs to a Google Cloud Storage object, using the default service account.
+type GCSConfigPublisher struct {
+	bucket  string
+	object  string
+	baseURL string
+	tokens  *gcpTokenSource
+	client  *http.Client
+}
+
+func (p *GCSConfigPublisher) Name() string {
+	return "gcs"
+}
+
+func (p *GCSConfigPublisher) Publish(configs []byte) error {
+	token, err := p.tokens.Token()
+	if err != nil {
+		return err
+	}
+	query := url.Values{"uploadType": {"media"}, "name": {p.object}}
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/b/%s/o?%s", p.baseURL, url.PathEscape(p.bucket), query.Encode()), bytes.NewReader(configs))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", ohttpKeysContentType)
+	return doPublishRequest(p.client, req)
+}
+
+// WebhookConfigPublisher POSTs configs to a URL.
+type WebhookConfigPublisher struct {
+	url    string
+	client *http.Client
+}
+
+func (p *WebhookConfigPublisher) Name() string {
+	return "webhook"
+}
+
+func (p *WebhookConfigPublisher) Publish(configs []byte) error {
+	req, err := http.NewRequest(http.MethodPost, p.url, bytes.NewReader(configs))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", ohttpKeysContentType)
+	return doPublishRequest(p.client, req)
+}
+
+func doPublishRequest(client *http.Client, req *http.Request) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s %s failed with status %d", req.Method, req.URL.Redacted(), resp.StatusCode)
+	}
+	return nil
+}
+
+// publishConfigsOnChange publishes the key configs served by keyring now and whenever its keys change.
+func publishConfigsOnChange(keyring *RotatingKeyring, publisher ConfigPublisher) error {
+	if err := publisher.Publish(marshalConfigs(keyring.Configs())); err != nil {
+		return err
+	}
+	keyring.OnChange(func() {
+		if err := publisher.Publish(marshalConfigs(keyring.Configs())); err != nil {
+			log.Printf("Failed to publish key configs to %s: %s", publisher.Name(), err)
+		}
+	})
+	return nil
+}
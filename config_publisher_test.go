@@ -0,0 +1,103 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPublishConfigsOnChange(t *testing.T) {
+	published := [][]byte{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != ohttpKeysContentType {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		published = append(published, body)
+	}))
+	defer server.Close()
+
+	publisher, err := configPublisherFromLocation(server.URL + "/configs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyring := createKeyring(t)
+	if err := publishConfigsOnChange(keyring, publisher); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := keyring.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(published) != 2 || !bytes.Equal(published[1], marshalConfigs(keyring.Configs())) {
+		t.Fatalf("Unexpected published configs %x", published)
+	}
+}
+
+func TestGCSConfigPublisher(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer test-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path != "/b/bucket/o" || r.URL.Query().Get("name") != "keys/ohttp-configs" || r.URL.Query().Get("uploadType") != "media" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+	}))
+	defer server.Close()
+
+	publisher, err := configPublisherFromLocation("gs://bucket/keys/ohttp-configs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gcs := publisher.(*GCSConfigPublisher)
+	gcs.baseURL = server.URL
+	gcs.tokens = &gcpTokenSource{token: "test-token", expires: time.Now().Add(time.Hour)}
+	if err := gcs.Publish([]byte{0x00}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestS3ConfigPublisher(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut || r.URL.Path != "/keys/ohttp-configs" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/") || r.Header.Get("X-Amz-Content-Sha256") == "" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+	}))
+	defer server.Close()
+
+	t.Setenv(awsRegionVariable, "us-east-1")
+	t.Setenv(awsAccessKeyIDVariable, "AKIDEXAMPLE")
+	t.Setenv(awsSecretAccessKeyVariable, "secret")
+	publisher, err := configPublisherFromLocation("s3://bucket/keys/ohttp-configs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s3 := publisher.(*S3ConfigPublisher)
+	s3.endpoint = server.URL
+	if err := s3.Publish([]byte{0x00}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConfigPublisherRejectsInvalidLocations(t *testing.T) {
+	for _, location := range []string{"s3://bucket", "gs:///object", "ftp://host/configs"} {
+		if _, err := configPublisherFromLocation(location); err == nil {
+			t.Fatalf("Expected %s to be rejected", location)
+		}
+	}
+}
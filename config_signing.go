@@ -0,0 +1,31 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+)
+
+// configSigningKeyFromEnvironment loads the long-lived Ed25519 key that signs served configs from a
+// hex-encoded 32-byte seed. It returns nil if signing is not configured.
+func configSigningKeyFromEnvironment() (ed25519.PrivateKey, error) {
+	seedHex := os.Getenv(configSigningKeyEnvironmentVariable)
+	if seedHex == "" {
+		return nil, nil
+	}
+	seed, err := hex.DecodeString(seedHex)
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("%s must be a hex-encoded %d-byte Ed25519 seed", configSigningKeyEnvironmentVariable, ed25519.SeedSize)
+	}
+	key := ed25519.NewKeyFromSeed(seed)
+	zeroize(seed)
+
+	// Relays pin the public key to verify configs
+	log.Printf("Signing key configs with Ed25519 public key %x", key.Public())
+	return key, nil
+}
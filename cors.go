@@ -0,0 +1,95 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// corsPolicy lets browser-based clients on other origins fetch key configs, or send encapsulated requests.
+// The zero value disables CORS.
+type corsPolicy struct {
+	allowedOrigins map[string]bool
+	allowAll       bool
+	// maxAge is how long browsers may cache preflight responses. Zero leaves it to the browser.
+	maxAge time.Duration
+	// methods and headers are allowed in preflight responses, and exposedHeaders in the others
+	methods        string
+	headers        string
+	exposedHeaders string
+}
+
+// newCORSPolicy builds the corsPolicy of the config endpoints from a comma-separated list of origins, where
+// "*" allows any origin.
+func newCORSPolicy(origins string, maxAge time.Duration) corsPolicy {
+	policy := parseCORSOrigins(origins, maxAge)
+	policy.methods = "GET, HEAD"
+	policy.headers = "Accept, If-None-Match"
+	policy.exposedHeaders = "ETag, " + configSignatureHeader + ", " + configExpiryHeader
+	return policy
+}
+
+// newGatewayCORSPolicy builds the corsPolicy of the encapsulation endpoints, whose requests are preflighted
+// because of their Content-Type.
+func newGatewayCORSPolicy(origins string, maxAge time.Duration) corsPolicy {
+	policy := parseCORSOrigins(origins, maxAge)
+	policy.methods = http.MethodPost
+	policy.headers = "Content-Type"
+	return policy
+}
+
+func parseCORSOrigins(origins string, maxAge time.Duration) corsPolicy {
+	policy := corsPolicy{allowedOrigins: map[string]bool{}, maxAge: maxAge}
+	for _, origin := range strings.Split(origins, ",") {
+		origin = strings.TrimSpace(origin)
+		if origin == "*" {
+			policy.allowAll = true
+		} else if origin != "" {
+			policy.allowedOrigins[origin] = true
+		}
+	}
+	return policy
+}
+
+func (p corsPolicy) allows(origin string) bool {
+	return origin != "" && (p.allowAll || p.allowedOrigins[origin])
+}
+
+// apply sets the CORS response headers for r, and reports whether r is a preflight request, which has
+// then been answered.
+func (p corsPolicy) apply(w http.ResponseWriter, r *http.Request) bool {
+	if !p.allowAll && len(p.allowedOrigins) == 0 {
+		return false
+	}
+	origin := r.Header.Get("Origin")
+	if !p.allowAll {
+		w.Header().Add("Vary", "Origin")
+	}
+	if !p.allows(origin) {
+		return false
+	}
+
+	if p.allowAll {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+	} else {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+	}
+
+	if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+		w.Header().Set("Access-Control-Allow-Methods", p.methods)
+		w.Header().Set("Access-Control-Allow-Headers", p.headers)
+		if p.maxAge > 0 {
+			w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(p.maxAge.Seconds())))
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return true
+	}
+	if p.exposedHeaders != "" {
+		w.Header().Set("Access-Control-Expose-Headers", p.exposedHeaders)
+	}
+	return false
+}
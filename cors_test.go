@@ -0,0 +1,101 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/chris-wood/ohttp-go"
+)
+
+func TestConfigHandlerCORS(t *testing.T) {
+	target := createMockEchoGatewayServer(t)
+	target.configCORS = newCORSPolicy("https://app.example, https://other.example", 10*time.Minute)
+	handler := http.HandlerFunc(target.configHandler)
+
+	request := httptest.NewRequest(http.MethodGet, configEndpoint, nil)
+	request.Header.Set("Origin", "https://app.example")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, request)
+	if rr.Code != http.StatusOK || rr.Header().Get("Access-Control-Allow-Origin") != "https://app.example" {
+		t.Fatalf("Expected CORS response for allowed origin, got %d %v", rr.Code, rr.Header())
+	}
+	if rr.Header().Get("Access-Control-Expose-Headers") != "ETag, "+configSignatureHeader+", "+configExpiryHeader || rr.Header().Get("Vary") != "Origin" {
+		t.Fatalf("Unexpected CORS headers %v", rr.Header())
+	}
+
+	request = httptest.NewRequest(http.MethodGet, configEndpoint, nil)
+	request.Header.Set("Origin", "https://evil.example")
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, request)
+	if rr.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Fatal("Disallowed origin received CORS headers")
+	}
+
+	request = httptest.NewRequest(http.MethodOptions, configEndpoint, nil)
+	request.Header.Set("Origin", "https://other.example")
+	request.Header.Set("Access-Control-Request-Method", http.MethodGet)
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, request)
+	if rr.Code != http.StatusNoContent || rr.Header().Get("Access-Control-Max-Age") != "600" || rr.Body.Len() != 0 {
+		t.Fatalf("Unexpected preflight response %d %v", rr.Code, rr.Header())
+	}
+}
+
+func TestConfigHandlerCORSDisabled(t *testing.T) {
+	target := createMockEchoGatewayServer(t)
+	handler := http.HandlerFunc(target.configHandler)
+
+	request := httptest.NewRequest(http.MethodGet, configEndpoint, nil)
+	request.Header.Set("Origin", "https://app.example")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, request)
+	if rr.Header().Get("Access-Control-Allow-Origin") != "" || rr.Header().Get("Vary") != "" {
+		t.Fatalf("Unexpected CORS headers %v", rr.Header())
+	}
+}
+
+func TestGatewayHandlerCORS(t *testing.T) {
+	target := createMockEchoGatewayServer(t)
+	target.gatewayCORS = newGatewayCORSPolicy("https://app.example", time.Minute)
+
+	preflight := func(handler http.HandlerFunc, path, origin string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(http.MethodOptions, path, nil)
+		request.Header.Set("Origin", origin)
+		request.Header.Set("Access-Control-Request-Method", http.MethodPost)
+		request.Header.Set("Access-Control-Request-Headers", "content-type")
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, request)
+		return rr
+	}
+	for _, handler := range []http.HandlerFunc{target.gatewayHandler, target.wellKnownHandler} {
+		rr := preflight(handler, echoEndpoint, "https://app.example")
+		if rr.Code != http.StatusNoContent || rr.Header().Get("Access-Control-Allow-Origin") != "https://app.example" {
+			t.Fatalf("Unexpected preflight response %d %v", rr.Code, rr.Header())
+		}
+		if rr.Header().Get("Access-Control-Allow-Methods") != http.MethodPost || rr.Header().Get("Access-Control-Allow-Headers") != "Content-Type" || rr.Header().Get("Access-Control-Max-Age") != "60" {
+			t.Fatalf("Unexpected preflight headers %v", rr.Header())
+		}
+	}
+	if rr := preflight(target.gatewayHandler, echoEndpoint, "https://evil.example"); rr.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Fatal("Disallowed origin received CORS headers")
+	}
+
+	req, _, err := ohttp.NewDefaultClient(target.keyring.Current()).EncapsulateRequest([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := httptest.NewRequest(http.MethodPost, echoEndpoint, bytes.NewReader(req.Marshal()))
+	request.Header.Set("Content-Type", ohttpRequestContentType)
+	request.Header.Set("Origin", "https://app.example")
+	rr := httptest.NewRecorder()
+	target.gatewayHandler(rr, request)
+	if rr.Code != http.StatusOK || rr.Header().Get("Access-Control-Allow-Origin") != "https://app.example" || rr.Header().Get("Access-Control-Expose-Headers") != "" {
+		t.Fatalf("Unexpected CORS response %d %v", rr.Code, rr.Header())
+	}
+}
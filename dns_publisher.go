@@ -0,0 +1,228 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	route53APIURL    = "https://route53.amazonaws.com/2013-04-01"
+	route53Region    = "us-east-1"
+	cloudflareAPIURL = "https://api.cloudflare.com/client/v4"
+
+	// The ohttp SvcParamKey from draft-ietf-ohai-svcb-config marks a service as an OHTTP gateway. The key
+	// config hash has no registered SvcParamKey, so it is carried in the first private-use key.
+	svcbOHTTPKey      = "ohttp"
+	svcbConfigHashKey = "key65280"
+
+	dnsRecordTTL = 300
+)
+
+// svcbRecord is the HTTPS resource record advertising the gateway for DNS-based key discovery.
+type svcbRecord struct {
+	name       string
+	configHash string
+}
+
+// params returns the record's SvcParams in presentation format.
+func (r svcbRecord) params() string {
+	return fmt.Sprintf(`alpn="h2" %s %s="%s"`, svcbOHTTPKey, svcbConfigHashKey, r.configHash)
+}
+
+// value returns the record's RDATA in presentation format: a ServiceMode record for the owner name.
+func (r svcbRecord) value() string {
+	return "1 . " + r.params()
+}
+
+// DNSPublisher keeps an HTTPS record in sync with the served key configs through a DNS provider's API.
+type DNSPublisher interface {
+	// Name identifies the publisher in logs.
+	Name() string
+
+	// Publish creates or replaces the record.
+	Publish(record svcbRecord) error
+}
+
+// dnsPublisherFromLocation builds a DNSPublisher from a location of the form route53://<hosted zone ID>/<name>
+// or cloudflare://<zone ID>/<name>.
+func dnsPublisherFromLocation(location string) (DNSPublisher, string, error) {
+	publishURL, err := url.Parse(location)
+	if err != nil {
+		return nil, "", fmt.Errorf("Invalid DNS publish location %q: %s", location, err)
+	}
+	zone := publishURL.Host
+	name := strings.Trim(publishURL.Path, "/")
+	if zone == "" || name == "" {
+		return nil, "", fmt.Errorf("DNS publish location %q must name a zone and a record", location)
+	}
+
+	switch publishURL.Scheme {
+	case "route53":
+		return &Route53DNSPublisher{
+			baseURL:      route53APIURL,
+			hostedZoneID: zone,
+			credentials:  newAWSCredentialChain(),
+			client:       keyProviderHTTPClient,
+		}, name, nil
+	case "cloudflare":
+		token := os.Getenv(cloudflareAPITokenEnvironmentVariable)
+		if token == "" {
+			return nil, "", fmt.Errorf("%s must be set to publish to Cloudflare DNS", cloudflareAPITokenEnvironmentVariable)
+		}
+		return &CloudflareDNSPublisher{
+			baseURL: cloudflareAPIURL,
+			zoneID:  zone,
+			token:   token,
+			client:  keyProviderHTTPClient,
+		}, name, nil
+	default:
+		return nil, "", fmt.Errorf("Unsupported DNS publish location %q", location)
+	}
+}
+
+// Route53DNSPublisher upserts the record in an Amazon Route 53 hosted zone, using the AWS credential chain.
+type Route53DNSPublisher struct {
+	baseURL      string
+	hostedZoneID string
+	credentials  *awsCredentialChain
+	client       *http.Client
+}
+
+type route53ChangeRequest struct {
+	XMLName xml.Name `xml:"https://route53.amazonaws.com/doc/2013-04-01/ ChangeResourceRecordSetsRequest"`
+	Action  string   `xml:"ChangeBatch>Changes>Change>Action"`
+	Name    string   `xml:"ChangeBatch>Changes>Change>ResourceRecordSet>Name"`
+	Type    string   `xml:"ChangeBatch>Changes>Change>ResourceRecordSet>Type"`
+	TTL     int      `xml:"ChangeBatch>Changes>Change>ResourceRecordSet>TTL"`
+	Value   string   `xml:"ChangeBatch>Changes>Change>ResourceRecordSet>ResourceRecords>ResourceRecord>Value"`
+}
+
+func (p *Route53DNSPublisher) Name() string {
+	return "route53"
+}
+
+func (p *Route53DNSPublisher) Publish(record svcbRecord) error {
+	creds, err := p.credentials.Retrieve()
+	if err != nil {
+		return err
+	}
+	payload, err := xml.Marshal(route53ChangeRequest{
+		Action: "UPSERT",
+		Name:   record.name,
+		Type:   "HTTPS",
+		TTL:    dnsRecordTTL,
+		Value:  record.value(),
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/hostedzone/%s/rrset", p.baseURL, p.hostedZoneID), bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/xml")
+	signAWSRequest(req, payload, creds, route53Region, "route53", time.Now())
+	return doPublishRequest(p.client, req)
+}
+
+// CloudflareDNSPublisher creates or updates the record in a Cloudflare zone, using an API token with
+// DNS edit permission.
+type CloudflareDNSPublisher struct {
+	baseURL string
+	zoneID  string
+	token   string
+	client  *http.Client
+}
+
+type cloudflareDNSRecord struct {
+	ID   string `json:"id,omitempty"`
+	Type string `json:"type"`
+	Name string `json:"name"`
+	TTL  int    `json:"ttl"`
+	Data struct {
+		Priority int    `json:"priority"`
+		Target   string `json:"target"`
+		Value    string `json:"value"`
+	} `json:"data"`
+}
+
+func (p *CloudflareDNSPublisher) Name() string {
+	return "cloudflare"
+}
+
+func (p *CloudflareDNSPublisher) do(method, path string, body interface{}, result interface{}) error {
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, p.baseURL+path, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+p.token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("Cloudflare %s %s failed with status %d", method, path, resp.StatusCode)
+	}
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+func (p *CloudflareDNSPublisher) Publish(record svcbRecord) error {
+	path := fmt.Sprintf("/zones/%s/dns_records", url.PathEscape(p.zoneID))
+	var existing struct {
+		Result []cloudflareDNSRecord `json:"result"`
+	}
+	query := url.Values{"type": {"HTTPS"}, "name": {record.name}}
+	if err := p.do(http.MethodGet, path+"?"+query.Encode(), nil, &existing); err != nil {
+		return err
+	}
+
+	update := cloudflareDNSRecord{Type: "HTTPS", Name: record.name, TTL: dnsRecordTTL}
+	update.Data.Priority = 1
+	update.Data.Target = "."
+	update.Data.Value = record.params()
+	if len(existing.Result) > 0 {
+		return p.do(http.MethodPut, path+"/"+url.PathEscape(existing.Result[0].ID), update, nil)
+	}
+	return p.do(http.MethodPost, path, update, nil)
+}
+
+// publishDNSOnChange publishes the HTTPS record for the key configs served by keyring now and whenever
+// its keys change.
+func publishDNSOnChange(keyring *RotatingKeyring, publisher DNSPublisher, name string) error {
+	record := func() svcbRecord {
+		return svcbRecord{name: name, configHash: configsHash(marshalConfigs(keyring.Configs()))}
+	}
+	if err := publisher.Publish(record()); err != nil {
+		return err
+	}
+	keyring.OnChange(func() {
+		if err := publisher.Publish(record()); err != nil {
+			log.Printf("Failed to publish DNS record %s to %s: %s", name, publisher.Name(), err)
+		}
+	})
+	return nil
+}
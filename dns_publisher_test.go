@@ -0,0 +1,102 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSVCBRecordValue(t *testing.T) {
+	record := svcbRecord{name: "gateway.example", configHash: "0102030405060708"}
+	if value := record.value(); value != `1 . alpn="h2" ohttp key65280="0102030405060708"` {
+		t.Fatalf("Unexpected record value %s", value)
+	}
+}
+
+func TestCloudflareDNSPublisher(t *testing.T) {
+	records := map[string]cloudflareDNSRecord{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer test-token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			result := []cloudflareDNSRecord{}
+			for _, record := range records {
+				if record.Name == r.URL.Query().Get("name") {
+					result = append(result, record)
+				}
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"result": result})
+		case http.MethodPost, http.MethodPut:
+			var record cloudflareDNSRecord
+			json.NewDecoder(r.Body).Decode(&record)
+			record.ID = "record-id"
+			if r.Method == http.MethodPut && !strings.HasSuffix(r.URL.Path, "/record-id") {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			records[record.ID] = record
+		}
+	}))
+	defer server.Close()
+
+	t.Setenv(cloudflareAPITokenEnvironmentVariable, "test-token")
+	publisher, name, err := dnsPublisherFromLocation("cloudflare://zone/gateway.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	publisher.(*CloudflareDNSPublisher).baseURL = server.URL
+
+	keyring := createKeyring(t)
+	if err := publishDNSOnChange(keyring, publisher, name); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := keyring.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+
+	record, ok := records["record-id"]
+	if !ok || len(records) != 1 {
+		t.Fatalf("Unexpected records %+v", records)
+	}
+	expected := svcbRecord{name: name, configHash: configsHash(marshalConfigs(keyring.Configs()))}
+	if record.Data.Value != expected.params() || record.Data.Priority != 1 || record.Data.Target != "." {
+		t.Fatalf("Record was not updated after rotation: %+v", record)
+	}
+}
+
+func TestRoute53DNSPublisher(t *testing.T) {
+	var change route53ChangeRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/hostedzone/Z123/rrset" || !strings.Contains(r.Header.Get("Authorization"), "/us-east-1/route53/") {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		xml.NewDecoder(r.Body).Decode(&change)
+	}))
+	defer server.Close()
+
+	t.Setenv(awsAccessKeyIDVariable, "AKIDEXAMPLE")
+	t.Setenv(awsSecretAccessKeyVariable, "secret")
+	publisher, name, err := dnsPublisherFromLocation("route53://Z123/gateway.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	publisher.(*Route53DNSPublisher).baseURL = server.URL
+
+	record := svcbRecord{name: name, configHash: "0102030405060708"}
+	if err := publisher.Publish(record); err != nil {
+		t.Fatal(err)
+	}
+	if change.Action != "UPSERT" || change.Type != "HTTPS" || change.Name != name || change.Value != record.value() {
+		t.Fatalf("Unexpected change %+v", change)
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+const (
+	dnsMessageContentType = "application/dns-message"
+
+	// DNS messages carry their own 12-byte header and can not exceed 65535 bytes (RFC 1035, Section 4.1.1)
+	dnsHeaderLength     = 12
+	dnsMaxMessageLength = 65535
+
+	// RCODE of a response to a query that the server failed to process
+	dnsRcodeServerFailure = 2
+)
+
+// DNSAppHandler is an AppContentHandler that treats the application request as an application/dns-message
+// query and resolves it with a DoH resolver (RFC 8484), so that the gateway also serves Oblivious DoH-style
+// traffic.
+type DNSAppHandler struct {
+	client      *http.Client
+	resolverURL string
+}
+
+// dnsServerFailure builds a SERVFAIL response to query, which carries the query ID and no records, so that
+// clients fail fast instead of waiting for a response that never comes.
+func dnsServerFailure(query []byte) []byte {
+	response := make([]byte, dnsHeaderLength)
+	copy(response, query[:2])
+	response[2] = 0x80 | query[2]&0x79 // QR, with the query's opcode and RD bit
+	response[3] = dnsRcodeServerFailure
+	return response
+}
+
+func (h DNSAppHandler) resolve(query []byte) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodPost, h.resolverURL, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", dnsMessageContentType)
+	req.Header.Set("Accept", dnsMessageContentType)
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DoH resolver returned %s", resp.Status)
+	}
+	response, err := ioutil.ReadAll(io.LimitReader(resp.Body, dnsMaxMessageLength+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(response) < dnsHeaderLength || len(response) > dnsMaxMessageLength {
+		return nil, fmt.Errorf("DoH resolver returned an invalid DNS message of %d bytes", len(response))
+	}
+	return response, nil
+}
+
+// Handle forwards the DNS query to the resolver and returns its response, or a SERVFAIL response if the
+// resolver can not be reached.
+func (h DNSAppHandler) Handle(binaryRequest []byte, metrics Metrics) ([]byte, error) {
+	if len(binaryRequest) < dnsHeaderLength || len(binaryRequest) > dnsMaxMessageLength {
+		metrics.Fire(metricsResultContentDecodingFailed)
+		return nil, PayloadMarshallingError
+	}
+
+	response, err := h.resolve(binaryRequest)
+	if err != nil {
+		metrics.Fire(metricsResultTargetRequestFailed)
+		return dnsServerFailure(binaryRequest), nil
+	}
+
+	metrics.Fire(metricsResultSuccess)
+	return response, nil
+}
@@ -0,0 +1,51 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDNSAppHandler(t *testing.T) {
+	query := []byte{0xab, 0xcd, 0x01, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
+	answer := append([]byte{0xab, 0xcd, 0x81, 0x80}, query[4:]...)
+	resolver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != dnsMessageContentType || !bytes.Equal(body, query) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", dnsMessageContentType)
+		w.Write(answer)
+	}))
+	defer resolver.Close()
+
+	handler := DNSAppHandler{client: resolver.Client(), resolverURL: resolver.URL}
+	factory := &MockMetricsFactory{}
+	response, err := handler.Handle(query, factory.Create(metricsEventGatewayRequest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(response, answer) {
+		t.Fatalf("Unexpected DNS response %x", response)
+	}
+
+	if _, err := handler.Handle(query[:4], factory.Create(metricsEventGatewayRequest)); err != PayloadMarshallingError {
+		t.Fatalf("Expected truncated query to be rejected, got %v", err)
+	}
+
+	resolver.Close()
+	response, err = handler.Handle(query, factory.Create(metricsEventGatewayRequest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []byte{0xab, 0xcd, 0x81, dnsRcodeServerFailure, 0, 0, 0, 0, 0, 0, 0, 0}
+	if !bytes.Equal(response, expected) {
+		t.Fatalf("Expected SERVFAIL response, got %x", response)
+	}
+}
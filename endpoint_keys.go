@@ -0,0 +1,65 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/chris-wood/ohttp-go"
+)
+
+// endpointSeedSalt domain-separates endpoint seeds from other uses of the gateway seed.
+var endpointSeedSalt = []byte("ohttp-gateway endpoint seed")
+
+// endpointKeyring is a keyring dedicated to a single encapsulation endpoint.
+type endpointKeyring struct {
+	keyring          *RotatingKeyring
+	rotationInterval time.Duration
+}
+
+// endpointKeyringsFromEnvironment builds the dedicated keyrings listed in ENDPOINT_KEYS, a comma-separated
+// list of endpoints, each optionally followed by "=<rotation interval>" (e.g., "/gateway-metadata=12h").
+// The initial key of each endpoint is derived from seed and the endpoint path, so that it is stable
+// across restarts whenever seed is.
+func endpointKeyringsFromEnvironment(keyID uint8, suite keySuite, seed []byte, newGateway func(ohttp.PrivateConfig) ohttp.Gateway, overlap time.Duration) (map[string]endpointKeyring, error) {
+	keyrings := make(map[string]endpointKeyring)
+	value := os.Getenv(endpointKeysEnvironmentVariable)
+	if value == "" {
+		return keyrings, nil
+	}
+
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		endpoint, interval := entry, ""
+		if i := strings.Index(entry, "="); i >= 0 {
+			endpoint, interval = entry[:i], entry[i+1:]
+		}
+		switch endpoint {
+		case gatewayEndpoint, echoEndpoint, metadataEndpoint:
+		default:
+			return nil, fmt.Errorf("Unknown encapsulation endpoint %q", endpoint)
+		}
+
+		var rotationInterval time.Duration
+		if interval != "" {
+			var err error
+			if rotationInterval, err = time.ParseDuration(interval); err != nil {
+				return nil, fmt.Errorf("Invalid rotation interval for %s: %s", endpoint, err)
+			}
+		}
+
+		keyring, err := NewKeyring(keyID, suite, deriveSeed(seed, endpointSeedSalt, []byte(endpoint)), newGateway, overlap)
+		if err != nil {
+			return nil, err
+		}
+		keyrings[endpoint] = endpointKeyring{
+			keyring:          keyring,
+			rotationInterval: rotationInterval,
+		}
+	}
+	return keyrings, nil
+}
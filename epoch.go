@@ -0,0 +1,104 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"encoding/binary"
+	"log"
+	"time"
+
+	"github.com/chris-wood/ohttp-go"
+)
+
+// epochSeedSalt domain-separates epoch seeds from other uses of the master secret.
+var epochSeedSalt = []byte("ohttp-gateway epoch seed")
+
+// deriveEpochSeed derives the key seed for epoch as HKDF-SHA256(master, epoch). Replicas sharing the
+// master secret derive identical keys for the same epoch without coordinating.
+func deriveEpochSeed(master []byte, epoch uint64) []byte {
+	info := make([]byte, 8)
+	binary.BigEndian.PutUint64(info, epoch)
+	return deriveSeed(master, epochSeedSalt, info)
+}
+
+// epochKeyID is the key ID of the key for epoch, so that replicas also agree on key IDs.
+func epochKeyID(epoch uint64) uint8 {
+	return uint8(epoch)
+}
+
+// epochKeySchedule rotates a keyring to a key derived from a master secret at the start of every epoch.
+// Epochs are consecutive periods of fixed length counted from the Unix epoch.
+type epochKeySchedule struct {
+	provider KeyProvider
+	master   []byte
+	period   time.Duration
+	overlap  time.Duration
+	keyring  *RotatingKeyring
+}
+
+func epochAt(t time.Time, period time.Duration) uint64 {
+	return uint64(t.UnixNano() / int64(period))
+}
+
+func epochStart(epoch uint64, period time.Duration) time.Time {
+	return time.Unix(0, int64(epoch)*int64(period))
+}
+
+// newEpochKeySchedule creates the keyring for the epoch containing now. If the previous epoch ended
+// less than overlap ago, its key is included as a retired key, as it would be on a replica that had
+// been running through the epoch boundary.
+func newEpochKeySchedule(provider KeyProvider, master []byte, period time.Duration, suite keySuite, newGateway func(ohttp.PrivateConfig) ohttp.Gateway, overlap time.Duration, now time.Time) (*epochKeySchedule, error) {
+	epoch := epochAt(now, period)
+	s := &epochKeySchedule{
+		provider: provider,
+		master:   master,
+		period:   period,
+		overlap:  overlap,
+	}
+
+	retireAt := epochStart(epoch, period).Add(overlap)
+	if epoch == 0 || !now.Before(retireAt) {
+		keyring, err := NewKeyring(epochKeyID(epoch), suite, deriveEpochSeed(master, epoch), newGateway, overlap)
+		if err != nil {
+			return nil, err
+		}
+		keyring.setNextRotation(epochStart(epoch+1, period))
+		s.keyring = keyring
+		return s, nil
+	}
+
+	keyring, err := NewKeyring(epochKeyID(epoch-1), suite, deriveEpochSeed(master, epoch-1), newGateway, overlap)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := keyring.rotateToKeyID(epochKeyID(epoch), deriveEpochSeed(master, epoch), retireAt.Sub(now)); err != nil {
+		return nil, err
+	}
+	keyring.setNextRotation(epochStart(epoch+1, period))
+	s.keyring = keyring
+	return s, nil
+}
+
+// Run rotates the keyring at each epoch boundary until the process exits. The master secret is
+// re-read from the key provider before each rotation, so a new secret takes effect at the next epoch.
+func (s *epochKeySchedule) Run() {
+	for {
+		epoch := epochAt(time.Now(), s.period) + 1
+		time.Sleep(time.Until(epochStart(epoch, s.period)))
+
+		if master, err := refreshSeed(s.provider); err != nil {
+			log.Printf("Failed to refresh master secret from %s, keeping the previous one: %s", s.provider.Name(), err)
+		} else {
+			s.master = master
+		}
+
+		s.keyring.setNextRotation(epochStart(epoch+1, s.period))
+		config, err := s.keyring.rotateToKeyID(epochKeyID(epoch), deriveEpochSeed(s.master, epoch), s.overlap)
+		if err != nil {
+			log.Printf("Epoch key rotation failed: %s", err)
+			continue
+		}
+		log.Printf("Rotated to key for epoch %d, current key ID is now %d", epoch, config.ID)
+	}
+}
@@ -0,0 +1,44 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/chris-wood/ohttp-go"
+)
+
+func TestEpochKeysAreDeterministic(t *testing.T) {
+	master := []byte("shared master secret")
+	period := time.Hour
+	now := epochStart(1000, period).Add(10 * time.Minute)
+
+	first, err := newEpochKeySchedule(nil, master, period, defaultKeySuite, ohttp.NewDefaultGateway, time.Hour, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := newEpochKeySchedule(nil, master, period, defaultKeySuite, ohttp.NewDefaultGateway, time.Hour, now.Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	current := first.keyring.Current()
+	if current.ID != epochKeyID(1000) {
+		t.Fatalf("Current key ID is %d, expected %d", current.ID, epochKeyID(1000))
+	}
+	if !current.IsEqual(second.keyring.Current()) {
+		t.Fatal("Replicas derived different keys for the same epoch")
+	}
+
+	// The previous epoch's key is still inside its overlap window
+	if _, ok := first.keyring.Gateway(epochKeyID(999)); !ok {
+		t.Fatal("Previous epoch key missing inside the overlap window")
+	}
+
+	if bytes.Equal(deriveEpochSeed(master, 1000), deriveEpochSeed(master, 1001)) {
+		t.Fatal("Consecutive epochs derived the same seed")
+	}
+}
@@ -0,0 +1,48 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"time"
+)
+
+// defaultFileKeyWatchInterval is how often a FileKeyProvider seed is re-read when
+// KEY_SOURCE_REFRESH_INTERVAL is unset.
+const defaultFileKeyWatchInterval = 10 * time.Second
+
+// FileKeyProvider is a KeyProvider that reads the seed from a file, such as a key of a Kubernetes Secret
+// mounted as a volume. The kubelet updates mounted Secrets in place by swapping a symlink, so re-reading
+// the file picks up a rotated Secret without restarting the gateway.
+type FileKeyProvider struct {
+	path string
+}
+
+// newFileKeyProvider builds a FileKeyProvider from a key source of the form file:///path/to/seed.
+func newFileKeyProvider(source *url.URL) (*FileKeyProvider, error) {
+	if source.Path == "" {
+		return nil, fmt.Errorf("File key source is missing a path")
+	}
+	return &FileKeyProvider{path: source.Path}, nil
+}
+
+func (p *FileKeyProvider) Name() string {
+	return "file"
+}
+
+// Seed reads the file, which may hold either the raw seed bytes or their hex encoding.
+func (p *FileKeyProvider) Seed() ([]byte, error) {
+	contents, err := ioutil.ReadFile(p.path)
+	if err != nil {
+		return nil, err
+	}
+	if seed, err := hex.DecodeString(string(bytes.TrimSpace(contents))); err == nil {
+		return seed, nil
+	}
+	return contents, nil
+}
@@ -0,0 +1,60 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileKeyProviderFollowsSecretUpdates(t *testing.T) {
+	// Lay out the directory like the kubelet does for a mounted Secret
+	dir := t.TempDir()
+	writeVersion := func(name string, contents string) {
+		version := filepath.Join(dir, name)
+		if err := os.Mkdir(version, 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(version, "seed"), []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+		os.Remove(filepath.Join(dir, "..data_tmp"))
+		if err := os.Symlink(name, filepath.Join(dir, "..data_tmp")); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(filepath.Join(dir, "..data_tmp"), filepath.Join(dir, "..data")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeVersion("..v1", "0102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f20\n")
+	if err := os.Symlink(filepath.Join("..data", "seed"), filepath.Join(dir, "seed")); err != nil {
+		t.Fatal(err)
+	}
+
+	source, _ := url.Parse("file://" + filepath.Join(dir, "seed"))
+	provider, err := newFileKeyProvider(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seed, err := provider.Seed()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(seed) != defaultSeedLength || seed[0] != 0x01 {
+		t.Fatalf("Unexpected seed %x", seed)
+	}
+
+	writeVersion("..v2", "raw seed bytes")
+	seed, err = provider.Seed()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(seed, []byte("raw seed bytes")) {
+		t.Fatalf("Updated secret not picked up, got %q", seed)
+	}
+}
@@ -0,0 +1,14 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build boringcrypto
+// +build boringcrypto
+
+package main
+
+import "crypto/boring"
+
+// fipsMode reports whether the standard library crypto is backed by the FIPS-validated BoringCrypto module.
+func fipsMode() bool {
+	return boring.Enabled()
+}
@@ -0,0 +1,12 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !boringcrypto
+// +build !boringcrypto
+
+package main
+
+// fipsMode reports false, since builds without the boringcrypto tag use the standard Go crypto.
+func fipsMode() bool {
+	return false
+}
@@ -0,0 +1,405 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Maximum size of the request line and headers, and of the trailers, of a request
+	maxHeaderBytes = 64 << 10
+
+	// Maximum length of a chunk size line, which carries no chunk extensions
+	maxChunkLineLength = 64
+
+	// rejectedRequest replaces a request whose framing was rejected before any of it reached the server. Its
+	// header line has no colon, so the server answers it with a 400 Bad Request and closes the connection,
+	// after any response to the previous requests of the connection.
+	rejectedRequest = "POST / HTTP/1.1\r\nRejected request framing\r\n\r\n"
+
+	// Time allowed for the TLS handshake of a connection to a tlsFramingListener
+	tlsHandshakeTimeout = 10 * time.Second
+
+	// Maximum number of TLS handshakes that a tlsFramingListener runs at once. Further connections wait
+	// in the listen backlog.
+	maxConcurrentTLSHandshakes = 256
+
+	// Bounds of the delay before a tlsFramingListener accepts again after a temporary error, which match
+	// those of http.Server
+	minAcceptRetryDelay = 5 * time.Millisecond
+	maxAcceptRetryDelay = time.Second
+)
+
+var (
+	errFramingTooLarge   = errors.New("Request header block too large")
+	errMalformedChunking = errors.New("Malformed chunked request body")
+)
+
+type framingState int
+
+const (
+	framingHead framingState = iota
+	framingBody
+	framingChunkSize
+	framingChunkData
+	framingTrailers
+	framingPassthrough
+	framingRejected
+)
+
+// framingListener validates the HTTP/1.1 framing of the requests read from its connections before the
+// server parses them, since a relay or load balancer in front of the gateway may frame a request
+// differently than net/http, which would let one request smuggle another past it. Requests with both
+// Content-Length and Transfer-Encoding, repeated or invalid framing headers, obsolete line folding, bare LF
+// line endings, or header blocks larger than maxHeaderBytes are rejected with a 400 Bad Request, and
+// connections whose chunked bodies carry chunk extensions or malformed chunk sizes are closed. HTTP/2 with
+// prior knowledge, which frames requests itself, is passed through. TLS connections are validated by the
+// tlsFramingListener.
+type framingListener struct {
+	net.Listener
+}
+
+func (l framingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &framingConn{Conn: conn, r: bufio.NewReader(conn)}, nil
+}
+
+// tlsFramingListener is a framingListener for TLS connections. It completes the TLS handshake of each
+// connection before returning it, so that the framing of HTTP/1.1 connections can be validated after
+// decryption, while connections that negotiated another protocol with ALPN, such as h2, are returned as TLS
+// connections for the server to hand to that protocol. Up to maxConcurrentTLSHandshakes handshakes run
+// concurrently, so a slow client does not delay the connections accepted after it. Since the server only
+// fills in the TLS connection state of requests read from a *tls.Conn, servers of a tlsFramingListener
+// must set it with withTLSConnectionState.
+type tlsFramingListener struct {
+	net.Listener
+	config     *tls.Config
+	conns      chan net.Conn
+	err        chan error
+	done       chan struct{}
+	handshakes chan struct{}
+	// start and stop start the accept loop and stop the handshakes once
+	start, stop sync.Once
+}
+
+func newTLSFramingListener(listener net.Listener, config *tls.Config) *tlsFramingListener {
+	l := &tlsFramingListener{
+		Listener:   listener,
+		config:     config,
+		conns:      make(chan net.Conn),
+		err:        make(chan error, 1),
+		done:       make(chan struct{}),
+		handshakes: make(chan struct{}, maxConcurrentTLSHandshakes),
+	}
+	return l
+}
+
+// acceptLoop accepts connections until the listener fails permanently, retrying after temporary errors
+// such as running out of file descriptors.
+func (l *tlsFramingListener) acceptLoop() {
+	delay := time.Duration(0)
+	for {
+		select {
+		case l.handshakes <- struct{}{}:
+		case <-l.done:
+			return
+		}
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			<-l.handshakes
+			if ne, ok := err.(net.Error); ok && ne.Temporary() && !errors.Is(err, net.ErrClosed) {
+				if delay *= 2; delay == 0 {
+					delay = minAcceptRetryDelay
+				} else if delay > maxAcceptRetryDelay {
+					delay = maxAcceptRetryDelay
+				}
+				log.Printf("TLS listener accept error: %s; retrying in %v", err, delay)
+				select {
+				case <-time.After(delay):
+					continue
+				case <-l.done:
+					return
+				}
+			}
+			l.err <- err
+			return
+		}
+		delay = 0
+		go l.handshake(tls.Server(conn, l.config))
+	}
+}
+
+func (l *tlsFramingListener) handshake(conn *tls.Conn) {
+	defer func() { <-l.handshakes }()
+	conn.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+	if err := conn.Handshake(); err != nil {
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	var accepted net.Conn = conn
+	if protocol := conn.ConnectionState().NegotiatedProtocol; protocol == "" || protocol == "http/1.1" {
+		accepted = &framingConn{Conn: conn, r: bufio.NewReader(conn)}
+	}
+	select {
+	case l.conns <- accepted:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+func (l *tlsFramingListener) Accept() (net.Conn, error) {
+	// The server completes the TLS config before it first accepts a connection
+	l.start.Do(func() { go l.acceptLoop() })
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case err := <-l.err:
+		// The error is permanent, so every later call fails alike
+		l.err <- err
+		return nil, err
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *tlsFramingListener) Close() error {
+	l.stop.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
+
+// tlsConnContextKey is the context key of the TLS connection under a framingConn.
+type tlsConnContextKey struct{}
+
+// withTLSConnectionState sets the TLS connection state of the requests that server reads from the
+// framingConn wrapping of a TLS connection of a tlsFramingListener, which the server can not see itself.
+func withTLSConnectionState(server *http.Server) {
+	connContext := server.ConnContext
+	server.ConnContext = func(ctx context.Context, c net.Conn) context.Context {
+		if connContext != nil {
+			ctx = connContext(ctx, c)
+		}
+		if framed, ok := c.(*framingConn); ok {
+			if conn, ok := framed.Conn.(*tls.Conn); ok {
+				ctx = context.WithValue(ctx, tlsConnContextKey{}, conn)
+			}
+		}
+		return ctx
+	}
+
+	handler := server.Handler
+	if handler == nil {
+		handler = http.DefaultServeMux
+	}
+	server.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if conn, ok := r.Context().Value(tlsConnContextKey{}).(*tls.Conn); ok && r.TLS == nil {
+			state := conn.ConnectionState()
+			r.TLS = &state
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// framingConn returns the bytes read from a connection as each piece of framing has been validated.
+type framingConn struct {
+	net.Conn
+	r         *bufio.Reader
+	state     framingState
+	remaining int64
+	pending   []byte
+	err       error
+}
+
+func (c *framingConn) Read(p []byte) (int, error) {
+	for len(c.pending) == 0 {
+		if c.err != nil {
+			return 0, c.err
+		}
+		switch c.state {
+		case framingPassthrough:
+			return c.r.Read(p)
+		case framingBody, framingChunkData:
+			if int64(len(p)) > c.remaining {
+				p = p[:c.remaining]
+			}
+			n, err := c.r.Read(p)
+			if c.remaining -= int64(n); c.remaining == 0 {
+				if c.state == framingBody {
+					c.state = framingHead
+				} else {
+					c.state = framingChunkSize
+				}
+			}
+			return n, err
+		case framingHead:
+			c.pending, c.err = c.readHead()
+		case framingChunkSize:
+			c.pending, c.err = c.readChunkSize()
+		case framingTrailers:
+			c.pending, c.err = c.readTrailers()
+		case framingRejected:
+			c.err = errMalformedChunking
+		}
+	}
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// readLine appends the next line to line, failing if line grows beyond limit.
+func (c *framingConn) readLine(line []byte, limit int) ([]byte, error) {
+	for {
+		fragment, err := c.r.ReadSlice('\n')
+		line = append(line, fragment...)
+		if len(line) > limit {
+			return line, errFramingTooLarge
+		}
+		if err != bufio.ErrBufferFull {
+			return line, err
+		}
+	}
+}
+
+// reject replaces the request being read with rejectedRequest.
+func (c *framingConn) reject() ([]byte, error) {
+	c.state = framingRejected
+	return []byte(rejectedRequest), nil
+}
+
+// readHeaderLine returns the next header line of head without its CRLF, or ok false if it is malformed.
+func (c *framingConn) readHeaderLine(head []byte) ([]byte, []byte, bool, error) {
+	start := len(head)
+	head, err := c.readLine(head, maxHeaderBytes)
+	if err == errFramingTooLarge {
+		return head, nil, false, nil
+	}
+	if err != nil {
+		return head, nil, true, err
+	}
+	line := head[start:]
+	if !bytes.HasSuffix(line, []byte("\r\n")) || bytes.IndexByte(line[:len(line)-2], '\r') >= 0 {
+		return head, nil, false, nil
+	}
+	line = line[:len(line)-2]
+	if len(line) > 0 && (line[0] == ' ' || line[0] == '\t') {
+		return head, nil, false, nil
+	}
+	return head, line, true, nil
+}
+
+func (c *framingConn) readHead() ([]byte, error) {
+	head, requestLine, ok, err := c.readHeaderLine(nil)
+	if err != nil {
+		return head, err
+	}
+	if !ok {
+		return c.reject()
+	}
+	if string(requestLine) == "PRI * HTTP/2.0" {
+		c.state = framingPassthrough
+		return head, nil
+	}
+
+	var contentLength, transferEncoding []string
+	for {
+		var line []byte
+		if head, line, ok, err = c.readHeaderLine(head); err != nil {
+			return head, err
+		}
+		if !ok {
+			return c.reject()
+		}
+		if len(line) == 0 {
+			break
+		}
+		colon := bytes.IndexByte(line, ':')
+		if colon <= 0 || bytes.ContainsAny(line[:colon], " \t") {
+			return c.reject()
+		}
+		name, value := string(line[:colon]), strings.TrimSpace(string(line[colon+1:]))
+		if strings.EqualFold(name, "Content-Length") {
+			contentLength = append(contentLength, value)
+		} else if strings.EqualFold(name, "Transfer-Encoding") {
+			transferEncoding = append(transferEncoding, value)
+		}
+	}
+
+	switch {
+	case len(contentLength) > 0 && len(transferEncoding) > 0, len(contentLength) > 1, len(transferEncoding) > 1:
+		return c.reject()
+	case len(transferEncoding) == 1:
+		if !strings.EqualFold(transferEncoding[0], "chunked") {
+			return c.reject()
+		}
+		c.state = framingChunkSize
+	case len(contentLength) == 1:
+		length, err := strconv.ParseInt(contentLength[0], 10, 64)
+		if err != nil || length < 0 || strings.HasPrefix(contentLength[0], "+") {
+			return c.reject()
+		}
+		if length > 0 {
+			c.state, c.remaining = framingBody, length
+		}
+	}
+	return head, nil
+}
+
+func (c *framingConn) readChunkSize() ([]byte, error) {
+	line, err := c.readLine(nil, maxChunkLineLength)
+	if err != nil {
+		if err == errFramingTooLarge {
+			err = errMalformedChunking
+		}
+		return nil, err
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errMalformedChunking
+	}
+	// Chunk extensions and whitespace, which parsers disagree on, fail the hex size
+	size, err := strconv.ParseUint(string(line[:len(line)-2]), 16, 62)
+	if err != nil {
+		return nil, errMalformedChunking
+	}
+	if size == 0 {
+		c.state = framingTrailers
+	} else {
+		// The chunk data is followed by a CRLF, which the server checks
+		c.state, c.remaining = framingChunkData, int64(size)+2
+	}
+	return line, nil
+}
+
+func (c *framingConn) readTrailers() ([]byte, error) {
+	var trailers, line []byte
+	for {
+		var ok bool
+		var err error
+		if trailers, line, ok, err = c.readHeaderLine(trailers); err != nil {
+			return trailers, err
+		}
+		if !ok {
+			return nil, errMalformedChunking
+		}
+		if len(line) == 0 {
+			c.state = framingHead
+			return trailers, nil
+		}
+	}
+}
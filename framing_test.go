@@ -0,0 +1,219 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFramingListener(t *testing.T) {
+	var smuggled int32
+	server := newListenerServer("", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/smuggled" {
+			atomic.AddInt32(&smuggled, 1)
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Write(body)
+	}), nil, true)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(framingListener{listener})
+	defer server.Close()
+
+	// send writes raw to a new connection and returns the status codes of the responses, and their bodies,
+	// until the server closes the connection
+	send := func(raw string) ([]int, []string) {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := conn.Write([]byte(raw)); err != nil {
+			t.Fatal(err)
+		}
+		statuses, bodies := []int{}, []string{}
+		r := bufio.NewReader(conn)
+		for {
+			resp, err := http.ReadResponse(r, nil)
+			if err != nil {
+				return statuses, bodies
+			}
+			body, _ := ioutil.ReadAll(resp.Body)
+			statuses, bodies = append(statuses, resp.StatusCode), append(bodies, string(body))
+			if resp.Close {
+				return statuses, bodies
+			}
+		}
+	}
+
+	// Well-framed pipelined requests are served, including chunked bodies with trailers
+	statuses, bodies := send("POST / HTTP/1.1\r\nHost: gateway\r\nContent-Length: 5\r\n\r\nhello" +
+		"POST / HTTP/1.1\r\nHost: gateway\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nworld\r\n0\r\nX-Trailer: 1\r\n\r\n" +
+		"GET / HTTP/1.1\r\nHost: gateway\r\nConnection: close\r\n\r\n")
+	if len(statuses) != 3 || statuses[0] != http.StatusOK || bodies[0] != "hello" || bodies[1] != "world" || statuses[2] != http.StatusOK {
+		t.Fatalf("Unexpected responses %v %q", statuses, bodies)
+	}
+
+	for name, raw := range map[string]string{
+		"conflicting framing":      "POST / HTTP/1.1\r\nHost: gateway\r\nContent-Length: 4\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n",
+		"repeated content length":  "POST / HTTP/1.1\r\nHost: gateway\r\nContent-Length: 5\r\nContent-Length: 5\r\n\r\nhello",
+		"signed content length":    "POST / HTTP/1.1\r\nHost: gateway\r\nContent-Length: +5\r\n\r\nhello",
+		"other transfer coding":    "POST / HTTP/1.1\r\nHost: gateway\r\nTransfer-Encoding: gzip, chunked\r\n\r\n0\r\n\r\n",
+		"obsolete line folding":    "POST / HTTP/1.1\r\nHost: gateway\r\nTransfer-Encoding:\r\n chunked\r\n\r\n0\r\n\r\n",
+		"space before colon":       "POST / HTTP/1.1\r\nHost: gateway\r\nTransfer-Encoding : chunked\r\n\r\n0\r\n\r\n",
+		"bare line feed":           "POST / HTTP/1.1\nHost: gateway\nContent-Length: 5\n\nhello",
+		"oversized header block":   "GET / HTTP/1.1\r\nHost: gateway\r\nX-Padding: " + strings.Repeat("a", maxHeaderBytes) + "\r\n\r\n",
+		"smuggled request in body": "POST / HTTP/1.1\r\nHost: gateway\r\nTransfer-Encoding: chunked\r\nContent-Length: 45\r\n\r\n0\r\n\r\nGET /smuggled HTTP/1.1\r\nHost: gateway\r\n\r\n",
+	} {
+		if statuses, _ := send(raw); len(statuses) != 1 || statuses[0] != http.StatusBadRequest {
+			t.Fatalf("Expected the request with %s to be rejected, got %v", name, statuses)
+		}
+	}
+	if atomic.LoadInt32(&smuggled) != 0 {
+		t.Fatal("Smuggled request was served")
+	}
+
+	// Malformed chunks fail the request body, and are never served as the next request
+	for name, raw := range map[string]string{
+		"chunk extension":   "POST / HTTP/1.1\r\nHost: gateway\r\nTransfer-Encoding: chunked\r\n\r\n5;ext=1\r\nhello\r\n0\r\n\r\n",
+		"padded chunk size": "POST / HTTP/1.1\r\nHost: gateway\r\nTransfer-Encoding: chunked\r\n\r\n5 \r\nhello\r\n0\r\n\r\n",
+		"malformed trailer": "POST / HTTP/1.1\r\nHost: gateway\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\n folded\r\n\r\nGET /smuggled HTTP/1.1\r\nHost: gateway\r\n\r\n",
+	} {
+		if statuses, _ := send(raw); len(statuses) > 1 || (len(statuses) == 1 && statuses[0] != http.StatusBadRequest) {
+			t.Fatalf("Expected the request with a %s to fail, got %v", name, statuses)
+		}
+	}
+	if atomic.LoadInt32(&smuggled) != 0 {
+		t.Fatal("Smuggled request was served")
+	}
+}
+
+func TestTLSFramingListener(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeClientCertificate(t, certFile, keyFile, "gateway.example")
+	config, err := serverTLSConfig(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newListenerServer("", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Handlers see the TLS connection state whether or not the framing of the request was validated
+		if r.TLS == nil || !r.TLS.HandshakeComplete {
+			w.WriteHeader(http.StatusMisdirectedRequest)
+			return
+		}
+		fmt.Fprintf(w, "HTTP/%d", r.ProtoMajor)
+	}), config, true)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go serveListener(server, listener)
+	defer server.Close()
+
+	// send writes raw to a new HTTP/1.1 TLS connection, and returns the status code of the first response
+	send := func(raw string) int {
+		conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"http/1.1"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := conn.Write([]byte(raw)); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if status := send("POST / HTTP/1.1\r\nHost: gateway\r\nContent-Length: 5\r\n\r\nhello"); status != http.StatusOK {
+		t.Fatalf("Expected a well-framed request over TLS to be served with its TLS state, got %d", status)
+	}
+	if status := send("POST / HTTP/1.1\r\nHost: gateway\r\nContent-Length: 4\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n"); status != http.StatusBadRequest {
+		t.Fatalf("Expected conflicting framing over TLS to be rejected, got %d", status)
+	}
+
+	// HTTP/2 is still negotiated with ALPN
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}, ForceAttemptHTTP2: true}}
+	resp, err := client.Get("https://" + listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if body, _ := ioutil.ReadAll(resp.Body); resp.ProtoMajor != 2 || string(body) != "HTTP/2" {
+		t.Fatalf("Expected HTTP/2 to be negotiated, got %s", resp.Proto)
+	}
+}
+
+// flakyListener fails its first Accept calls with a temporary error, as a listener out of file
+// descriptors does.
+type flakyListener struct {
+	net.Listener
+	failures int
+}
+
+type temporaryAcceptError struct{}
+
+func (temporaryAcceptError) Error() string   { return "too many open files" }
+func (temporaryAcceptError) Timeout() bool   { return false }
+func (temporaryAcceptError) Temporary() bool { return true }
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	if l.failures > 0 {
+		l.failures--
+		return nil, temporaryAcceptError{}
+	}
+	return l.Listener.Accept()
+}
+
+func TestTLSFramingListenerRetriesTemporaryErrors(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeClientCertificate(t, certFile, keyFile, "gateway.example")
+	config, err := serverTLSConfig(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsListener := newTLSFramingListener(&flakyListener{Listener: listener, failures: 3}, config)
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})}
+	go server.Serve(tlsListener)
+	defer server.Close()
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}, Timeout: 5 * time.Second}
+	resp, err := client.Get("https://" + listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Expected the listener to accept again after temporary errors: %s", err)
+	}
+	resp.Body.Close()
+
+	// Closing the listener is permanent
+	tlsListener.Close()
+	if _, err := tlsListener.Accept(); err == nil {
+		t.Fatal("Expected Accept to fail after Close")
+	}
+}
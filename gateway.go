@@ -4,38 +4,102 @@
 package main
 
 import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
-	"math/rand"
+	"mime"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/chris-wood/ohttp-go"
+	"golang.org/x/crypto/cryptobyte"
 )
 
 type gatewayResource struct {
 	verbose               bool
-	keyID                 uint8
-	gateway               ohttp.Gateway
+	keyring               Keyring
+	endpointKeyrings      map[string]Keyring
 	encapsulationHandlers map[string]EncapsulationHandler
 	debugResponse         bool
 	metricsFactory        MetricsFactory
+	configCache           cachePolicy
+	configCORS            corsPolicy
+	gatewayCORS           corsPolicy
+	strictMediaType       bool
+	configSigningKey      ed25519.PrivateKey
+	maxRequestSize        int64
+	// maxChunkedRequestSize bounds chunked requests instead of maxRequestSize, since they are not buffered
+	maxChunkedRequestSize int64
+	// attestation, if set, commits config responses to the attestation document of their configs
+	attestation *attestationCache
+	// tokenVerifier, if set, rejects requests that are not authorized with a Privacy Pass token
+	tokenVerifier *privacyPassVerifier
+}
+
+// cachePolicy controls the Cache-Control header of config responses. Zero values select the defaults.
+type cachePolicy struct {
+	// minMaxAge and maxMaxAge bound the max-age, which is spread evenly between them so that clients
+	// do not all refetch configs at once.
+	minMaxAge time.Duration
+	maxMaxAge time.Duration
+	public    bool
+}
+
+// header returns the Cache-Control header for configs with the given digest. The max-age is derived from
+// the digest rather than drawn per request, so every response for the same set of keys, from any
+// replica, carries the same max-age, while each new set of keys gets a different one.
+func (p cachePolicy) header(digest [sha256.Size]byte) string {
+	minAge, maxAge := twelveHours, twelveHours+twentyFourHours
+	if p.minMaxAge > 0 {
+		minAge = int(p.minMaxAge.Seconds())
+	}
+	if p.maxMaxAge > 0 {
+		maxAge = int(p.maxMaxAge.Seconds())
+	}
+	age := minAge
+	if maxAge > minAge {
+		age += int(binary.BigEndian.Uint64(digest[:8]) % uint64(maxAge-minAge))
+	}
+	visibility := "private"
+	if p.public {
+		visibility = "public"
+	}
+	return fmt.Sprintf("max-age=%d, %s", age, visibility)
 }
 
 const (
 	ohttpRequestContentType  = "message/ohttp-req"
 	ohttpResponseContentType = "message/ohttp-res"
+	ohttpKeysContentType     = "application/ohttp-keys"
+	configSignatureHeader    = "Ohttp-Keys-Signature"
+	configExpiryHeader       = "Ohttp-Keys-Expires"
+	configsHashLength        = 8
 	twelveHours              = 12 * 3600
 	twentyFourHours          = 24 * 3600
 
 	// Metrics constants
-	metricsEventGatewayRequest      = "gateway_request"
-	metricsEventConfigsRequest      = "configs_request"
-	metricsResultConfigsUnavalable  = "configs_unavailable"
-	metricsResultInvalidMethod      = "invalid_method"
-	metricsResultInvalidContentType = "invalid_content_type"
-	metricsResultInvalidContent     = "invalid_content"
+	metricsEventGatewayRequest        = "gateway_request"
+	metricsEventConfigsRequest        = "configs_request"
+	metricsEventAttestationRequest    = "attestation_request"
+	metricsEventConfigsHashRequest    = "configs_hash_request"
+	metricsResultConfigsUnavalable    = "configs_unavailable"
+	metricsResultInvalidMethod        = "invalid_method"
+	metricsResultUnsupportedMediaType = "unsupported_media_type"
+	metricsResultInvalidContent       = "invalid_content"
+	metricsResultNotAcceptable        = "not_acceptable"
+	metricsResultAttestationFailed    = "attestation_failed"
+	metricsResultRequestTooLarge      = "request_too_large"
+	metricsResultUnauthorized         = "unauthorized"
+	metricsTagKeyID                   = "key_id"
 )
 
 func (s *gatewayResource) httpError(w http.ResponseWriter, status int, debugMessage string, metrics Metrics, metricsPrefix string) {
@@ -50,6 +114,19 @@ func (s *gatewayResource) httpError(w http.ResponseWriter, status int, debugMess
 	metrics.ResponseStatus(metricsPrefix, status)
 }
 
+// requestMediaType returns the lower-case media type of a request Content-Type. Parameters are ignored,
+// since the OHTTP media types define none, unless strictMediaType is set, in which case they are rejected.
+func (s *gatewayResource) requestMediaType(contentType string) (string, error) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "", err
+	}
+	if s.strictMediaType && len(params) > 0 {
+		return "", fmt.Errorf("Unexpected media type parameters")
+	}
+	return mediaType, nil
+}
+
 func (s *gatewayResource) gatewayHandler(w http.ResponseWriter, r *http.Request) {
 	if s.verbose {
 		log.Printf("%s Handling %s\n", r.Method, r.URL.Path)
@@ -57,17 +134,52 @@ func (s *gatewayResource) gatewayHandler(w http.ResponseWriter, r *http.Request)
 
 	metrics := s.metricsFactory.Create(metricsEventGatewayRequest)
 
+	if s.gatewayCORS.apply(w, r) {
+		metrics.ResponseStatus(r.Method, http.StatusNoContent)
+		return
+	}
+
+	// Encapsulated requests are only ever POSTed, so other methods point to a misconfigured relay
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Allow", http.MethodPost)
+		w.Header().Set("Accept-Post", ohttpRequestContentType+", "+ohttpChunkedRequestContentType)
+		w.WriteHeader(http.StatusNoContent)
+		metrics.ResponseStatus(r.Method, http.StatusNoContent)
+		return
+	}
 	if r.Method != http.MethodPost {
 		metrics.Fire(metricsResultInvalidMethod)
-		s.httpError(w, http.StatusBadRequest, fmt.Sprintf("Invalid method: %s", r.Method), metrics, r.Method)
+		w.Header().Set("Allow", http.MethodPost)
+		s.httpError(w, http.StatusMethodNotAllowed, fmt.Sprintf("Invalid method: %s", r.Method), metrics, r.Method)
 		return
 	}
-	if r.Header.Get("Content-Type") != ohttpRequestContentType {
-		metrics.Fire(metricsResultInvalidContentType)
-		s.httpError(w, http.StatusBadRequest, fmt.Sprintf("Invalid content type: %s", r.Header.Get("Content-Type")), metrics, r.Method)
+	contentType, err := s.requestMediaType(r.Header.Get("Content-Type"))
+	if err != nil || (contentType != ohttpRequestContentType && contentType != ohttpChunkedRequestContentType) {
+		metrics.Fire(metricsResultUnsupportedMediaType)
+		w.Header().Set("Accept-Post", ohttpRequestContentType+", "+ohttpChunkedRequestContentType)
+		s.httpError(w, http.StatusUnsupportedMediaType, fmt.Sprintf("Invalid content type: %s", r.Header.Get("Content-Type")), metrics, r.Method)
+		return
+	}
+	// The response is framed like the request, so it can only be returned if the relay accepts that framing
+	responseType := ohttpResponseContentType
+	if contentType == ohttpChunkedRequestContentType {
+		responseType = ohttpChunkedResponseContentType
+	}
+	if accept := r.Header.Get("Accept"); !acceptsMediaType(accept, responseType) {
+		metrics.Fire(metricsResultNotAcceptable)
+		s.httpError(w, http.StatusNotAcceptable, fmt.Sprintf("Not acceptable: %s", accept), metrics, r.Method)
 		return
 	}
 
+	if s.tokenVerifier != nil {
+		if err := s.tokenVerifier.verify(r); err != nil {
+			metrics.Fire(metricsResultUnauthorized)
+			w.Header().Set("WWW-Authenticate", s.tokenVerifier.challengeHeader())
+			s.httpError(w, http.StatusUnauthorized, fmt.Sprintf("Unauthorized: %s", err), metrics, r.Method)
+			return
+		}
+	}
+
 	var encapHandler EncapsulationHandler
 	var ok bool
 	if encapHandler, ok = s.encapsulationHandlers[r.URL.Path]; !ok {
@@ -75,20 +187,47 @@ func (s *gatewayResource) gatewayHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	// net/http answers Expect: 100-continue when the body is first read, so every check that can reject the
+	// request must come before that, to spare relays from sending bodies that are rejected anyway
 	defer r.Body.Close()
-	encryptedMessageBytes, err := ioutil.ReadAll(r.Body)
+	maxRequestSize := s.maxRequestSize
+	if contentType == ohttpChunkedRequestContentType {
+		maxRequestSize = s.maxChunkedRequestSize
+	}
+	if maxRequestSize > 0 && r.ContentLength > maxRequestSize {
+		metrics.Fire(metricsResultRequestTooLarge)
+		s.httpError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("Request body exceeds %d bytes", maxRequestSize), metrics, r.Method)
+		return
+	}
+	body := r.Body
+	if maxRequestSize > 0 {
+		body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	}
+	if contentType == ohttpChunkedRequestContentType {
+		s.chunkedGatewayHandler(w, r, body, encapHandler, metrics)
+		return
+	}
+	encryptedMessageBytes, err := ioutil.ReadAll(body)
+	if err != nil && maxRequestSize > 0 && int64(len(encryptedMessageBytes)) >= maxRequestSize {
+		// MaxBytesReader only fails after returning every byte up to the limit
+		metrics.Fire(metricsResultRequestTooLarge)
+		s.httpError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("Request body exceeds %d bytes", maxRequestSize), metrics, r.Method)
+		return
+	}
 	if err != nil {
 		metrics.Fire(metricsResultInvalidContent)
 		s.httpError(w, http.StatusBadRequest, fmt.Sprintf("Reading request body failed"), metrics, r.Method)
 		return
 	}
 
+	metrics.Size(metricsSizeEncapsulatedRequest, len(encryptedMessageBytes))
 	encapsulatedReq, err := ohttp.UnmarshalEncapsulatedRequest(encryptedMessageBytes)
 	if err != nil {
 		metrics.Fire(metricsResultInvalidContent)
 		s.httpError(w, http.StatusBadRequest, fmt.Sprintf("Reading request body failed"), metrics, r.Method)
 		return
 	}
+	metrics.Tag(metricsTagKeyID, strconv.Itoa(int(encapsulatedReq.KeyID)))
 
 	encapsulatedResp, err := encapHandler.Handle(r, encapsulatedReq, metrics)
 	if err != nil {
@@ -102,6 +241,7 @@ func (s *gatewayResource) gatewayHandler(w http.ResponseWriter, r *http.Request)
 	}
 
 	packedResponse := encapsulatedResp.Marshal()
+	metrics.Size(metricsSizeEncapsulatedResponse, len(packedResponse))
 
 	w.Header().Set("Content-Type", ohttpResponseContentType)
 	w.Header().Set("Connection", "Keep-Alive")
@@ -109,26 +249,240 @@ func (s *gatewayResource) gatewayHandler(w http.ResponseWriter, r *http.Request)
 	metrics.ResponseStatus(r.Method, http.StatusOK)
 }
 
+// chunkedGatewayHandler handles a chunked OHTTP request, whose response is streamed by the encapsulation
+// handler. Errors are only returned as a status code until the response has started.
+func (s *gatewayResource) chunkedGatewayHandler(w http.ResponseWriter, r *http.Request, body io.Reader, encapHandler EncapsulationHandler, metrics Metrics) {
+	chunkedHandler, ok := encapHandler.(ChunkedEncapsulationHandler)
+	if !ok {
+		metrics.Fire(metricsResultUnsupportedMediaType)
+		w.Header().Set("Accept-Post", ohttpRequestContentType)
+		s.httpError(w, http.StatusUnsupportedMediaType, fmt.Sprintf("Chunked OHTTP is not supported by %s", r.URL.Path), metrics, r.Method)
+		return
+	}
+	if err := chunkedHandler.HandleChunked(r, body, w, s.maxRequestSize, metrics); err != nil {
+		if s.verbose {
+			log.Printf(err.Error())
+		}
+		errorCode := encapsulationErrorToGatewayStatusCode(err)
+		s.httpError(w, errorCode, http.StatusText(errorCode), metrics, r.Method)
+		return
+	}
+	metrics.ResponseStatus(r.Method, http.StatusOK)
+}
+
+// marshalConfigs encodes key configurations as the application/ohttp-keys media type from RFC 9458,
+// which prefixes each encoded KeyConfig with its two-byte length.
+func marshalConfigs(configs []ohttp.PublicConfig) []byte {
+	b := cryptobyte.NewBuilder(nil)
+	for _, config := range configs {
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddBytes(config.Marshal())
+		})
+	}
+	return b.BytesOrPanic()
+}
+
+// unmarshalConfigs decodes key configurations encoded as the application/ohttp-keys media type.
+func unmarshalConfigs(data []byte) ([]ohttp.PublicConfig, error) {
+	configs := []ohttp.PublicConfig{}
+	s := cryptobyte.String(data)
+	for !s.Empty() {
+		var encodedConfig cryptobyte.String
+		if !s.ReadUint16LengthPrefixed(&encodedConfig) {
+			return nil, fmt.Errorf("Invalid key config encoding")
+		}
+		config, err := ohttp.UnmarshalPublicConfig(encodedConfig)
+		if err != nil {
+			return nil, err
+		}
+		configs = append(configs, config)
+	}
+	return configs, nil
+}
+
+// configKeyring returns the keyring whose configs r asks for. Clients of endpoints with dedicated keys
+// select them with the endpoint query parameter.
+func (s *gatewayResource) configKeyring(r *http.Request) (Keyring, error) {
+	endpoint := r.URL.Query().Get("endpoint")
+	if endpoint == "" {
+		return s.keyring, nil
+	}
+	if _, ok := s.encapsulationHandlers[endpoint]; !ok {
+		return nil, fmt.Errorf("Unknown endpoint: %s", endpoint)
+	}
+	if endpointKeyring, ok := s.endpointKeyrings[endpoint]; ok {
+		return endpointKeyring, nil
+	}
+	return s.keyring, nil
+}
+
+// configsHash is a short hash of the served config set, which replicas and clients compare to detect
+// being served different keys.
+func configsHash(configs []byte) string {
+	digest := sha256.Sum256(configs)
+	return hex.EncodeToString(digest[:configsHashLength])
+}
+
+type configsHashResponse struct {
+	Hash   string  `json:"hash"`
+	KeyIDs []uint8 `json:"key_ids"`
+}
+
+// configHashHandler returns the hash of the served config set, so that relays and external monitors can
+// check that every gateway replica serves the same keys to every client, which defends against a
+// gateway targeting individual clients with unique keys.
+func (s *gatewayResource) configHashHandler(w http.ResponseWriter, r *http.Request) {
+	if s.verbose {
+		log.Printf("%s Handling %s\n", r.Method, r.URL.Path)
+	}
+	metrics := s.metricsFactory.Create(metricsEventConfigsHashRequest)
+
+	keyring, err := s.configKeyring(r)
+	if err != nil {
+		s.httpError(w, http.StatusBadRequest, err.Error(), metrics, r.Method)
+		return
+	}
+
+	configs := keyring.Configs()
+	response := configsHashResponse{Hash: configsHash(marshalConfigs(configs)), KeyIDs: []uint8{}}
+	for _, config := range configs {
+		response.KeyIDs = append(response.KeyIDs, config.ID)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	json.NewEncoder(w).Encode(response)
+	metrics.ResponseStatus(r.Method, http.StatusOK)
+}
+
+// wellKnownHandler serves the well-known gateway location from RFC 9540, which accepts encapsulated
+// requests like the gateway endpoint and returns the gateway key configs on GET.
+func (s *gatewayResource) wellKnownHandler(w http.ResponseWriter, r *http.Request) {
+	preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") == http.MethodPost
+	if r.Method == http.MethodPost || preflight {
+		s.gatewayHandler(w, r)
+		return
+	}
+	s.configHandler(w, r)
+}
+
+// configsETag returns a strong entity tag for the digest of encoded configs, which changes whenever the
+// served keys do.
+func configsETag(digest [sha256.Size]byte) string {
+	return `"` + hex.EncodeToString(digest[:16]) + `"`
+}
+
+// configsExpiry lists when each served config is no longer advertised, as comma-separated
+// <key ID>=<RFC 3339 time> pairs in the order of configs. Configs without a known expiry are omitted.
+func configsExpiry(keyring Keyring, configs []ohttp.PublicConfig) string {
+	expiry := []string{}
+	for _, config := range configs {
+		if t, ok := keyring.Expiry(config.ID); ok {
+			expiry = append(expiry, fmt.Sprintf("%d=%s", config.ID, t.UTC().Format(time.RFC3339)))
+		}
+	}
+	return strings.Join(expiry, ", ")
+}
+
+// etagMatches reports whether an If-None-Match header value matches etag, using the weak comparison
+// that RFC 9110 requires for If-None-Match.
+func etagMatches(ifNoneMatch string, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptsMediaType reports whether an Accept header value admits mediaType. An absent header accepts
+// anything, and media ranges with a zero quality value are refusals.
+func acceptsMediaType(accept string, mediaType string) bool {
+	if strings.TrimSpace(accept) == "" {
+		return true
+	}
+	typeName := strings.SplitN(mediaType, "/", 2)[0]
+	// Specificity is ignored: any matching range that is not refused is enough
+	for _, mediaRange := range strings.Split(accept, ",") {
+		params := strings.Split(mediaRange, ";")
+		name := strings.ToLower(strings.TrimSpace(params[0]))
+		if name != "*/*" && name != typeName+"/*" && name != mediaType {
+			continue
+		}
+		refused := false
+		for _, param := range params[1:] {
+			param = strings.ReplaceAll(strings.TrimSpace(param), " ", "")
+			if strings.HasPrefix(param, "q=") {
+				if q, err := strconv.ParseFloat(strings.TrimPrefix(param, "q="), 64); err == nil && q == 0 {
+					refused = true
+				}
+			}
+		}
+		if !refused {
+			return true
+		}
+	}
+	return false
+}
+
 func (s *gatewayResource) configHandler(w http.ResponseWriter, r *http.Request) {
 	if s.verbose {
 		log.Printf("%s Handling %s\n", r.Method, r.URL.Path)
 	}
 	metrics := s.metricsFactory.Create(metricsEventConfigsRequest)
 
-	config, err := s.gateway.Config(s.keyID)
+	if s.configCORS.apply(w, r) {
+		metrics.ResponseStatus(r.Method, http.StatusNoContent)
+		return
+	}
+
+	if accept := r.Header.Get("Accept"); !acceptsMediaType(accept, ohttpKeysContentType) {
+		metrics.Fire(metricsResultNotAcceptable)
+		s.httpError(w, http.StatusNotAcceptable, fmt.Sprintf("Not acceptable: %s", accept), metrics, r.Method)
+		return
+	}
+
+	keyring, err := s.configKeyring(r)
 	if err != nil {
-		log.Printf("Config unavailable")
-		metrics.Fire(metricsResultConfigsUnavalable)
-		s.httpError(w, http.StatusInternalServerError, "Config unavailable", metrics, r.Method)
+		s.httpError(w, http.StatusBadRequest, err.Error(), metrics, r.Method)
 		return
 	}
 
-	// Make expiration time even/random throughout interval 12-36h
-	rand.Seed(time.Now().UnixNano())
-	maxAge := twelveHours + rand.Intn(twentyFourHours)
-	w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d, private", maxAge))
+	publicConfigs := keyring.Configs()
+	configs := marshalConfigs(publicConfigs)
+	digest := sha256.Sum256(configs)
+	etag := configsETag(digest)
+	if expiry := configsExpiry(keyring, publicConfigs); expiry != "" {
+		w.Header().Set(configExpiryHeader, expiry)
+	}
 
-	w.Write(config.Marshal())
+	// Spread expiration times evenly throughout the configured interval, 12-36h by default
+	w.Header().Set("Cache-Control", s.configCache.header(digest))
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Content-Type", ohttpKeysContentType)
+	if s.attestation != nil {
+		if err := s.attestation.setConfigAttestation(w, r, keyring); err != nil {
+			metrics.Fire(metricsResultAttestationFailed)
+			s.httpError(w, http.StatusInternalServerError, fmt.Sprintf("Attestation failed: %s", err), metrics, r.Method)
+			return
+		}
+	}
+	if s.configSigningKey != nil {
+		w.Header().Set(configSignatureHeader, base64.StdEncoding.EncodeToString(ed25519.Sign(s.configSigningKey, configs)))
+	}
+
+	// Relays and clients polling for key updates revalidate their copy instead of downloading it again
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		metrics.ResponseStatus(r.Method, http.StatusNotModified)
+		return
+	}
+
+	// HEAD lets monitoring systems and CDNs validate freshness without fetching the configs
+	w.Header().Set("Content-Length", strconv.Itoa(len(configs)))
+	if r.Method != http.MethodHead {
+		w.Write(configs)
+	}
 
 	metrics.ResponseStatus(r.Method, http.StatusOK)
 }
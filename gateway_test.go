@@ -4,18 +4,26 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/chris-wood/ohttp-go"
 	"github.com/cisco/go-hpke"
+	"golang.org/x/crypto/cryptobyte"
 	"google.golang.org/protobuf/proto"
 )
 
@@ -26,18 +34,23 @@ var (
 	GATEWAY_DEBUG    = true
 )
 
-func createGateway(t *testing.T) ohttp.Gateway {
-	config, err := ohttp.NewConfig(FIXED_KEY_ID, hpke.DHKEM_X25519, hpke.KDF_HKDF_SHA256, hpke.AEAD_AESGCM128)
+func createKeyring(t *testing.T) *RotatingKeyring {
+	seed := make([]byte, defaultSeedLength)
+	rand.Read(seed)
+	keyring, err := NewKeyring(FIXED_KEY_ID, defaultKeySuite, seed, ohttp.NewDefaultGateway, time.Hour)
 	if err != nil {
 		t.Fatal("Failed to create a valid config. Exiting now.")
 	}
 
-	return ohttp.NewDefaultGateway(config)
+	return keyring
 }
 
 type MockMetrics struct {
 	eventName    string
 	resultLabels map[string]bool
+	tags         map[string]string
+	durations    map[string]time.Duration
+	sizes        map[string]int
 }
 
 func (s *MockMetrics) ResponseStatus(prefix string, status int) {
@@ -53,6 +66,24 @@ func (s *MockMetrics) Fire(result string) {
 	s.resultLabels[result] = true
 }
 
+func (s *MockMetrics) Tag(name string, value string) {
+	s.tags[name] = value
+}
+
+func (s *MockMetrics) Duration(stage string, duration time.Duration) {
+	if s.durations == nil {
+		s.durations = map[string]time.Duration{}
+	}
+	s.durations[stage] += duration
+}
+
+func (s *MockMetrics) Size(message string, size int) {
+	if s.sizes == nil {
+		s.sizes = map[string]int{}
+	}
+	s.sizes[message] += size
+}
+
 type MockMetricsFactory struct {
 	metrics []*MockMetrics
 }
@@ -61,6 +92,7 @@ func (f *MockMetricsFactory) Create(eventName string) Metrics {
 	metrics := &MockMetrics{
 		eventName:    eventName,
 		resultLabels: map[string]bool{},
+		tags:         map[string]string{},
 	}
 	f.metrics = append(f.metrics, metrics)
 	return metrics
@@ -91,15 +123,13 @@ func (h ForbiddenCheckHttpRequestHandler) Handle(req *http.Request, metrics Metr
 }
 
 func createMockEchoGatewayServer(t *testing.T) gatewayResource {
-	gateway := createGateway(t)
+	keyring := createKeyring(t)
 	echoEncapHandler := DefaultEncapsulationHandler{
-		keyID:      FIXED_KEY_ID,
-		gateway:    gateway,
+		keyring:    keyring,
 		appHandler: EchoAppHandler{},
 	}
 	mockProtoHTTPFilterHandler := DefaultEncapsulationHandler{
-		keyID:   FIXED_KEY_ID,
-		gateway: gateway,
+		keyring: keyring,
 		appHandler: ProtoHTTPAppHandler{
 			httpHandler: ForbiddenCheckHttpRequestHandler{
 				FORBIDDEN_TARGET,
@@ -111,7 +141,7 @@ func createMockEchoGatewayServer(t *testing.T) gatewayResource {
 	encapHandlers[echoEndpoint] = echoEncapHandler
 	encapHandlers[gatewayEndpoint] = mockProtoHTTPFilterHandler
 	return gatewayResource{
-		gateway:               gateway,
+		keyring:               keyring,
 		encapsulationHandlers: encapHandlers,
 		debugResponse:         GATEWAY_DEBUG,
 		metricsFactory:        &MockMetricsFactory{},
@@ -120,11 +150,7 @@ func createMockEchoGatewayServer(t *testing.T) gatewayResource {
 
 func TestConfigHandler(t *testing.T) {
 	target := createMockEchoGatewayServer(t)
-	config, err := target.gateway.Config(FIXED_KEY_ID)
-	if err != nil {
-		t.Fatal(err)
-	}
-	marshalledConfig := config.Marshal()
+	marshalledConfig := marshalConfigs([]ohttp.PublicConfig{target.keyring.Current()})
 
 	handler := http.HandlerFunc(target.configHandler)
 
@@ -167,6 +193,251 @@ func TestConfigHandler(t *testing.T) {
 	}
 }
 
+func TestConfigHandlerCachePolicy(t *testing.T) {
+	target := createMockEchoGatewayServer(t)
+	target.configCache = cachePolicy{minMaxAge: time.Hour, maxMaxAge: time.Hour, public: true}
+	handler := http.HandlerFunc(target.configHandler)
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, configEndpoint, nil))
+	if cctrl := rr.Header().Get("Cache-Control"); cctrl != "max-age=3600, public" {
+		t.Fatalf("Unexpected Cache-Control %q", cctrl)
+	}
+}
+
+func TestConfigHandlerHead(t *testing.T) {
+	target := createMockEchoGatewayServer(t)
+	handler := http.HandlerFunc(target.configHandler)
+
+	get := httptest.NewRecorder()
+	handler.ServeHTTP(get, httptest.NewRequest(http.MethodGet, configEndpoint, nil))
+	head := httptest.NewRecorder()
+	handler.ServeHTTP(head, httptest.NewRequest(http.MethodHead, configEndpoint, nil))
+
+	if head.Code != http.StatusOK || head.Body.Len() != 0 {
+		t.Fatalf("Unexpected HEAD response %d with %d body bytes", head.Code, head.Body.Len())
+	}
+	if head.Header().Get("Content-Length") != strconv.Itoa(get.Body.Len()) {
+		t.Fatalf("Unexpected Content-Length %q", head.Header().Get("Content-Length"))
+	}
+	if head.Header().Get("ETag") != get.Header().Get("ETag") || head.Header().Get("Cache-Control") == "" {
+		t.Fatal("HEAD headers differ from GET")
+	}
+}
+
+func TestConfigHandlerSignature(t *testing.T) {
+	target := createMockEchoGatewayServer(t)
+	t.Setenv(configSigningKeyEnvironmentVariable, strings.Repeat("01", ed25519.SeedSize))
+	signingKey, err := configSigningKeyFromEnvironment()
+	if err != nil {
+		t.Fatal(err)
+	}
+	target.configSigningKey = signingKey
+	handler := http.HandlerFunc(target.configHandler)
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, configEndpoint, nil))
+	signature, err := base64.StdEncoding.DecodeString(rr.Header().Get(configSignatureHeader))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ed25519.Verify(signingKey.Public().(ed25519.PublicKey), rr.Body.Bytes(), signature) {
+		t.Fatal("Invalid config signature")
+	}
+}
+
+func TestConfigHandlerExpiry(t *testing.T) {
+	target := createMockEchoGatewayServer(t)
+	keyring := target.keyring.(*RotatingKeyring)
+	handler := http.HandlerFunc(target.configHandler)
+
+	// Without a rotation schedule the current key has no known expiry
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, configEndpoint, nil))
+	if expiry := rr.Header().Get(configExpiryHeader); expiry != "" {
+		t.Fatalf("Unexpected expiry %q", expiry)
+	}
+
+	previous := keyring.Current()
+	current, err := keyring.Rotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	nextRotation := time.Now().Add(24 * time.Hour)
+	keyring.setNextRotation(nextRotation)
+	previousExpiry, _ := keyring.Expiry(previous.ID)
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, configEndpoint, nil))
+	expected := fmt.Sprintf("%d=%s, %d=%s",
+		current.ID, nextRotation.Add(keyring.overlap).UTC().Format(time.RFC3339),
+		previous.ID, previousExpiry.UTC().Format(time.RFC3339))
+	if expiry := rr.Header().Get(configExpiryHeader); expiry != expected {
+		t.Fatalf("Unexpected expiry %q, expected %q", expiry, expected)
+	}
+}
+
+func TestConfigHandlerMaxAgeIsStablePerKeySet(t *testing.T) {
+	target := createMockEchoGatewayServer(t)
+	handler := http.HandlerFunc(target.configHandler)
+	cacheControl := func() string {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, configEndpoint, nil))
+		return rr.Header().Get("Cache-Control")
+	}
+
+	first := cacheControl()
+	for i := 0; i < 10; i++ {
+		if cctrl := cacheControl(); cctrl != first {
+			t.Fatalf("Cache-Control changed from %q to %q without a key change", first, cctrl)
+		}
+	}
+}
+
+func TestConfigHashHandler(t *testing.T) {
+	target := createMockEchoGatewayServer(t)
+	handler := http.HandlerFunc(target.configHashHandler)
+	configsHashOf := func() configsHashResponse {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, configHashEndpoint, nil))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Unexpected status %d", rr.Code)
+		}
+		var response configsHashResponse
+		if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+			t.Fatal(err)
+		}
+		return response
+	}
+
+	first := configsHashOf()
+	if first.Hash != configsHash(marshalConfigs(target.keyring.Configs())) || len(first.Hash) != 2*configsHashLength {
+		t.Fatalf("Unexpected hash %q", first.Hash)
+	}
+	if _, err := target.keyring.(*RotatingKeyring).Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	second := configsHashOf()
+	if second.Hash == first.Hash || len(second.KeyIDs) != 2 {
+		t.Fatalf("Unexpected response after rotation %+v", second)
+	}
+}
+
+func TestConfigHandlerServesRotatedConfigs(t *testing.T) {
+	target := createMockEchoGatewayServer(t)
+	previous := target.keyring.Current()
+	current, err := target.keyring.(*RotatingKeyring).Rotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := http.HandlerFunc(target.configHandler)
+
+	request, err := http.NewRequest("GET", configEndpoint, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, request)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatal(fmt.Errorf("Failed request with error code: %d", status))
+	}
+
+	// Each config is prefixed with its two-byte length, newest first
+	body := cryptobyte.String(rr.Body.Bytes())
+	for _, expected := range []ohttp.PublicConfig{current, previous} {
+		var encodedConfig cryptobyte.String
+		if !body.ReadUint16LengthPrefixed(&encodedConfig) {
+			t.Fatal("Failed to read length-prefixed config")
+		}
+		config, err := ohttp.UnmarshalPublicConfig(encodedConfig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !config.IsEqual(expected) {
+			t.Fatalf("Received config %d, expected %d", config.ID, expected.ID)
+		}
+	}
+	if !body.Empty() {
+		t.Fatal("Unexpected trailing data after configs")
+	}
+}
+
+func TestConfigHandlerConditionalGet(t *testing.T) {
+	target := createMockEchoGatewayServer(t)
+	handler := http.HandlerFunc(target.configHandler)
+
+	request := httptest.NewRequest(http.MethodGet, configEndpoint, nil)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, request)
+	etag := rr.Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("Missing ETag")
+	}
+
+	request = httptest.NewRequest(http.MethodGet, configEndpoint, nil)
+	request.Header.Set("If-None-Match", `"other", W/`+etag)
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, request)
+	if status := rr.Code; status != http.StatusNotModified {
+		t.Fatalf("Expected 304, got %d", status)
+	}
+	if rr.Body.Len() != 0 || rr.Header().Get("ETag") != etag {
+		t.Fatal("Unexpected 304 response")
+	}
+
+	// Rotating the key changes the ETag, so the stale copy is replaced
+	if _, err := target.keyring.(*RotatingKeyring).Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	request = httptest.NewRequest(http.MethodGet, configEndpoint, nil)
+	request.Header.Set("If-None-Match", etag)
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, request)
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("Expected 200 after rotation, got %d", status)
+	}
+	if rr.Header().Get("ETag") == etag {
+		t.Fatal("ETag did not change after rotation")
+	}
+}
+
+func TestConfigHandlerMediaType(t *testing.T) {
+	target := createMockEchoGatewayServer(t)
+	handler := http.HandlerFunc(target.configHandler)
+
+	for accept, expected := range map[string]int{
+		"":                                    http.StatusOK,
+		"application/ohttp-keys":              http.StatusOK,
+		"text/html, application/*;q=0.5":      http.StatusOK,
+		"*/*":                                 http.StatusOK,
+		"text/html":                           http.StatusNotAcceptable,
+		"application/ohttp-keys;q=0, */*;q=0": http.StatusNotAcceptable,
+	} {
+		request := httptest.NewRequest(http.MethodGet, configEndpoint, nil)
+		if accept != "" {
+			request.Header.Set("Accept", accept)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, request)
+
+		if status := rr.Code; status != expected {
+			t.Fatalf("Accept %q: expected %d, got %d", accept, expected, status)
+		}
+		if expected == http.StatusOK && rr.Header().Get("Content-Type") != ohttpKeysContentType {
+			t.Fatalf("Unexpected Content-Type %q", rr.Header().Get("Content-Type"))
+		}
+	}
+
+	target = createMockEchoGatewayServer(t)
+	request := httptest.NewRequest(http.MethodGet, configEndpoint, nil)
+	request.Header.Set("Accept", "text/html")
+	http.HandlerFunc(target.configHandler).ServeHTTP(httptest.NewRecorder(), request)
+	testMetricsContainsResult(t, target.metricsFactory.(*MockMetricsFactory), metricsEventConfigsRequest, metricsResultNotAcceptable)
+}
+
 func testBodyContainsError(t *testing.T, resp *http.Response, expectedText string) {
 	body, err := io.ReadAll(resp.Body)
 	if err == nil {
@@ -192,6 +463,18 @@ func testMetricsContainsResult(t *testing.T, metricsCollector *MockMetricsFactor
 	t.Fatalf("Expected metric for event %s was not initialized", event)
 }
 
+func testMetricsContainsTag(t *testing.T, metricsCollector *MockMetricsFactory, event string, name string, value string) {
+	for _, metric := range metricsCollector.metrics {
+		if metric.eventName == event {
+			if metric.tags[name] != value {
+				t.Fatalf("Expected tag %s:%s on event %s, got %q", name, value, event, metric.tags[name])
+			}
+			return
+		}
+	}
+	t.Fatalf("Expected metric for event %s was not initialized", event)
+}
+
 func TestQueryHandlerInvalidContentType(t *testing.T) {
 	target := createMockEchoGatewayServer(t)
 
@@ -206,23 +489,138 @@ func TestQueryHandlerInvalidContentType(t *testing.T) {
 	rr := httptest.NewRecorder()
 	handler.ServeHTTP(rr, request)
 
-	if status := rr.Result().StatusCode; status != http.StatusBadRequest {
-		t.Fatal(fmt.Errorf("Result did not yield %d, got %d instead", http.StatusBadRequest, status))
+	if status := rr.Result().StatusCode; status != http.StatusUnsupportedMediaType {
+		t.Fatal(fmt.Errorf("Result did not yield %d, got %d instead", http.StatusUnsupportedMediaType, status))
+	}
+	if accept := rr.Header().Get("Accept-Post"); accept != "message/ohttp-req, message/ohttp-chunked-req" {
+		t.Fatalf("Unexpected Accept-Post header %q", accept)
 	}
 
 	testBodyContainsError(t, rr.Result(), "Invalid content type: application/not-the-droids-youre-looking-for")
-	testMetricsContainsResult(t, mustGetMetricsFactory(t, target), metricsEventGatewayRequest, metricsResultInvalidContentType)
+	testMetricsContainsResult(t, mustGetMetricsFactory(t, target), metricsEventGatewayRequest, metricsResultUnsupportedMediaType)
 }
 
-func TestGatewayHandler(t *testing.T) {
+func TestGatewayHandlerMediaTypeParameters(t *testing.T) {
 	target := createMockEchoGatewayServer(t)
+	post := func(contentType string) int {
+		req, _, err := ohttp.NewDefaultClient(target.keyring.Current()).EncapsulateRequest([]byte("hello"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		request := httptest.NewRequest(http.MethodPost, echoEndpoint, bytes.NewReader(req.Marshal()))
+		request.Header.Set("Content-Type", contentType)
+		rr := httptest.NewRecorder()
+		target.gatewayHandler(rr, request)
+		return rr.Code
+	}
 
-	handler := http.HandlerFunc(target.gatewayHandler)
+	for _, contentType := range []string{"message/ohttp-req", "Message/OHTTP-Req", "message/ohttp-req; charset=utf-8"} {
+		if status := post(contentType); status != http.StatusOK {
+			t.Fatalf("Expected %q to be accepted, got %d", contentType, status)
+		}
+	}
+	if status := post("message/ohttp-req; charset"); status != http.StatusUnsupportedMediaType {
+		t.Fatalf("Expected a malformed media type to be rejected, got %d", status)
+	}
+
+	target.strictMediaType = true
+	if status := post("Message/OHTTP-Req"); status != http.StatusOK {
+		t.Fatalf("Expected a case variation to be accepted in strict mode, got %d", status)
+	}
+	if status := post("message/ohttp-req; charset=utf-8"); status != http.StatusUnsupportedMediaType {
+		t.Fatalf("Expected parameters to be rejected in strict mode, got %d", status)
+	}
+}
+
+func TestGatewayHandlerExpectContinue(t *testing.T) {
+	target := createMockEchoGatewayServer(t)
+	target.maxRequestSize = 1024
+	server := httptest.NewServer(http.HandlerFunc(target.gatewayHandler))
+	defer server.Close()
+	req, context, err := ohttp.NewDefaultClient(target.keyring.Current()).EncapsulateRequest([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := req.Marshal()
 
-	config, err := target.gateway.Config(FIXED_KEY_ID)
+	// expect sends the request headers with Expect: 100-continue, and returns the first response
+	expect := func(contentType string, contentLength int) (*bufio.Reader, net.Conn, *http.Response) {
+		conn, err := net.Dial("tcp", server.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		fmt.Fprintf(conn, "POST %s HTTP/1.1\r\nHost: gateway\r\nContent-Type: %s\r\nContent-Length: %d\r\nExpect: 100-continue\r\n\r\n", echoEndpoint, contentType, contentLength)
+		r := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(r, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r, conn, resp
+	}
+
+	// Rejected requests are answered without asking for their body
+	for contentType, contentLength := range map[string]int{"application/octet-stream": len(body), ohttpRequestContentType: 2048} {
+		_, conn, resp := expect(contentType, contentLength)
+		conn.Close()
+		if resp.StatusCode == http.StatusContinue || resp.StatusCode == http.StatusOK {
+			t.Fatalf("Expected the request with %s and %d bytes to be rejected before its body, got %d", contentType, contentLength, resp.StatusCode)
+		}
+	}
+
+	r, conn, resp := expect(ohttpRequestContentType, len(body))
+	defer conn.Close()
+	if resp.StatusCode != http.StatusContinue {
+		t.Fatalf("Expected a 100 Continue response, got %d", resp.StatusCode)
+	}
+	conn.Write(body)
+	if resp, err = http.ReadResponse(r, nil); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("Unexpected response %v (%v)", resp, err)
+	}
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	encapsulated, err := ohttp.UnmarshalEncapsulatedResponse(respBody)
 	if err != nil {
 		t.Fatal(err)
 	}
+	if response, err := context.DecapsulateResponse(encapsulated); err != nil || string(response) != "hello" {
+		t.Fatalf("Unexpected response %q (%v)", response, err)
+	}
+}
+
+func TestConfigHandlerServesEndpointKeys(t *testing.T) {
+	target := createMockEchoGatewayServer(t)
+	echoKeyring := createKeyring(t)
+	target.endpointKeyrings = map[string]Keyring{echoEndpoint: echoKeyring}
+
+	handler := http.HandlerFunc(target.configHandler)
+
+	for endpoint, keyring := range map[string]Keyring{"": target.keyring, gatewayEndpoint: target.keyring, echoEndpoint: echoKeyring} {
+		request := httptest.NewRequest(http.MethodGet, configEndpoint+"?endpoint="+endpoint, nil)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, request)
+
+		if status := rr.Code; status != http.StatusOK {
+			t.Fatal(fmt.Errorf("Failed request with error code: %d", status))
+		}
+		if !bytes.Equal(rr.Body.Bytes(), marshalConfigs(keyring.Configs())) {
+			t.Fatalf("Received invalid config for endpoint %q", endpoint)
+		}
+	}
+
+	request := httptest.NewRequest(http.MethodGet, configEndpoint+"?endpoint=/unknown", nil)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, request)
+	if status := rr.Code; status != http.StatusBadRequest {
+		t.Fatal(fmt.Errorf("Result did not yield %d, got %d instead", http.StatusBadRequest, status))
+	}
+}
+
+func TestGatewayHandler(t *testing.T) {
+	target := createMockEchoGatewayServer(t)
+
+	handler := http.HandlerFunc(target.gatewayHandler)
+
+	config := target.keyring.Current()
 	client := ohttp.NewDefaultClient(config)
 
 	testMessage := []byte{0xCA, 0xFE}
@@ -247,15 +645,37 @@ func TestGatewayHandler(t *testing.T) {
 	testMetricsContainsResult(t, mustGetMetricsFactory(t, target), metricsEventGatewayRequest, metricsResultSuccess)
 }
 
-func TestGatewayHandlerWithInvalidMethod(t *testing.T) {
+func TestWellKnownHandler(t *testing.T) {
 	target := createMockEchoGatewayServer(t)
+	target.encapsulationHandlers[wellKnownConfigEndpoint] = target.encapsulationHandlers[echoEndpoint]
+	handler := http.HandlerFunc(target.wellKnownHandler)
 
-	handler := http.HandlerFunc(target.gatewayHandler)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, wellKnownConfigEndpoint, nil))
+	if rr.Code != http.StatusOK || !bytes.Equal(rr.Body.Bytes(), marshalConfigs(target.keyring.Configs())) {
+		t.Fatalf("Unexpected GET response %d", rr.Code)
+	}
 
-	config, err := target.gateway.Config(FIXED_KEY_ID)
+	client := ohttp.NewDefaultClient(target.keyring.Current())
+	req, _, err := client.EncapsulateRequest([]byte{0xCA, 0xFE})
 	if err != nil {
 		t.Fatal(err)
 	}
+	request := httptest.NewRequest(http.MethodPost, wellKnownConfigEndpoint, bytes.NewReader(req.Marshal()))
+	request.Header.Set("Content-Type", ohttpRequestContentType)
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, request)
+	if rr.Code != http.StatusOK || rr.Header().Get("Content-Type") != ohttpResponseContentType {
+		t.Fatalf("Unexpected POST response %d", rr.Code)
+	}
+}
+
+func TestGatewayHandlerWithInvalidMethod(t *testing.T) {
+	target := createMockEchoGatewayServer(t)
+
+	handler := http.HandlerFunc(target.gatewayHandler)
+
+	config := target.keyring.Current()
 	client := ohttp.NewDefaultClient(config)
 
 	testMessage := []byte{0xCA, 0xFE}
@@ -270,11 +690,20 @@ func TestGatewayHandlerWithInvalidMethod(t *testing.T) {
 	rr := httptest.NewRecorder()
 	handler.ServeHTTP(rr, request)
 
-	if status := rr.Result().StatusCode; status != http.StatusBadRequest {
-		t.Fatal(fmt.Errorf("Result did not yield %d, got %d instead", http.StatusBadRequest, status))
+	if status := rr.Result().StatusCode; status != http.StatusMethodNotAllowed {
+		t.Fatal(fmt.Errorf("Result did not yield %d, got %d instead", http.StatusMethodNotAllowed, status))
+	}
+	if allow := rr.Header().Get("Allow"); allow != http.MethodPost {
+		t.Fatalf("Unexpected Allow header %q", allow)
 	}
 
 	testMetricsContainsResult(t, mustGetMetricsFactory(t, target), metricsEventGatewayRequest, metricsResultInvalidMethod)
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodOptions, echoEndpoint, nil))
+	if rr.Code != http.StatusNoContent || rr.Header().Get("Allow") != http.MethodPost {
+		t.Fatalf("Unexpected OPTIONS response %d with Allow header %q", rr.Code, rr.Header().Get("Allow"))
+	}
 }
 
 func TestGatewayHandlerWithInvalidKey(t *testing.T) {
@@ -337,17 +766,44 @@ func TestGatewayHandlerWithUnknownKey(t *testing.T) {
 	}
 
 	testMetricsContainsResult(t, mustGetMetricsFactory(t, target), metricsEventGatewayRequest, metricsResultConfigurationMismatch)
+	testMetricsContainsTag(t, mustGetMetricsFactory(t, target), metricsEventGatewayRequest, metricsTagKeyID, strconv.Itoa(int(FIXED_KEY_ID^0xFF)))
 }
 
-func TestGatewayHandlerWithCorruptContent(t *testing.T) {
+func TestGatewayHandlerWithRevokedKey(t *testing.T) {
 	target := createMockEchoGatewayServer(t)
 
 	handler := http.HandlerFunc(target.gatewayHandler)
 
-	config, err := target.gateway.Config(FIXED_KEY_ID)
+	client := ohttp.NewDefaultClient(target.keyring.Current())
+	if err := target.keyring.(*RotatingKeyring).Revoke(FIXED_KEY_ID); err != nil {
+		t.Fatal(err)
+	}
+
+	testMessage := []byte{0xCA, 0xFE}
+	req, _, err := client.EncapsulateRequest(testMessage)
+
+	request, err := http.NewRequest(http.MethodPost, echoEndpoint, bytes.NewReader(req.Marshal()))
 	if err != nil {
 		t.Fatal(err)
 	}
+	request.Header.Add("Content-Type", "message/ohttp-req")
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, request)
+
+	if status := rr.Result().StatusCode; status != http.StatusForbidden {
+		t.Fatal(fmt.Errorf("Result did not yield %d, got %d instead", http.StatusForbidden, status))
+	}
+
+	testMetricsContainsResult(t, mustGetMetricsFactory(t, target), metricsEventGatewayRequest, metricsResultKeyRevoked)
+}
+
+func TestGatewayHandlerWithCorruptContent(t *testing.T) {
+	target := createMockEchoGatewayServer(t)
+
+	handler := http.HandlerFunc(target.gatewayHandler)
+
+	config := target.keyring.Current()
 	client := ohttp.NewDefaultClient(config)
 
 	// Corrupt the message
@@ -372,15 +828,68 @@ func TestGatewayHandlerWithCorruptContent(t *testing.T) {
 	testMetricsContainsResult(t, mustGetMetricsFactory(t, target), metricsEventGatewayRequest, metricsResultDecapsulationFailed)
 }
 
+func TestGatewayHandlerWithOversizedRequest(t *testing.T) {
+	for _, contentLength := range []int64{64, -1} {
+		target := createMockEchoGatewayServer(t)
+		target.maxRequestSize = 32
+
+		request, err := http.NewRequest(http.MethodPost, echoEndpoint, bytes.NewReader(make([]byte, 64)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		request.ContentLength = contentLength
+		request.Header.Add("Content-Type", "message/ohttp-req")
+
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(target.gatewayHandler).ServeHTTP(rr, request)
+
+		if status := rr.Result().StatusCode; status != http.StatusRequestEntityTooLarge {
+			t.Fatal(fmt.Errorf("Result did not yield %d, got %d instead", http.StatusRequestEntityTooLarge, status))
+		}
+		testMetricsContainsResult(t, mustGetMetricsFactory(t, target), metricsEventGatewayRequest, metricsResultRequestTooLarge)
+	}
+}
+
+func TestGatewayHandlerWithDefaultRequestSizeLimits(t *testing.T) {
+	for _, test := range []struct {
+		contentType string
+		size        int64
+	}{
+		{"message/ohttp-req", defaultMaxRequestSize + 1},
+		{ohttpChunkedRequestContentType, defaultMaxChunkedRequestSize + 1},
+	} {
+		target := createMockEchoGatewayServer(t)
+		target.maxRequestSize, target.maxChunkedRequestSize = requestSizeLimitsFromEnvironment()
+
+		request, err := http.NewRequest(http.MethodPost, echoEndpoint, bytes.NewReader(make([]byte, test.size)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		request.Header.Add("Content-Type", test.contentType)
+
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(target.gatewayHandler).ServeHTTP(rr, request)
+
+		if status := rr.Result().StatusCode; status != http.StatusRequestEntityTooLarge {
+			t.Fatalf("Result for %s did not yield %d, got %d instead", test.contentType, http.StatusRequestEntityTooLarge, status)
+		}
+		testMetricsContainsResult(t, mustGetMetricsFactory(t, target), metricsEventGatewayRequest, metricsResultRequestTooLarge)
+	}
+
+	// An explicit 0 disables the limits
+	t.Setenv(maxRequestSizeEnvironmentVariable, "0")
+	t.Setenv(maxChunkedRequestSizeVariable, "0")
+	if maxRequestSize, maxChunkedRequestSize := requestSizeLimitsFromEnvironment(); maxRequestSize != 0 || maxChunkedRequestSize != 0 {
+		t.Fatalf("Expected no limits, got %d and %d", maxRequestSize, maxChunkedRequestSize)
+	}
+}
+
 func TestGatewayHandlerProtoHTTPRequestWithForbiddenTarget(t *testing.T) {
 	target := createMockEchoGatewayServer(t)
 
 	handler := http.HandlerFunc(target.gatewayHandler)
 
-	config, err := target.gateway.Config(FIXED_KEY_ID)
-	if err != nil {
-		t.Fatal(err)
-	}
+	config := target.keyring.Current()
 	client := ohttp.NewDefaultClient(config)
 
 	httpRequest, err := http.NewRequest(http.MethodPost, fmt.Sprintf("http://%s%s", FORBIDDEN_TARGET, gatewayEndpoint), nil)
@@ -445,10 +954,7 @@ func TestGatewayHandlerProtoHTTPRequestWithAllowedTarget(t *testing.T) {
 
 	handler := http.HandlerFunc(target.gatewayHandler)
 
-	config, err := target.gateway.Config(FIXED_KEY_ID)
-	if err != nil {
-		t.Fatal(err)
-	}
+	config := target.keyring.Current()
 	client := ohttp.NewDefaultClient(config)
 
 	httpRequest, err := http.NewRequest(http.MethodPost, fmt.Sprintf("http://%s%s", ALLOWED_TARGET, gatewayEndpoint), nil)
@@ -510,4 +1016,53 @@ func TestGatewayHandlerProtoHTTPRequestWithAllowedTarget(t *testing.T) {
 	}
 
 	testMetricsContainsResult(t, mustGetMetricsFactory(t, target), metricsEventGatewayRequest, metricsResultSuccess)
+
+	// Every stage of the request is timed
+	metrics := mustGetMetricsFactory(t, target).metrics[0]
+	for _, stage := range []string{metricsStageDecapsulation, metricsStageTargetFetch, metricsStageAppContent, metricsStageEncapsulation} {
+		if _, ok := metrics.durations[stage]; !ok {
+			t.Fatalf("Duration of the %s stage was not recorded, got %v", stage, metrics.durations)
+		}
+	}
+	if metrics.durations[metricsStageAppContent] < metrics.durations[metricsStageTargetFetch] {
+		t.Fatal("Expected the target fetch to be part of the handling of the application content")
+	}
+
+	// Every message of the request is measured
+	if metrics.sizes[metricsSizeEncapsulatedResponse] != len(bodyBytes) || metrics.sizes[metricsSizeTargetResponse] != len(binaryResp) {
+		t.Fatalf("Unexpected response sizes %v", metrics.sizes)
+	}
+	if metrics.sizes[metricsSizeInnerRequest] == 0 || metrics.sizes[metricsSizeEncapsulatedRequest] <= metrics.sizes[metricsSizeInnerRequest] {
+		t.Fatalf("Unexpected request sizes %v", metrics.sizes)
+	}
+}
+
+func TestEncapsulationHandlerTimeout(t *testing.T) {
+	cancelled := make(chan struct{})
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+		close(cancelled)
+	}))
+	defer target.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, target.URL+"/slow", nil)
+	binaryRequest, err := (*ohttp.BinaryRequest)(req).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := DefaultEncapsulationHandler{
+		appHandler: BinaryHTTPAppHandler{httpHandler: FilteredHttpRequestHandler{client: &http.Client{}}},
+		timeout:    50 * time.Millisecond,
+	}
+	outerRequest := httptest.NewRequest(http.MethodPost, gatewayEndpoint, nil)
+	metrics := &MockMetricsFactory{}
+	if _, err := handler.handleApp(outerRequest, binaryRequest, metrics.Create(metricsEventGatewayRequest)); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Target request was not cancelled after the handler timeout")
+	}
 }
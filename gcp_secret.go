@@ -0,0 +1,186 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	gcpMetadataTokenURL   = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+	gcpSecretManagerURL   = "https://secretmanager.googleapis.com/v1"
+	gcpLatestVersion      = "latest"
+	gcpTokenExpiryWindow  = time.Minute
+	gcpMetadataFlavorName = "Metadata-Flavor"
+)
+
+// gcpTokenSource fetches and caches OAuth access tokens for the default service account from the GCE
+// metadata server, which is available on GCE, GKE (with Workload Identity), and Cloud Run.
+type gcpTokenSource struct {
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+	client  *http.Client
+}
+
+func (s *gcpTokenSource) Token() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.token != "" && time.Until(s.expires) > gcpTokenExpiryWindow {
+		return s.token, nil
+	}
+
+	req, err := http.NewRequest(http.MethodGet, gcpMetadataTokenURL, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set(gcpMetadataFlavorName, "Google")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Metadata server token request failed with status %d", resp.StatusCode)
+	}
+
+	var result struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", err
+	}
+	s.token = result.AccessToken
+	s.expires = time.Now().Add(time.Duration(result.ExpiresIn) * time.Second)
+	return s.token, nil
+}
+
+// GCPSecretKeyProvider is a KeyProvider that reads the seed from a Google Secret Manager secret version.
+type GCPSecretKeyProvider struct {
+	secret  string
+	version string
+	// pinned is the resolved version name that Seed accesses, so that a version added to the secret
+	// only takes effect when Repin resolves the configured version again. mu guards it, since the
+	// refresh goroutine repins while requests may still seed.
+	mu      sync.Mutex
+	pinned  string
+	baseURL string
+	tokens  *gcpTokenSource
+	client  *http.Client
+}
+
+// newGCPSecretKeyProvider builds a GCPSecretKeyProvider from a key source of the form
+// gcp-secret://projects/<project>/secrets/<secret>[/versions/<version>]. Without an explicit
+// version the latest version is used. It is resolved to a concrete version on the first access
+// and re-resolved only by the periodic refresh, which logs the version whenever it changes.
+func newGCPSecretKeyProvider(source *url.URL) (*GCPSecretKeyProvider, error) {
+	name := strings.Trim(source.Host+source.Path, "/")
+	parts := strings.Split(name, "/")
+	if len(parts) != 4 && len(parts) != 6 || parts[0] != "projects" || parts[2] != "secrets" || (len(parts) == 6 && parts[4] != "versions") {
+		return nil, fmt.Errorf("Invalid GCP secret name %q, expected projects/<project>/secrets/<secret>[/versions/<version>]", name)
+	}
+
+	version := gcpLatestVersion
+	if len(parts) == 6 {
+		version = parts[5]
+	}
+
+	return &GCPSecretKeyProvider{
+		secret:  strings.Join(parts[:4], "/"),
+		version: version,
+		baseURL: gcpSecretManagerURL,
+		tokens:  &gcpTokenSource{client: keyProviderHTTPClient},
+		client:  keyProviderHTTPClient,
+	}, nil
+}
+
+func (p *GCPSecretKeyProvider) Name() string {
+	return "gcp-secret"
+}
+
+// Seed accesses the pinned secret version, resolving the configured version on the first access. The
+// payload may hold either the raw seed bytes or their hex encoding.
+func (p *GCPSecretKeyProvider) Seed() ([]byte, error) {
+	p.mu.Lock()
+	pinned := p.pinned
+	p.mu.Unlock()
+	if pinned == "" {
+		return p.Repin()
+	}
+	return p.seed(path.Base(pinned))
+}
+
+// Repin resolves the configured version, such as latest, again and pins the version it points to.
+func (p *GCPSecretKeyProvider) Repin() ([]byte, error) {
+	return p.seed(p.version)
+}
+
+func (p *GCPSecretKeyProvider) seed(version string) ([]byte, error) {
+	payload, name, err := p.access(version)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	if name != p.pinned {
+		log.Printf("Using key seed from GCP secret version %s", name)
+		p.pinned = name
+	}
+	p.mu.Unlock()
+
+	if seed, err := hex.DecodeString(string(bytes.TrimSpace(payload))); err == nil {
+		return seed, nil
+	}
+	return payload, nil
+}
+
+// access returns the payload of a secret version, and the resolved version name.
+func (p *GCPSecretKeyProvider) access(version string) ([]byte, string, error) {
+	token, err := p.tokens.Token()
+	if err != nil {
+		return nil, "", err
+	}
+
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/%s/versions/%s:access", p.baseURL, p.secret, version), nil)
+	if err != nil {
+		return nil, "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("Accessing secret %s failed with status %d", p.secret, resp.StatusCode)
+	}
+
+	var result struct {
+		Name    string `json:"name"`
+		Payload struct {
+			Data string `json:"data"`
+		} `json:"payload"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, "", err
+	}
+	payload, err := base64.StdEncoding.DecodeString(result.Payload.Data)
+	if err != nil {
+		return nil, "", err
+	}
+	return payload, result.Name, nil
+}
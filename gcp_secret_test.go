@@ -0,0 +1,141 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestGCPSecretKeyProviderSeed(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer test-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path != "/projects/p/secrets/gateway/versions/latest:access" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		// base64("cafe")
+		fmt.Fprint(w, `{"name": "projects/123/secrets/gateway/versions/2", "payload": {"data": "Y2FmZQ=="}}`)
+	}))
+	defer server.Close()
+
+	sourceURL, err := url.Parse("gcp-secret://projects/p/secrets/gateway")
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider, err := newGCPSecretKeyProvider(sourceURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider.baseURL = server.URL
+	provider.tokens = &gcpTokenSource{token: "test-token", expires: time.Now().Add(time.Hour)}
+
+	seed, err := provider.Seed()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(seed, []byte{0xCA, 0xFE}) {
+		t.Fatalf("Unexpected seed %x", seed)
+	}
+	if provider.pinned != "projects/123/secrets/gateway/versions/2" {
+		t.Fatalf("Unexpected pinned version %s", provider.pinned)
+	}
+}
+
+func TestGCPSecretKeyProviderRejectsInvalidNames(t *testing.T) {
+	for _, source := range []string{
+		"gcp-secret://projects/p",
+		"gcp-secret://projects/p/keys/gateway",
+		"gcp-secret://projects/p/secrets/gateway/aliases/1",
+	} {
+		sourceURL, err := url.Parse(source)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := newGCPSecretKeyProvider(sourceURL); err == nil {
+			t.Fatalf("Accepted invalid key source %s", source)
+		}
+	}
+}
+
+func TestGCPSecretKeyProviderRepin(t *testing.T) {
+	// base64 payloads of each version's hex seed
+	payloads := map[string]string{"2": "Y2FmZQ==", "3": "YmVlZg=="}
+	latest := "2"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		version := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/projects/p/secrets/gateway/versions/"), ":access")
+		if version == gcpLatestVersion {
+			version = latest
+		}
+		payload, ok := payloads[version]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		fmt.Fprintf(w, `{"name": "projects/123/secrets/gateway/versions/%s", "payload": {"data": %q}}`, version, payload)
+	}))
+	defer server.Close()
+
+	sourceURL, err := url.Parse("gcp-secret://projects/p/secrets/gateway")
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider, err := newGCPSecretKeyProvider(sourceURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider.baseURL = server.URL
+	provider.tokens = &gcpTokenSource{token: "test-token", expires: time.Now().Add(time.Hour)}
+
+	if seed, err := provider.Seed(); err != nil || !bytes.Equal(seed, []byte{0xCA, 0xFE}) {
+		t.Fatalf("Unexpected seed %x: %v", seed, err)
+	}
+
+	// A new version is only picked up when the refresh re-pins the provider
+	latest = "3"
+	if seed, err := provider.Seed(); err != nil || !bytes.Equal(seed, []byte{0xCA, 0xFE}) {
+		t.Fatalf("Seed did not stay on the pinned version, got %x: %v", seed, err)
+	}
+	if seed, err := refreshSeed(provider); err != nil || !bytes.Equal(seed, []byte{0xBE, 0xEF}) {
+		t.Fatalf("Refresh did not pick up the new version, got %x: %v", seed, err)
+	}
+	if provider.pinned != "projects/123/secrets/gateway/versions/3" {
+		t.Fatalf("Unexpected pinned version %s", provider.pinned)
+	}
+	if seed, err := provider.Seed(); err != nil || !bytes.Equal(seed, []byte{0xBE, 0xEF}) {
+		t.Fatalf("Seed did not stay on the re-pinned version, got %x: %v", seed, err)
+	}
+
+	// Requests may seed while the refresh goroutine re-pins a version that changes on every access
+	versions := int32(0)
+	changing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"name": "projects/123/secrets/gateway/versions/%d", "payload": {"data": "Y2FmZQ=="}}`, atomic.AddInt32(&versions, 1))
+	}))
+	defer changing.Close()
+	provider.baseURL = changing.URL
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			provider.Seed()
+		}()
+		go func() {
+			defer wg.Done()
+			provider.Repin()
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,72 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/chris-wood/ohttp-go"
+)
+
+const genkeyCommand = "genkey"
+
+// runGenkey implements the genkey subcommand, which generates a key seed and prints it together with the
+// matching configuration variables, so that the gateway can be provisioned with a known key. The key
+// config can also be written out in the application/ohttp-keys encoding for distribution to relays and
+// clients ahead of deployment.
+func runGenkey(args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet(genkeyCommand, flag.ContinueOnError)
+	keyID := flags.Uint("key-id", 0, "key ID of the generated key config (0-255)")
+	kem := flags.String("kem", "", "HPKE KEM, as accepted by HPKE_KEM (default X25519)")
+	kdf := flags.String("kdf", "", "HPKE KDF, as accepted by HPKE_KDF (default SHA256)")
+	aead := flags.String("aead", "", "HPKE AEAD, as accepted by HPKE_AEAD (default AES128GCM)")
+	configPath := flags.String("config", "", "write the key config, encoded as application/ohttp-keys, to this file")
+	printConfig := flags.Bool("print-config", false, "also print the hex-encoded key config")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *keyID > 255 {
+		return fmt.Errorf("Key ID %d is out of range", *keyID)
+	}
+
+	suite, err := parseKeySuite(*kem, *kdf, *aead)
+	if err != nil {
+		return err
+	}
+	seed := make([]byte, suite.seedLength())
+	if _, err := rand.Read(seed); err != nil {
+		return err
+	}
+	defer zeroize(seed)
+	config, err := ohttp.NewConfigFromSeed(uint8(*keyID), suite.KEMID, suite.KDFID, suite.AEADID, seed)
+	if err != nil {
+		return err
+	}
+	encodedConfig := marshalConfigs([]ohttp.PublicConfig{config.Config()})
+
+	fmt.Fprintf(stdout, "%s=%s\n", secretSeedEnvironmentVariable, hex.EncodeToString(seed))
+	fmt.Fprintf(stdout, "%s=%d\n", configurationIdEnvironmentVariable, *keyID)
+	if *kem != "" {
+		fmt.Fprintf(stdout, "%s=%s\n", hpkeKEMEnvironmentVariable, *kem)
+	}
+	if *kdf != "" {
+		fmt.Fprintf(stdout, "%s=%s\n", hpkeKDFEnvironmentVariable, *kdf)
+	}
+	if *aead != "" {
+		fmt.Fprintf(stdout, "%s=%s\n", hpkeAEADEnvironmentVariable, *aead)
+	}
+	if *printConfig {
+		fmt.Fprintf(stdout, "# Key config: %s\n", hex.EncodeToString(encodedConfig))
+	}
+
+	if *configPath != "" {
+		return ioutil.WriteFile(*configPath, encodedConfig, 0644)
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/chris-wood/ohttp-go"
+	"github.com/cisco/go-hpke"
+)
+
+func TestGenkey(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "config")
+	var stdout bytes.Buffer
+	if err := runGenkey([]string{"-key-id", "7", "-aead", "chacha20poly1305", "-config", configPath}, &stdout); err != nil {
+		t.Fatal(err)
+	}
+
+	variables := map[string]string{}
+	for _, line := range strings.Split(strings.TrimSpace(stdout.String()), "\n") {
+		parts := strings.SplitN(line, "=", 2)
+		variables[parts[0]] = parts[1]
+	}
+	seed, err := hex.DecodeString(variables[secretSeedEnvironmentVariable])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if variables[configurationIdEnvironmentVariable] != "7" {
+		t.Fatalf("Unexpected %s %q", configurationIdEnvironmentVariable, variables[configurationIdEnvironmentVariable])
+	}
+
+	// The printed seed reproduces the written key config
+	expected, err := ohttp.NewConfigFromSeed(7, hpke.DHKEM_X25519, hpke.KDF_HKDF_SHA256, hpke.AEAD_CHACHA20POLY1305, seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	written, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(written, marshalConfigs([]ohttp.PublicConfig{expected.Config()})) {
+		t.Fatal("Written key config does not match the seed")
+	}
+
+	if err := runGenkey([]string{"-key-id", "256"}, &stdout); err == nil {
+		t.Fatal("Out of range key ID accepted")
+	}
+}
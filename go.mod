@@ -7,6 +7,7 @@ require (
 	github.com/chris-wood/ohttp-go v0.0.0-20220810133439-e65868841109
 	github.com/cisco/go-hpke v0.0.0-20220110164554-aec202176774
 	github.com/golang/protobuf v1.5.2
+	golang.org/x/crypto v0.0.0-20210220033148-5ea612d1eb83
 	google.golang.org/protobuf v1.28.1
 )
 
@@ -15,6 +16,5 @@ require (
 	github.com/Microsoft/go-winio v0.5.0 // indirect
 	github.com/cisco/go-tls-syntax v0.0.0-20200617162716-46b0cfb76b9b // indirect
 	github.com/cloudflare/circl v1.0.0 // indirect
-	golang.org/x/crypto v0.0.0-20210220033148-5ea612d1eb83 // indirect
 	golang.org/x/sys v0.0.0-20210630005230-0f9fa26af87c // indirect
 )
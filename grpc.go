@@ -0,0 +1,18 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// gRPC requests (application/grpc, application/grpc+proto, ...) are forwarded like any other binary HTTP
+// request, except that they need "TE: trailers" and the target's HTTP/2 trailers carry the gRPC status.
+const grpcContentType = "application/grpc"
+
+func isGRPCRequest(req *http.Request) bool {
+	contentType := req.Header.Get("Content-Type")
+	return contentType == grpcContentType || strings.HasPrefix(contentType, grpcContentType+"+") || strings.HasPrefix(contentType, grpcContentType+";")
+}
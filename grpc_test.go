@@ -0,0 +1,100 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/chris-wood/ohttp-go"
+)
+
+func readVarintBytes(t *testing.T, r *bufio.Reader) []byte {
+	length, err := ohttp.Read(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// readBinaryResponseTrailer returns the status, content, and trailer fields of a known-length binary HTTP
+// response.
+func readBinaryResponseTrailer(t *testing.T, binaryResponse []byte) (uint64, []byte, map[string]string) {
+	r := bufio.NewReader(bytes.NewReader(binaryResponse))
+	if _, err := ohttp.Read(r); err != nil {
+		t.Fatal(err)
+	}
+	status, err := ohttp.Read(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readVarintBytes(t, r)
+	content := readVarintBytes(t, r)
+
+	trailer := map[string]string{}
+	if _, err := r.Peek(1); err != nil {
+		// The trailer field section is optional
+		return status, content, trailer
+	}
+	fields := bufio.NewReader(bytes.NewReader(readVarintBytes(t, r)))
+	for {
+		if _, err := fields.Peek(1); err != nil {
+			break
+		}
+		name := readVarintBytes(t, fields)
+		trailer[string(name)] = string(readVarintBytes(t, fields))
+	}
+	return status, content, trailer
+}
+
+func TestGRPCTarget(t *testing.T) {
+	target := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 || r.Header.Get("Te") != "trailers" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+		w.Write([]byte("grpc message"))
+		w.Header().Set("Grpc-Status", "5")
+		w.Header().Set("Grpc-Message", "not found")
+	}))
+	target.EnableHTTP2 = true
+	target.StartTLS()
+	defer target.Close()
+
+	req, err := http.NewRequest(http.MethodPost, target.URL+"/example.Service/Get", bytes.NewReader([]byte("grpc request")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/grpc+proto")
+	req.Header.Set("Te", "trailers")
+	binaryRequest, err := (*ohttp.BinaryRequest)(req).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := BinaryHTTPAppHandler{httpHandler: FilteredHttpRequestHandler{client: target.Client()}}
+	metrics := &MockMetricsFactory{}
+	binaryResponse, err := handler.Handle(binaryRequest, metrics.Create(metricsEventGatewayRequest))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status, content, trailer := readBinaryResponseTrailer(t, binaryResponse)
+	if status != http.StatusOK || !bytes.Equal(content, []byte("grpc message")) {
+		t.Fatalf("Unexpected gRPC response %d %s", status, content)
+	}
+	if trailer["grpc-status"] != "5" || trailer["grpc-message"] != "not found" {
+		t.Fatalf("Expected the gRPC status in the trailer, got %v", trailer)
+	}
+}
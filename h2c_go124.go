@@ -0,0 +1,19 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build go1.24
+// +build go1.24
+
+package main
+
+import "net/http"
+
+// enableH2C lets the plaintext server accept HTTP/2 connections with prior knowledge (RFC 9113, Section
+// 3.3), in addition to HTTP/1.1.
+func enableH2C(server *http.Server) error {
+	protocols := new(http.Protocols)
+	protocols.SetHTTP1(true)
+	protocols.SetUnencryptedHTTP2(true)
+	server.Protocols = protocols
+	return nil
+}
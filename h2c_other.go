@@ -0,0 +1,16 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !go1.24
+// +build !go1.24
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+func enableH2C(server *http.Server) error {
+	return fmt.Errorf("Cleartext HTTP/2 requires a gateway built with Go 1.24 or later")
+}
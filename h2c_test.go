@@ -0,0 +1,70 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build go1.24
+// +build go1.24
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/chris-wood/ohttp-go"
+)
+
+func TestListenerServerH2C(t *testing.T) {
+	gateway := createMockEchoGatewayServer(t)
+	mux := http.NewServeMux()
+	mux.HandleFunc(echoEndpoint, gateway.gatewayHandler)
+	server := newListenerServer("", mux, nil, true)
+	if err := enableH2C(server); err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(framingListener{listener})
+	defer server.Close()
+
+	protocols := new(http.Protocols)
+	protocols.SetUnencryptedHTTP2(true)
+	client := &http.Client{Transport: &http.Transport{Protocols: protocols}}
+
+	request, context, err := ohttp.NewDefaultClient(gateway.keyring.Current()).EncapsulateRequest([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest(http.MethodPost, "http://"+listener.Addr().String()+echoEndpoint, bytes.NewReader(request.Marshal()))
+	req.Header.Set("Content-Type", ohttpRequestContentType)
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.ProtoMajor != 2 || resp.StatusCode != http.StatusOK {
+		t.Fatalf("Unexpected %s response %d", resp.Proto, resp.StatusCode)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	encapsulated, err := ohttp.UnmarshalEncapsulatedResponse(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response, err := context.DecapsulateResponse(encapsulated); err != nil || string(response) != "hello" {
+		t.Fatalf("Unexpected response %q (%v)", response, err)
+	}
+
+	// Clients without prior knowledge are still served HTTP/1.1
+	resp, err = http.Post("http://"+listener.Addr().String()+echoEndpoint, ohttpRequestContentType, bytes.NewReader(request.Marshal()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.ProtoMajor != 1 {
+		t.Fatalf("Unexpected %s response", resp.Proto)
+	}
+}
@@ -5,6 +5,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"github.com/chris-wood/ohttp-go"
 	"google.golang.org/protobuf/proto"
@@ -13,6 +14,7 @@ import (
 	"net/http"
 	"net/http/httputil"
 	"strconv"
+	"time"
 )
 
 // Description of the error handling in the specification:
@@ -21,25 +23,49 @@ import (
 // 401 - Unauthorized in Gateway response
 var ConfigMismatchError = errors.New("Configuration mismatch")
 
+// 403 - Forbidden in Gateway response. The request was encapsulated to a revoked key.
+var KeyRevokedError = errors.New("Key revoked")
+
 // 400 - BadRequest in Gateway response
 var EncapsulationError = errors.New("Encapsulation error")
 
+// 413 - Request entity too large in Gateway response. The decapsulated request of a chunked request exceeds
+// the size the gateway buffers.
+var RequestTooLargeError = errors.New("Request too large")
+
 // 400 - BadRequest in Payload response. Payload is not a valid protobuf or marshalling error.
 var PayloadMarshallingError = errors.New("Issues with payload marshalling (BHTTP or Protobuf)")
 
+// 400 - BadRequest in Payload response. The request is smaller than the size clients pad requests to.
+var PayloadTooSmallError = errors.New("Payload smaller than the minimum request size")
+
 // 403 - Forbidden in Payload response. The request is not allowed to be sent to the target.
 var GatewayTargetForbiddenError = errors.New("Target forbidden on gateway (request was blocked by gateway)")
 
+// 503 - Service unavailable in Payload response. The target failed repeatedly, so the request was not sent.
+var GatewayTargetUnavailableError = errors.New("Target unavailable (circuit breaker is open)")
+
+// 502 - Bad gateway in Payload response. The target response exceeds the size the gateway encapsulates.
+var GatewayTargetResponseTooLargeError = errors.New("Target response too large")
+
+// 502 - Bad gateway in Payload response. The target response has a content coding that the client does not
+// accept and the gateway can not decode.
+var GatewayTargetResponseEncodingError = errors.New("Target response has an unsupported content encoding")
+
 // 500 - Internal server error in Payload response. The request failed to be processed after decapsulation.
 var GatewayInternalServerError = errors.New("The request failed to be processed after decapsulation")
 
-// Errors happened during decapsulation/encapsulation are returned as gateway response's error status (401 and 400)
+// Errors happened during decapsulation/encapsulation are returned as gateway response's error status (401, 403 and 400)
 func encapsulationErrorToGatewayStatusCode(e error) int {
 	switch e {
 	case ConfigMismatchError:
 		return http.StatusUnauthorized
+	case KeyRevokedError:
+		return http.StatusForbidden
 	case EncapsulationError:
 		return http.StatusBadRequest
+	case RequestTooLargeError:
+		return http.StatusRequestEntityTooLarge
 	default:
 		return http.StatusBadRequest
 	}
@@ -48,10 +74,14 @@ func encapsulationErrorToGatewayStatusCode(e error) int {
 // Errors happened after decapsulation are returned as encapsulated payload errors while gatewy status is 200
 func payloadErrorToPayloadStatusCode(e error) int {
 	switch e {
-	case PayloadMarshallingError:
+	case PayloadMarshallingError, PayloadTooSmallError:
 		return http.StatusBadRequest
 	case GatewayTargetForbiddenError:
 		return http.StatusForbidden
+	case GatewayTargetUnavailableError:
+		return http.StatusServiceUnavailable
+	case GatewayTargetResponseTooLargeError, GatewayTargetResponseEncodingError:
+		return http.StatusBadGateway
 	case GatewayInternalServerError:
 		return http.StatusInternalServerError
 	default:
@@ -67,16 +97,38 @@ func EncapsulationFail(err error) (ohttp.EncapsulatedResponse, error) {
 const (
 	// Metrics constants
 	metricsResultConfigurationMismatch     = "config_mismatch"
+	metricsResultKeyRevoked                = "key_revoked"
+	metricsResultDecryptOnlyKey            = "decrypt_only_key"
 	metricsResultDecapsulationFailed       = "decapsulation_failed"
+	metricsResultExtensionRejected         = "extension_rejected"
 	metricsResultEncapsulationFailed       = "encapsulation_failed"
 	metricsResultContentDecodingFailed     = "content_decode_failed"
+	metricsResultRequestTooSmall           = "request_too_small"
 	metricsResultContentEncodingFailed     = "content_encode_failed"
 	metricsResultRequestTranslationFailed  = "request_translate_failed"
 	metricsResultResponseTranslationFailed = "response_translate_failed"
 	metricsResultTargetRequestForbidden    = "request_forbidden"
 	metricsResultTargetRequestFailed       = "request_failed"
+	metricsResultTargetRequestDenied       = "request_denied"
+	metricsResultTargetCircuitOpen         = "circuit_open"
+	metricsResultTargetResponseTooLarge    = "response_too_large"
+	metricsResultTargetBadEncoding         = "response_encoding_unsupported"
+	metricsResultTargetRedirectForbidden   = "redirect_forbidden"
+	metricsResultTargetAddressForbidden    = "address_forbidden"
 	metricsResultSuccess                   = "success"
 	metricsPayloadStatusPrefix             = "gateway_payload"
+
+	// Stages whose durations are recorded
+	metricsStageDecapsulation = "decapsulation"
+	metricsStageAppContent    = "app_content"
+	metricsStageTargetFetch   = "target_fetch"
+	metricsStageEncapsulation = "encapsulation"
+
+	// Messages whose sizes are recorded
+	metricsSizeEncapsulatedRequest  = "encapsulated_request"
+	metricsSizeInnerRequest         = "inner_request"
+	metricsSizeTargetResponse       = "target_response"
+	metricsSizeEncapsulatedResponse = "encapsulated_response"
 )
 
 // EncapsulationHandler handles OHTTP encapsulated requests and produces OHTTP encapsulated responses.
@@ -86,36 +138,75 @@ type EncapsulationHandler interface {
 	Handle(outerRequest *http.Request, encapRequest ohttp.EncapsulatedRequest, metrics Metrics) (ohttp.EncapsulatedResponse, error)
 }
 
-// DefaultEncapsulationHandler is an EncapsulationHandler that uses a default OHTTP gateway to decapsulate
-// requests, pass them to an AppContentHandler to produce a response for encapsulation, and encapsulates the
+// DefaultEncapsulationHandler is an EncapsulationHandler that uses the OHTTP gateway matching the request's
+// key ID to decapsulate requests, pass them to an AppContentHandler to produce a response for encapsulation, and encapsulates the
 // response.
+//
+// A ContextAppHandler gets a context derived from the context of the outer request, bounded by timeout if
+// set, so that a client disconnect or an exhausted budget cancel the target request.
 type DefaultEncapsulationHandler struct {
-	keyID      uint8
-	gateway    ohttp.Gateway
+	keyring    Keyring
 	appHandler AppContentHandler
+	timeout    time.Duration
+}
+
+func (h DefaultEncapsulationHandler) handleApp(outerRequest *http.Request, binaryRequest []byte, metrics Metrics) ([]byte, error) {
+	contextHandler, ok := h.appHandler.(ContextAppHandler)
+	if !ok {
+		return h.appHandler.Handle(binaryRequest, metrics)
+	}
+	ctx := outerRequest.Context()
+	if h.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.timeout)
+		defer cancel()
+	}
+	return contextHandler.HandleContext(ctx, binaryRequest, metrics)
 }
 
 // Handle attempts to decapsulate the incoming encapsulated request and, if successful, passes the
 // corresponding application payload to the AppContentHandler for producing a response to encapsulate
 // and return.
 func (h DefaultEncapsulationHandler) Handle(outerRequest *http.Request, encapsulatedReq ohttp.EncapsulatedRequest, metrics Metrics) (ohttp.EncapsulatedResponse, error) {
-	if encapsulatedReq.KeyID != h.keyID {
+	if h.keyring.Revoked(encapsulatedReq.KeyID) {
+		metrics.Fire(metricsResultKeyRevoked)
+		return EncapsulationFail(KeyRevokedError)
+	}
+	gateway, ok := h.keyring.Gateway(encapsulatedReq.KeyID)
+	if !ok {
 		metrics.Fire(metricsResultConfigurationMismatch)
 		return EncapsulationFail(ConfigMismatchError)
 	}
+	if h.keyring.DecryptOnly(encapsulatedReq.KeyID) {
+		metrics.Fire(metricsResultDecryptOnlyKey)
+	}
 
-	binaryRequest, context, err := h.gateway.DecapsulateRequest(encapsulatedReq)
+	started := time.Now()
+	binaryRequest, context, err := gateway.DecapsulateRequest(encapsulatedReq)
+	metrics.Duration(metricsStageDecapsulation, time.Since(started))
 	if err != nil {
 		metrics.Fire(metricsResultDecapsulationFailed)
 		return EncapsulationFail(EncapsulationError)
 	}
+	metrics.Size(metricsSizeInnerRequest, len(binaryRequest))
+	// The header of RFC 9458 requests carries no extensions
+	extensions, err := checkOHTTPExtensions(nil)
+	if err != nil {
+		metrics.Fire(metricsResultExtensionRejected)
+		return EncapsulationFail(EncapsulationError)
+	}
+	outerRequest = outerRequest.WithContext(withOHTTPExtensions(outerRequest.Context(), extensions))
 
-	binaryResponse, err := h.appHandler.Handle(binaryRequest, metrics)
+	started = time.Now()
+	binaryResponse, err := h.handleApp(outerRequest, binaryRequest, metrics)
+	metrics.Duration(metricsStageAppContent, time.Since(started))
 	if err != nil {
 		return EncapsulationFail(err)
 	}
 
+	started = time.Now()
 	encapsulatedResponse, err := context.EncapsulateResponse(binaryResponse)
+	metrics.Duration(metricsStageEncapsulation, time.Since(started))
 	if err != nil {
 		metrics.Fire(metricsResultEncapsulationFailed)
 		return EncapsulationFail(EncapsulationError)
@@ -124,23 +215,30 @@ func (h DefaultEncapsulationHandler) Handle(outerRequest *http.Request, encapsul
 	return encapsulatedResponse, nil
 }
 
-// MetadataEncapsulationHandler is an EncapsulationHandler that uses a default OHTTP gateway to decapsulate
-// requests and return metadata about the encapsulated request context as an encapsulated response. Metadata
+// MetadataEncapsulationHandler is an EncapsulationHandler that uses the OHTTP gateway matching the request's
+// key ID to decapsulate requests and return metadata about the encapsulated request context as an encapsulated response. Metadata
 // includes, for example, the list of headers carried on the encapsulated request from the client or relay.
 type MetadataEncapsulationHandler struct {
-	keyID   uint8
-	gateway ohttp.Gateway
+	keyring Keyring
 }
 
 // Handle attempts to decapsulate the incoming encapsulated request and, if successful, foramts
 // metadata from the request context, and then encapsulates and returns the result.
 func (h MetadataEncapsulationHandler) Handle(outerRequest *http.Request, encapsulatedReq ohttp.EncapsulatedRequest, metrics Metrics) (ohttp.EncapsulatedResponse, error) {
-	if encapsulatedReq.KeyID != h.keyID {
+	if h.keyring.Revoked(encapsulatedReq.KeyID) {
+		metrics.Fire(metricsResultKeyRevoked)
+		return EncapsulationFail(KeyRevokedError)
+	}
+	gateway, ok := h.keyring.Gateway(encapsulatedReq.KeyID)
+	if !ok {
 		metrics.Fire(metricsResultConfigurationMismatch)
 		return EncapsulationFail(ConfigMismatchError)
 	}
+	if h.keyring.DecryptOnly(encapsulatedReq.KeyID) {
+		metrics.Fire(metricsResultDecryptOnlyKey)
+	}
 
-	_, context, err := h.gateway.DecapsulateRequest(encapsulatedReq)
+	_, context, err := gateway.DecapsulateRequest(encapsulatedReq)
 	if err != nil {
 		metrics.Fire(metricsResultDecapsulationFailed)
 		return EncapsulationFail(EncapsulationError)
@@ -168,6 +266,12 @@ type AppContentHandler interface {
 	Handle(binaryRequest []byte, metrics Metrics) ([]byte, error)
 }
 
+// ContextAppHandler is an AppContentHandler whose target requests are bound to a context.
+type ContextAppHandler interface {
+	// HandleContext is Handle with the target requests made with ctx.
+	HandleContext(ctx context.Context, binaryRequest []byte, metrics Metrics) ([]byte, error)
+}
+
 // EchoAppHandler is an AppContentHandler that returns the application request as the response.
 type EchoAppHandler struct {
 }
@@ -182,6 +286,10 @@ func (h EchoAppHandler) Handle(binaryRequest []byte, metrics Metrics) ([]byte, e
 // a protobuf-based HTTP request for resolution with an HttpRequestHandler.
 type ProtoHTTPAppHandler struct {
 	httpHandler HttpRequestHandler
+	// minRequestSize rejects requests of fewer bytes, including their padding
+	minRequestSize int
+	// padding pads the protobuf-based HTTP responses, including those of errors
+	padding responsePadding
 }
 
 // returns the same object format as for PayloadSuccess moving error inside successful response
@@ -191,6 +299,7 @@ func (h ProtoHTTPAppHandler) wrappedError(e error, metrics Metrics) ([]byte, err
 		StatusCode: int32(status),
 		Body:       []byte(e.Error()),
 	}
+	padProtoResponse(resp, h.padding)
 	respEnc, err := proto.Marshal(resp)
 	if err != nil {
 		return nil, err
@@ -204,11 +313,22 @@ func (h ProtoHTTPAppHandler) wrappedError(e error, metrics Metrics) ([]byte, err
 // The http.Response result from the handler is then translated back into an equivalent protobuf-based HTTP
 // response and returned to the caller.
 func (h ProtoHTTPAppHandler) Handle(binaryRequest []byte, metrics Metrics) ([]byte, error) {
+	return h.HandleContext(context.Background(), binaryRequest, metrics)
+}
+
+// HandleContext is Handle with the translated http.Request bound to ctx.
+func (h ProtoHTTPAppHandler) HandleContext(ctx context.Context, binaryRequest []byte, metrics Metrics) ([]byte, error) {
+	if len(binaryRequest) < h.minRequestSize {
+		metrics.Fire(metricsResultRequestTooSmall)
+		return h.wrappedError(PayloadTooSmallError, metrics)
+	}
 	req := &Request{}
 	if err := proto.Unmarshal(binaryRequest, req); err != nil {
 		metrics.Fire(metricsResultContentDecodingFailed)
 		return h.wrappedError(PayloadMarshallingError, metrics)
 	}
+	// The padding of the client is not part of the target request
+	req.Padding = nil
 
 	httpRequest, err := protoHTTPToRequest(req)
 	if err != nil {
@@ -216,13 +336,18 @@ func (h ProtoHTTPAppHandler) Handle(binaryRequest []byte, metrics Metrics) ([]by
 		return h.wrappedError(PayloadMarshallingError, metrics)
 	}
 
-	httpResponse, err := h.httpHandler.Handle(httpRequest, metrics)
+	started := time.Now()
+	httpResponse, err := h.httpHandler.Handle(httpRequest.WithContext(ctx), metrics)
+	metrics.Duration(metricsStageTargetFetch, time.Since(started))
 	if err != nil {
 		if err == GatewayTargetForbiddenError {
 			// Return 403 (Forbidden) in the event the client request was for a
 			// Target not on the allow list
 			return h.wrappedError(GatewayTargetForbiddenError, metrics)
 		}
+		if err == GatewayTargetUnavailableError || err == GatewayTargetResponseTooLargeError || err == GatewayTargetResponseEncodingError {
+			return h.wrappedError(err, metrics)
+		}
 		return h.wrappedError(GatewayInternalServerError, metrics)
 	}
 
@@ -232,6 +357,9 @@ func (h ProtoHTTPAppHandler) Handle(binaryRequest []byte, metrics Metrics) ([]by
 		return h.wrappedError(PayloadMarshallingError, metrics)
 	}
 
+	// The target response is measured before padding, which hides its size
+	metrics.Size(metricsSizeTargetResponse, proto.Size(protoResponse))
+	padProtoResponse(protoResponse, h.padding)
 	marshalledProtoResponse, err := proto.Marshal(protoResponse)
 	if err != nil {
 		metrics.Fire(metricsResultContentEncodingFailed)
@@ -246,6 +374,13 @@ func (h ProtoHTTPAppHandler) Handle(binaryRequest []byte, metrics Metrics) ([]by
 // a binary HTTP request for resolution with an HttpRequestHandler.
 type BinaryHTTPAppHandler struct {
 	httpHandler HttpRequestHandler
+	// forwardInformational encodes the informational responses of the target in the binary HTTP
+	// response, which are stripped otherwise
+	forwardInformational bool
+	// padding pads the binary HTTP responses, including those of errors
+	padding responsePadding
+	// minRequestSize rejects requests of fewer bytes, including their padding
+	minRequestSize int
 }
 
 func (h BinaryHTTPAppHandler) wrappedError(e error, metrics Metrics) ([]byte, error) {
@@ -256,7 +391,11 @@ func (h BinaryHTTPAppHandler) wrappedError(e error, metrics Metrics) ([]byte, er
 	}
 	binaryResponse := ohttp.CreateBinaryResponse(resp)
 	metrics.Fire(metricsPayloadStatusPrefix + strconv.Itoa(status))
-	return binaryResponse.Marshal()
+	binaryResponseEnc, err := binaryResponse.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	return h.padding.pad(binaryResponseEnc), nil
 }
 
 // Handle attempts to parse the application payload as a binary HTTP request and, if successful,
@@ -264,19 +403,52 @@ func (h BinaryHTTPAppHandler) wrappedError(e error, metrics Metrics) ([]byte, er
 // The http.Response result from the handler is then translated back into an equivalent binary HTTP
 // response and returned to the caller.
 func (h BinaryHTTPAppHandler) Handle(binaryRequest []byte, metrics Metrics) ([]byte, error) {
+	return h.HandleContext(context.Background(), binaryRequest, metrics)
+}
+
+// HandleContext is Handle with the translated http.Request bound to ctx.
+func (h BinaryHTTPAppHandler) HandleContext(ctx context.Context, binaryRequest []byte, metrics Metrics) ([]byte, error) {
+	if len(binaryRequest) < h.minRequestSize {
+		metrics.Fire(metricsResultRequestTooSmall)
+		return h.wrappedError(PayloadTooSmallError, metrics)
+	}
+	binaryRequest, err := unpadBinaryRequest(binaryRequest)
+	if err != nil {
+		metrics.Fire(metricsResultContentDecodingFailed)
+		return h.wrappedError(PayloadMarshallingError, metrics)
+	}
 	req, err := ohttp.UnmarshalBinaryRequest(binaryRequest)
 	if err != nil {
 		metrics.Fire(metricsResultContentDecodingFailed)
 		return h.wrappedError(PayloadMarshallingError, metrics)
 	}
+	trailer, err := binaryRequestTrailer(binaryRequest)
+	if err != nil {
+		metrics.Fire(metricsResultContentDecodingFailed)
+		return h.wrappedError(PayloadMarshallingError, metrics)
+	}
+	if len(trailer) > 0 {
+		// Trailers are only sent with a body of unknown length, which is chunked over HTTP/1.1
+		req.Trailer = trailer
+		req.ContentLength = -1
+	}
+	var interim *informationalResponses
+	if h.forwardInformational {
+		ctx, interim = withInformationalResponses(ctx)
+	}
 
-	resp, err := h.httpHandler.Handle(req, metrics)
+	started := time.Now()
+	resp, err := h.httpHandler.Handle(req.WithContext(ctx), metrics)
+	metrics.Duration(metricsStageTargetFetch, time.Since(started))
 	if err != nil {
 		if err == GatewayTargetForbiddenError {
 			// Return 403 (Forbidden) in the event the client request was for a
 			// Target not on the allow list
 			return h.wrappedError(GatewayTargetForbiddenError, metrics)
 		}
+		if err == GatewayTargetUnavailableError || err == GatewayTargetResponseTooLargeError || err == GatewayTargetResponseEncodingError {
+			return h.wrappedError(err, metrics)
+		}
 		return h.wrappedError(GatewayInternalServerError, metrics)
 	}
 
@@ -286,6 +458,16 @@ func (h BinaryHTTPAppHandler) Handle(binaryRequest []byte, metrics Metrics) ([]b
 		metrics.Fire(metricsResultContentEncodingFailed)
 		return h.wrappedError(PayloadMarshallingError, metrics)
 	}
+	// The trailer is only complete once Marshal has read the body
+	if len(resp.Trailer) > 0 {
+		binaryRespEnc = appendTrailerFields(binaryRespEnc, resp.Trailer)
+	}
+	if interim != nil {
+		binaryRespEnc = interim.insert(binaryRespEnc)
+	}
+	// The target response is measured before padding, which hides its size
+	metrics.Size(metricsSizeTargetResponse, len(binaryRespEnc))
+	binaryRespEnc = h.padding.pad(binaryRespEnc)
 
 	metrics.Fire(metricsPayloadStatusPrefix + "200")
 	var r error = nil
@@ -302,16 +484,35 @@ type HttpRequestHandler interface {
 // outbound HTTP requests to an allowed set of targets.
 type FilteredHttpRequestHandler struct {
 	client             *http.Client
-	allowedOrigins     map[string]bool
+	retry              retryPolicy
+	hedge              hedgePolicy
+	breaker            *circuitBreaker
+	allowedOrigins     targetList
+	deniedOrigins      targetList
+	scrubber           headerScrubber
+	redirects          redirectPolicy
+	credentials        []*targetCredential
+	maxResponseSize    int64
 	logForbiddenErrors bool
 }
 
+// permits reports whether Handle sends req to its target rather than rejecting it as forbidden, without
+// firing any metrics.
+func (h FilteredHttpRequestHandler) permits(req *http.Request) bool {
+	if h.deniedOrigins.matches(req.URL.Scheme, req.Host) || h.deniedOrigins.matches(req.URL.Scheme, req.URL.Host) {
+		return false
+	}
+	return h.allowedOrigins == nil || h.allowedOrigins.matches(req.URL.Scheme, req.Host)
+}
+
 // Handle processes HTTP requests to targets that are permitted according to a list of
-// allowed targets.
+// allowed targets and are not on the list of denied targets.
 func (h FilteredHttpRequestHandler) Handle(req *http.Request, metrics Metrics) (*http.Response, error) {
+	if targetDenied(h.deniedOrigins, req, metrics) {
+		return nil, GatewayTargetForbiddenError
+	}
 	if h.allowedOrigins != nil {
-		_, ok := h.allowedOrigins[req.Host]
-		if !ok {
+		if !h.allowedOrigins.matches(req.URL.Scheme, req.Host) {
 			metrics.Fire(metricsResultTargetRequestForbidden)
 			if h.logForbiddenErrors {
 				// to allow clients to fix improper third party urls usage (e.g. to change URLs from our direct s3 refs to CDN)
@@ -321,12 +522,36 @@ func (h FilteredHttpRequestHandler) Handle(req *http.Request, metrics Metrics) (
 		}
 	}
 
-	resp, err := h.client.Do(req)
-	if err != nil {
+	h.scrubber.scrub(req)
+	offerDecodableEncodings(req)
+	injectCredentials(req, h.credentials)
+	req = traceInformationalResponses(req, h.scrubber)
+	client := h.redirects.client(h.client, metrics, func(redirect *http.Request) bool {
+		return !h.deniedOrigins.matches(redirect.URL.Scheme, redirect.URL.Host) &&
+			(h.allowedOrigins == nil || h.allowedOrigins.matches(redirect.URL.Scheme, redirect.URL.Host))
+	})
+	resp, err := h.breaker.do(req, metrics, func() (*http.Response, error) {
+		return h.hedge.do(req, metrics, func(attempt *http.Request, metrics Metrics) (*http.Response, error) {
+			return h.retry.do(client, attempt, metrics)
+		})
+	})
+	if err == GatewayTargetUnavailableError {
+		return nil, err
+	} else if errors.Is(err, targetAddressForbiddenError) {
+		metrics.Fire(metricsResultTargetAddressForbidden)
+		return nil, GatewayTargetForbiddenError
+	} else if err != nil {
 		metrics.Fire(metricsResultTargetRequestFailed)
 		return nil, err
 	}
 
+	if err := decodeTargetResponse(req, resp, metrics); err != nil {
+		return nil, err
+	}
+	if err := limitTargetResponse(resp, h.maxResponseSize, metrics); err != nil {
+		return nil, err
+	}
+	h.scrubber.scrubResponse(resp)
 	metrics.Fire(metricsResultSuccess)
 	return resp, nil
 }
@@ -0,0 +1,466 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Encapsulation handler types of handler configs
+const (
+	handlerTypeTarget   = "target"
+	handlerTypeEcho     = "echo"
+	handlerTypeMetadata = "metadata"
+	handlerTypeProxy    = "proxy"
+	handlerTypeDNS      = "dns"
+)
+
+// handlerConfig declares the encapsulation handler served at an endpoint path.
+type handlerConfig struct {
+	// Path is the endpoint path, which may end with a parameter segment such as "/gateway/{app}" that
+	// Routes expand into one endpoint per parameter value.
+	Path string `json:"path"`
+	// Routes are the handler configs of a parameterized Path by parameter value, whose fields replace
+	// those of the parameterized config. The parameter in Target and Targets is replaced by the value.
+	Routes map[string]json.RawMessage `json:"routes,omitempty"`
+	// Type is one of the handler types: "target" resolves requests with the gateway's application content
+	// handler, "echo" and "metadata" return the request or its metadata, "proxy" forwards binary HTTP
+	// requests to the allowed targets, and "dns" resolves DNS queries.
+	Type string `json:"type"`
+	// Target is the URL whose scheme and authority replace those of every "target" request, or the DoH
+	// resolver URL of a "dns" handler.
+	Target string `json:"target,omitempty"`
+	// Targets are the base URLs of the upstreams of a "target" handler, tried in turn until one of them
+	// responds without a network error or 5xx status. A base URL path prefixes the request path.
+	Targets []string `json:"targets,omitempty"`
+	// Weights are the relative weights of Targets, and Balance is the strategy that distributes requests
+	// among them: "failover" (the default), "round_robin", or "least_pending".
+	Weights []int  `json:"weights,omitempty"`
+	Balance string `json:"balance,omitempty"`
+	// HealthCheckPath enables active health checks of Targets, which are sent HealthCheckMethod requests
+	// (HEAD by default) for the path every HealthCheckInterval (10s by default).
+	HealthCheckPath     string `json:"health_check_path,omitempty"`
+	HealthCheckMethod   string `json:"health_check_method,omitempty"`
+	HealthCheckInterval string `json:"health_check_interval,omitempty"`
+	// Discovery replaces Targets with the targets discovered from a source, "srv:<name>" or
+	// "consul:<service>", every DiscoveryInterval (30s by default), which are reached with
+	// DiscoveryScheme ("https" by default).
+	Discovery         string `json:"discovery,omitempty"`
+	DiscoveryScheme   string `json:"discovery_scheme,omitempty"`
+	DiscoveryInterval string `json:"discovery_interval,omitempty"`
+	// AppHandler names a registered custom AppContentHandler that replaces the gateway's application
+	// content handler of a "target" handler.
+	AppHandler string `json:"app_handler,omitempty"`
+	// AllowedOrigins replaces ALLOWED_TARGET_ORIGINS for a "target" handler, and is the required target
+	// allowlist of a "proxy" handler.
+	AllowedOrigins []string `json:"allowed_origins,omitempty"`
+	// DeniedOrigins are denied in addition to DENIED_TARGET_ORIGINS.
+	DeniedOrigins []string `json:"denied_origins,omitempty"`
+	// AllowHTTP lets a "proxy" handler forward requests to targets over plain HTTP.
+	AllowHTTP bool `json:"allow_http,omitempty"`
+	// ClientCert and ClientKey are the PEM files of a client certificate that replaces TARGET_CLIENT_CERT
+	// when the targets of a "target" or "proxy" handler request one.
+	ClientCert string `json:"client_cert,omitempty"`
+	ClientKey  string `json:"client_key,omitempty"`
+	// CABundle, TLSMinVersion, and SPKIPins replace TARGET_CA_BUNDLE, TARGET_TLS_MIN_VERSION, and
+	// TARGET_TLS_PINS for the targets of a "target" or "proxy" handler.
+	CABundle      string   `json:"ca_bundle,omitempty"`
+	TLSMinVersion string   `json:"tls_min_version,omitempty"`
+	SPKIPins      []string `json:"spki_pins,omitempty"`
+	// TargetProtocol replaces TARGET_PROTOCOL for the targets of a "target" or "proxy" handler.
+	TargetProtocol string `json:"target_protocol,omitempty"`
+	// AWSService replaces TARGET_AWS_SERVICE, signing the target requests of a "target" or "proxy" handler
+	// for the AWS service (e.g., "execute-api" or "lambda").
+	AWSService string `json:"aws_service,omitempty"`
+	// BearerToken and APIKey are secret sources (env:<variable>, file:///path, vault://<path>#<field>, or
+	// gcp-secret://<name>) of credentials that are set on the target requests of a "target" or "proxy"
+	// handler, the bearer token as the Authorization header, and the API key as APIKeyHeader.
+	BearerToken  string `json:"bearer_token,omitempty"`
+	APIKeyHeader string `json:"api_key_header,omitempty"`
+	APIKey       string `json:"api_key,omitempty"`
+	// ShadowTarget is the base URL of a shadow target that ShadowPercent (0 to 100) percent of the requests
+	// of a "target" handler are mirrored to in the background, ignoring its responses.
+	ShadowTarget  string  `json:"shadow_target,omitempty"`
+	ShadowPercent float64 `json:"shadow_percent,omitempty"`
+	// DisableCache excludes the target responses of a "target" handler from TARGET_CACHE.
+	DisableCache bool `json:"disable_cache,omitempty"`
+	// HedgePercentile replaces TARGET_HEDGE_PERCENTILE for the targets of a "target" or "proxy" handler.
+	HedgePercentile float64 `json:"hedge_percentile,omitempty"`
+	// Timeout is the time budget, as a duration such as "5s", of the target requests of a "target" or
+	// "proxy" handler, after which they are cancelled.
+	Timeout string `json:"timeout,omitempty"`
+}
+
+type handlerConfigFile struct {
+	Handlers []handlerConfig `json:"handlers"`
+}
+
+// loadHandlerConfigs reads handler configs from a JSON file of the form {"handlers": [...]}.
+func loadHandlerConfigs(path string) ([]handlerConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file handlerConfigFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("Invalid handler config file %s: %s", path, err)
+	}
+	reserved := map[string]bool{"/": true, healthEndpoint: true, readyEndpoint: true, versionEndpoint: true, configEndpoint: true, configHashEndpoint: true, attestationEndpoint: true}
+	configs := []handlerConfig{}
+	for _, config := range file.Handlers {
+		expanded, err := expandHandlerRoutes(config)
+		if err != nil {
+			return nil, err
+		}
+		for _, config := range expanded {
+			if !strings.HasPrefix(config.Path, "/") || reserved[config.Path] {
+				return nil, fmt.Errorf("Invalid handler path %q", config.Path)
+			}
+		}
+		configs = append(configs, expanded...)
+	}
+	return configs, nil
+}
+
+// expandHandlerRoutes returns the handler configs of the routes of a parameterized config, in the order of
+// their parameter values, or the config itself if its path has no parameter.
+func expandHandlerRoutes(config handlerConfig) ([]handlerConfig, error) {
+	i := strings.LastIndex(config.Path, "/")
+	segment := config.Path[i+1:]
+	if !strings.HasPrefix(segment, "{") || !strings.HasSuffix(segment, "}") || len(segment) < 3 {
+		if strings.ContainsAny(config.Path, "{}") || len(config.Routes) > 0 {
+			return nil, fmt.Errorf("Invalid handler path %q: routes require a final parameter segment such as {app}", config.Path)
+		}
+		return []handlerConfig{config}, nil
+	}
+	prefix := config.Path[:i+1]
+	if strings.ContainsAny(prefix, "{}") || len(config.Routes) == 0 {
+		return nil, fmt.Errorf("Invalid handler path %q: a parameterized path requires routes", config.Path)
+	}
+
+	// Every route is decoded onto its own copy of the parameterized config, so that routes do not share
+	// the slices of the copy
+	template := config
+	template.Routes = nil
+	defaults, err := json.Marshal(template)
+	if err != nil {
+		return nil, err
+	}
+	values := make([]string, 0, len(config.Routes))
+	for value := range config.Routes {
+		values = append(values, value)
+	}
+	sort.Strings(values)
+	routes := make([]handlerConfig, 0, len(values))
+	for _, value := range values {
+		if value == "" || strings.ContainsAny(value, "/{}?#") {
+			return nil, fmt.Errorf("Invalid route %q of %s", value, config.Path)
+		}
+		var route handlerConfig
+		json.Unmarshal(defaults, &route)
+		if err := json.Unmarshal(config.Routes[value], &route); err != nil {
+			return nil, fmt.Errorf("Invalid route %q of %s: %s", value, config.Path, err)
+		}
+		if len(route.Routes) > 0 {
+			return nil, fmt.Errorf("Invalid route %q of %s: routes can not be nested", value, config.Path)
+		}
+		route.Path = prefix + value
+		route.Target = strings.Replace(route.Target, segment, value, -1)
+		for j, target := range route.Targets {
+			route.Targets[j] = strings.Replace(target, segment, value, -1)
+		}
+		routes = append(routes, route)
+	}
+	return routes, nil
+}
+
+// mergeHandlerConfigs returns configs followed by overrides, where an override replaces the config with
+// the same path.
+func mergeHandlerConfigs(configs, overrides []handlerConfig) []handlerConfig {
+	merged := []handlerConfig{}
+	index := map[string]int{}
+	for _, config := range append(append([]handlerConfig{}, configs...), overrides...) {
+		if i, ok := index[config.Path]; ok {
+			merged[i] = config
+			continue
+		}
+		index[config.Path] = len(merged)
+		merged = append(merged, config)
+	}
+	return merged
+}
+
+// FixedTargetHttpRequestHandler is an HttpRequestHandler that sends every request to the active target
+// of its switch, replacing the scheme and authority of the request URL, before passing it to the next
+// handler.
+type FixedTargetHttpRequestHandler struct {
+	target      *targetSwitch
+	httpHandler HttpRequestHandler
+}
+
+func (h FixedTargetHttpRequestHandler) Handle(req *http.Request, metrics Metrics) (*http.Response, error) {
+	target := h.target.current()
+	req.URL.Scheme = target.Scheme
+	req.URL.Host = target.Host
+	req.Host = target.Host
+	return h.httpHandler.Handle(req, metrics)
+}
+
+func parseTargetURL(rawURL, path string) (*url.URL, error) {
+	target, err := url.Parse(rawURL)
+	if err != nil || target.Host == "" || (target.Scheme != "https" && target.Scheme != "http") {
+		return nil, fmt.Errorf("Invalid target URL %q for %s", rawURL, path)
+	}
+	return target, nil
+}
+
+// handlerFactory builds encapsulation handlers from handler configs, sharing the gateway's keys, target
+// client, and policies.
+type handlerFactory struct {
+	keyring       Keyring
+	keyrings      map[string]Keyring
+	newAppHandler func(HttpRequestHandler) AppContentHandler
+	targetHandler FilteredHttpRequestHandler
+	proxyHandler  TargetProxyHttpRequestHandler
+	dnsClient     *http.Client
+	resolver      *net.Resolver
+
+	// clientConfig builds the target clients of handlers with their own TLS configuration
+	clientConfig targetClientConfig
+	// responseCache, if not nil, caches the target responses of "target" handlers
+	responseCache responseCache
+	// forwardInformational forwards the informational responses of targets to the clients of "proxy"
+	// handlers
+	forwardInformational bool
+	// padding pads the binary HTTP responses of "proxy" handlers
+	padding responsePadding
+	// minRequestSize rejects the requests of "proxy" handlers of fewer bytes
+	minRequestSize int
+
+	// upstreamPools and targetSwitches collect the upstream pools and target switches of the built
+	// handlers by path, if not nil
+	upstreamPools  map[string]*upstreamPool
+	targetSwitches map[string]*targetSwitch
+}
+
+func (f handlerFactory) build(config handlerConfig) (EncapsulationHandler, error) {
+	keyring, ok := f.keyrings[config.Path]
+	if !ok {
+		keyring = f.keyring
+	}
+	deniedOrigins := append(append(targetList{}, f.targetHandler.deniedOrigins...), newTargetList(strings.Join(config.DeniedOrigins, ","))...)
+	timeout := time.Duration(0)
+	if config.Timeout != "" {
+		var err error
+		if timeout, err = time.ParseDuration(config.Timeout); err != nil || timeout < 0 {
+			return nil, fmt.Errorf("Invalid timeout %q for %s", config.Timeout, config.Path)
+		}
+	}
+
+	var client *http.Client
+	tlsSettings := targetTLSConfig{
+		certFile:   config.ClientCert,
+		keyFile:    config.ClientKey,
+		caFile:     config.CABundle,
+		minVersion: config.TLSMinVersion,
+		pins:       config.SPKIPins,
+	}
+	if !tlsSettings.isDefault() || config.AWSService != "" || config.TargetProtocol != "" {
+		clientConfig := f.clientConfig
+		if config.Type == handlerTypeProxy {
+			clientConfig = clientConfig.forProxy()
+		}
+		if !tlsSettings.isDefault() {
+			clientConfig.tlsSettings = clientConfig.tlsSettings.override(tlsSettings)
+			tlsConfig, err := clientConfig.tlsSettings.load()
+			if err != nil {
+				return nil, fmt.Errorf("Invalid TLS settings for %s: %s", config.Path, err)
+			}
+			clientConfig.tls = tlsConfig
+		}
+		if config.TargetProtocol != "" {
+			if err := validateTargetProtocol(config.TargetProtocol); err != nil {
+				return nil, fmt.Errorf("Invalid target protocol for %s: %s", config.Path, err)
+			}
+			clientConfig.protocol = config.TargetProtocol
+		}
+		if config.AWSService != "" {
+			if err := clientConfig.signAWS(config.AWSService); err != nil {
+				return nil, fmt.Errorf("Invalid AWS signing for %s: %s", config.Path, err)
+			}
+		}
+		client = clientConfig.client()
+	}
+	var credentials []*targetCredential
+	if config.BearerToken != "" {
+		credential, err := newTargetCredential("Authorization", "Bearer ", config.BearerToken)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid bearer token for %s: %s", config.Path, err)
+		}
+		credentials = append(credentials, credential)
+	}
+	if config.APIKey != "" || config.APIKeyHeader != "" {
+		if config.APIKey == "" || config.APIKeyHeader == "" {
+			return nil, fmt.Errorf("Handler %s requires both api_key and api_key_header", config.Path)
+		}
+		credential, err := newTargetCredential(config.APIKeyHeader, "", config.APIKey)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid API key for %s: %s", config.Path, err)
+		}
+		credentials = append(credentials, credential)
+	}
+
+	switch config.Type {
+	case handlerTypeTarget:
+		httpHandler := f.targetHandler
+		if client != nil {
+			httpHandler.client = client
+		}
+		httpHandler.deniedOrigins = deniedOrigins
+		httpHandler.credentials = credentials
+		httpHandler.hedge = httpHandler.hedge.forHandler(config.HedgePercentile)
+		if len(config.AllowedOrigins) > 0 {
+			httpHandler.allowedOrigins = newTargetList(strings.Join(config.AllowedOrigins, ","))
+		}
+		newAppHandler := f.newAppHandler
+		if config.AppHandler != "" {
+			factory, ok := lookupAppHandler(config.AppHandler)
+			if !ok {
+				return nil, fmt.Errorf("Unknown app handler %q for %s", config.AppHandler, config.Path)
+			}
+			newAppHandler = factory
+		}
+		var shadowTarget *url.URL
+		if config.ShadowTarget != "" {
+			var err error
+			if shadowTarget, err = parseTargetURL(config.ShadowTarget, config.Path); err != nil {
+				return nil, err
+			}
+			if config.ShadowPercent <= 0 || config.ShadowPercent > 100 {
+				return nil, fmt.Errorf("Invalid shadow percent %v for %s", config.ShadowPercent, config.Path)
+			}
+		}
+		var targetHandler HttpRequestHandler = httpHandler
+		if f.responseCache != nil && !config.DisableCache {
+			targetHandler = newCachingHttpRequestHandler(f.responseCache, config.Path, httpHandler)
+		}
+		// Requests to targets chosen by the client are only mirrored once the target handler would accept them
+		withShadow := func(next HttpRequestHandler, permits func(*http.Request) bool) HttpRequestHandler {
+			if shadowTarget == nil {
+				return next
+			}
+			shadow := newShadowHttpRequestHandler(shadowTarget, config.ShadowPercent, timeout, httpHandler, next)
+			shadow.permits = permits
+			return shadow
+		}
+		if config.Target != "" && len(config.Targets) > 0 || config.Discovery != "" && (config.Target != "" || len(config.Targets) > 0) {
+			return nil, fmt.Errorf("Handler %s can only have one of target, targets, and discovery", config.Path)
+		}
+		if config.Target == "" && len(config.Targets) == 0 && config.Discovery == "" {
+			return DefaultEncapsulationHandler{keyring: keyring, appHandler: newAppHandler(withShadow(targetHandler, httpHandler.permits)), timeout: timeout}, nil
+		}
+		if config.Target != "" {
+			target, err := parseTargetURL(config.Target, config.Path)
+			if err != nil {
+				return nil, err
+			}
+			targetSwitch := newTargetSwitch(target)
+			if f.targetSwitches != nil {
+				f.targetSwitches[config.Path] = targetSwitch
+			}
+			return DefaultEncapsulationHandler{
+				keyring:    keyring,
+				appHandler: newAppHandler(withShadow(FixedTargetHttpRequestHandler{target: targetSwitch, httpHandler: targetHandler}, nil)),
+				timeout:    timeout,
+			}, nil
+		}
+		if len(config.Weights) > 0 && len(config.Weights) != len(config.Targets) {
+			return nil, fmt.Errorf("Handler %s must have a weight for each target", config.Path)
+		}
+		switch config.Balance {
+		case "", balanceFailover, balanceRoundRobin, balanceLeastPending:
+		default:
+			return nil, fmt.Errorf("Unknown balancing strategy %q for %s", config.Balance, config.Path)
+		}
+		targets := []*url.URL{}
+		for _, rawURL := range config.Targets {
+			target, err := parseTargetURL(rawURL, config.Path)
+			if err != nil {
+				return nil, err
+			}
+			targets = append(targets, target)
+		}
+		pool := newUpstreamPool(targets, config.Weights, config.Balance)
+		if config.HealthCheckPath != "" {
+			check := upstreamHealthCheck{method: http.MethodHead, path: config.HealthCheckPath, interval: defaultHealthCheckInterval, client: client}
+			if config.HealthCheckMethod != "" {
+				check.method = config.HealthCheckMethod
+			}
+			if config.HealthCheckInterval != "" {
+				interval, err := time.ParseDuration(config.HealthCheckInterval)
+				if err != nil || interval <= 0 {
+					return nil, fmt.Errorf("Invalid health check interval %q for %s", config.HealthCheckInterval, config.Path)
+				}
+				check.interval = interval
+			}
+			pool.healthCheck = &check
+		}
+		if config.Discovery != "" {
+			discovery, err := newUpstreamDiscovery(config.Discovery, config.DiscoveryScheme, f.resolver)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid discovery for %s: %s", config.Path, err)
+			}
+			pool.discovery = discovery
+			pool.discoveryInterval = defaultDiscoveryInterval
+			if config.DiscoveryInterval != "" {
+				interval, err := time.ParseDuration(config.DiscoveryInterval)
+				if err != nil || interval <= 0 {
+					return nil, fmt.Errorf("Invalid discovery interval %q for %s", config.DiscoveryInterval, config.Path)
+				}
+				pool.discoveryInterval = interval
+			}
+		}
+		if f.upstreamPools != nil {
+			f.upstreamPools[config.Path] = pool
+		}
+		return DefaultEncapsulationHandler{
+			keyring:    keyring,
+			appHandler: newAppHandler(withShadow(UpstreamHttpRequestHandler{pool: pool, httpHandler: targetHandler}, nil)),
+			timeout:    timeout,
+		}, nil
+	case handlerTypeEcho:
+		return DefaultEncapsulationHandler{keyring: keyring, appHandler: EchoAppHandler{}}, nil
+	case handlerTypeMetadata:
+		return MetadataEncapsulationHandler{keyring: keyring}, nil
+	case handlerTypeProxy:
+		if len(config.AllowedOrigins) == 0 {
+			return nil, fmt.Errorf("Proxy handler %s requires allowed_origins", config.Path)
+		}
+		httpHandler := f.proxyHandler
+		if client != nil {
+			httpHandler.client = client
+		}
+		httpHandler.credentials = credentials
+		httpHandler.hedge = httpHandler.hedge.forHandler(config.HedgePercentile)
+		httpHandler.allowlist = newTargetList(strings.Join(config.AllowedOrigins, ","))
+		httpHandler.denylist = deniedOrigins
+		httpHandler.allowHTTP = config.AllowHTTP
+		return DefaultEncapsulationHandler{keyring: keyring, appHandler: BinaryHTTPAppHandler{httpHandler: httpHandler, forwardInformational: f.forwardInformational, padding: f.padding, minRequestSize: f.minRequestSize}, timeout: timeout}, nil
+	case handlerTypeDNS:
+		if config.Target == "" {
+			return nil, fmt.Errorf("DNS handler %s requires a target resolver URL", config.Path)
+		}
+		return DefaultEncapsulationHandler{keyring: keyring, appHandler: DNSAppHandler{client: f.dnsClient, resolverURL: config.Target}}, nil
+	default:
+		return nil, fmt.Errorf("Unknown handler type %q for %s", config.Type, config.Path)
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadHandlerConfigs(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "handlers.json")
+	ioutil.WriteFile(path, []byte(`{"handlers": [
+		{"path": "/gateway-echo", "type": "metadata"},
+		{"path": "/gateway-app", "type": "target", "target": "https://app.internal", "denied_origins": ["admin.internal"]}
+	]}`), 0600)
+
+	fileConfigs, err := loadHandlerConfigs(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	configs := mergeHandlerConfigs([]handlerConfig{
+		{Path: gatewayEndpoint, Type: handlerTypeTarget},
+		{Path: echoEndpoint, Type: handlerTypeEcho},
+	}, fileConfigs)
+	if len(configs) != 3 || configs[1].Type != handlerTypeMetadata || configs[2].Target != "https://app.internal" {
+		t.Fatalf("Unexpected merged configs %+v", configs)
+	}
+
+	ioutil.WriteFile(path, []byte(`{"handlers": [{"path": "/health", "type": "echo"}]}`), 0600)
+	if _, err := loadHandlerConfigs(path); err == nil {
+		t.Fatal("Expected a reserved path to be rejected")
+	}
+}
+
+func TestLoadHandlerConfigsWithRoutes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "handlers.json")
+	ioutil.WriteFile(path, []byte(`{"handlers": [
+		{"path": "/gateway/{app}", "type": "target", "target": "https://{app}.internal", "denied_origins": ["admin.internal"], "routes": {
+			"billing": {},
+			"search": {"targets": ["https://{app}-a.internal", "https://{app}-b.internal"], "timeout": "2s"},
+			"debug": {"type": "echo", "denied_origins": ["debug.internal"]}
+		}}
+	]}`), 0600)
+
+	configs, err := loadHandlerConfigs(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(configs) != 3 {
+		t.Fatalf("Unexpected route configs %+v", configs)
+	}
+	billing, debug, search := configs[0], configs[1], configs[2]
+	if billing.Path != "/gateway/billing" || billing.Type != handlerTypeTarget || billing.Target != "https://billing.internal" || billing.Routes != nil {
+		t.Fatalf("Unexpected billing route %+v", billing)
+	}
+	if debug.Path != "/gateway/debug" || debug.Type != handlerTypeEcho || len(debug.DeniedOrigins) != 1 || debug.DeniedOrigins[0] != "debug.internal" {
+		t.Fatalf("Unexpected debug route %+v", debug)
+	}
+	if billing.DeniedOrigins[0] != "admin.internal" {
+		t.Fatalf("Route changed the denied origins of another route to %v", billing.DeniedOrigins)
+	}
+	if search.Timeout != "2s" || len(search.Targets) != 2 || search.Targets[1] != "https://search-b.internal" {
+		t.Fatalf("Unexpected search route %+v", search)
+	}
+
+	for _, invalid := range []string{
+		`{"path": "/gateway/{app}", "type": "target"}`,
+		`{"path": "/gateway", "type": "target", "routes": {"app": {}}}`,
+		`{"path": "/{tenant}/gateway/{app}", "type": "target", "routes": {"app": {}}}`,
+		`{"path": "/gateway/{app}", "type": "target", "routes": {"a/b": {}}}`,
+		`{"path": "/gateway/{app}", "type": "target", "routes": {"app": {"routes": {"nested": {}}}}}`,
+	} {
+		ioutil.WriteFile(path, []byte(`{"handlers": [`+invalid+`]}`), 0600)
+		if _, err := loadHandlerConfigs(path); err == nil {
+			t.Fatalf("Expected %s to be rejected", invalid)
+		}
+	}
+}
+
+func TestHandlerFactory(t *testing.T) {
+	keyring := createKeyring(t)
+	factory := handlerFactory{
+		keyring: keyring,
+		newAppHandler: func(httpHandler HttpRequestHandler) AppContentHandler {
+			return BinaryHTTPAppHandler{httpHandler: httpHandler}
+		},
+		targetHandler: FilteredHttpRequestHandler{client: &http.Client{}},
+	}
+
+	handler, err := factory.build(handlerConfig{Path: "/gateway-app", Type: handlerTypeTarget, Target: "https://app.internal"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	appHandler := handler.(DefaultEncapsulationHandler).appHandler.(BinaryHTTPAppHandler)
+	if fixed, ok := appHandler.httpHandler.(FixedTargetHttpRequestHandler); !ok || fixed.target.current().Host != "app.internal" {
+		t.Fatalf("Expected requests to be sent to the fixed target, got %+v", appHandler.httpHandler)
+	}
+
+	for _, config := range []handlerConfig{
+		{Path: "/gateway-proxy", Type: handlerTypeProxy},
+		{Path: "/gateway-dns", Type: handlerTypeDNS},
+		{Path: "/gateway-app", Type: handlerTypeTarget, Target: "ftp://app.internal"},
+		{Path: "/gateway-app", Type: "unknown"},
+		{Path: "/gateway-app", Type: handlerTypeTarget, Timeout: "soon"},
+	} {
+		if _, err := factory.build(config); err == nil {
+			t.Errorf("Expected config %+v to be rejected", config)
+		}
+	}
+}
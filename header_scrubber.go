@@ -0,0 +1,176 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// hopByHopHeaders are connection-specific headers (RFC 9110, Section 7.6.1) that must not be forwarded.
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"TE",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// identifyingHeaders are headers added by proxies and CDNs that reveal the client's address or the path
+// its request took, and so would undo the unlinkability OHTTP provides if they reached the target.
+var identifyingHeaders = []string{
+	"Forwarded",
+	"Via",
+	"X-Forwarded-For",
+	"X-Forwarded-Host",
+	"X-Forwarded-Proto",
+	"X-Real-Ip",
+	"True-Client-Ip",
+	"Cf-Connecting-Ip",
+	"Cf-Connecting-Ipv6",
+	"Fastly-Client-Ip",
+	"X-Client-Ip",
+	"X-Cluster-Client-Ip",
+}
+
+// infrastructureHeaders are target response headers that reveal the target's software or request
+// tracing identifiers, which could link a response to target-side logs.
+var infrastructureHeaders = []string{
+	"Server",
+	"X-Powered-By",
+	"Via",
+	"Traceparent",
+	"Tracestate",
+	"X-Request-Id",
+	"X-Trace-Id",
+	"X-Amzn-Trace-Id",
+	"X-Amzn-Requestid",
+	"X-B3-Traceid",
+	"X-B3-Spanid",
+	"X-B3-Parentspanid",
+	"X-B3-Sampled",
+	"B3",
+	"Uber-Trace-Id",
+	"X-Cloud-Trace-Context",
+	"Cf-Ray",
+	"X-Served-By",
+	"X-Backend-Server",
+}
+
+// headerScrubber removes hop-by-hop headers, the headers named in the Connection header, and the
+// configured identifying headers from decapsulated requests before they are sent to a target, and the
+// infrastructure headers from target responses before they are encapsulated. When responseHeaders is set,
+// only the response headers it names are returned instead. When cookies is set, only the cookies it
+// names are forwarded and set. The zero value only removes hop-by-hop headers from requests, and
+// hop-by-hop and infrastructure headers from responses.
+type headerScrubber struct {
+	headers         []string
+	responseHeaders map[string]bool
+	cookies         map[string]bool
+}
+
+// newHeaderScrubber builds a scrubber for the identifying headers and any extra comma-separated header
+// names, which returns only the comma-separated response header names, or every header but the
+// infrastructure headers if responseHeaders is empty, and forwards only the comma-separated cookie names,
+// or every cookie if cookies is empty.
+func newHeaderScrubber(extraHeaders, responseHeaders, cookies string) headerScrubber {
+	scrubber := headerScrubber{headers: append([]string{}, identifyingHeaders...)}
+	if responseHeaders != "" {
+		scrubber.responseHeaders = map[string]bool{}
+		for _, header := range strings.Split(responseHeaders, ",") {
+			if header = strings.TrimSpace(header); header != "" {
+				scrubber.responseHeaders[http.CanonicalHeaderKey(header)] = true
+			}
+		}
+	}
+	for _, header := range strings.Split(extraHeaders, ",") {
+		if header = strings.TrimSpace(header); header != "" {
+			scrubber.headers = append(scrubber.headers, header)
+		}
+	}
+	if cookies != "" {
+		scrubber.cookies = map[string]bool{}
+		for _, cookie := range strings.Split(cookies, ",") {
+			if cookie = strings.TrimSpace(cookie); cookie != "" {
+				scrubber.cookies[cookie] = true
+			}
+		}
+	}
+	return scrubber
+}
+
+func (s headerScrubber) scrub(req *http.Request) {
+	grpc := isGRPCRequest(req)
+	for _, header := range strings.Split(req.Header.Get("Connection"), ",") {
+		if header = strings.TrimSpace(header); header != "" {
+			req.Header.Del(header)
+		}
+	}
+	for _, header := range hopByHopHeaders {
+		req.Header.Del(header)
+	}
+	for _, header := range s.headers {
+		req.Header.Del(header)
+	}
+	if grpc {
+		// gRPC targets reject requests that do not accept trailers
+		req.Header.Set("Te", "trailers")
+	}
+
+	if s.cookies == nil {
+		return
+	}
+	cookies := req.Cookies()
+	req.Header.Del("Cookie")
+	for _, cookie := range cookies {
+		if s.cookies[cookie.Name] {
+			req.AddCookie(cookie)
+		}
+	}
+}
+
+// scrubResponse removes headers from a target response. The Date header is kept with minute precision,
+// which is enough for caching but does not pin the response to the second the target produced it.
+func (s headerScrubber) scrubResponse(resp *http.Response) {
+	for _, header := range strings.Split(resp.Header.Get("Connection"), ",") {
+		if header = strings.TrimSpace(header); header != "" {
+			resp.Header.Del(header)
+		}
+	}
+	for _, header := range hopByHopHeaders {
+		resp.Header.Del(header)
+	}
+	if s.responseHeaders != nil {
+		for header := range resp.Header {
+			if !s.responseHeaders[header] {
+				delete(resp.Header, header)
+			}
+		}
+	} else {
+		for _, header := range infrastructureHeaders {
+			resp.Header.Del(header)
+		}
+	}
+
+	if date, err := http.ParseTime(resp.Header.Get("Date")); err == nil {
+		resp.Header.Set("Date", date.Truncate(time.Minute).UTC().Format(http.TimeFormat))
+	}
+
+	if s.cookies == nil {
+		return
+	}
+	setCookies := resp.Header.Values("Set-Cookie")
+	resp.Header.Del("Set-Cookie")
+	for _, setCookie := range setCookies {
+		cookies := (&http.Response{Header: http.Header{"Set-Cookie": {setCookie}}}).Cookies()
+		if len(cookies) == 1 && s.cookies[cookies[0].Name] {
+			resp.Header.Add("Set-Cookie", setCookie)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestHeaderScrubber(t *testing.T) {
+	req, _ := http.NewRequest(http.MethodGet, "https://target.example/", nil)
+	req.Header.Set("Connection", "X-Hop")
+	req.Header.Set("X-Hop", "1")
+	req.Header.Set("X-Forwarded-For", "192.0.2.1")
+	req.Header.Set("Via", "1.1 relay")
+	req.Header.Set("X-Device-Id", "abc")
+	req.Header.Set("Accept", "application/json")
+	req.AddCookie(&http.Cookie{Name: "session", Value: "1"})
+	req.AddCookie(&http.Cookie{Name: "tracking", Value: "2"})
+
+	newHeaderScrubber("x-device-id", "", "session").scrub(req)
+	for _, header := range []string{"Connection", "X-Hop", "X-Forwarded-For", "Via", "X-Device-Id"} {
+		if req.Header.Get(header) != "" {
+			t.Errorf("Expected %s to be removed", header)
+		}
+	}
+	if req.Header.Get("Accept") != "application/json" {
+		t.Error("Expected Accept to be forwarded")
+	}
+	if cookies := req.Cookies(); len(cookies) != 1 || cookies[0].Name != "session" {
+		t.Errorf("Expected only the session cookie to be forwarded, got %v", cookies)
+	}
+}
+
+func TestHeaderScrubberResponse(t *testing.T) {
+	newResponse := func() *http.Response {
+		return &http.Response{Header: http.Header{
+			"Content-Type": {"application/json"},
+			"Server":       {"nginx/1.2.3"},
+			"Traceparent":  {"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"},
+			"Date":         {"Mon, 02 Jan 2006 15:04:05 GMT"},
+			"Set-Cookie":   {"session=1; Path=/; Secure", "tracking=2"},
+		}}
+	}
+
+	resp := newResponse()
+	newHeaderScrubber("", "", "session").scrubResponse(resp)
+	if resp.Header.Get("Server") != "" || resp.Header.Get("Traceparent") != "" {
+		t.Errorf("Expected infrastructure headers to be removed, got %v", resp.Header)
+	}
+	if date := resp.Header.Get("Date"); date != "Mon, 02 Jan 2006 15:04:00 GMT" {
+		t.Errorf("Expected Date with minute precision, got %s", date)
+	}
+	if cookies := resp.Header.Values("Set-Cookie"); len(cookies) != 1 || cookies[0] != "session=1; Path=/; Secure" {
+		t.Errorf("Expected only the session cookie to be set, got %v", cookies)
+	}
+
+	resp = newResponse()
+	newHeaderScrubber("", "content-type", "").scrubResponse(resp)
+	if len(resp.Header) != 1 || resp.Header.Get("Content-Type") != "application/json" {
+		t.Errorf("Expected only allowed headers, got %v", resp.Header)
+	}
+}
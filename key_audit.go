@@ -0,0 +1,188 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chris-wood/ohttp-go"
+)
+
+// Key lifecycle events recorded in the audit log
+const (
+	auditEventLoaded              = "loaded"
+	auditEventGenerated           = "generated"
+	auditEventRotated             = "rotated"
+	auditEventRetirementScheduled = "retirement_scheduled"
+	auditEventDestroyed           = "destroyed"
+	auditEventRevoked             = "revoked"
+)
+
+// auditEvent is a single audit log record, written as one line of JSON.
+type auditEvent struct {
+	Time          time.Time  `json:"time"`
+	Event         string     `json:"event"`
+	KeyID         uint8      `json:"key_id"`
+	Fingerprint   string     `json:"fingerprint,omitempty"`
+	PreviousKeyID *uint8     `json:"previous_key_id,omitempty"`
+	RetireAt      *time.Time `json:"retire_at,omitempty"`
+}
+
+// keyFingerprint identifies a key by the hex-encoded SHA-256 digest of its public config, so that audit
+// records can be matched against the configs served to clients without exposing secret material.
+func keyFingerprint(config ohttp.PublicConfig) string {
+	digest := sha256.Sum256(config.Marshal())
+	return hex.EncodeToString(digest[:])
+}
+
+// auditSink receives audit log records.
+type auditSink interface {
+	Write(record []byte) error
+}
+
+// fileAuditSink appends records to a file opened in append-only mode, syncing after each one.
+type fileAuditSink struct {
+	file *os.File
+}
+
+func (s fileAuditSink) Write(record []byte) error {
+	if _, err := s.file.Write(record); err != nil {
+		return err
+	}
+	return s.file.Sync()
+}
+
+// webhookAuditSink POSTs each record to an external collector.
+type webhookAuditSink struct {
+	url    string
+	client *http.Client
+}
+
+func (s webhookAuditSink) Write(record []byte) error {
+	resp, err := s.client.Post(s.url, "application/json", bytes.NewReader(record))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("Audit collector returned %s", resp.Status)
+	}
+	return nil
+}
+
+// auditSinkFromLocation opens a file sink, or a webhook sink for an http:// or https:// URL.
+func auditSinkFromLocation(location string) (auditSink, error) {
+	if strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://") {
+		return webhookAuditSink{url: location, client: keyProviderHTTPClient}, nil
+	}
+	file, err := os.OpenFile(location, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return fileAuditSink{file: file}, nil
+}
+
+// keyAuditor records the lifecycle events of a keyring's keys by comparing its state after every change
+// with the previously recorded one. Keys restored or synced from a keystore are recorded as generated.
+type keyAuditor struct {
+	sink auditSink
+	now  func() time.Time
+
+	mu      sync.Mutex
+	keys    map[uint8]keyState
+	revoked map[uint8]bool
+}
+
+// attachKeyAudit records the keys currently held by keyring, then every change made to them.
+func attachKeyAudit(keyring *RotatingKeyring, sink auditSink) {
+	auditor := &keyAuditor{sink: sink, now: time.Now}
+	auditor.record(keyring)
+	keyring.OnChange(func() {
+		auditor.record(keyring)
+	})
+}
+
+func (a *keyAuditor) record(keyring *RotatingKeyring) {
+	states, revoked := keyring.keyStates()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := a.now()
+	events := []auditEvent{}
+	keys := map[uint8]keyState{}
+	var previousCurrent *uint8
+	for keyID, state := range a.keys {
+		if state.current {
+			id := keyID
+			previousCurrent = &id
+		}
+	}
+
+	for _, state := range states {
+		keyID := state.config.ID
+		keys[keyID] = state
+		fingerprint := keyFingerprint(state.config)
+		previous, known := a.keys[keyID]
+		if known && keyFingerprint(previous.config) != fingerprint {
+			events = append(events, auditEvent{Event: auditEventDestroyed, KeyID: keyID, Fingerprint: keyFingerprint(previous.config)})
+			known = false
+		}
+
+		switch {
+		case a.keys == nil:
+			events = append(events, auditEvent{Event: auditEventLoaded, KeyID: keyID, Fingerprint: fingerprint})
+		case !known:
+			events = append(events, auditEvent{Event: auditEventGenerated, KeyID: keyID, Fingerprint: fingerprint})
+		}
+		if state.current && a.keys != nil && (previousCurrent == nil || *previousCurrent != keyID) {
+			events = append(events, auditEvent{Event: auditEventRotated, KeyID: keyID, Fingerprint: fingerprint, PreviousKeyID: previousCurrent})
+		}
+		if !state.retireAt.IsZero() && (!known || !previous.retireAt.Equal(state.retireAt)) {
+			retireAt := state.retireAt
+			events = append(events, auditEvent{Event: auditEventRetirementScheduled, KeyID: keyID, Fingerprint: fingerprint, RetireAt: &retireAt})
+		}
+	}
+
+	// A revoked key is removed from the keyring, which is recorded as its revocation only
+	for keyID := range revoked {
+		if a.revoked[keyID] {
+			continue
+		}
+		event := auditEvent{Event: auditEventRevoked, KeyID: keyID}
+		if previous, ok := a.keys[keyID]; ok {
+			event.Fingerprint = keyFingerprint(previous.config)
+		}
+		events = append(events, event)
+	}
+	for keyID, previous := range a.keys {
+		if _, ok := keys[keyID]; !ok && (!revoked[keyID] || a.revoked[keyID]) {
+			events = append(events, auditEvent{Event: auditEventDestroyed, KeyID: keyID, Fingerprint: keyFingerprint(previous.config)})
+		}
+	}
+
+	a.keys = keys
+	a.revoked = revoked
+	for _, event := range events {
+		event.Time = now
+		record, err := json.Marshal(event)
+		if err != nil {
+			log.Printf("Failed to encode key audit event: %s", err)
+			continue
+		}
+		if err := a.sink.Write(append(record, '\n')); err != nil {
+			log.Printf("Failed to write key audit event %s for key ID %d: %s", event.Event, event.KeyID, err)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+type memoryAuditSink struct {
+	events []auditEvent
+}
+
+func (s *memoryAuditSink) Write(record []byte) error {
+	var event auditEvent
+	if err := json.Unmarshal(record, &event); err != nil {
+		return err
+	}
+	s.events = append(s.events, event)
+	return nil
+}
+
+func (s *memoryAuditSink) find(t *testing.T, name string, keyID uint8) auditEvent {
+	for _, event := range s.events {
+		if event.Event == name && event.KeyID == keyID {
+			return event
+		}
+	}
+	t.Fatalf("Missing %s event for key ID %d in %+v", name, keyID, s.events)
+	return auditEvent{}
+}
+
+func TestKeyAudit(t *testing.T) {
+	keyring := createKeyring(t)
+	sink := &memoryAuditSink{}
+	attachKeyAudit(keyring, sink)
+
+	initial := keyring.Current()
+	loaded := sink.find(t, auditEventLoaded, initial.ID)
+	if loaded.Fingerprint != keyFingerprint(initial) || loaded.Time.IsZero() {
+		t.Fatalf("Unexpected loaded event %+v", loaded)
+	}
+
+	current, err := keyring.Rotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink.find(t, auditEventGenerated, current.ID)
+	rotated := sink.find(t, auditEventRotated, current.ID)
+	if rotated.PreviousKeyID == nil || *rotated.PreviousKeyID != initial.ID {
+		t.Fatalf("Unexpected rotated event %+v", rotated)
+	}
+	if sink.find(t, auditEventRetirementScheduled, initial.ID).RetireAt == nil {
+		t.Fatal("Retirement event is missing its time")
+	}
+
+	if err := keyring.Revoke(initial.ID); err != nil {
+		t.Fatal(err)
+	}
+	if sink.find(t, auditEventRevoked, initial.ID).Fingerprint != keyFingerprint(initial) {
+		t.Fatal("Revoked event has the wrong fingerprint")
+	}
+	for _, event := range sink.events {
+		if event.Event == auditEventDestroyed {
+			t.Fatalf("Unexpected destroyed event %+v", event)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// readKeySeeds reads a seeds file for key import, which holds one "<key ID>=<hex seed>" line per key.
+// Blank lines and lines starting with # are ignored.
+func readKeySeeds(path string) (map[uint8][]byte, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	seeds := map[uint8][]byte{}
+	scanner := bufio.NewScanner(bytes.NewReader(contents))
+	for line := 1; scanner.Scan(); line++ {
+		entry := strings.TrimSpace(scanner.Text())
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected <key ID>=<hex seed>", path, line)
+		}
+		keyID, err := strconv.ParseUint(strings.TrimSpace(parts[0]), 10, 8)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid key ID: %s", path, line, err)
+		}
+		seed, err := hex.DecodeString(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid seed: %s", path, line, err)
+		}
+		seeds[uint8(keyID)] = seed
+	}
+	return seeds, scanner.Err()
+}
+
+// importKeys replaces the keys of keyring with the key configs in configsPath, encoded as
+// application/ohttp-keys, and their seeds in seedsPath.
+func importKeys(keyring *RotatingKeyring, configsPath, seedsPath string) error {
+	encoded, err := ioutil.ReadFile(configsPath)
+	if err != nil {
+		return err
+	}
+	configs, err := unmarshalConfigs(encoded)
+	if err != nil {
+		return err
+	}
+	seeds, err := readKeySeeds(seedsPath)
+	if err != nil {
+		return err
+	}
+	return keyring.Import(configs, seeds)
+}
+
+// exportConfigs writes the key configs served by keyring to path, encoded as application/ohttp-keys.
+func exportConfigs(keyring Keyring, path string) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(marshalConfigs(keyring.Configs())); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// exportConfigsOnChange keeps path up to date with the key configs served by keyring.
+func exportConfigsOnChange(keyring *RotatingKeyring, path string) error {
+	if err := exportConfigs(keyring, path); err != nil {
+		return err
+	}
+	keyring.OnChange(func() {
+		if err := exportConfigs(keyring, path); err != nil {
+			log.Printf("Failed to export key configs to %s: %s", path, err)
+		}
+	})
+	return nil
+}
@@ -0,0 +1,80 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/chris-wood/ohttp-go"
+	"github.com/cisco/go-hpke"
+)
+
+func TestKeyConfigImportExport(t *testing.T) {
+	dir := t.TempDir()
+
+	// Provision two keys externally, newest first
+	configs := []ohttp.PublicConfig{}
+	seeds := ""
+	for _, keyID := range []uint8{9, 8} {
+		seed := make([]byte, defaultSeedLength)
+		seed[0] = keyID
+		config, err := ohttp.NewConfigFromSeed(keyID, hpke.DHKEM_X25519, hpke.KDF_HKDF_SHA256, hpke.AEAD_AESGCM128, seed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		configs = append(configs, config.Config())
+		seeds += fmt.Sprintf("%d=%s\n", keyID, hex.EncodeToString(seed))
+	}
+	configsPath := filepath.Join(dir, "configs")
+	seedsPath := filepath.Join(dir, "seeds")
+	if err := ioutil.WriteFile(configsPath, marshalConfigs(configs), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(seedsPath, []byte("# provisioned keys\n"+seeds), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	keyring := createKeyring(t)
+	if err := importKeys(keyring, configsPath, seedsPath); err != nil {
+		t.Fatal(err)
+	}
+	if !keyring.Current().IsEqual(configs[0]) {
+		t.Fatal("First imported config is not current")
+	}
+	if _, ok := keyring.Gateway(FIXED_KEY_ID); ok {
+		t.Fatal("Import kept the previous key")
+	}
+
+	exportPath := filepath.Join(dir, "export")
+	if err := exportConfigsOnChange(keyring, exportPath); err != nil {
+		t.Fatal(err)
+	}
+	rotated, err := keyring.Rotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded, err := ioutil.ReadFile(exportPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exported, err := unmarshalConfigs(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(exported) != 3 || !exported[0].IsEqual(rotated) || !exported[1].IsEqual(configs[0]) {
+		t.Fatal("Exported configs do not match the served ones")
+	}
+
+	// A seed that does not derive the config is rejected
+	if err := ioutil.WriteFile(seedsPath, []byte("9=00\n8=00\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := importKeys(keyring, configsPath, seedsPath); err == nil {
+		t.Fatal("Import accepted mismatched seeds")
+	}
+}
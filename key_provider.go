@@ -0,0 +1,159 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// KeyProvider supplies the secret seed from which the gateway key pair is derived.
+type KeyProvider interface {
+	// Name identifies the provider in logs.
+	Name() string
+
+	// Seed fetches the current seed.
+	Seed() ([]byte, error)
+}
+
+// repinningKeyProvider is implemented by providers that resolve a moving reference, such as the latest
+// version of a secret, once and keep serving the resolved version from Seed. Repin resolves the
+// reference again and returns the seed it now points to.
+type repinningKeyProvider interface {
+	KeyProvider
+	Repin() ([]byte, error)
+}
+
+// refreshSeed fetches the seed for a periodic refresh, letting the provider follow a moving reference.
+func refreshSeed(provider KeyProvider) ([]byte, error) {
+	if repinning, ok := provider.(repinningKeyProvider); ok {
+		return repinning.Repin()
+	}
+	return provider.Seed()
+}
+
+// EnvironmentKeyProvider is a KeyProvider that reads a hex-encoded seed from the SEED_SECRET_KEY
+// environment variable, or generates a random one if the variable is unset.
+type EnvironmentKeyProvider struct {
+	seed []byte
+}
+
+// NewEnvironmentKeyProvider loads the seed from the environment once, so that a generated seed stays
+// the same for the lifetime of the process.
+func NewEnvironmentKeyProvider() (*EnvironmentKeyProvider, error) {
+	if seedHex := os.Getenv(secretSeedEnvironmentVariable); seedHex != "" {
+		// Never log the seed itself, not even in verbose mode
+		log.Printf("Using secret key seed from %s", secretSeedEnvironmentVariable)
+		seed, err := hex.DecodeString(seedHex)
+		if err != nil {
+			return nil, err
+		}
+		return &EnvironmentKeyProvider{seed: seed}, nil
+	}
+
+	seed := make([]byte, defaultSeedLength)
+	if _, err := rand.Read(seed); err != nil {
+		return nil, err
+	}
+	return &EnvironmentKeyProvider{seed: seed}, nil
+}
+
+func (p *EnvironmentKeyProvider) Name() string {
+	return "environment"
+}
+
+func (p *EnvironmentKeyProvider) Seed() ([]byte, error) {
+	return p.seed, nil
+}
+
+// keyProviderFromSource builds the KeyProvider selected by the --key-source flag or KEY_SOURCE. An empty
+// source, or "env", selects the EnvironmentKeyProvider.
+func keyProviderFromSource(source string) (KeyProvider, error) {
+	if source == "" || source == "env" {
+		return NewEnvironmentKeyProvider()
+	}
+
+	sourceURL, err := url.Parse(source)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid key source %q: %s", source, err)
+	}
+
+	switch sourceURL.Scheme {
+	case "vault":
+		return newVaultKeyProvider(sourceURL)
+	case "aws-kms":
+		return newAWSKMSKeyProvider(sourceURL)
+	case "gcp-secret":
+		return newGCPSecretKeyProvider(sourceURL)
+	case "azure-keyvault":
+		return newAzureKeyVaultKeyProvider(sourceURL)
+	case "file":
+		return newFileKeyProvider(sourceURL)
+	case "pkcs11":
+		// Decapsulating with a key held in an HSM would require the HPKE implementation to delegate the
+		// KEM private key operation to the token, which the vendored ohttp and HPKE libraries cannot do,
+		// and a cgo PKCS#11 binding. Fail loudly instead of silently using a software key.
+		return nil, fmt.Errorf("PKCS#11 key sources are not supported by this build")
+	default:
+		return nil, fmt.Errorf("Unsupported key source scheme: %s", sourceURL.Scheme)
+	}
+}
+
+// loadSeed fetches the seed from provider, falling back to SEED_SECRET_KEY if the provider fails so that
+// an unreachable secret store does not prevent the gateway from starting. Without SEED_SECRET_KEY the
+// provider error is returned, since a random seed would serve a key that no other replica shares.
+func loadSeed(provider KeyProvider) ([]byte, error) {
+	seed, err := provider.Seed()
+	if err == nil {
+		return seed, nil
+	}
+	if _, ok := provider.(*EnvironmentKeyProvider); ok {
+		return nil, err
+	}
+	if os.Getenv(secretSeedEnvironmentVariable) == "" {
+		return nil, fmt.Errorf("Failed to load key seed from %s: %s", provider.Name(), err)
+	}
+
+	log.Printf("Failed to load key seed from %s, falling back to the environment: %s", provider.Name(), err)
+	fallback, err := NewEnvironmentKeyProvider()
+	if err != nil {
+		return nil, err
+	}
+	return fallback.Seed()
+}
+
+// refreshKeys polls provider each interval and rotates the keyring to the new seed whenever it changes.
+// Fetch failures are logged and the keyring keeps its current key.
+func refreshKeys(provider KeyProvider, keyring *RotatingKeyring, seed []byte, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		latest, err := refreshSeed(provider)
+		if err != nil {
+			log.Printf("Failed to refresh key seed from %s: %s", provider.Name(), err)
+			continue
+		}
+		if bytes.Equal(latest, seed) {
+			continue
+		}
+
+		config, err := keyring.RotateToSeed(latest)
+		if err != nil {
+			log.Printf("Failed to rotate to refreshed key seed from %s: %s", provider.Name(), err)
+			continue
+		}
+		seed = latest
+		log.Printf("Key seed changed in %s, current key ID is now %d", provider.Name(), config.ID)
+	}
+}
+
+// keyProviderHTTPClient is the HTTP client used by key providers that talk to remote secret stores.
+var keyProviderHTTPClient = &http.Client{Timeout: 10 * time.Second}
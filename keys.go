@@ -0,0 +1,734 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chris-wood/ohttp-go"
+	"github.com/cisco/go-hpke"
+)
+
+// Keyring holds the gateway key configurations that can currently be used to decapsulate requests.
+type Keyring interface {
+	// Current returns the key configuration advertised to clients.
+	Current() ohttp.PublicConfig
+
+	// Configs returns every key configuration that is still valid, newest first.
+	Configs() []ohttp.PublicConfig
+
+	// Gateway returns the gateway that holds the private key for keyID, if that key is still valid.
+	Gateway(keyID uint8) (ohttp.Gateway, bool)
+
+	// PrivateConfig returns the private key configuration for keyID, if that key is still valid. It is used
+	// by encapsulation formats the gateway implements itself, such as chunked OHTTP.
+	PrivateConfig(keyID uint8) (ohttp.PrivateConfig, bool)
+
+	// Revoked reports whether keyID has been revoked.
+	Revoked(keyID uint8) bool
+
+	// DecryptOnly reports whether keyID is past its overlap window but still inside its grace period,
+	// in which it is no longer advertised but still decapsulates requests.
+	DecryptOnly(keyID uint8) bool
+
+	// Expiry returns the time after which keyID is no longer advertised, if it is known: the end of the
+	// overlap window of a retired key, or of the current key once its replacement is scheduled.
+	Expiry(keyID uint8) (time.Time, bool)
+}
+
+// keySuite is the HPKE ciphersuite of a gateway key.
+type keySuite struct {
+	KEMID  hpke.KEMID
+	KDFID  hpke.KDFID
+	AEADID hpke.AEADID
+}
+
+// defaultKeySuite is DHKEM(X25519, HKDF-SHA256), HKDF-SHA256, AES-128-GCM.
+var defaultKeySuite = keySuite{
+	KEMID:  hpke.DHKEM_X25519,
+	KDFID:  hpke.KDF_HKDF_SHA256,
+	AEADID: hpke.AEAD_AESGCM128,
+}
+
+// hybridPostQuantumKEMName names the X25519Kyber768 hybrid KEM (draft-westerbaan-cfrg-hpke-xyber768d00).
+const hybridPostQuantumKEMName = "X25519KYBER768"
+
+var (
+	keySuiteKEMs = map[string]hpke.KEMID{
+		"X25519": hpke.DHKEM_X25519,
+		"X448":   hpke.DHKEM_X448,
+		"P256":   hpke.DHKEM_P256,
+		"P521":   hpke.DHKEM_P521,
+	}
+	keySuiteKDFs = map[string]hpke.KDFID{
+		"SHA256": hpke.KDF_HKDF_SHA256,
+		"SHA384": hpke.KDF_HKDF_SHA384,
+		"SHA512": hpke.KDF_HKDF_SHA512,
+	}
+	keySuiteAEADs = map[string]hpke.AEADID{
+		"AES128GCM":        hpke.AEAD_AESGCM128,
+		"AES256GCM":        hpke.AEAD_AESGCM256,
+		"CHACHA20POLY1305": hpke.AEAD_CHACHA20POLY1305,
+	}
+)
+
+// keySuiteFromEnvironment returns the ciphersuite selected by HPKE_KEM, HPKE_KDF, and HPKE_AEAD. Unset
+// variables keep the corresponding algorithm of defaultKeySuite.
+func keySuiteFromEnvironment() (keySuite, error) {
+	return parseKeySuite(os.Getenv(hpkeKEMEnvironmentVariable), os.Getenv(hpkeKDFEnvironmentVariable), os.Getenv(hpkeAEADEnvironmentVariable))
+}
+
+// parseKeySuite returns the ciphersuite with the named algorithms. Empty names keep the corresponding
+// algorithm of defaultKeySuite.
+func parseKeySuite(kem, kdf, aead string) (keySuite, error) {
+	suite := defaultKeySuite
+	if kem != "" {
+		kemID, ok := keySuiteKEMs[strings.ToUpper(kem)]
+		if !ok && strings.ToUpper(kem) == hybridPostQuantumKEMName {
+			// The vendored HPKE library has no ML-KEM/Kyber implementation, so hybrid post-quantum keys
+			// cannot be generated or used for decapsulation yet.
+			return keySuite{}, fmt.Errorf("HPKE KEM %s is not supported by this build", kem)
+		} else if !ok {
+			return keySuite{}, fmt.Errorf("Unsupported HPKE KEM: %s", kem)
+		}
+		suite.KEMID = kemID
+	}
+	if kdf != "" {
+		kdfID, ok := keySuiteKDFs[strings.ToUpper(kdf)]
+		if !ok {
+			return keySuite{}, fmt.Errorf("Unsupported HPKE KDF: %s", kdf)
+		}
+		suite.KDFID = kdfID
+	}
+	if aead != "" {
+		aeadID, ok := keySuiteAEADs[strings.ToUpper(aead)]
+		if !ok {
+			return keySuite{}, fmt.Errorf("Unsupported HPKE AEAD: %s", aead)
+		}
+		suite.AEADID = aeadID
+	}
+	return suite, nil
+}
+
+// seedLength is the length of the seeds generated for keys of the suite, which matches the KEM's
+// private key size so that the seed carries at least as much entropy as the key.
+func (s keySuite) seedLength() int {
+	suite, err := hpke.AssembleCipherSuite(s.KEMID, s.KDFID, s.AEADID)
+	if err != nil || suite.KEM.PrivateKeySize() < defaultSeedLength {
+		return defaultSeedLength
+	}
+	return suite.KEM.PrivateKeySize()
+}
+
+// zeroize overwrites key material that is no longer needed, so that it does not linger in memory.
+func zeroize(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+// deriveSeed derives a key seed from secret with HKDF-SHA256, using salt and info for domain separation.
+func deriveSeed(secret, salt, info []byte) []byte {
+	suite, err := hpke.AssembleCipherSuite(defaultKeySuite.KEMID, defaultKeySuite.KDFID, defaultKeySuite.AEADID)
+	if err != nil {
+		panic(err)
+	}
+	prk := suite.KDF.Extract(salt, secret)
+	defer zeroize(prk)
+	return suite.KDF.Expand(prk, info, defaultSeedLength)
+}
+
+// gatewayKey is a single key pair held by a RotatingKeyring.
+type gatewayKey struct {
+	seed    []byte
+	suite   keySuite
+	config  ohttp.PrivateConfig
+	gateway ohttp.Gateway
+	// retireAt is the time after which the key is no longer advertised. It is zero while the key is current.
+	retireAt time.Time
+}
+
+// RotatingKeyring is a Keyring that periodically replaces the current key with a freshly generated one.
+// Replaced keys remain valid for decapsulation until the overlap window elapses, so clients holding a
+// cached copy of the previous config keep working while they pick up the new one.
+type RotatingKeyring struct {
+	mu         sync.RWMutex
+	currentID  uint8
+	keys       map[uint8]*gatewayKey
+	newGateway func(ohttp.PrivateConfig) ohttp.Gateway
+	overlap    time.Duration
+	now        func() time.Time
+	onChange   []func()
+	revoked    map[uint8]bool
+	// gracePeriod is how long a key stays decrypt-only after its overlap window.
+	gracePeriod time.Duration
+	// leader reports whether this replica performs scheduled rotations. It is nil for a standalone gateway.
+	leader func() bool
+	// nextRotation is when the current key is next scheduled to be replaced. It is zero without a schedule.
+	nextRotation time.Time
+}
+
+// NewKeyring creates a RotatingKeyring whose current key is derived from seed. The newGateway function
+// builds the gateway used to decapsulate requests for a key, and overlap is how long a replaced key
+// stays valid.
+func NewKeyring(keyID uint8, suite keySuite, seed []byte, newGateway func(ohttp.PrivateConfig) ohttp.Gateway, overlap time.Duration) (*RotatingKeyring, error) {
+	k := &RotatingKeyring{
+		currentID:  keyID,
+		keys:       map[uint8]*gatewayKey{},
+		revoked:    map[uint8]bool{},
+		newGateway: newGateway,
+		overlap:    overlap,
+		now:        time.Now,
+	}
+	key, err := k.newKey(keyID, suite, seed)
+	if err != nil {
+		return nil, err
+	}
+	k.keys[keyID] = key
+	return k, nil
+}
+
+func (k *RotatingKeyring) newKey(keyID uint8, suite keySuite, seed []byte) (*gatewayKey, error) {
+	config, err := ohttp.NewConfigFromSeed(keyID, suite.KEMID, suite.KDFID, suite.AEADID, seed)
+	if err != nil {
+		return nil, err
+	}
+	return &gatewayKey{
+		seed:    append([]byte(nil), seed...),
+		suite:   suite,
+		config:  config,
+		gateway: k.newGateway(config),
+	}, nil
+}
+
+// destroy zeroizes the key's seed. The private key held by the ohttp gateway cannot be reached, so it is
+// left to the garbage collector.
+func (key *gatewayKey) destroy() {
+	zeroize(key.seed)
+}
+
+// destroyKeys zeroizes the seeds of every key before the keys are replaced. The caller must hold the
+// write lock.
+func (k *RotatingKeyring) destroyKeys() {
+	for _, key := range k.keys {
+		key.destroy()
+	}
+}
+
+// OnChange registers fn to be called, without the keyring locked, after the set of keys changes.
+func (k *RotatingKeyring) OnChange(fn func()) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.onChange = append(k.onChange, fn)
+}
+
+func (k *RotatingKeyring) notify() {
+	k.mu.RLock()
+	observers := k.onChange
+	k.mu.RUnlock()
+	for _, fn := range observers {
+		fn()
+	}
+}
+
+// Current returns the public configuration of the current key.
+func (k *RotatingKeyring) Current() ohttp.PublicConfig {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.keys[k.currentID].config.Config()
+}
+
+// Configs returns the current key configuration followed by replaced ones still inside their overlap
+// window, ordered from most to least recently replaced.
+func (k *RotatingKeyring) Configs() []ohttp.PublicConfig {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	retired := []*gatewayKey{}
+	for keyID, key := range k.keys {
+		if keyID != k.currentID && !k.retired(key) {
+			retired = append(retired, key)
+		}
+	}
+	sort.Slice(retired, func(i, j int) bool {
+		return retired[i].retireAt.After(retired[j].retireAt)
+	})
+
+	configs := []ohttp.PublicConfig{k.keys[k.currentID].config.Config()}
+	for _, key := range retired {
+		configs = append(configs, key.config.Config())
+	}
+	return configs
+}
+
+// Gateway returns the gateway for keyID if it is the current key or a replaced key still inside its
+// overlap window or grace period.
+func (k *RotatingKeyring) Gateway(keyID uint8) (ohttp.Gateway, bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	key, ok := k.keys[keyID]
+	if !ok || k.expired(key) {
+		return ohttp.Gateway{}, false
+	}
+	return key.gateway, true
+}
+
+// PrivateConfig returns the private key configuration for keyID, if that key is still valid.
+func (k *RotatingKeyring) PrivateConfig(keyID uint8) (ohttp.PrivateConfig, bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	key, ok := k.keys[keyID]
+	if !ok || k.expired(key) {
+		return ohttp.PrivateConfig{}, false
+	}
+	return key.config, true
+}
+
+// DecryptOnly reports whether keyID is a replaced key past its overlap window but inside its grace period.
+func (k *RotatingKeyring) DecryptOnly(keyID uint8) bool {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	key, ok := k.keys[keyID]
+	return ok && k.retired(key) && !k.expired(key)
+}
+
+// Expiry returns the time after which keyID is no longer advertised, if it is known.
+func (k *RotatingKeyring) Expiry(keyID uint8) (time.Time, bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	key, ok := k.keys[keyID]
+	switch {
+	case !ok:
+		return time.Time{}, false
+	case !key.retireAt.IsZero():
+		return key.retireAt, true
+	case !k.nextRotation.IsZero():
+		return k.nextRotation.Add(k.overlap), true
+	default:
+		return time.Time{}, false
+	}
+}
+
+// setNextRotation records when the current key is next scheduled to be replaced.
+func (k *RotatingKeyring) setNextRotation(t time.Time) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.nextRotation = t
+}
+
+// SetGracePeriod keeps replaced keys decrypt-only for gracePeriod after their overlap window elapses.
+func (k *RotatingKeyring) SetGracePeriod(gracePeriod time.Duration) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.gracePeriod = gracePeriod
+}
+
+// retired reports whether the key's overlap window has elapsed, so that it is no longer advertised.
+func (k *RotatingKeyring) retired(key *gatewayKey) bool {
+	return !key.retireAt.IsZero() && !k.now().Before(key.retireAt)
+}
+
+// expired reports whether the key's grace period has elapsed, so that it may no longer be used.
+func (k *RotatingKeyring) expired(key *gatewayKey) bool {
+	return !key.retireAt.IsZero() && !k.now().Before(key.retireAt.Add(k.gracePeriod))
+}
+
+// nextKeyID returns the first key ID after the current one that is neither held by the keyring nor revoked.
+func (k *RotatingKeyring) nextKeyID() (uint8, error) {
+	for i := 1; i < 256; i++ {
+		keyID := k.currentID + uint8(i)
+		if _, ok := k.keys[keyID]; !ok && !k.revoked[keyID] {
+			return keyID, nil
+		}
+	}
+	return 0, fmt.Errorf("No free key ID available")
+}
+
+// prune drops keys whose overlap window has elapsed. The caller must hold the write lock.
+func (k *RotatingKeyring) prune() {
+	for keyID, key := range k.keys {
+		if k.expired(key) {
+			key.destroy()
+			delete(k.keys, keyID)
+		}
+	}
+}
+
+// Rotate generates a new key with the same ciphersuite as the current one, makes it current, and
+// schedules the previous key for retirement once the overlap window elapses.
+func (k *RotatingKeyring) Rotate() (ohttp.PublicConfig, error) {
+	return k.RotateWithOverlap(k.overlap)
+}
+
+// RotateWithOverlap is like Rotate, but retires the previous key after the given overlap instead of
+// the keyring's default. A zero overlap retires the previous key immediately.
+func (k *RotatingKeyring) RotateWithOverlap(overlap time.Duration) (ohttp.PublicConfig, error) {
+	k.mu.Lock()
+	config, err := k.rotate(overlap)
+	k.mu.Unlock()
+	if err != nil {
+		return ohttp.PublicConfig{}, err
+	}
+	k.notify()
+	return config, nil
+}
+
+// rotate replaces the current key with a freshly generated one and retires the previous key after
+// overlap. The caller must hold the write lock.
+func (k *RotatingKeyring) rotate(overlap time.Duration) (ohttp.PublicConfig, error) {
+	seed := make([]byte, k.keys[k.currentID].suite.seedLength())
+	defer zeroize(seed)
+	if _, err := rand.Read(seed); err != nil {
+		return ohttp.PublicConfig{}, err
+	}
+
+	k.prune()
+	keyID, err := k.nextKeyID()
+	if err != nil {
+		return ohttp.PublicConfig{}, err
+	}
+	return k.installCurrentKey(keyID, seed, overlap)
+}
+
+// RotateToSeed is like Rotate, but derives the new key pair from seed rather than generating it.
+func (k *RotatingKeyring) RotateToSeed(seed []byte) (ohttp.PublicConfig, error) {
+	return k.rotateToSeed(seed, k.overlap)
+}
+
+func (k *RotatingKeyring) rotateToSeed(seed []byte, overlap time.Duration) (ohttp.PublicConfig, error) {
+	config, err := k.replaceCurrentKey(seed, overlap)
+	if err != nil {
+		return ohttp.PublicConfig{}, err
+	}
+	k.notify()
+	return config, nil
+}
+
+func (k *RotatingKeyring) replaceCurrentKey(seed []byte, overlap time.Duration) (ohttp.PublicConfig, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.prune()
+	keyID, err := k.nextKeyID()
+	if err != nil {
+		return ohttp.PublicConfig{}, err
+	}
+	return k.installCurrentKey(keyID, seed, overlap)
+}
+
+// rotateToKeyID is like rotateToSeed, but installs the new key under keyID rather than the next free
+// key ID. It fails if keyID is revoked or still held by a valid key.
+func (k *RotatingKeyring) rotateToKeyID(keyID uint8, seed []byte, overlap time.Duration) (ohttp.PublicConfig, error) {
+	config, err := k.replaceCurrentKeyWithID(keyID, seed, overlap)
+	if err != nil {
+		return ohttp.PublicConfig{}, err
+	}
+	k.notify()
+	return config, nil
+}
+
+func (k *RotatingKeyring) replaceCurrentKeyWithID(keyID uint8, seed []byte, overlap time.Duration) (ohttp.PublicConfig, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.prune()
+	if _, ok := k.keys[keyID]; ok {
+		return ohttp.PublicConfig{}, fmt.Errorf("Key ID %d is still in use", keyID)
+	}
+	if k.revoked[keyID] {
+		return ohttp.PublicConfig{}, fmt.Errorf("Key ID %d is revoked", keyID)
+	}
+	return k.installCurrentKey(keyID, seed, overlap)
+}
+
+// installCurrentKey makes a key derived from seed current under keyID and retires the previous key
+// after overlap. The caller must hold the write lock.
+func (k *RotatingKeyring) installCurrentKey(keyID uint8, seed []byte, overlap time.Duration) (ohttp.PublicConfig, error) {
+	key, err := k.newKey(keyID, k.keys[k.currentID].suite, seed)
+	if err != nil {
+		return ohttp.PublicConfig{}, err
+	}
+
+	k.keys[k.currentID].retireAt = k.now().Add(overlap)
+	k.keys[keyID] = key
+	k.currentID = keyID
+
+	return key.config.Config(), nil
+}
+
+// Revoked reports whether keyID has been revoked.
+func (k *RotatingKeyring) Revoked(keyID uint8) bool {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.revoked[keyID]
+}
+
+// errUnknownKeyID is returned when revoking a key ID that the keyring neither holds nor has revoked.
+var errUnknownKeyID = errors.New("Unknown key ID")
+
+// Revoke removes keyID from the keyring immediately and refuses to reuse the ID for new keys.
+// Revoking the current key first rotates to a new one, in the same critical section so that no other
+// change can make the revoked key current again. Revoking a revoked key ID does nothing.
+func (k *RotatingKeyring) Revoke(keyID uint8) error {
+	k.mu.Lock()
+	if k.revoked[keyID] {
+		k.mu.Unlock()
+		return nil
+	}
+	key, ok := k.keys[keyID]
+	if !ok {
+		k.mu.Unlock()
+		return errUnknownKeyID
+	}
+	if keyID == k.currentID {
+		if _, err := k.rotate(0); err != nil {
+			k.mu.Unlock()
+			return err
+		}
+	}
+	key.destroy()
+	delete(k.keys, keyID)
+	k.revoked[keyID] = true
+	k.mu.Unlock()
+
+	k.notify()
+	return nil
+}
+
+// reserveRevokedKeyID records keyID as revoked without a key being held for it, so that the ID of a key
+// revoked before the gateway started is never reused. A held key is revoked as with Revoke.
+func (k *RotatingKeyring) reserveRevokedKeyID(keyID uint8) error {
+	k.mu.Lock()
+	_, held := k.keys[keyID]
+	if !held {
+		k.revoked[keyID] = true
+	}
+	k.mu.Unlock()
+	if held {
+		return k.Revoke(keyID)
+	}
+	k.notify()
+	return nil
+}
+
+// Import replaces the keyring's keys with externally generated ones. Each config must be matched by a
+// seed in seeds, keyed by key ID, from which it derives. The first config becomes the current key, and
+// the others are retired after the overlap window.
+func (k *RotatingKeyring) Import(configs []ohttp.PublicConfig, seeds map[uint8][]byte) error {
+	if len(configs) == 0 {
+		return fmt.Errorf("No key configs to import")
+	}
+
+	keys := map[uint8]*gatewayKey{}
+	for _, config := range configs {
+		if _, ok := keys[config.ID]; ok {
+			return fmt.Errorf("Duplicate key ID %d", config.ID)
+		}
+		seed, ok := seeds[config.ID]
+		if !ok {
+			return fmt.Errorf("No seed for key %d", config.ID)
+		}
+		if len(config.Suites) == 0 {
+			return fmt.Errorf("Key %d has no cipher suite", config.ID)
+		}
+		suite := keySuite{
+			KEMID:  config.KEMID,
+			KDFID:  config.Suites[0].KDFID,
+			AEADID: config.Suites[0].AEADID,
+		}
+		key, err := k.newKey(config.ID, suite, seed)
+		if err != nil {
+			return err
+		}
+		if !key.config.Config().IsEqual(config) {
+			return fmt.Errorf("Seed for key %d does not match its config", config.ID)
+		}
+		keys[config.ID] = key
+	}
+
+	k.mu.Lock()
+	for _, config := range configs {
+		if k.revoked[config.ID] {
+			k.mu.Unlock()
+			return fmt.Errorf("Key ID %d is revoked", config.ID)
+		}
+	}
+	for _, config := range configs[1:] {
+		keys[config.ID].retireAt = k.now().Add(k.overlap)
+	}
+	k.destroyKeys()
+	k.keys = keys
+	k.currentID = configs[0].ID
+	k.mu.Unlock()
+
+	k.notify()
+	return nil
+}
+
+// storedKey is the serialized form of a gatewayKey.
+type storedKey struct {
+	KeyID    uint8     `json:"key_id"`
+	KEMID    uint16    `json:"kem_id"`
+	KDFID    uint16    `json:"kdf_id"`
+	AEADID   uint16    `json:"aead_id"`
+	Seed     []byte    `json:"seed"`
+	RetireAt time.Time `json:"retire_at"`
+}
+
+// storedKeyring is the serialized form of a RotatingKeyring's keys.
+type storedKeyring struct {
+	CurrentID uint8       `json:"current_id"`
+	Keys      []storedKey `json:"keys"`
+	Revoked   []uint8     `json:"revoked,omitempty"`
+}
+
+// Snapshot returns the keyring's valid keys, including copies of their seeds, for persistence. Callers
+// should zeroize the seeds once they are done with the snapshot.
+func (k *RotatingKeyring) Snapshot() storedKeyring {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	snapshot := storedKeyring{CurrentID: k.currentID}
+	for keyID, key := range k.keys {
+		if k.expired(key) {
+			continue
+		}
+		snapshot.Keys = append(snapshot.Keys, storedKey{
+			KeyID:    keyID,
+			KEMID:    uint16(key.suite.KEMID),
+			KDFID:    uint16(key.suite.KDFID),
+			AEADID:   uint16(key.suite.AEADID),
+			Seed:     append([]byte(nil), key.seed...),
+			RetireAt: key.retireAt,
+		})
+	}
+	sort.Slice(snapshot.Keys, func(i, j int) bool {
+		return snapshot.Keys[i].KeyID < snapshot.Keys[j].KeyID
+	})
+	for keyID := range k.revoked {
+		snapshot.Revoked = append(snapshot.Revoked, keyID)
+	}
+	sort.Slice(snapshot.Revoked, func(i, j int) bool {
+		return snapshot.Revoked[i] < snapshot.Revoked[j]
+	})
+	return snapshot
+}
+
+// keyState describes a key held by a RotatingKeyring, without its secret material.
+type keyState struct {
+	config   ohttp.PublicConfig
+	current  bool
+	retireAt time.Time
+}
+
+// keyStates returns the state of every valid key, ordered by key ID, and the revoked key IDs.
+func (k *RotatingKeyring) keyStates() ([]keyState, map[uint8]bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	states := []keyState{}
+	for keyID, key := range k.keys {
+		if k.expired(key) {
+			continue
+		}
+		states = append(states, keyState{
+			config:   key.config.Config(),
+			current:  keyID == k.currentID,
+			retireAt: key.retireAt,
+		})
+	}
+	sort.Slice(states, func(i, j int) bool {
+		return states[i].config.ID < states[j].config.ID
+	})
+	revoked := map[uint8]bool{}
+	for keyID := range k.revoked {
+		revoked[keyID] = true
+	}
+	return states, revoked
+}
+
+// zeroizeSnapshot zeroizes the seeds held by snapshot.
+func zeroizeSnapshot(snapshot storedKeyring) {
+	for _, key := range snapshot.Keys {
+		zeroize(key.Seed)
+	}
+}
+
+// Restore replaces the keyring's keys with those from a snapshot. Keys whose overlap window has
+// elapsed in the meantime are dropped.
+func (k *RotatingKeyring) Restore(snapshot storedKeyring) error {
+	keys := map[uint8]*gatewayKey{}
+	for _, stored := range snapshot.Keys {
+		suite := keySuite{
+			KEMID:  hpke.KEMID(stored.KEMID),
+			KDFID:  hpke.KDFID(stored.KDFID),
+			AEADID: hpke.AEADID(stored.AEADID),
+		}
+		key, err := k.newKey(stored.KeyID, suite, stored.Seed)
+		if err != nil {
+			return err
+		}
+		key.retireAt = stored.RetireAt
+		if !k.expired(key) {
+			keys[stored.KeyID] = key
+		}
+	}
+	if current, ok := keys[snapshot.CurrentID]; !ok || !current.retireAt.IsZero() {
+		return fmt.Errorf("Snapshot has no current key")
+	}
+
+	revoked := map[uint8]bool{}
+	for _, keyID := range snapshot.Revoked {
+		revoked[keyID] = true
+	}
+
+	k.mu.Lock()
+	k.destroyKeys()
+	k.keys = keys
+	k.currentID = snapshot.CurrentID
+	k.revoked = revoked
+	k.mu.Unlock()
+
+	k.notify()
+	return nil
+}
+
+// SetRotationLeader restricts scheduled rotations to when leader returns true, so that only one of
+// several replicas sharing keys rotates them.
+func (k *RotatingKeyring) SetRotationLeader(leader func() bool) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.leader = leader
+}
+
+// RotateEvery rotates the keyring each interval until the process exits.
+func (k *RotatingKeyring) RotateEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	k.setNextRotation(k.now().Add(interval))
+	for range ticker.C {
+		k.setNextRotation(k.now().Add(interval))
+		k.mu.RLock()
+		leader := k.leader
+		k.mu.RUnlock()
+		if leader != nil && !leader() {
+			continue
+		}
+
+		config, err := k.Rotate()
+		if err != nil {
+			log.Printf("Key rotation failed: %s", err)
+			continue
+		}
+		log.Printf("Rotated gateway key, current key ID is now %d", config.ID)
+	}
+}
@@ -0,0 +1,247 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/chris-wood/ohttp-go"
+	"github.com/cisco/go-hpke"
+)
+
+func TestKeyringRotation(t *testing.T) {
+	keyring := createKeyring(t)
+	now := time.Now()
+	keyring.now = func() time.Time { return now }
+
+	config, err := keyring.Rotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.ID == FIXED_KEY_ID {
+		t.Fatal("Rotation did not allocate a new key ID")
+	}
+	if current := keyring.Current(); !current.IsEqual(config) {
+		t.Fatal("Rotated key is not the current key")
+	}
+
+	// The retired key stays valid during the overlap window
+	if _, ok := keyring.Gateway(FIXED_KEY_ID); !ok {
+		t.Fatal("Retired key rejected inside the overlap window")
+	}
+	if _, ok := keyring.Gateway(config.ID); !ok {
+		t.Fatal("Current key rejected")
+	}
+
+	// ... and is dropped once the window closes
+	now = now.Add(keyring.overlap)
+	if _, ok := keyring.Gateway(FIXED_KEY_ID); ok {
+		t.Fatal("Retired key accepted after the overlap window")
+	}
+	if _, ok := keyring.Gateway(config.ID); !ok {
+		t.Fatal("Current key rejected after the overlap window")
+	}
+}
+
+func TestKeyringRotationSkipsKeyIDsInUse(t *testing.T) {
+	keyring := createKeyring(t)
+
+	seen := map[uint8]bool{FIXED_KEY_ID: true}
+	for i := 0; i < 255; i++ {
+		config, err := keyring.Rotate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seen[config.ID] {
+			t.Fatalf("Key ID %d reused while still in the overlap window", config.ID)
+		}
+		seen[config.ID] = true
+	}
+
+	if _, err := keyring.Rotate(); err == nil {
+		t.Fatal("Rotation succeeded with every key ID in use")
+	}
+}
+
+func TestKeyringRevocation(t *testing.T) {
+	keyring := createKeyring(t)
+
+	if err := keyring.Revoke(FIXED_KEY_ID); err != nil {
+		t.Fatal(err)
+	}
+	if !keyring.Revoked(FIXED_KEY_ID) {
+		t.Fatal("Revoked key not reported as revoked")
+	}
+	if _, ok := keyring.Gateway(FIXED_KEY_ID); ok {
+		t.Fatal("Revoked key still valid")
+	}
+	current := keyring.Current()
+	if current.ID == FIXED_KEY_ID {
+		t.Fatal("Revoking the current key did not rotate")
+	}
+	for _, config := range keyring.Configs() {
+		if config.ID == FIXED_KEY_ID {
+			t.Fatal("Revoked key still served")
+		}
+	}
+
+	// Revoked key IDs are never reallocated, and survive a snapshot round trip
+	for i := 0; i < 253; i++ {
+		config, err := keyring.RotateWithOverlap(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if config.ID == FIXED_KEY_ID {
+			t.Fatal("Rotation reused a revoked key ID")
+		}
+	}
+
+	restored := createKeyring(t)
+	if err := restored.Restore(keyring.Snapshot()); err != nil {
+		t.Fatal(err)
+	}
+	if !restored.Revoked(FIXED_KEY_ID) {
+		t.Fatal("Revocation lost in snapshot")
+	}
+
+	// Key IDs that were never held are not revoked
+	if err := createKeyring(t).Revoke(FIXED_KEY_ID + 1); err != errUnknownKeyID {
+		t.Fatalf("Expected an unknown key ID error, got %v", err)
+	}
+	if err := keyring.Revoke(FIXED_KEY_ID); err != nil {
+		t.Fatalf("Expected revoking a revoked key ID to succeed, got %v", err)
+	}
+}
+
+func TestKeyringConcurrentRevocation(t *testing.T) {
+	keyring := createKeyring(t)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				if err := keyring.Revoke(keyring.Current().ID); err != nil && err != errUnknownKeyID {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				if _, err := keyring.RotateWithOverlap(0); err != nil {
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	// The current key is never one that was revoked
+	if current := keyring.Current(); keyring.Revoked(current.ID) {
+		t.Fatalf("Current key %d is revoked", current.ID)
+	}
+}
+
+func TestKeySuiteFromEnvironment(t *testing.T) {
+	t.Setenv(hpkeKEMEnvironmentVariable, "p256")
+	t.Setenv(hpkeAEADEnvironmentVariable, "ChaCha20Poly1305")
+	suite, err := keySuiteFromEnvironment()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if suite.KEMID != hpke.DHKEM_P256 || suite.KDFID != hpke.KDF_HKDF_SHA256 || suite.AEADID != hpke.AEAD_CHACHA20POLY1305 {
+		t.Fatalf("Unexpected suite %+v", suite)
+	}
+
+	keyring, err := NewKeyring(FIXED_KEY_ID, suite, make([]byte, defaultSeedLength), ohttp.NewDefaultGateway, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := keyring.Current()
+	if config.KEMID != suite.KEMID || len(config.Suites) != 1 || config.Suites[0].KDFID != suite.KDFID || config.Suites[0].AEADID != suite.AEADID {
+		t.Fatal("Config does not advertise the selected suite")
+	}
+
+	// Rotated keys keep the suite
+	if config, err = keyring.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	if config.KEMID != suite.KEMID || config.Suites[0].AEADID != suite.AEADID {
+		t.Fatal("Rotated config does not advertise the selected suite")
+	}
+
+	client := ohttp.NewDefaultClient(config)
+	req, _, err := client.EncapsulateRequest([]byte{0xCA, 0xFE})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gateway, _ := keyring.Gateway(config.ID)
+	if _, _, err := gateway.DecapsulateRequest(req); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv(hpkeKEMEnvironmentVariable, "X25519Kyber768")
+	if _, err := keySuiteFromEnvironment(); err == nil {
+		t.Fatal("Hybrid post-quantum KEM accepted without support")
+	}
+
+	t.Setenv(hpkeKEMEnvironmentVariable, "SIKE503")
+	if _, err := keySuiteFromEnvironment(); err == nil {
+		t.Fatal("Unsupported KEM accepted")
+	}
+}
+
+func TestKeyringGracePeriod(t *testing.T) {
+	keyring := createKeyring(t)
+	keyring.SetGracePeriod(time.Hour)
+	now := time.Now()
+	keyring.now = func() time.Time { return now }
+
+	config, err := keyring.Rotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keyring.DecryptOnly(FIXED_KEY_ID) {
+		t.Fatal("Retired key decrypt-only inside the overlap window")
+	}
+
+	// Past the overlap window the key is no longer advertised but still decapsulates
+	now = now.Add(keyring.overlap)
+	if _, ok := keyring.Gateway(FIXED_KEY_ID); !ok {
+		t.Fatal("Retired key rejected inside the grace period")
+	}
+	if !keyring.DecryptOnly(FIXED_KEY_ID) {
+		t.Fatal("Retired key not decrypt-only inside the grace period")
+	}
+	if configs := keyring.Configs(); len(configs) != 1 || !configs[0].IsEqual(config) {
+		t.Fatal("Decrypt-only key still advertised")
+	}
+
+	now = now.Add(time.Hour)
+	if _, ok := keyring.Gateway(FIXED_KEY_ID); ok {
+		t.Fatal("Retired key accepted after the grace period")
+	}
+}
+
+func TestKeyringZeroizesDroppedSeeds(t *testing.T) {
+	keyring := createKeyring(t)
+	retired := keyring.keys[FIXED_KEY_ID]
+
+	if _, err := keyring.RotateWithOverlap(0); err != nil {
+		t.Fatal(err)
+	}
+	// The next rotation prunes the expired key
+	if _, err := keyring.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range retired.seed {
+		if b != 0 {
+			t.Fatal("Seed of a dropped key was not zeroized")
+		}
+	}
+}
@@ -0,0 +1,294 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const (
+	keystoreVersion = 1
+	keystoreKDF     = "pbkdf2-sha256"
+
+	// PBKDF2 iteration count for passphrase-protected keystores
+	keystoreIterations = 600000
+	keystoreSaltLength = 16
+	keystoreKeyLength  = 32
+
+	// Iteration counts accepted when opening a keystore, so that a tampered keystore can neither stall
+	// startup nor weaken the derivation
+	keystoreMinIterations = 100000
+	keystoreMaxIterations = 10000000
+)
+
+// keystoreAAD binds the ciphertext to the keystore format.
+var keystoreAAD = []byte("ohttp-gateway keystore v1")
+
+// keystoreFile is the on-disk encoding of an encrypted keystore. The keyring snapshot is sealed with
+// AES-256-GCM under a data key that is either derived from a passphrase (Salt and Iterations are set)
+// or randomly generated and wrapped with AWS KMS (WrappedKey is set).
+type keystoreFile struct {
+	Version    int    `json:"version"`
+	KDF        string `json:"kdf,omitempty"`
+	Iterations int    `json:"iterations,omitempty"`
+	Salt       []byte `json:"salt,omitempty"`
+	WrappedKey []byte `json:"wrapped_key,omitempty"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// Keystore persists the keys of a RotatingKeyring.
+type Keystore interface {
+	// Attach restores keyring from the keystore, and keeps the keystore up to date as the keys change.
+	Attach(keyring *RotatingKeyring) error
+}
+
+// keystoreCipher encrypts keyring snapshots. Exactly one of passphrase and kms is set.
+type keystoreCipher struct {
+	passphrase []byte
+	kms        *awsKMSClient
+	kmsKeyID   string
+}
+
+// FileKeystore persists keyring snapshots to an encrypted file, so rotated keys survive restarts and
+// retired keys can still decapsulate in-flight requests after a crash.
+type FileKeystore struct {
+	path string
+	keystoreCipher
+
+	// saveMu serializes saves, so that the file always ends up with the latest snapshot
+	saveMu sync.Mutex
+}
+
+// keystoreFromEnvironment returns the keystore configured by KEYSTORE_PATH, or nil if none is. A
+// redis:// or rediss:// URL selects a RedisKeystore, and anything else is a file path.
+func keystoreFromEnvironment() (Keystore, error) {
+	path := os.Getenv(keystorePathEnvironmentVariable)
+	if path == "" {
+		return nil, nil
+	}
+
+	var cipher keystoreCipher
+	if passphrase := os.Getenv(keystorePassphraseEnvironmentVariable); passphrase != "" {
+		cipher.passphrase = []byte(passphrase)
+	} else if kmsKeyID := os.Getenv(keystoreKMSKeyEnvironmentVariable); kmsKeyID != "" {
+		region, err := awsRegion()
+		if err != nil {
+			return nil, err
+		}
+		cipher.kms = newAWSKMSClient(region)
+		cipher.kmsKeyID = kmsKeyID
+	} else {
+		return nil, fmt.Errorf("%s or %s must be set to use a keystore", keystorePassphraseEnvironmentVariable, keystoreKMSKeyEnvironmentVariable)
+	}
+
+	if strings.HasPrefix(path, "redis://") || strings.HasPrefix(path, "rediss://") {
+		return newRedisKeystore(path, cipher)
+	}
+	return &FileKeystore{path: path, keystoreCipher: cipher}, nil
+}
+
+func sealKeystore(key []byte, plaintext []byte, file *keystoreFile) error {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+	file.Nonce = make([]byte, aead.NonceSize())
+	if _, err := rand.Read(file.Nonce); err != nil {
+		return err
+	}
+	file.Ciphertext = aead.Seal(nil, file.Nonce, plaintext, keystoreAAD)
+	return nil
+}
+
+func openKeystore(key []byte, file keystoreFile) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Open(nil, file.Nonce, file.Ciphertext, keystoreAAD)
+}
+
+// seal encrypts snapshot and encodes it as a keystoreFile. The seeds in snapshot, and every intermediate
+// copy of them, are zeroized.
+func (c keystoreCipher) seal(snapshot storedKeyring) ([]byte, error) {
+	plaintext, err := json.Marshal(snapshot)
+	zeroizeSnapshot(snapshot)
+	if err != nil {
+		return nil, err
+	}
+	defer zeroize(plaintext)
+
+	file := keystoreFile{Version: keystoreVersion}
+	key := make([]byte, keystoreKeyLength)
+	defer func() { zeroize(key) }()
+	if c.kms != nil {
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		if file.WrappedKey, err = c.kms.Encrypt(c.kmsKeyID, key); err != nil {
+			return nil, err
+		}
+	} else {
+		file.KDF = keystoreKDF
+		file.Iterations = keystoreIterations
+		file.Salt = make([]byte, keystoreSaltLength)
+		if _, err := rand.Read(file.Salt); err != nil {
+			return nil, err
+		}
+		key = pbkdf2.Key(c.passphrase, file.Salt, file.Iterations, keystoreKeyLength, sha256.New)
+	}
+	if err := sealKeystore(key, plaintext, &file); err != nil {
+		return nil, err
+	}
+	return json.Marshal(file)
+}
+
+// open decodes and decrypts a keystoreFile produced by seal.
+func (c keystoreCipher) open(encoded []byte) (storedKeyring, error) {
+	var file keystoreFile
+	if err := json.Unmarshal(encoded, &file); err != nil {
+		return storedKeyring{}, err
+	}
+	if file.Version != keystoreVersion {
+		return storedKeyring{}, fmt.Errorf("Unsupported keystore version %d", file.Version)
+	}
+
+	var key []byte
+	var err error
+	if file.WrappedKey != nil {
+		if c.kms == nil {
+			return storedKeyring{}, fmt.Errorf("Keystore is protected by KMS but no KMS key is configured")
+		}
+		if key, err = c.kms.Decrypt(file.WrappedKey); err != nil {
+			return storedKeyring{}, err
+		}
+	} else {
+		if c.passphrase == nil {
+			return storedKeyring{}, fmt.Errorf("Keystore is protected by a passphrase but none is configured")
+		}
+		if file.KDF != keystoreKDF {
+			return storedKeyring{}, fmt.Errorf("Unsupported keystore KDF %q", file.KDF)
+		}
+		if file.Iterations < keystoreMinIterations || file.Iterations > keystoreMaxIterations {
+			return storedKeyring{}, fmt.Errorf("Keystore iteration count %d is outside [%d, %d]", file.Iterations, keystoreMinIterations, keystoreMaxIterations)
+		}
+		key = pbkdf2.Key(c.passphrase, file.Salt, file.Iterations, keystoreKeyLength, sha256.New)
+	}
+
+	plaintext, err := openKeystore(key, file)
+	zeroize(key)
+	if err != nil {
+		return storedKeyring{}, fmt.Errorf("Failed to decrypt keystore: %s", err)
+	}
+	defer zeroize(plaintext)
+
+	var snapshot storedKeyring
+	if err := json.Unmarshal(plaintext, &snapshot); err != nil {
+		return storedKeyring{}, err
+	}
+	return snapshot, nil
+}
+
+// Save encrypts snapshot and atomically replaces the keystore file with it.
+func (s *FileKeystore) Save(snapshot storedKeyring) error {
+	s.saveMu.Lock()
+	defer s.saveMu.Unlock()
+	return s.save(snapshot)
+}
+
+// saveKeyring saves a snapshot of keyring. The snapshot is only taken once the previous save is done, so
+// that a save of an older change that finishes last can not overwrite a newer one.
+func (s *FileKeystore) saveKeyring(keyring *RotatingKeyring) error {
+	s.saveMu.Lock()
+	defer s.saveMu.Unlock()
+	return s.save(keyring.Snapshot())
+}
+
+func (s *FileKeystore) save(snapshot storedKeyring) error {
+	encoded, err := s.seal(snapshot)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(encoded); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+// Load reads and decrypts the keystore. It returns false if the keystore does not exist yet.
+func (s *FileKeystore) Load() (storedKeyring, bool, error) {
+	encoded, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return storedKeyring{}, false, nil
+	} else if err != nil {
+		return storedKeyring{}, false, err
+	}
+
+	snapshot, err := s.open(encoded)
+	if err != nil {
+		return storedKeyring{}, false, err
+	}
+	return snapshot, true, nil
+}
+
+// Attach restores keyring from the keystore if it holds keys, or seeds the keystore with the
+// keyring's keys otherwise, and then saves the keyring whenever its keys change.
+func (s *FileKeystore) Attach(keyring *RotatingKeyring) error {
+	snapshot, ok, err := s.Load()
+	if err != nil {
+		return err
+	}
+	if ok {
+		err := keyring.Restore(snapshot)
+		zeroizeSnapshot(snapshot)
+		if err != nil {
+			return err
+		}
+		log.Printf("Restored %d gateway keys from keystore %s", len(snapshot.Keys), s.path)
+	} else if err := s.saveKeyring(keyring); err != nil {
+		return err
+	}
+
+	keyring.OnChange(func() {
+		if err := s.saveKeyring(keyring); err != nil {
+			log.Printf("Failed to save keystore %s: %s", s.path, err)
+		}
+	})
+	return nil
+}
@@ -0,0 +1,106 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestKeystoreIterationBounds(t *testing.T) {
+	keystore := &FileKeystore{
+		path:           filepath.Join(t.TempDir(), "keystore.json"),
+		keystoreCipher: keystoreCipher{passphrase: []byte("correct horse battery staple")},
+	}
+	if err := keystore.Save(createKeyring(t).Snapshot()); err != nil {
+		t.Fatal(err)
+	}
+	encoded, err := ioutil.ReadFile(keystore.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, iterations := range []int{1, keystoreMaxIterations + 1} {
+		var file keystoreFile
+		if err := json.Unmarshal(encoded, &file); err != nil {
+			t.Fatal(err)
+		}
+		file.Iterations = iterations
+		tampered, _ := json.Marshal(file)
+		if err := ioutil.WriteFile(keystore.path, tampered, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := keystore.Load(); err == nil {
+			t.Fatalf("Expected a keystore with %d iterations to be rejected", iterations)
+		}
+	}
+}
+
+func TestFileKeystoreRoundTrip(t *testing.T) {
+	keystore := &FileKeystore{
+		path:           filepath.Join(t.TempDir(), "keystore.json"),
+		keystoreCipher: keystoreCipher{passphrase: []byte("correct horse battery staple")},
+	}
+
+	keyring := createKeyring(t)
+	if err := keystore.Attach(keyring); err != nil {
+		t.Fatal(err)
+	}
+	retired := keyring.Current()
+	// Rotating saves the keystore through the OnChange hook
+	current, err := keyring.Rotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restored := createKeyring(t)
+	if err := keystore.Attach(restored); err != nil {
+		t.Fatal(err)
+	}
+	if !restored.Current().IsEqual(current) {
+		t.Fatal("Restored keyring has a different current key")
+	}
+	if _, ok := restored.Gateway(retired.ID); !ok {
+		t.Fatal("Restored keyring lost the retired key")
+	}
+
+	// Keys whose overlap window elapsed while the gateway was down are dropped
+	expired := createKeyring(t)
+	expired.now = func() time.Time { return time.Now().Add(2 * keyring.overlap) }
+	if err := keystore.Attach(expired); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := expired.Gateway(retired.ID); ok {
+		t.Fatal("Restored keyring kept an expired key")
+	}
+
+	// Concurrent rotations leave the keystore with the latest keys
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := keyring.Rotate(); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	snapshot, _, err := keystore.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snapshot.CurrentID != keyring.Current().ID {
+		t.Fatalf("Keystore holds key %d instead of the current key %d", snapshot.CurrentID, keyring.Current().ID)
+	}
+
+	wrongPassphrase := &FileKeystore{path: keystore.path, keystoreCipher: keystoreCipher{passphrase: []byte("hunter2")}}
+	if _, _, err := wrongPassphrase.Load(); err == nil {
+		t.Fatal("Keystore decrypted with the wrong passphrase")
+	}
+}
@@ -0,0 +1,147 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// newListenerServer returns the server of a gateway listener at addr, which serves TLS with tlsConfig if it
+// is not nil. When serving TLS, it negotiates
+// HTTP/2 with clients that support it unless http2 is false, so that a relay can multiplex the requests
+// of many clients over one connection. HTTP/2 flow control paces each encapsulated request body as the
+// handler reads it, and chunked requests are read while their response is written.
+func newListenerServer(addr string, handler http.Handler, tlsConfig *tls.Config, http2 bool) *http.Server {
+	server := &http.Server{Addr: addr, Handler: handler, TLSConfig: tlsConfig, MaxHeaderBytes: maxHeaderBytes}
+	if !http2 {
+		// A non-nil TLSNextProto disables the HTTP/2 support of the standard library
+		server.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+	}
+	return server
+}
+
+// serve serves server with TLS if it has a TLS config, and over plain TCP otherwise.
+func serve(server *http.Server) error {
+	addr := server.Addr
+	if addr == "" {
+		addr = ":http"
+		if server.TLSConfig != nil {
+			addr = ":https"
+		}
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return serveListener(server, listener)
+}
+
+// serveListener serves server on listener, with TLS if the server has a TLS config. The framing of
+// HTTP/1.1 requests, whether relays send them directly over TLS or reverse proxies forward them over plain
+// TCP, is validated before the server parses them.
+func serveListener(server *http.Server, listener net.Listener) error {
+	if server.TLSConfig == nil {
+		return server.Serve(framingListener{listener})
+	}
+	// The server only negotiates HTTP/2 on connections it does not accept through its own TLS listener if
+	// the TLS config advertises it, unless TLSNextProto disabled HTTP/2
+	config := server.TLSConfig.Clone()
+	if server.TLSNextProto == nil && !containsString(config.NextProtos, "h2") {
+		config.NextProtos = append(config.NextProtos, "h2")
+	}
+	if !containsString(config.NextProtos, "http/1.1") {
+		config.NextProtos = append(config.NextProtos, "http/1.1")
+	}
+	server.TLSConfig = config
+	withTLSConnectionState(server)
+	return server.Serve(newTLSFramingListener(listener, config))
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// defaultUnixSocketMode lets the reverse proxy connect to the socket if it runs as the same user or group
+const defaultUnixSocketMode os.FileMode = 0660
+
+// listenUnix listens on the Unix domain socket at path with the permissions mode. A socket left behind at
+// path by a previous process is replaced, but any other file is not.
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// parseUnixSocketMode parses the octal permissions of a Unix domain socket, such as "0660".
+func parseUnixSocketMode(value string) (os.FileMode, error) {
+	if value == "" {
+		return defaultUnixSocketMode, nil
+	}
+	mode, err := strconv.ParseUint(value, 8, 32)
+	if err != nil || mode&^uint64(os.ModePerm) != 0 {
+		return 0, fmt.Errorf("Invalid socket permissions %q", value)
+	}
+	return os.FileMode(mode), nil
+}
+
+// serverTLSConfig loads the comma-separated certificate (chain) files with the private key files at the
+// same positions. With several certificates, each connection is served the first certificate valid for
+// the server name of its SNI extension, or the first certificate if none is.
+func serverTLSConfig(certFiles, keyFiles string) (*tls.Config, error) {
+	certs, keys := splitList(certFiles), splitList(keyFiles)
+	if len(certs) != len(keys) {
+		return nil, fmt.Errorf("%d certificate files but %d key files", len(certs), len(keys))
+	}
+	config := &tls.Config{}
+	for i := range certs {
+		cert, err := tls.LoadX509KeyPair(certs[i], keys[i])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid certificate %s: %s", certs[i], err)
+		}
+		config.Certificates = append(config.Certificates, cert)
+	}
+	return config, nil
+}
+
+// httpsRedirectHandler permanently redirects plain HTTP requests to the same URL over HTTPS on port. The
+// redirect preserves the method, so that encapsulated requests are not turned into GET requests.
+func httpsRedirectHandler(port string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = strings.Trim(r.Host, "[]")
+		}
+		if port != "443" {
+			host = net.JoinHostPort(host, port)
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+}
@@ -0,0 +1,212 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/chris-wood/ohttp-go"
+)
+
+func TestListenerServerHTTP2(t *testing.T) {
+	gateway := createMockEchoGatewayServer(t)
+	gateway.maxRequestSize = 8 << 20
+	mux := http.NewServeMux()
+	mux.HandleFunc(echoEndpoint, gateway.gatewayHandler)
+	server := httptest.NewUnstartedServer(mux)
+	server.Config = newListenerServer("", mux, nil, true)
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+	client := server.Client()
+
+	// post is called concurrently, so it returns its errors instead of failing the test
+	post := func(contentType string, body []byte) (*http.Response, []byte, error) {
+		req, err := http.NewRequest(http.MethodPost, server.URL+echoEndpoint, bytes.NewReader(body))
+		if err != nil {
+			return nil, nil, err
+		}
+		req.Header.Set("Content-Type", contentType)
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, nil, err
+		}
+		defer resp.Body.Close()
+		respBody, err := ioutil.ReadAll(resp.Body)
+		return resp, respBody, err
+	}
+
+	// A chunked request larger than the HTTP/2 flow control windows is streamed back
+	message := make([]byte, 4<<20)
+	rand.Read(message)
+	chunks := [][]byte{}
+	for i := 0; i < len(message); i += 1 << 19 {
+		chunks = append(chunks, message[i:i+1<<19])
+	}
+	body, context, suite, enc := encapsulateChunked(t, gateway.keyring.Current(), chunks)
+	resp, respBody, err := post(ohttpChunkedRequestContentType, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.ProtoMajor != 2 || resp.StatusCode != http.StatusOK {
+		t.Fatalf("Unexpected %s response %d", resp.Proto, resp.StatusCode)
+	}
+	if !bytes.Equal(decapsulateChunked(t, respBody, context, suite, enc), message) {
+		t.Fatal("Chunked response does not match the chunked request")
+	}
+
+	// Concurrent requests share the connection
+	var wg sync.WaitGroup
+	errs := make(chan string, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			message := make([]byte, 900<<10)
+			rand.Read(message)
+			req, reqContext, err := ohttp.NewDefaultClient(gateway.keyring.Current()).EncapsulateRequest(message)
+			if err != nil {
+				errs <- err.Error()
+				return
+			}
+			resp, respBody, err := post(ohttpRequestContentType, req.Marshal())
+			if err != nil {
+				errs <- err.Error()
+				return
+			}
+			encapsulated, err := ohttp.UnmarshalEncapsulatedResponse(respBody)
+			if err != nil || resp.ProtoMajor != 2 {
+				errs <- "unexpected " + resp.Proto + " response"
+				return
+			}
+			if response, err := reqContext.DecapsulateResponse(encapsulated); err != nil || !bytes.Equal(response, message) {
+				errs <- "response does not match the request"
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+}
+
+func TestServerTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	certFiles, keyFiles := []string{}, []string{}
+	for _, name := range []string{"a.example", "b.example"} {
+		certFile, keyFile := filepath.Join(dir, name+".pem"), filepath.Join(dir, name+"-key.pem")
+		writeClientCertificate(t, certFile, keyFile, name)
+		certFiles, keyFiles = append(certFiles, certFile), append(keyFiles, keyFile)
+	}
+	config, err := serverTLSConfig(certFiles[0]+", "+certFiles[1], keyFiles[0]+","+keyFiles[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Each server name is served its own certificate, and unknown names the first one
+	for serverName, expected := range map[string]string{"a.example": "a.example", "b.example": "b.example", "c.example": "a.example"} {
+		serverConn, clientConn := net.Pipe()
+		go tls.Server(serverConn, config).Handshake()
+		client := tls.Client(clientConn, &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+		if err := client.Handshake(); err != nil {
+			t.Fatal(err)
+		}
+		if name := client.ConnectionState().PeerCertificates[0].Subject.CommonName; name != expected {
+			t.Fatalf("Server name %s was served the certificate of %s", serverName, name)
+		}
+		serverConn.Close()
+		clientConn.Close()
+	}
+
+	if _, err := serverTLSConfig(certFiles[0]+","+certFiles[1], keyFiles[0]); err == nil {
+		t.Fatal("Expected a certificate without key to be rejected")
+	}
+}
+
+func TestHTTPSRedirectHandler(t *testing.T) {
+	for _, test := range []struct {
+		port, host, location string
+	}{
+		{"8443", "gateway.example:8080", "https://gateway.example:8443/gateway?x=1"},
+		{"443", "gateway.example", "https://gateway.example/gateway?x=1"},
+		{"443", "[::1]:8080", "https://[::1]/gateway?x=1"},
+	} {
+		req := httptest.NewRequest(http.MethodPost, "http://"+test.host+"/gateway?x=1", nil)
+		rr := httptest.NewRecorder()
+		httpsRedirectHandler(test.port).ServeHTTP(rr, req)
+		if rr.Code != http.StatusPermanentRedirect || rr.Header().Get("Location") != test.location {
+			t.Fatalf("Unexpected redirect %d to %s, expected %s", rr.Code, rr.Header().Get("Location"), test.location)
+		}
+	}
+}
+
+func TestUnixSocketListener(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gateway.sock")
+	if err := ioutil.WriteFile(path, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := listenUnix(path, defaultUnixSocketMode); err == nil {
+		t.Fatal("Expected a file that is not a socket not to be replaced")
+	}
+	os.Remove(path)
+
+	// A socket left behind by a previous process is replaced
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.SetUnlinkOnClose(false)
+	stale.Close()
+
+	mode, err := parseUnixSocketMode("0600")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := listenUnix(path, mode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("Unexpected socket permissions %v (%v)", info.Mode(), err)
+	}
+
+	server := newListenerServer("", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}), nil, true)
+	go server.Serve(listener)
+	defer server.Close()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+	resp, err := client.Get("http://gateway" + healthEndpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "ok" {
+		t.Fatalf("Unexpected response %d %q", resp.StatusCode, body)
+	}
+
+	for _, value := range []string{"rw", "0999", "1777"} {
+		if _, err := parseUnixSocketMode(value); err == nil {
+			t.Fatalf("Expected socket permissions %q to be rejected", value)
+		}
+	}
+}
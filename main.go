@@ -4,17 +4,17 @@
 package main
 
 import (
-	"crypto/rand"
-	"encoding/hex"
+	"crypto/tls"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/chris-wood/ohttp-go"
-	"github.com/cisco/go-hpke"
 )
 
 const (
@@ -23,26 +23,148 @@ const (
 	defaultSeedLength = 32
 
 	// HTTP constants. Fill in your proxy and target here.
-	defaultPort      = "8080"
-	gatewayEndpoint  = "/gateway"
-	echoEndpoint     = "/gateway-echo"
-	metadataEndpoint = "/gateway-metadata"
-	healthEndpoint   = "/health"
-	configEndpoint   = "/ohttp-configs"
+	defaultPort         = "8080"
+	gatewayEndpoint     = "/gateway"
+	echoEndpoint        = "/gateway-echo"
+	metadataEndpoint    = "/gateway-metadata"
+	targetProxyEndpoint = "/gateway-proxy"
+	dnsEndpoint         = "/gateway-dns"
+	healthEndpoint      = "/health"
+	readyEndpoint       = "/ready"
+	configEndpoint      = "/ohttp-configs"
+	versionEndpoint     = "/version"
+	configHashEndpoint  = "/ohttp-configs-hash"
+
+	// Well-known discovery path for the gateway key configs (RFC 8615)
+	wellKnownConfigEndpoint = "/.well-known/ohttp-gateway"
 
 	// Environment variables
-	configurationIdEnvironmentVariable = "CONFIGURATION_ID"
-	secretSeedEnvironmentVariable      = "SEED_SECRET_KEY"
-	targetOriginAllowList              = "ALLOWED_TARGET_ORIGINS"
-	customRequestEncodingType          = "CUSTOM_REQUEST_TYPE"
-	customResponseEncodingType         = "CUSTOM_RESPONSE_TYPE"
-	certificateEnvironmentVariable     = "CERT"
-	keyEnvironmentVariable             = "KEY"
-	statsdHostVariable                 = "MONITORING_STATSD_HOST"
-	statsdPortVariable                 = "MONITORING_STATSD_PORT"
-	statsdTimeoutVariable              = "MONITORING_STATSD_TIMEOUT_MS"
-	gatewayDebugEnvironmentVariable    = "GATEWAY_DEBUG"
-	gatewayVerboseEnvironmentVariable  = "VERBOSE"
+	configurationIdEnvironmentVariable    = "CONFIGURATION_ID"
+	secretSeedEnvironmentVariable         = "SEED_SECRET_KEY"
+	targetOriginAllowList                 = "ALLOWED_TARGET_ORIGINS"
+	targetOriginDenyList                  = "DENIED_TARGET_ORIGINS"
+	customRequestEncodingType             = "CUSTOM_REQUEST_TYPE"
+	customResponseEncodingType            = "CUSTOM_RESPONSE_TYPE"
+	certificateEnvironmentVariable        = "CERT"
+	keyEnvironmentVariable                = "KEY"
+	statsdHostVariable                    = "MONITORING_STATSD_HOST"
+	statsdPortVariable                    = "MONITORING_STATSD_PORT"
+	statsdTimeoutVariable                 = "MONITORING_STATSD_TIMEOUT_MS"
+	statsdPrefixVariable                  = "MONITORING_STATSD_PREFIX"
+	statsdTagsVariable                    = "MONITORING_STATSD_TAGS"
+	prometheusMetricsVariable             = "MONITORING_PROMETHEUS"
+	gatewayDebugEnvironmentVariable       = "GATEWAY_DEBUG"
+	gatewayVerboseEnvironmentVariable     = "VERBOSE"
+	gatewayHTTP2EnvironmentVariable       = "GATEWAY_HTTP2"
+	gatewayH2CEnvironmentVariable         = "GATEWAY_H2C"
+	http3AddressEnvironmentVariable       = "HTTP3_ADDRESS"
+	httpRedirectPortEnvironmentVariable   = "HTTP_REDIRECT_PORT"
+	unixSocketPathEnvironmentVariable     = "UNIX_SOCKET_PATH"
+	unixSocketModeEnvironmentVariable     = "UNIX_SOCKET_MODE"
+	acmeHostnamesVariable                 = "ACME_HOSTNAMES"
+	acmeEmailVariable                     = "ACME_EMAIL"
+	acmeDirectoryURLVariable              = "ACME_DIRECTORY_URL"
+	acmeCacheVariable                     = "ACME_CACHE"
+	keyRotationIntervalVariable           = "KEY_ROTATION_INTERVAL"
+	keyRotationOverlapVariable            = "KEY_ROTATION_OVERLAP"
+	keySourceEnvironmentVariable          = "KEY_SOURCE"
+	keySourceRefreshIntervalVariable      = "KEY_SOURCE_REFRESH_INTERVAL"
+	vaultAddressEnvironmentVariable       = "VAULT_ADDR"
+	vaultTokenEnvironmentVariable         = "VAULT_TOKEN"
+	keystorePathEnvironmentVariable       = "KEYSTORE_PATH"
+	keystorePassphraseEnvironmentVariable = "KEYSTORE_PASSPHRASE"
+	keystoreKMSKeyEnvironmentVariable     = "KEYSTORE_KMS_KEY_ID"
+	adminAddressEnvironmentVariable       = "ADMIN_ADDRESS"
+	adminTokenEnvironmentVariable         = "ADMIN_TOKEN"
+	revokedKeyIDsEnvironmentVariable      = "REVOKED_KEY_IDS"
+	keyDerivationEpochVariable            = "KEY_DERIVATION_EPOCH"
+	endpointKeysEnvironmentVariable       = "ENDPOINT_KEYS"
+	hpkeKEMEnvironmentVariable            = "HPKE_KEM"
+	hpkeKDFEnvironmentVariable            = "HPKE_KDF"
+	hpkeAEADEnvironmentVariable           = "HPKE_AEAD"
+	keyRotationGracePeriodVariable        = "KEY_ROTATION_GRACE_PERIOD"
+	keyImportPathVariable                 = "KEY_IMPORT_PATH"
+	keyImportSeedsPathVariable            = "KEY_IMPORT_SEEDS_PATH"
+	keyConfigExportPathVariable           = "KEY_CONFIG_EXPORT_PATH"
+	lockKeyMemoryVariable                 = "LOCK_KEY_MEMORY"
+	nitroEnclaveEnvironmentVariable       = "NITRO_ENCLAVE"
+	fipsRequiredEnvironmentVariable       = "FIPS_REQUIRED"
+	keyAuditLogEnvironmentVariable        = "KEY_AUDIT_LOG"
+	configMinMaxAgeEnvironmentVariable    = "CONFIG_MIN_MAX_AGE"
+	configMaxMaxAgeEnvironmentVariable    = "CONFIG_MAX_MAX_AGE"
+	configCachePublicEnvironmentVariable  = "CONFIG_CACHE_PUBLIC"
+	configCORSOriginsEnvironmentVariable  = "CONFIG_CORS_ALLOWED_ORIGINS"
+	configCORSMaxAgeEnvironmentVariable   = "CONFIG_CORS_MAX_AGE"
+	gatewayCORSOriginsEnvironmentVariable = "GATEWAY_CORS_ALLOWED_ORIGINS"
+	gatewayCORSMaxAgeEnvironmentVariable  = "GATEWAY_CORS_MAX_AGE"
+	strictMediaTypeEnvironmentVariable    = "STRICT_MEDIA_TYPE"
+	configPublishURLEnvironmentVariable   = "CONFIG_PUBLISH_URL"
+	configSigningKeyEnvironmentVariable   = "CONFIG_SIGNING_KEY"
+	wellKnownEnvironmentVariable          = "SERVE_WELL_KNOWN"
+	configAddressEnvironmentVariable      = "CONFIG_ADDRESS"
+	dnsPublishURLEnvironmentVariable      = "DNS_PUBLISH_URL"
+	cloudflareAPITokenEnvironmentVariable = "CLOUDFLARE_API_TOKEN"
+	targetProxyAllowListVariable          = "TARGET_PROXY_ALLOWED_TARGETS"
+	targetProxyAllowHTTPVariable          = "TARGET_PROXY_ALLOW_HTTP"
+	dohResolverURLEnvironmentVariable     = "DOH_RESOLVER_URL"
+	targetDialTimeoutVariable             = "TARGET_DIAL_TIMEOUT"
+	targetTLSHandshakeTimeoutVariable     = "TARGET_TLS_HANDSHAKE_TIMEOUT"
+	targetResponseHeaderTimeoutVariable   = "TARGET_RESPONSE_HEADER_TIMEOUT"
+	targetRequestTimeoutVariable          = "TARGET_REQUEST_TIMEOUT"
+	targetMaxIdleConnsVariable            = "TARGET_MAX_IDLE_CONNS"
+	targetMaxIdleConnsPerHostVariable     = "TARGET_MAX_IDLE_CONNS_PER_HOST"
+	targetMaxConnsPerHostVariable         = "TARGET_MAX_CONNS_PER_HOST"
+	targetIdleConnTimeoutVariable         = "TARGET_IDLE_CONN_TIMEOUT"
+	targetUnixSocketsVariable             = "TARGET_UNIX_SOCKETS"
+	egressProxyURLVariable                = "EGRESS_PROXY_URL"
+	targetResolverVariable                = "TARGET_RESOLVER"
+	targetSSRFProtectionVariable          = "TARGET_SSRF_PROTECTION"
+	targetAllowedNetworksVariable         = "TARGET_ALLOWED_NETWORKS"
+	targetClientCertVariable              = "TARGET_CLIENT_CERT"
+	targetClientKeyVariable               = "TARGET_CLIENT_KEY"
+	targetCABundleVariable                = "TARGET_CA_BUNDLE"
+	targetTLSMinVersionVariable           = "TARGET_TLS_MIN_VERSION"
+	targetTLSPinsVariable                 = "TARGET_TLS_PINS"
+	targetAWSServiceVariable              = "TARGET_AWS_SERVICE"
+	targetCacheVariable                   = "TARGET_CACHE"
+	targetCacheSizeVariable               = "TARGET_CACHE_SIZE"
+	targetProtocolVariable                = "TARGET_PROTOCOL"
+	targetHedgePercentileVariable         = "TARGET_HEDGE_PERCENTILE"
+	targetHedgeMinDelayVariable           = "TARGET_HEDGE_MIN_DELAY"
+	handlersConfigVariable                = "HANDLERS_CONFIG"
+	appHandlerPluginsVariable             = "APP_HANDLER_PLUGINS"
+	unknownOHTTPExtensionsVariable        = "OHTTP_UNKNOWN_EXTENSIONS"
+	privacyPassIssuerNameVariable         = "PRIVACY_PASS_ISSUER_NAME"
+	privacyPassTokenKeysVariable          = "PRIVACY_PASS_TOKEN_KEYS"
+	privacyPassReplayWindowVariable       = "PRIVACY_PASS_REPLAY_WINDOW"
+	targetRetryMaxAttemptsVariable        = "TARGET_RETRY_MAX_ATTEMPTS"
+	targetRetryBackoffVariable            = "TARGET_RETRY_BACKOFF"
+	targetRetryMaxBackoffVariable         = "TARGET_RETRY_MAX_BACKOFF"
+	targetRetryStatusesVariable           = "TARGET_RETRY_STATUS_CODES"
+	targetRetryNetworkErrorsVariable      = "TARGET_RETRY_NETWORK_ERRORS"
+	targetCircuitBreakerThresholdVariable = "TARGET_CIRCUIT_BREAKER_THRESHOLD"
+	targetCircuitBreakerCooldownVariable  = "TARGET_CIRCUIT_BREAKER_COOLDOWN"
+	scrubRequestHeadersVariable           = "SCRUB_REQUEST_HEADERS"
+	forwardedCookiesVariable              = "FORWARDED_COOKIES"
+	forwardInformationalVariable          = "FORWARD_INFORMATIONAL_RESPONSES"
+	responsePaddingVariable               = "RESPONSE_PADDING"
+	minInnerRequestSizeVariable           = "MIN_INNER_REQUEST_SIZE"
+	allowedResponseHeadersVariable        = "ALLOWED_RESPONSE_HEADERS"
+	maxRequestSizeEnvironmentVariable     = "MAX_REQUEST_SIZE"
+	maxChunkedRequestSizeVariable         = "MAX_CHUNKED_REQUEST_SIZE"
+	targetMaxResponseSizeVariable         = "TARGET_MAX_RESPONSE_SIZE"
+	targetRedirectPolicyVariable          = "TARGET_REDIRECT_POLICY"
+	targetMaxRedirectsVariable            = "TARGET_MAX_REDIRECTS"
+
+	// Key rotation defaults
+	defaultKeyRotationOverlap = 36 * time.Hour
+
+	// Maximum size of a target response body, in bytes
+	defaultMaxTargetResponseSize = 16 << 20
+
+	// Maximum sizes of an encapsulated request body, in bytes
+	defaultMaxRequestSize        = 1 << 20
+	defaultMaxChunkedRequestSize = 16 << 20
 )
 
 type gatewayServer struct {
@@ -51,6 +173,7 @@ type gatewayServer struct {
 	endpoints      map[string]string
 	target         *gatewayResource
 	metricsFactory MetricsFactory
+	upstreamPools  map[string]*upstreamPool
 }
 
 func (s gatewayServer) indexHandler(w http.ResponseWriter, r *http.Request) {
@@ -84,6 +207,13 @@ func getUintEnv(key string, defaultVal uint64) uint64 {
 	return ret
 }
 
+// requestSizeLimitsFromEnvironment returns the maximum sizes of encapsulated request bodies and of chunked
+// ones, which are bounded by default. An explicit 0 disables a limit.
+func requestSizeLimitsFromEnvironment() (int64, int64) {
+	return int64(getUintEnv(maxRequestSizeEnvironmentVariable, defaultMaxRequestSize)),
+		int64(getUintEnv(maxChunkedRequestSizeVariable, defaultMaxChunkedRequestSize))
+}
+
 func getBoolEnv(key string, defaultVal bool) bool {
 	val := os.Getenv(key)
 	if val == "" {
@@ -97,103 +227,371 @@ func getBoolEnv(key string, defaultVal bool) bool {
 	return ret
 }
 
+func getDurationEnv(key string, defaultVal time.Duration) time.Duration {
+	val := os.Getenv(key)
+	if val == "" {
+		return defaultVal
+	}
+
+	ret, err := time.ParseDuration(val)
+	if err != nil {
+		return defaultVal
+	}
+	return ret
+}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == genkeyCommand {
+		if err := runGenkey(os.Args[2:], os.Stdout); err != nil {
+			log.Fatalf("Failed to generate key: %s", err)
+		}
+		return
+	}
+
+	// The TLS and key source flags override CERT, KEY, HTTP_REDIRECT_PORT, and KEY_SOURCE
+	flags := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	tlsCert := flags.String("tls-cert", os.Getenv(certificateEnvironmentVariable), "comma-separated certificate (chain) files to serve TLS with, chosen by SNI")
+	tlsKey := flags.String("tls-key", os.Getenv(keyEnvironmentVariable), "comma-separated private key files of the certificates")
+	redirectPort := flags.String("http-redirect-port", os.Getenv(httpRedirectPortEnvironmentVariable), "port on which plain HTTP requests are redirected to HTTPS")
+	keySource := flags.String("key-source", os.Getenv(keySourceEnvironmentVariable), "source of the secret seed, such as gcp-secret://projects/<project>/secrets/<secret>")
+	flags.Parse(os.Args[1:])
+
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = defaultPort
 	}
 
-	var seed []byte
-	if seedHex := os.Getenv(secretSeedEnvironmentVariable); seedHex != "" {
-		log.Printf("Using Secret Key Seed : [%v]", seedHex)
-		var err error
-		seed, err = hex.DecodeString(seedHex)
-		if err != nil {
-			panic(err)
+	info := currentVersionInfo()
+	log.Printf("OHTTP gateway %s (%s), FIPS mode: %v", info.Version, info.GoVersion, info.FIPS)
+	if getBoolEnv(fipsRequiredEnvironmentVariable, false) && !info.FIPS {
+		log.Fatalf("%s is set, but the gateway is not running with a FIPS-validated crypto backend", fipsRequiredEnvironmentVariable)
+	}
+
+	// Lock memory before any key material is loaded
+	if getBoolEnv(lockKeyMemoryVariable, false) {
+		if err := lockMemory(); err != nil {
+			log.Fatalf("Failed to lock memory: %s", err)
 		}
-	} else {
-		seed = make([]byte, defaultSeedLength)
-		rand.Read(seed)
 	}
 
-	var allowedOrigins map[string]bool
-	var originAllowList string
-	if originAllowList = os.Getenv(targetOriginAllowList); originAllowList != "" {
-		origins := strings.Split(originAllowList, ",")
-		allowedOrigins = make(map[string]bool)
-		for _, origin := range origins {
-			allowedOrigins[origin] = true
+	nitroEnclave := getBoolEnv(nitroEnclaveEnvironmentVariable, false)
+	if nitroEnclave {
+		if err := checkEnclaveKeySource(*keySource); err != nil {
+			log.Fatalf("Invalid Nitro Enclave configuration: %s", err)
 		}
 	}
 
+	keyProvider, err := keyProviderFromSource(*keySource)
+	if err != nil {
+		log.Fatalf("Failed to configure key source: %s", err)
+	}
+	seed, err := loadSeed(keyProvider)
+	if err != nil {
+		log.Fatalf("Failed to load key seed: %s", err)
+	}
+
+	var allowedOrigins targetList
+	if originAllowList := os.Getenv(targetOriginAllowList); originAllowList != "" {
+		allowedOrigins = newTargetList(originAllowList)
+	}
+	deniedOrigins := newTargetList(os.Getenv(targetOriginDenyList))
+
 	var certFile string
-	if certFile = os.Getenv(certificateEnvironmentVariable); certFile == "" {
+	if certFile = *tlsCert; certFile == "" {
 		certFile = "cert.pem"
 	}
 
 	var keyFile string
 	enableTLSServe := true
-	if keyFile = os.Getenv(keyEnvironmentVariable); keyFile == "" {
+	if keyFile = *tlsKey; keyFile == "" {
 		keyFile = "key.pem"
 		enableTLSServe = false
 	}
+	var tlsConfig *tls.Config
+	certificates := fmt.Sprintf("cert %v and key %v", certFile, keyFile)
+	if enableTLSServe {
+		if tlsConfig, err = serverTLSConfig(certFile, keyFile); err != nil {
+			log.Fatalf("Failed to load TLS certificates: %s", err)
+		}
+	}
+	acmeManager, err := acmeManagerFromEnvironment()
+	if err != nil {
+		log.Fatalf("Invalid ACME configuration: %s", err)
+	}
+	if acmeManager != nil {
+		if enableTLSServe {
+			log.Fatalf("%s and a TLS certificate can not both be set", acmeHostnamesVariable)
+		}
+		tlsConfig = acmeManager.tlsConfig()
+		enableTLSServe = true
+		certificates = "ACME certificates for " + strings.Join(acmeManager.hostnames, ", ")
+		go acmeManager.run()
+	}
 
 	debugResponse := getBoolEnv(gatewayDebugEnvironmentVariable, false)
 	verbose := getBoolEnv(gatewayVerboseEnvironmentVariable, false)
 
 	configID := uint8(getUintEnv(configurationIdEnvironmentVariable, 0))
-	config, err := ohttp.NewConfigFromSeed(configID, hpke.DHKEM_X25519, hpke.KDF_HKDF_SHA256, hpke.AEAD_AESGCM128, seed)
-	if err != nil {
-		log.Fatalf("Failed to create gateway configuration from seed: %s", err)
-	}
 
 	// Create the default HTTP handler
+	targetClientConfig, err := targetClientConfigFromEnvironment()
+	if err != nil {
+		log.Fatalf("Invalid target client configuration: %s", err)
+	}
+	targetClient := targetClientConfig.client()
+	targetRetry := retryPolicyFromEnvironment()
+	targetHedge := hedgePolicyFromEnvironment()
+	targetBreaker := newCircuitBreaker(int(getUintEnv(targetCircuitBreakerThresholdVariable, 0)),
+		getDurationEnv(targetCircuitBreakerCooldownVariable, defaultCircuitBreakerCooldown))
+	targetScrubber := newHeaderScrubber(os.Getenv(scrubRequestHeadersVariable), os.Getenv(allowedResponseHeadersVariable),
+		os.Getenv(forwardedCookiesVariable))
+	targetMaxResponseSize := int64(getUintEnv(targetMaxResponseSizeVariable, defaultMaxTargetResponseSize))
+	targetRedirects, err := redirectPolicyFromEnvironment()
+	if err != nil {
+		log.Fatalf("Invalid target redirect policy: %s", err)
+	}
 	httpHandler := FilteredHttpRequestHandler{
-		client:             &http.Client{},
+		client:             targetClient,
+		retry:              targetRetry,
+		hedge:              targetHedge,
+		breaker:            targetBreaker,
+		scrubber:           targetScrubber,
+		redirects:          targetRedirects,
+		maxResponseSize:    targetMaxResponseSize,
 		allowedOrigins:     allowedOrigins,
+		deniedOrigins:      deniedOrigins,
 		logForbiddenErrors: verbose,
 	}
 
 	// Create the default gateway and its request handler chain
-	var gateway ohttp.Gateway
-	var targetHandler EncapsulationHandler
+	var newGateway func(ohttp.PrivateConfig) ohttp.Gateway
+	var newAppHandler func(HttpRequestHandler) AppContentHandler
+	forwardInformational := getBoolEnv(forwardInformationalVariable, false)
+	padding, err := parseResponsePadding(os.Getenv(responsePaddingVariable))
+	if err != nil {
+		log.Fatal(err)
+	}
+	minRequestSize := int(getUintEnv(minInnerRequestSizeVariable, 0))
 	requestLabel := os.Getenv(customRequestEncodingType)
 	responseLabel := os.Getenv(customResponseEncodingType)
 	if requestLabel == "" || responseLabel == "" || requestLabel == responseLabel {
-		gateway = ohttp.NewDefaultGateway(config)
+		newGateway = ohttp.NewDefaultGateway
 		requestLabel = "message/bhttp request"
 		responseLabel = "message/bhttp response"
-		targetHandler = DefaultEncapsulationHandler{
-			keyID:   configID,
-			gateway: gateway,
-			appHandler: BinaryHTTPAppHandler{
-				httpHandler: httpHandler,
-			},
+		newAppHandler = func(httpHandler HttpRequestHandler) AppContentHandler {
+			return BinaryHTTPAppHandler{httpHandler: httpHandler, forwardInformational: forwardInformational, padding: padding, minRequestSize: minRequestSize}
 		}
 	} else if requestLabel == "message/protohttp request" && responseLabel == "message/protohttp response" {
-		gateway = ohttp.NewCustomGateway(config, requestLabel, responseLabel)
-		targetHandler = DefaultEncapsulationHandler{
-			keyID:   configID,
-			gateway: gateway,
-			appHandler: ProtoHTTPAppHandler{
-				httpHandler: httpHandler,
-			},
+		newGateway = func(config ohttp.PrivateConfig) ohttp.Gateway {
+			return ohttp.NewCustomGateway(config, requestLabel, responseLabel)
+		}
+		newAppHandler = func(httpHandler HttpRequestHandler) AppContentHandler {
+			return ProtoHTTPAppHandler{httpHandler: httpHandler, padding: padding, minRequestSize: minRequestSize}
 		}
 	} else {
 		panic("Unsupported application content handler")
 	}
 
-	// Create the echo handler chain
-	echoHandler := DefaultEncapsulationHandler{
-		keyID:      configID,
-		gateway:    gateway,
-		appHandler: EchoAppHandler{},
+	// Create the keyring, rotating keys in the background if configured. With a key derivation epoch,
+	// the seed is a master secret from which the key for each epoch is derived.
+	overlap := getDurationEnv(keyRotationOverlapVariable, defaultKeyRotationOverlap)
+	suite, err := keySuiteFromEnvironment()
+	if err != nil {
+		log.Fatalf("Invalid HPKE ciphersuite: %s", err)
+	}
+	epochPeriod := getDurationEnv(keyDerivationEpochVariable, 0)
+	var keyring *RotatingKeyring
+	var epochs *epochKeySchedule
+	if epochPeriod > 0 {
+		epochs, err = newEpochKeySchedule(keyProvider, seed, epochPeriod, suite, newGateway, overlap, time.Now())
+		if err != nil {
+			log.Fatalf("Failed to derive gateway configuration from master secret: %s", err)
+		}
+		keyring = epochs.keyring
+	} else {
+		keyring, err = NewKeyring(configID, suite, seed, newGateway, overlap)
+		if err != nil {
+			log.Fatalf("Failed to create gateway configuration from seed: %s", err)
+		}
+	}
+	gracePeriod := getDurationEnv(keyRotationGracePeriodVariable, 0)
+	keyring.SetGracePeriod(gracePeriod)
+	if auditLog := os.Getenv(keyAuditLogEnvironmentVariable); auditLog != "" {
+		sink, err := auditSinkFromLocation(auditLog)
+		if err != nil {
+			log.Fatalf("Failed to open key audit log %s: %s", auditLog, err)
+		}
+		attachKeyAudit(keyring, sink)
+	}
+	keystore, err := keystoreFromEnvironment()
+	if err != nil {
+		log.Fatalf("Failed to configure keystore: %s", err)
+	}
+	if keystore != nil {
+		if err := keystore.Attach(keyring); err != nil {
+			log.Fatalf("Failed to load keystore: %s", err)
+		}
+	}
+	if importPath := os.Getenv(keyImportPathVariable); importPath != "" {
+		if err := importKeys(keyring, importPath, os.Getenv(keyImportSeedsPathVariable)); err != nil {
+			log.Fatalf("Failed to import keys from %s: %s", importPath, err)
+		}
+		log.Printf("Imported gateway keys from %s, current key ID is %d", importPath, keyring.Current().ID)
+	}
+	if revokedKeyIDs := os.Getenv(revokedKeyIDsEnvironmentVariable); revokedKeyIDs != "" {
+		for _, value := range strings.Split(revokedKeyIDs, ",") {
+			keyID, err := strconv.ParseUint(strings.TrimSpace(value), 10, 8)
+			if err != nil {
+				log.Fatalf("Invalid revoked key ID %q: %s", value, err)
+			}
+			if err := keyring.reserveRevokedKeyID(uint8(keyID)); err != nil {
+				log.Fatalf("Failed to revoke key %d: %s", keyID, err)
+			}
+			log.Printf("Revoked gateway key %d", keyID)
+		}
+	}
+	if exportPath := os.Getenv(keyConfigExportPathVariable); exportPath != "" {
+		if err := exportConfigsOnChange(keyring, exportPath); err != nil {
+			log.Fatalf("Failed to export key configs to %s: %s", exportPath, err)
+		}
+	}
+	if publishLocation := os.Getenv(configPublishURLEnvironmentVariable); publishLocation != "" {
+		publisher, err := configPublisherFromLocation(publishLocation)
+		if err != nil {
+			log.Fatalf("Failed to configure config publisher: %s", err)
+		}
+		if err := publishConfigsOnChange(keyring, publisher); err != nil {
+			log.Fatalf("Failed to publish key configs to %s: %s", publisher.Name(), err)
+		}
+	}
+	if dnsLocation := os.Getenv(dnsPublishURLEnvironmentVariable); dnsLocation != "" {
+		publisher, name, err := dnsPublisherFromLocation(dnsLocation)
+		if err != nil {
+			log.Fatalf("Failed to configure DNS publisher: %s", err)
+		}
+		if err := publishDNSOnChange(keyring, publisher, name); err != nil {
+			log.Fatalf("Failed to publish DNS record %s to %s: %s", name, publisher.Name(), err)
+		}
+	}
+	if epochs != nil {
+		log.Printf("Deriving gateway keys for epochs of %v", epochPeriod)
+		go epochs.Run()
+	} else {
+		if rotationInterval := getDurationEnv(keyRotationIntervalVariable, 0); rotationInterval > 0 {
+			log.Printf("Rotating gateway keys every %v", rotationInterval)
+			go keyring.RotateEvery(rotationInterval)
+		}
+		// Mounted secrets are watched for changes by default
+		defaultRefreshInterval := time.Duration(0)
+		if _, ok := keyProvider.(*FileKeyProvider); ok {
+			defaultRefreshInterval = defaultFileKeyWatchInterval
+		}
+		if refreshInterval := getDurationEnv(keySourceRefreshIntervalVariable, defaultRefreshInterval); refreshInterval > 0 {
+			go refreshKeys(keyProvider, keyring, seed, refreshInterval)
+		}
+	}
+
+	// Endpoints listed in ENDPOINT_KEYS use their own keyrings, and the others share the gateway keyring
+	endpointKeyrings, err := endpointKeyringsFromEnvironment(configID, suite, seed, newGateway, overlap)
+	if err != nil {
+		log.Fatalf("Failed to create endpoint keys: %s", err)
+	}
+	keyrings := make(map[string]Keyring)
+	for _, endpoint := range []string{gatewayEndpoint, echoEndpoint, metadataEndpoint} {
+		keyrings[endpoint] = keyring
+	}
+	for endpoint, endpointKeyring := range endpointKeyrings {
+		keyrings[endpoint] = endpointKeyring.keyring
+		endpointKeyring.keyring.SetGracePeriod(gracePeriod)
+		if endpointKeyring.rotationInterval > 0 {
+			log.Printf("Rotating %s keys every %v", endpoint, endpointKeyring.rotationInterval)
+			go endpointKeyring.keyring.RotateEvery(endpointKeyring.rotationInterval)
+		}
+	}
+
+	// Refuse to start with keys that cannot decapsulate requests
+	for endpoint, endpointKeyring := range keyrings {
+		if err := selfTest(endpointKeyring, requestLabel, responseLabel); err != nil {
+			log.Fatalf("Key self-test for %s failed: %s", endpoint, err)
+		}
+	}
+	log.Printf("Key self-test passed")
+
+	// Declare the encapsulation handlers of the built-in endpoints, to which HANDLERS_CONFIG adds or
+	// replaces endpoints
+	targetProxyAllowList := os.Getenv(targetProxyAllowListVariable)
+	dohResolverURL := os.Getenv(dohResolverURLEnvironmentVariable)
+	handlerConfigs := []handlerConfig{
+		{Path: gatewayEndpoint, Type: handlerTypeTarget}, // Content-specific handler
+		{Path: echoEndpoint, Type: handlerTypeEcho},      // Content-agnostic handler
+		{Path: metadataEndpoint, Type: handlerTypeMetadata},
+	}
+	if getBoolEnv(wellKnownEnvironmentVariable, true) {
+		handlerConfigs = append(handlerConfigs, handlerConfig{Path: wellKnownConfigEndpoint, Type: handlerTypeTarget})
+	}
+	if targetProxyAllowList != "" {
+		handlerConfigs = append(handlerConfigs, handlerConfig{
+			Path:           targetProxyEndpoint,
+			Type:           handlerTypeProxy,
+			AllowedOrigins: []string{targetProxyAllowList},
+			AllowHTTP:      getBoolEnv(targetProxyAllowHTTPVariable, false),
+		})
+	}
+	if dohResolverURL != "" {
+		handlerConfigs = append(handlerConfigs, handlerConfig{Path: dnsEndpoint, Type: handlerTypeDNS, Target: dohResolverURL})
+	}
+	if plugins := os.Getenv(appHandlerPluginsVariable); plugins != "" {
+		if err := loadAppHandlerPlugins(plugins); err != nil {
+			log.Fatalf("Failed to load app handler plugins: %s", err)
+		}
+	}
+	if err := setUnknownOHTTPExtensionPolicy(os.Getenv(unknownOHTTPExtensionsVariable)); err != nil {
+		log.Fatalf("Failed to parse %s: %s", unknownOHTTPExtensionsVariable, err)
+	}
+	if path := os.Getenv(handlersConfigVariable); path != "" {
+		fileConfigs, err := loadHandlerConfigs(path)
+		if err != nil {
+			log.Fatalf("Failed to load handler configs: %s", err)
+		}
+		handlerConfigs = mergeHandlerConfigs(handlerConfigs, fileConfigs)
 	}
 
-	// Create the metadata handler chain
-	metadataHandler := MetadataEncapsulationHandler{
-		keyID:   configID,
-		gateway: gateway,
+	targetCache, err := responseCacheFromEnvironment()
+	if err != nil {
+		log.Fatalf("Invalid target cache: %s", err)
+	}
+	factory := handlerFactory{
+		keyring:       keyring,
+		keyrings:      keyrings,
+		newAppHandler: newAppHandler,
+		targetHandler: httpHandler,
+		proxyHandler: TargetProxyHttpRequestHandler{
+			client:             targetClientConfig.forProxy().client(),
+			retry:              targetRetry,
+			hedge:              targetHedge,
+			breaker:            targetBreaker,
+			scrubber:           targetScrubber,
+			redirects:          targetRedirects,
+			maxResponseSize:    targetMaxResponseSize,
+			logForbiddenErrors: verbose,
+		},
+		dnsClient:            targetClientConfig.dnsClient(5 * time.Second),
+		resolver:             targetClientConfig.resolver,
+		clientConfig:         targetClientConfig,
+		responseCache:        targetCache,
+		forwardInformational: forwardInformational,
+		padding:              padding,
+		minRequestSize:       minRequestSize,
+		upstreamPools:        map[string]*upstreamPool{},
+		targetSwitches:       map[string]*targetSwitch{},
+	}
+	handlers := make(map[string]EncapsulationHandler)
+	for _, config := range handlerConfigs {
+		handler, err := factory.build(config)
+		if err != nil {
+			log.Fatalf("Invalid handler config: %s", err)
+		}
+		handlers[config.Path] = handler
 	}
 
 	// Configure metrics
@@ -204,29 +602,82 @@ func main() {
 		log.Printf("Failed parsing metrics timeout: %s", err)
 		metricsTimeout = 100
 	}
-	client, err := createStatsDClient(metricsHost, metricsPort, int(metricsTimeout))
+	metricsTags := splitList(os.Getenv(statsdTagsVariable))
+	client, err := createStatsDClient(metricsHost, metricsPort, int(metricsTimeout), os.Getenv(statsdPrefixVariable), metricsTags)
 	if err != nil {
 		log.Fatalf("Failed to create statsd client: %s", err)
 	}
 	defer client.Close()
 
-	metricsFactory := &StatsDMetricsFactory{
-		serviceName: "ohttp_gateway",
-		metricsName: "ohttp_gateway_duration",
-		client:      client,
+	serviceName := "ohttp_gateway"
+	for _, tag := range metricsTags {
+		// A configured service tag replaces the one of every metric
+		if strings.HasPrefix(tag, "service:") {
+			serviceName = ""
+		}
+	}
+	var metricsFactory MetricsFactory = &StatsDMetricsFactory{
+		serviceName:      serviceName,
+		metricsName:      "ohttp_gateway_duration",
+		stageMetricsName: "ohttp_gateway_stage_duration",
+		sizeMetricsName:  "ohttp_gateway_message_size",
+		client:           client,
+	}
+	// The Prometheus and OTLP exporters share the aggregated results, stage durations, and message sizes
+	aggregator := newMetricsAggregator()
+	prometheusMetrics := getBoolEnv(prometheusMetricsVariable, false)
+	if prometheusMetrics && os.Getenv(adminAddressEnvironmentVariable) == "" {
+		log.Fatalf("%s requires %s, whose listener serves %s", prometheusMetricsVariable, adminAddressEnvironmentVariable, adminMetricsEndpoint)
+	}
+	otlpMetrics, err := newOTLPExporterFromEnvironment(aggregator)
+	if err != nil {
+		log.Fatalf("Invalid OpenTelemetry metrics configuration: %s", err)
+	}
+	if prometheusMetrics || otlpMetrics != nil {
+		metricsFactory = multiMetricsFactory{metricsFactory, aggregator}
+	}
+	if otlpMetrics != nil {
+		log.Printf("Exporting metrics to %s every %s", otlpMetrics.endpoint, otlpMetrics.interval)
+		go otlpMetrics.run()
+	}
+	if vault, ok := keyProvider.(*VaultKeyProvider); ok {
+		go vault.KeepTokenAlive(metricsFactory)
+	}
+
+	configCache := cachePolicy{
+		minMaxAge: getDurationEnv(configMinMaxAgeEnvironmentVariable, 0),
+		maxMaxAge: getDurationEnv(configMaxMaxAgeEnvironmentVariable, 0),
+		public:    getBoolEnv(configCachePublicEnvironmentVariable, false),
+	}
+	if configCache.minMaxAge > 0 && configCache.maxMaxAge > 0 && configCache.maxMaxAge < configCache.minMaxAge {
+		log.Fatalf("%s must not be less than %s", configMaxMaxAgeEnvironmentVariable, configMinMaxAgeEnvironmentVariable)
+	}
+
+	configSigningKey, err := configSigningKeyFromEnvironment()
+	if err != nil {
+		log.Fatalf("Failed to load config signing key: %s", err)
 	}
 
-	handlers := make(map[string]EncapsulationHandler)
-	handlers[gatewayEndpoint] = targetHandler    // Content-specific handler
-	handlers[echoEndpoint] = echoHandler         // Content-agnostic handler
-	handlers[metadataEndpoint] = metadataHandler // Metadata handler
 	target := &gatewayResource{
 		verbose:               verbose,
-		keyID:                 configID,
-		gateway:               gateway,
+		keyring:               keyring,
+		endpointKeyrings:      keyrings,
 		encapsulationHandlers: handlers,
 		debugResponse:         debugResponse,
 		metricsFactory:        metricsFactory,
+		configCache:           configCache,
+		configCORS:            newCORSPolicy(os.Getenv(configCORSOriginsEnvironmentVariable), getDurationEnv(configCORSMaxAgeEnvironmentVariable, 0)),
+		strictMediaType:       getBoolEnv(strictMediaTypeEnvironmentVariable, false),
+		gatewayCORS:           newGatewayCORSPolicy(os.Getenv(gatewayCORSOriginsEnvironmentVariable), getDurationEnv(gatewayCORSMaxAgeEnvironmentVariable, 0)),
+		configSigningKey:      configSigningKey,
+	}
+	target.maxRequestSize, target.maxChunkedRequestSize = requestSizeLimitsFromEnvironment()
+	if tokenKeys := os.Getenv(privacyPassTokenKeysVariable); tokenKeys != "" {
+		replayWindow := getDurationEnv(privacyPassReplayWindowVariable, defaultPrivacyPassReplayWindow)
+		target.tokenVerifier, err = newPrivacyPassVerifier(os.Getenv(privacyPassIssuerNameVariable), tokenKeys, replayWindow)
+		if err != nil {
+			log.Fatalf("Failed to configure Privacy Pass token verification: %s", err)
+		}
 	}
 
 	endpoints := make(map[string]string)
@@ -241,21 +692,131 @@ func main() {
 		responseLabel: responseLabel,
 		endpoints:     endpoints,
 		target:        target,
+		upstreamPools: factory.upstreamPools,
+	}
+	for _, pool := range factory.upstreamPools {
+		if pool.discovery != nil {
+			go pool.runDiscovery()
+		}
+		if pool.healthCheck != nil {
+			go pool.runHealthChecks(targetClient, metricsFactory)
+		}
 	}
 
-	http.HandleFunc(gatewayEndpoint, server.target.gatewayHandler)
-	http.HandleFunc(echoEndpoint, server.target.gatewayHandler)
-	http.HandleFunc(metadataEndpoint, server.target.gatewayHandler)
+	for _, config := range handlerConfigs {
+		// The well-known location also serves configs, so it is registered below
+		if config.Path != wellKnownConfigEndpoint {
+			http.HandleFunc(config.Path, server.target.gatewayHandler)
+		}
+	}
 	http.HandleFunc(healthEndpoint, server.healthCheckHandler)
-	http.HandleFunc(configEndpoint, target.configHandler)
+	http.HandleFunc(readyEndpoint, server.readyHandler)
+	http.HandleFunc(versionEndpoint, server.versionHandler)
+	if getBoolEnv(wellKnownEnvironmentVariable, true) {
+		http.HandleFunc(wellKnownConfigEndpoint, target.wellKnownHandler)
+	}
 	http.HandleFunc("/", server.indexHandler)
 
+	// Key discovery can be exposed publicly on its own listener, while the encapsulation endpoints stay
+	// reachable only from the relay network
+	configAddress := os.Getenv(configAddressEnvironmentVariable)
+	configMux := http.DefaultServeMux
+	if configAddress != "" {
+		configMux = http.NewServeMux()
+		configMux.HandleFunc(healthEndpoint, server.healthCheckHandler)
+		if getBoolEnv(wellKnownEnvironmentVariable, true) {
+			configMux.HandleFunc(wellKnownConfigEndpoint, target.configHandler)
+		}
+	}
+	configMux.HandleFunc(configEndpoint, target.configHandler)
+	configMux.HandleFunc(configHashEndpoint, target.configHashHandler)
+	if nitroEnclave {
+		target.attestation = newAttestationCache()
+		configMux.HandleFunc(attestationEndpoint, target.attestationHandler)
+	}
+	http2 := getBoolEnv(gatewayHTTP2EnvironmentVariable, true)
+	h2c := getBoolEnv(gatewayH2CEnvironmentVariable, false)
+	if h2c && enableTLSServe {
+		log.Fatalf("%s enables cleartext HTTP/2, so it can not be combined with TLS certificates", gatewayH2CEnvironmentVariable)
+	}
+	if http3Address := os.Getenv(http3AddressEnvironmentVariable); http3Address != "" {
+		// HTTP/3 requires a QUIC implementation, such as quic-go, which the standard library and the
+		// vendored modules do not provide. Fail loudly instead of silently serving only TCP.
+		log.Fatalf("%s is set, but HTTP/3 listeners are not supported by this build", http3AddressEnvironmentVariable)
+	}
+	if configAddress != "" {
+		go func() {
+			if enableTLSServe {
+				log.Printf("Config listener on %v with %s\n", configAddress, certificates)
+			} else {
+				log.Printf("Config listener on %v without enabling TLS\n", configAddress)
+			}
+			log.Fatal(serve(newListenerServer(configAddress, configMux, tlsConfig, http2)))
+		}()
+	}
+
+	if adminAddress := os.Getenv(adminAddressEnvironmentVariable); adminAddress != "" {
+		adminToken := os.Getenv(adminTokenEnvironmentVariable)
+		if adminToken == "" {
+			log.Fatalf("%s must be set to enable the admin listener", adminTokenEnvironmentVariable)
+		}
+		admin := adminServer{
+			token:          adminToken,
+			keyring:        keyring,
+			targetSwitches: factory.targetSwitches,
+		}
+		if prometheusMetrics {
+			admin.metrics = prometheusHandler{metricsName: "ohttp_gateway_results_total", durationMetricsName: "ohttp_gateway_stage_duration_seconds", sizeMetricsName: "ohttp_gateway_message_size_bytes", aggregator: aggregator}
+		}
+		go func() {
+			log.Printf("Admin listener on %v\n", adminAddress)
+			log.Fatal(http.ListenAndServe(adminAddress, admin.mux()))
+		}()
+	}
+
+	if *redirectPort != "" {
+		if !enableTLSServe {
+			log.Fatalf("Redirecting to HTTPS requires a TLS certificate and key")
+		}
+		go func() {
+			log.Printf("Redirecting HTTP requests on port %v to HTTPS\n", *redirectPort)
+			log.Fatal(http.ListenAndServe(fmt.Sprintf(":%s", *redirectPort), httpsRedirectHandler(port)))
+		}()
+	}
+
+	// With h2c, the inbound listener also accepts cleartext HTTP/2 from relays on a private network
+	gatewayListenerServer := func(addr string) *http.Server {
+		inbound := newListenerServer(addr, nil, tlsConfig, http2)
+		if h2c {
+			if err := enableH2C(inbound); err != nil {
+				log.Fatalf("Failed to enable %s: %s", gatewayH2CEnvironmentVariable, err)
+			}
+		}
+		return inbound
+	}
+
+	// A local reverse proxy that terminates TLS can forward requests over a Unix domain socket instead of PORT
+	if socketPath := os.Getenv(unixSocketPathEnvironmentVariable); socketPath != "" {
+		if enableTLSServe || *redirectPort != "" {
+			log.Fatalf("%s is served without TLS, so it can not be combined with TLS certificates or HTTPS redirects", unixSocketPathEnvironmentVariable)
+		}
+		mode, err := parseUnixSocketMode(os.Getenv(unixSocketModeEnvironmentVariable))
+		if err != nil {
+			log.Fatalf("Failed to parse %s: %s", unixSocketModeEnvironmentVariable, err)
+		}
+		listener, err := listenUnix(socketPath, mode)
+		if err != nil {
+			log.Fatalf("Failed to listen on %s: %s", socketPath, err)
+		}
+		log.Printf("Listening on Unix socket %v with permissions %v\n", socketPath, mode)
+		log.Fatal(gatewayListenerServer("").Serve(framingListener{listener}))
+	}
+
 	if enableTLSServe {
-		log.Printf("Listening on port %v with cert %v and key %v\n", port, certFile, keyFile)
-		log.Fatal(http.ListenAndServeTLS(fmt.Sprintf(":%s", port), certFile, keyFile, nil))
+		log.Printf("Listening on port %v with %s\n", port, certificates)
 	} else {
 		log.Printf("Listening on port %v without enabling TLS\n", port)
-		log.Fatal(http.ListenAndServe(fmt.Sprintf(":%s", port), nil))
 	}
+	log.Fatal(serve(gatewayListenerServer(fmt.Sprintf(":%s", port))))
 
 }
@@ -1,10 +1,223 @@
 package main
 
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
 type Metrics interface {
 	Fire(result string)
 	ResponseStatus(prefix string, status int)
+	// Tag attaches a tag to the results fired after it.
+	Tag(name string, value string)
+	// Duration records how long a stage of the event took.
+	Duration(stage string, duration time.Duration)
+	// Size records the size in bytes of a message of the event.
+	Size(message string, size int)
 }
 
 type MetricsFactory interface {
 	Create(eventName string) Metrics
 }
+
+// multiMetricsFactory creates metrics that report to every factory.
+type multiMetricsFactory []MetricsFactory
+
+func (f multiMetricsFactory) Create(eventName string) Metrics {
+	metrics := make(multiMetrics, 0, len(f))
+	for _, factory := range f {
+		metrics = append(metrics, factory.Create(eventName))
+	}
+	return metrics
+}
+
+type multiMetrics []Metrics
+
+func (m multiMetrics) Fire(result string) {
+	for _, metrics := range m {
+		metrics.Fire(result)
+	}
+}
+
+func (m multiMetrics) ResponseStatus(prefix string, status int) {
+	for _, metrics := range m {
+		metrics.ResponseStatus(prefix, status)
+	}
+}
+
+func (m multiMetrics) Tag(name string, value string) {
+	for _, metrics := range m {
+		metrics.Tag(name, value)
+	}
+}
+
+func (m multiMetrics) Duration(stage string, duration time.Duration) {
+	for _, metrics := range m {
+		metrics.Duration(stage, duration)
+	}
+}
+
+func (m multiMetrics) Size(message string, size int) {
+	for _, metrics := range m {
+		metrics.Size(message, size)
+	}
+}
+
+// resultSeries is the number of times a result was fired with the same labels.
+type resultSeries struct {
+	labels map[string]string
+	count  uint64
+}
+
+// durationBuckets are the upper bounds, in seconds, of the buckets of stage durations, from the
+// microseconds of decapsulation to the seconds of slow target fetches.
+var durationBuckets = []float64{0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// sizeBuckets are the upper bounds, in bytes, of the buckets of message sizes, which grow by powers of
+// four from a small DNS query to the default maximum target response size.
+var sizeBuckets = []float64{64, 256, 1 << 10, 4 << 10, 16 << 10, 64 << 10, 256 << 10, 1 << 20, 4 << 20, 16 << 20}
+
+// histogramSeries is the distribution of the values observed with the same labels. counts[i] is the number
+// of values of at most bounds[i], and not in an earlier bucket, and the last count is that of the larger
+// ones.
+type histogramSeries struct {
+	labels map[string]string
+	bounds []float64
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// metricsAggregator is a MetricsFactory that counts the results fired by the metrics it creates, labelled
+// with their event, result, and tags, and collects the durations of their stages and the sizes of their
+// messages in histograms labelled with their event and stage or message, for the exporters that read them.
+type metricsAggregator struct {
+	mu        sync.Mutex
+	series    map[string]*resultSeries
+	durations map[string]*histogramSeries
+	sizes     map[string]*histogramSeries
+}
+
+func newMetricsAggregator() *metricsAggregator {
+	return &metricsAggregator{
+		series:    make(map[string]*resultSeries),
+		durations: make(map[string]*histogramSeries),
+		sizes:     make(map[string]*histogramSeries),
+	}
+}
+
+func (c *metricsAggregator) Create(eventName string) Metrics {
+	return &countingMetrics{aggregator: c, eventName: eventName, tags: map[string]string{}}
+}
+
+// labelsKey returns a key that is equal for equal labels.
+func labelsKey(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var key strings.Builder
+	for _, name := range names {
+		key.WriteString(name + "=" + labels[name] + "\x00")
+	}
+	return key.String()
+}
+
+func (c *metricsAggregator) increment(labels map[string]string) {
+	key := labelsKey(labels)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	series, ok := c.series[key]
+	if !ok {
+		series = &resultSeries{labels: labels}
+		c.series[key] = series
+	}
+	series.count++
+}
+
+// observe adds value to the histogram of labels in histograms, which has the buckets of bounds.
+func (c *metricsAggregator) observe(histograms map[string]*histogramSeries, bounds []float64, labels map[string]string, value float64) {
+	key := labelsKey(labels)
+	bucket := sort.SearchFloat64s(bounds, value)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	histogram, ok := histograms[key]
+	if !ok {
+		histogram = &histogramSeries{labels: labels, bounds: bounds, counts: make([]uint64, len(bounds)+1)}
+		histograms[key] = histogram
+	}
+	histogram.counts[bucket]++
+	histogram.count++
+	histogram.sum += value
+}
+
+// snapshot returns a copy of every result series, in a stable order.
+func (c *metricsAggregator) snapshot() []resultSeries {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	keys := make([]string, 0, len(c.series))
+	for key := range c.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	series := make([]resultSeries, 0, len(keys))
+	for _, key := range keys {
+		series = append(series, *c.series[key])
+	}
+	return series
+}
+
+// histogramSnapshot returns a copy of every histogram of histograms, in a stable order.
+func (c *metricsAggregator) histogramSnapshot(histograms map[string]*histogramSeries) []histogramSeries {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	keys := make([]string, 0, len(histograms))
+	for key := range histograms {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	snapshot := make([]histogramSeries, 0, len(keys))
+	for _, key := range keys {
+		histogram := *histograms[key]
+		histogram.counts = append([]uint64{}, histogram.counts...)
+		snapshot = append(snapshot, histogram)
+	}
+	return snapshot
+}
+
+type countingMetrics struct {
+	aggregator *metricsAggregator
+	eventName  string
+	tags       map[string]string
+}
+
+func (m *countingMetrics) Fire(result string) {
+	labels := map[string]string{"event_name": m.eventName, "result": result}
+	for name, value := range m.tags {
+		labels[name] = value
+	}
+	m.aggregator.increment(labels)
+}
+
+func (m *countingMetrics) ResponseStatus(prefix string, status int) {
+	m.Fire(fmt.Sprintf("%s_response_status_%d", prefix, status))
+}
+
+func (m *countingMetrics) Tag(name string, value string) {
+	m.tags[name] = value
+}
+
+// Durations and sizes are not labelled with the tags, which would multiply the buckets of every histogram.
+func (m *countingMetrics) Duration(stage string, duration time.Duration) {
+	labels := map[string]string{"event_name": m.eventName, "stage": stage}
+	m.aggregator.observe(m.aggregator.durations, durationBuckets, labels, duration.Seconds())
+}
+
+func (m *countingMetrics) Size(message string, size int) {
+	labels := map[string]string{"event_name": m.eventName, "message": message}
+	m.aggregator.observe(m.aggregator.sizes, sizeBuckets, labels, float64(size))
+}
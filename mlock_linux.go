@@ -0,0 +1,19 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build linux
+// +build linux
+
+package main
+
+import "syscall"
+
+// lockMemory locks all current and future pages of the process into RAM, so that key material is never
+// written to swap, and disables core dumps, so that it does not end up in one after a crash. Locking
+// requires CAP_IPC_LOCK or a sufficient RLIMIT_MEMLOCK.
+func lockMemory() error {
+	if err := syscall.Setrlimit(syscall.RLIMIT_CORE, &syscall.Rlimit{}); err != nil {
+		return err
+	}
+	return syscall.Mlockall(syscall.MCL_CURRENT | syscall.MCL_FUTURE)
+}
@@ -0,0 +1,13 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !linux
+// +build !linux
+
+package main
+
+import "fmt"
+
+func lockMemory() error {
+	return fmt.Errorf("Locking memory is only supported on Linux")
+}
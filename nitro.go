@@ -0,0 +1,228 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	attestationEndpoint = "/attestation"
+
+	// Maximum nonce length accepted by the Nitro Secure Module
+	nitroMaxNonceLength = 512
+
+	attestationContentType = "application/cbor"
+
+	// Config responses carry the digest of the attestation document of their configs, and link to it
+	configAttestationHeader = "Ohttp-Keys-Attestation"
+
+	// Attestation documents without a nonce are reused for the same configs until their certificates,
+	// which the Nitro Secure Module issues for a few hours, come close to expiring
+	attestationCacheDuration = time.Hour
+)
+
+// checkEnclaveKeySource ensures the gateway key is generated inside the enclave, rather than loaded from a
+// seed that exists outside of it, since an attestation document would otherwise vouch for an exposed key.
+// keySource is the key source selected by the --key-source flag or KEY_SOURCE.
+func checkEnclaveKeySource(keySource string) error {
+	for _, variable := range []string{secretSeedEnvironmentVariable, keyImportSeedsPathVariable} {
+		if os.Getenv(variable) != "" {
+			return fmt.Errorf("%s cannot be set when running in a Nitro Enclave", variable)
+		}
+	}
+	if keySource != "" && keySource != "env" {
+		return fmt.Errorf("%s cannot be set when running in a Nitro Enclave", keySourceEnvironmentVariable)
+	}
+	return nil
+}
+
+// nitroAttestationRequest encodes an NSM Attestation request, binding userData and nonce into the
+// attestation document.
+func nitroAttestationRequest(userData, nonce []byte) []byte {
+	request := appendCBORHead(nil, cborMap, 1)
+	request = appendCBORText(request, "Attestation")
+	request = appendCBORHead(request, cborMap, 3)
+	request = appendCBORText(request, "user_data")
+	request = appendCBORBytes(request, userData)
+	request = appendCBORText(request, "nonce")
+	request = appendCBORBytes(request, nonce)
+	request = appendCBORText(request, "public_key")
+	request = appendCBORBytes(request, nil)
+	return request
+}
+
+// nitroAttestationDocument extracts the attestation document from an NSM response.
+func nitroAttestationDocument(response []byte) ([]byte, error) {
+	decoded, _, err := decodeCBOR(response)
+	if err != nil {
+		return nil, err
+	}
+	fields, ok := decoded.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Unexpected NSM response")
+	}
+	if nsmError, ok := fields["Error"]; ok {
+		return nil, fmt.Errorf("NSM request failed: %v", nsmError)
+	}
+	attestation, ok := fields["Attestation"].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Unexpected NSM response")
+	}
+	document, ok := attestation["document"].([]byte)
+	if !ok {
+		return nil, fmt.Errorf("NSM response has no attestation document")
+	}
+	return document, nil
+}
+
+// configsDigest is the SHA-256 digest of the served key configs, encoded as application/ohttp-keys.
+// It is the user data of attestation documents, which binds the configs to the enclave measurements.
+func configsDigest(keyring Keyring) []byte {
+	digest := sha256.Sum256(marshalConfigs(keyring.Configs()))
+	return digest[:]
+}
+
+// cachedAttestation is the attestation document of a set of configs, without a nonce.
+type cachedAttestation struct {
+	document []byte
+	digest   [sha256.Size]byte
+	expiry   time.Time
+}
+
+// attestationCache requests attestation documents without a nonce once per set of configs, so that config
+// responses can commit to the document that clients fetch to verify them.
+type attestationCache struct {
+	request func([]byte) ([]byte, error)
+	now     func() time.Time
+
+	mu        sync.Mutex
+	documents map[[sha256.Size]byte]cachedAttestation
+}
+
+func newAttestationCache() *attestationCache {
+	return &attestationCache{
+		request:   nsmRequest,
+		now:       time.Now,
+		documents: make(map[[sha256.Size]byte]cachedAttestation),
+	}
+}
+
+// attestation returns the attestation document whose user data is the digest of the configs of keyring.
+func (c *attestationCache) attestation(keyring Keyring) (cachedAttestation, error) {
+	var userData [sha256.Size]byte
+	copy(userData[:], configsDigest(keyring))
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	if cached, ok := c.documents[userData]; ok && now.Before(cached.expiry) {
+		return cached, nil
+	}
+	response, err := c.request(nitroAttestationRequest(userData[:], nil))
+	if err != nil {
+		return cachedAttestation{}, err
+	}
+	document, err := nitroAttestationDocument(response)
+	if err != nil {
+		return cachedAttestation{}, err
+	}
+	// Documents of configs that are no longer served expire and are dropped with the others
+	for digest, cached := range c.documents {
+		if !now.Before(cached.expiry) {
+			delete(c.documents, digest)
+		}
+	}
+	cached := cachedAttestation{document: document, digest: sha256.Sum256(document), expiry: now.Add(attestationCacheDuration)}
+	c.documents[userData] = cached
+	return cached, nil
+}
+
+// attestationLink returns the Link header of config responses for the attestation of endpoint, or of the
+// default configs if endpoint is empty.
+func attestationLink(endpoint string) string {
+	target := attestationEndpoint
+	if endpoint != "" {
+		target += "?endpoint=" + url.QueryEscape(endpoint)
+	}
+	return fmt.Sprintf(`<%s>; rel="attestation"`, target)
+}
+
+// setConfigAttestation commits a config response for keyring to the attestation document of its configs.
+// The header carries the base64-encoded SHA-256 digest of the document served at the linked endpoint.
+func (c *attestationCache) setConfigAttestation(w http.ResponseWriter, r *http.Request, keyring Keyring) error {
+	cached, err := c.attestation(keyring)
+	if err != nil {
+		return err
+	}
+	w.Header().Set(configAttestationHeader, "sha-256="+base64.StdEncoding.EncodeToString(cached.digest[:]))
+	w.Header().Set("Link", attestationLink(r.URL.Query().Get("endpoint")))
+	return nil
+}
+
+// attestationHandler serves a Nitro Enclave attestation document for the served key configs, or those of
+// the endpoint query parameter. Clients pass a fresh hex-encoded nonce to guarantee the document's
+// freshness, check its signature chain and PCRs, and compare its user data with the SHA-256 digest of the
+// configs they fetched. Without a nonce, it serves the document that config responses commit to.
+func (s *gatewayResource) attestationHandler(w http.ResponseWriter, r *http.Request) {
+	if s.verbose {
+		log.Printf("%s Handling %s\n", r.Method, r.URL.Path)
+	}
+	metrics := s.metricsFactory.Create(metricsEventAttestationRequest)
+
+	var nonce []byte
+	if encoded := r.URL.Query().Get("nonce"); encoded != "" {
+		var err error
+		if nonce, err = hex.DecodeString(encoded); err != nil || len(nonce) > nitroMaxNonceLength {
+			s.httpError(w, http.StatusBadRequest, fmt.Sprintf("Invalid nonce: %s", encoded), metrics, r.Method)
+			return
+		}
+	}
+
+	keyring, err := s.configKeyring(r)
+	if err != nil {
+		s.httpError(w, http.StatusBadRequest, err.Error(), metrics, r.Method)
+		return
+	}
+	if nonce == nil && s.attestation != nil {
+		cached, err := s.attestation.attestation(keyring)
+		if err != nil {
+			metrics.Fire(metricsResultAttestationFailed)
+			s.httpError(w, http.StatusInternalServerError, fmt.Sprintf("Attestation failed: %s", err), metrics, r.Method)
+			return
+		}
+		w.Header().Set("Content-Type", attestationContentType)
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("ETag", configsETag(cached.digest))
+		w.Write(cached.document)
+		metrics.ResponseStatus(r.Method, http.StatusOK)
+		return
+	}
+
+	response, err := nsmRequest(nitroAttestationRequest(configsDigest(keyring), nonce))
+	if err != nil {
+		metrics.Fire(metricsResultAttestationFailed)
+		s.httpError(w, http.StatusInternalServerError, fmt.Sprintf("Attestation failed: %s", err), metrics, r.Method)
+		return
+	}
+	document, err := nitroAttestationDocument(response)
+	if err != nil {
+		metrics.Fire(metricsResultAttestationFailed)
+		s.httpError(w, http.StatusInternalServerError, fmt.Sprintf("Attestation failed: %s", err), metrics, r.Method)
+		return
+	}
+
+	w.Header().Set("Content-Type", attestationContentType)
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(document)
+	metrics.ResponseStatus(r.Method, http.StatusOK)
+}
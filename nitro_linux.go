@@ -0,0 +1,49 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	nsmDevicePath = "/dev/nsm"
+
+	// _IOWR(0x0A, 0, struct nsm_message) from the Nitro Secure Module driver
+	nsmIoctlRequest = 0xc0200a00
+	nsmMaxResponse  = 0x3000
+)
+
+// nsmMessage mirrors struct nsm_message: the request and response buffers as iovecs.
+type nsmMessage struct {
+	request  syscall.Iovec
+	response syscall.Iovec
+}
+
+// nsmRequest sends a CBOR-encoded request to the Nitro Secure Module and returns its CBOR-encoded
+// response. It only succeeds inside a Nitro Enclave.
+func nsmRequest(request []byte) ([]byte, error) {
+	device, err := os.OpenFile(nsmDevicePath, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer device.Close()
+
+	response := make([]byte, nsmMaxResponse)
+	message := nsmMessage{}
+	message.request.Base = &request[0]
+	message.request.SetLen(len(request))
+	message.response.Base = &response[0]
+	message.response.SetLen(len(response))
+
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, device.Fd(), nsmIoctlRequest, uintptr(unsafe.Pointer(&message))); errno != 0 {
+		return nil, errno
+	}
+	return response[:message.response.Len], nil
+}
@@ -0,0 +1,13 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !linux
+// +build !linux
+
+package main
+
+import "fmt"
+
+func nsmRequest(request []byte) ([]byte, error) {
+	return nil, fmt.Errorf("Nitro Enclave attestation is only supported on Linux")
+}
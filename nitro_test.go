@@ -0,0 +1,123 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestNitroAttestationRequest(t *testing.T) {
+	userData := bytes.Repeat([]byte{0xAA}, 32)
+	decoded, rest, err := decodeCBOR(nitroAttestationRequest(userData, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rest) != 0 {
+		t.Fatal("Trailing data after request")
+	}
+
+	attestation, ok := decoded.(map[string]interface{})["Attestation"].(map[string]interface{})
+	if !ok {
+		t.Fatal("Request is not an Attestation request")
+	}
+	if !bytes.Equal(attestation["user_data"].([]byte), userData) {
+		t.Fatal("User data mismatch")
+	}
+	if attestation["nonce"] != nil || attestation["public_key"] != nil {
+		t.Fatal("Expected null nonce and public key")
+	}
+}
+
+func TestNitroAttestationDocument(t *testing.T) {
+	document := bytes.Repeat([]byte{0x42}, 300)
+	response := appendCBORHead(nil, cborMap, 1)
+	response = appendCBORText(response, "Attestation")
+	response = appendCBORHead(response, cborMap, 1)
+	response = appendCBORText(response, "document")
+	response = appendCBORBytes(response, document)
+
+	decoded, err := nitroAttestationDocument(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decoded, document) {
+		t.Fatal("Document mismatch")
+	}
+
+	errorResponse := appendCBORHead(nil, cborMap, 1)
+	errorResponse = appendCBORText(errorResponse, "Error")
+	errorResponse = appendCBORText(errorResponse, "InvalidArgument")
+	if _, err := nitroAttestationDocument(errorResponse); err == nil {
+		t.Fatal("Expected NSM error to be returned")
+	}
+}
+
+func TestEnclaveKeySource(t *testing.T) {
+	if err := checkEnclaveKeySource("env"); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkEnclaveKeySource("file:///seed"); err == nil {
+		t.Fatal("Expected an external key source to be rejected")
+	}
+	t.Setenv(secretSeedEnvironmentVariable, "00")
+	if err := checkEnclaveKeySource(""); err == nil {
+		t.Fatal("Expected an externally provided seed to be rejected")
+	}
+}
+
+func TestConfigAttestation(t *testing.T) {
+	gateway := createMockEchoGatewayServer(t)
+	requests := 0
+	cache := newAttestationCache()
+	cache.request = func(request []byte) ([]byte, error) {
+		requests++
+		decoded, _, err := decodeCBOR(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		attestation := decoded.(map[string]interface{})["Attestation"].(map[string]interface{})
+		if attestation["nonce"] != nil {
+			t.Fatal("Expected cached documents to have no nonce")
+		}
+		response := appendCBORHead(nil, cborMap, 1)
+		response = appendCBORText(response, "Attestation")
+		response = appendCBORHead(response, cborMap, 1)
+		response = appendCBORText(response, "document")
+		return appendCBORBytes(response, append([]byte("document for "), attestation["user_data"].([]byte)...)), nil
+	}
+	gateway.attestation = cache
+
+	rr := httptest.NewRecorder()
+	gateway.configHandler(rr, httptest.NewRequest(http.MethodGet, configEndpoint, nil))
+	if rr.Code != http.StatusOK || rr.Header().Get("Link") != `</attestation>; rel="attestation"` {
+		t.Fatalf("Unexpected config response %d with link %q", rr.Code, rr.Header().Get("Link"))
+	}
+	commitment := rr.Header().Get(configAttestationHeader)
+
+	rr = httptest.NewRecorder()
+	gateway.attestationHandler(rr, httptest.NewRequest(http.MethodGet, attestationEndpoint, nil))
+	document, _ := ioutil.ReadAll(rr.Body)
+	digest := sha256.Sum256(document)
+	if commitment != "sha-256="+base64.StdEncoding.EncodeToString(digest[:]) {
+		t.Fatalf("Config response does not commit to the attestation document: %q", commitment)
+	}
+	if !bytes.Equal(document, append([]byte("document for "), configsDigest(gateway.keyring)...)) || requests != 1 {
+		t.Fatalf("Unexpected attestation document %q after %d requests", document, requests)
+	}
+
+	// Documents are requested again when their certificates come close to expiring
+	cache.now = func() time.Time { return time.Now().Add(2 * attestationCacheDuration) }
+	rr = httptest.NewRecorder()
+	gateway.configHandler(rr, httptest.NewRequest(http.MethodGet, configEndpoint, nil))
+	if rr.Header().Get(configAttestationHeader) != commitment || requests != 2 {
+		t.Fatalf("Expected the attestation document to be requested again, got %d requests", requests)
+	}
+}
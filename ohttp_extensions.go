@@ -0,0 +1,102 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// OHTTPExtension is an extension carried in the header of an encapsulated request, next to the key ID and
+// the ciphersuite. The header of RFC 9458 requests carries no extensions, so their extension list is always
+// empty, but handlers and policies are written against this API so that extensions of future header formats
+// only need to be parsed and passed to checkOHTTPExtensions.
+type OHTTPExtension struct {
+	Type  uint16
+	Value []byte
+}
+
+// OHTTPExtensions are the extensions of an encapsulated request, in the order of the request header.
+type OHTTPExtensions []OHTTPExtension
+
+// Get returns the value of the first extension of extensionType.
+func (e OHTTPExtensions) Get(extensionType uint16) ([]byte, bool) {
+	for _, extension := range e {
+		if extension.Type == extensionType {
+			return extension.Value, true
+		}
+	}
+	return nil, false
+}
+
+const (
+	// Policies for extensions that no handler registered
+	unknownOHTTPExtensionsIgnore = "ignore"
+	unknownOHTTPExtensionsReject = "reject"
+)
+
+var ohttpExtensions = struct {
+	sync.Mutex
+	// known holds the type of each registered extension
+	known         map[uint16]bool
+	rejectUnknown bool
+}{known: make(map[uint16]bool)}
+
+// RegisterOHTTPExtension makes extensions of extensionType available to handlers through
+// OHTTPExtensionsFromContext. It panics if extensionType is already registered. Extensions can not be
+// required, since RFC 9458 requests carry none and requiring one would reject all traffic.
+func RegisterOHTTPExtension(extensionType uint16) {
+	ohttpExtensions.Lock()
+	defer ohttpExtensions.Unlock()
+	if _, ok := ohttpExtensions.known[extensionType]; ok {
+		panic(fmt.Sprintf("OHTTP extension %d registered twice", extensionType))
+	}
+	ohttpExtensions.known[extensionType] = true
+}
+
+// setUnknownOHTTPExtensionPolicy sets whether requests with extensions that are not registered are rejected,
+// or passed to handlers without them.
+func setUnknownOHTTPExtensionPolicy(policy string) error {
+	ohttpExtensions.Lock()
+	defer ohttpExtensions.Unlock()
+	switch policy {
+	case "", unknownOHTTPExtensionsIgnore:
+		ohttpExtensions.rejectUnknown = false
+	case unknownOHTTPExtensionsReject:
+		ohttpExtensions.rejectUnknown = true
+	default:
+		return fmt.Errorf("Unknown OHTTP extension policy %q", policy)
+	}
+	return nil
+}
+
+// checkOHTTPExtensions applies the extension policy to the extensions of a request, and returns the
+// registered extensions.
+func checkOHTTPExtensions(extensions OHTTPExtensions) (OHTTPExtensions, error) {
+	ohttpExtensions.Lock()
+	defer ohttpExtensions.Unlock()
+	known := OHTTPExtensions{}
+	for _, extension := range extensions {
+		if _, ok := ohttpExtensions.known[extension.Type]; ok {
+			known = append(known, extension)
+		} else if ohttpExtensions.rejectUnknown {
+			return nil, fmt.Errorf("Unknown OHTTP extension %d", extension.Type)
+		}
+	}
+	return known, nil
+}
+
+type ohttpExtensionsKey struct{}
+
+func withOHTTPExtensions(ctx context.Context, extensions OHTTPExtensions) context.Context {
+	return context.WithValue(ctx, ohttpExtensionsKey{}, extensions)
+}
+
+// OHTTPExtensionsFromContext returns the registered extensions of the encapsulated request that ctx, the
+// context of a ContextAppHandler, belongs to.
+func OHTTPExtensionsFromContext(ctx context.Context) OHTTPExtensions {
+	extensions, _ := ctx.Value(ohttpExtensionsKey{}).(OHTTPExtensions)
+	return extensions
+}
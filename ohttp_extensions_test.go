@@ -0,0 +1,98 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/chris-wood/ohttp-go"
+)
+
+// extensionsAppHandler records the extensions that its requests were handled with.
+type extensionsAppHandler struct {
+	extensions *OHTTPExtensions
+}
+
+func (h extensionsAppHandler) Handle(binaryRequest []byte, metrics Metrics) ([]byte, error) {
+	return h.HandleContext(context.Background(), binaryRequest, metrics)
+}
+
+func (h extensionsAppHandler) HandleContext(ctx context.Context, binaryRequest []byte, metrics Metrics) ([]byte, error) {
+	*h.extensions = OHTTPExtensionsFromContext(ctx)
+	return binaryRequest, nil
+}
+
+// registerTestOHTTPExtension registers extensionType for the duration of the test.
+func registerTestOHTTPExtension(t *testing.T, extensionType uint16) {
+	RegisterOHTTPExtension(extensionType)
+	t.Cleanup(func() {
+		ohttpExtensions.Lock()
+		defer ohttpExtensions.Unlock()
+		delete(ohttpExtensions.known, extensionType)
+	})
+}
+
+func TestCheckOHTTPExtensions(t *testing.T) {
+	registerTestOHTTPExtension(t, 0x10)
+	t.Cleanup(func() { setUnknownOHTTPExtensionPolicy(unknownOHTTPExtensionsIgnore) })
+	extensions := OHTTPExtensions{{Type: 0x20, Value: []byte("unknown")}, {Type: 0x10, Value: []byte("known")}}
+
+	known, err := checkOHTTPExtensions(extensions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, ok := known.Get(0x10); !ok || string(value) != "known" || len(known) != 1 {
+		t.Fatalf("Unexpected extensions %v", known)
+	}
+
+	if err := setUnknownOHTTPExtensionPolicy(unknownOHTTPExtensionsReject); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := checkOHTTPExtensions(extensions); err == nil {
+		t.Fatal("Expected the unknown extension to be rejected")
+	}
+	if _, err := checkOHTTPExtensions(extensions[1:]); err != nil {
+		t.Fatal(err)
+	}
+	if err := setUnknownOHTTPExtensionPolicy("require"); err == nil {
+		t.Fatal("Expected an invalid policy to be rejected")
+	}
+}
+
+func TestOHTTPExtensionsPolicy(t *testing.T) {
+	keyring := createKeyring(t)
+	var extensions OHTTPExtensions
+	handler := DefaultEncapsulationHandler{keyring: keyring, appHandler: extensionsAppHandler{extensions: &extensions}}
+	encapsulate := func() ohttp.EncapsulatedRequest {
+		req, _, err := ohttp.NewDefaultClient(keyring.Current()).EncapsulateRequest([]byte("hello"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return req
+	}
+	outerRequest := httptest.NewRequest(http.MethodPost, gatewayEndpoint, nil)
+
+	// RFC 9458 requests carry no extensions, so handlers see an empty list
+	registerTestOHTTPExtension(t, 0x10)
+	metrics := &MockMetrics{resultLabels: map[string]bool{}, tags: map[string]string{}}
+	if _, err := handler.Handle(outerRequest, encapsulate(), metrics); err != nil {
+		t.Fatal(err)
+	}
+	if extensions == nil || len(extensions) != 0 {
+		t.Fatalf("Unexpected extensions %v", extensions)
+	}
+
+	// and are not rejected by the unknown extension policy
+	if err := setUnknownOHTTPExtensionPolicy(unknownOHTTPExtensionsReject); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { setUnknownOHTTPExtensionPolicy(unknownOHTTPExtensionsIgnore) })
+	metrics = &MockMetrics{resultLabels: map[string]bool{}, tags: map[string]string{}}
+	if _, err := handler.Handle(outerRequest, encapsulate(), metrics); err != nil {
+		t.Fatal(err)
+	}
+}
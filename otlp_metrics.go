@@ -0,0 +1,339 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The OTLP exporter is configured with the environment variables of the OpenTelemetry specification.
+const (
+	otelMetricsExporterVariable          = "OTEL_METRICS_EXPORTER"
+	otelExporterEndpointVariable         = "OTEL_EXPORTER_OTLP_ENDPOINT"
+	otelExporterMetricsEndpointVariable  = "OTEL_EXPORTER_OTLP_METRICS_ENDPOINT"
+	otelExporterHeadersVariable          = "OTEL_EXPORTER_OTLP_HEADERS"
+	otelExporterMetricsHeadersVariable   = "OTEL_EXPORTER_OTLP_METRICS_HEADERS"
+	otelExporterProtocolVariable         = "OTEL_EXPORTER_OTLP_PROTOCOL"
+	otelExporterMetricsProtocolVariable  = "OTEL_EXPORTER_OTLP_METRICS_PROTOCOL"
+	otelExporterTimeoutVariable          = "OTEL_EXPORTER_OTLP_TIMEOUT"
+	otelExporterMetricsTimeoutVariable   = "OTEL_EXPORTER_OTLP_METRICS_TIMEOUT"
+	otelMetricExportIntervalVariable     = "OTEL_METRIC_EXPORT_INTERVAL"
+	otelServiceNameVariable              = "OTEL_SERVICE_NAME"
+	otelResourceAttributesVariable       = "OTEL_RESOURCE_ATTRIBUTES"
+	defaultOTLPEndpoint                  = "http://localhost:4318"
+	defaultOTLPTimeout                   = 10 * time.Second
+	defaultOTLPExportInterval            = 60 * time.Second
+	otlpMetricsPath                      = "/v1/metrics"
+	otlpProtocol                         = "http/json"
+	otlpCumulativeAggregationTemporality = 2
+	otlpResultsMetricName                = "ohttp_gateway.results"
+	otlpDurationMetricName               = "ohttp_gateway.stage.duration"
+	otlpSizeMetricName                   = "ohttp_gateway.message.size"
+	otlpInstrumentationScope             = "github.com/cloudflare/app-gateway-go"
+)
+
+// otlpExporter pushes the counted results and stage durations to an OTLP/HTTP endpoint as cumulative sums
+// and histograms, encoded as JSON, which OpenTelemetry collectors accept without a protobuf dependency.
+type otlpExporter struct {
+	endpoint   string
+	headers    http.Header
+	resource   map[string]string
+	interval   time.Duration
+	client     *http.Client
+	aggregator *metricsAggregator
+	// start is the start time of the cumulative sums
+	start time.Time
+}
+
+// otelEnv returns the value of the metrics-specific variable, or of the general one if it is not set.
+func otelEnv(metricsKey, key string) string {
+	if value := os.Getenv(metricsKey); value != "" {
+		return value
+	}
+	return os.Getenv(key)
+}
+
+// parseOTELList parses a comma-separated list of key=value pairs with URL-encoded values, as used by
+// OTEL_EXPORTER_OTLP_HEADERS and OTEL_RESOURCE_ATTRIBUTES.
+func parseOTELList(value string) (map[string]string, error) {
+	pairs := map[string]string{}
+	for _, pair := range splitList(value) {
+		i := strings.IndexByte(pair, '=')
+		if i <= 0 {
+			return nil, fmt.Errorf("Invalid key-value pair %q", pair)
+		}
+		decoded, err := url.PathUnescape(strings.TrimSpace(pair[i+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid value of %q: %s", pair[:i], err)
+		}
+		pairs[strings.TrimSpace(pair[:i])] = decoded
+	}
+	return pairs, nil
+}
+
+// otelMilliseconds parses a duration in milliseconds, as used by the timeouts and the export interval.
+func otelMilliseconds(key, value string, defaultValue time.Duration) (time.Duration, error) {
+	if value == "" {
+		return defaultValue, nil
+	}
+	milliseconds, err := strconv.ParseUint(value, 10, 32)
+	if err != nil || milliseconds == 0 {
+		return 0, fmt.Errorf("Invalid %s %q", key, value)
+	}
+	return time.Duration(milliseconds) * time.Millisecond, nil
+}
+
+// newOTLPExporterFromEnvironment returns the exporter configured by the OTEL_* environment variables, or nil
+// if OTEL_METRICS_EXPORTER is not "otlp".
+func newOTLPExporterFromEnvironment(aggregator *metricsAggregator) (*otlpExporter, error) {
+	switch exporter := os.Getenv(otelMetricsExporterVariable); exporter {
+	case "", "none":
+		return nil, nil
+	case "otlp":
+	default:
+		return nil, fmt.Errorf("Unsupported %s %q", otelMetricsExporterVariable, exporter)
+	}
+	if protocol := otelEnv(otelExporterMetricsProtocolVariable, otelExporterProtocolVariable); protocol != "" && protocol != otlpProtocol {
+		return nil, fmt.Errorf("Unsupported OTLP protocol %q, only %s is supported", protocol, otlpProtocol)
+	}
+
+	endpoint := os.Getenv(otelExporterMetricsEndpointVariable)
+	if endpoint == "" {
+		base := os.Getenv(otelExporterEndpointVariable)
+		if base == "" {
+			base = defaultOTLPEndpoint
+		}
+		endpoint = strings.TrimSuffix(base, "/") + otlpMetricsPath
+	}
+	if u, err := url.Parse(endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("Invalid OTLP endpoint %q", endpoint)
+	}
+
+	headers := http.Header{}
+	for _, key := range []string{otelExporterHeadersVariable, otelExporterMetricsHeadersVariable} {
+		pairs, err := parseOTELList(os.Getenv(key))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid %s: %s", key, err)
+		}
+		for name, value := range pairs {
+			headers.Set(name, value)
+		}
+	}
+	resource, err := parseOTELList(os.Getenv(otelResourceAttributesVariable))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid %s: %s", otelResourceAttributesVariable, err)
+	}
+	if serviceName := os.Getenv(otelServiceNameVariable); serviceName != "" {
+		resource["service.name"] = serviceName
+	} else if resource["service.name"] == "" {
+		resource["service.name"] = "ohttp_gateway"
+	}
+	if resource["service.version"] == "" {
+		resource["service.version"] = version
+	}
+
+	timeoutKey := otelExporterMetricsTimeoutVariable
+	if os.Getenv(timeoutKey) == "" {
+		timeoutKey = otelExporterTimeoutVariable
+	}
+	timeout, err := otelMilliseconds(timeoutKey, os.Getenv(timeoutKey), defaultOTLPTimeout)
+	if err != nil {
+		return nil, err
+	}
+	interval, err := otelMilliseconds(otelMetricExportIntervalVariable, os.Getenv(otelMetricExportIntervalVariable), defaultOTLPExportInterval)
+	if err != nil {
+		return nil, err
+	}
+
+	return &otlpExporter{
+		endpoint:   endpoint,
+		headers:    headers,
+		resource:   resource,
+		interval:   interval,
+		client:     &http.Client{Timeout: timeout},
+		aggregator: aggregator,
+		start:      time.Now(),
+	}, nil
+}
+
+type otlpAnyValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+func otlpAttributes(attributes map[string]string) []otlpKeyValue {
+	keyValues := make([]otlpKeyValue, 0, len(attributes))
+	for key, value := range attributes {
+		keyValues = append(keyValues, otlpKeyValue{Key: key, Value: otlpAnyValue{StringValue: value}})
+	}
+	return keyValues
+}
+
+// The 64-bit integers of OTLP/JSON are encoded as strings.
+type otlpNumberDataPoint struct {
+	Attributes        []otlpKeyValue `json:"attributes"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	TimeUnixNano      string         `json:"timeUnixNano"`
+	AsInt             string         `json:"asInt"`
+}
+
+type otlpSum struct {
+	DataPoints             []otlpNumberDataPoint `json:"dataPoints"`
+	AggregationTemporality int                   `json:"aggregationTemporality"`
+	IsMonotonic            bool                  `json:"isMonotonic"`
+}
+
+type otlpHistogramDataPoint struct {
+	Attributes        []otlpKeyValue `json:"attributes"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	TimeUnixNano      string         `json:"timeUnixNano"`
+	Count             string         `json:"count"`
+	Sum               float64        `json:"sum"`
+	BucketCounts      []string       `json:"bucketCounts"`
+	ExplicitBounds    []float64      `json:"explicitBounds"`
+}
+
+type otlpHistogram struct {
+	DataPoints             []otlpHistogramDataPoint `json:"dataPoints"`
+	AggregationTemporality int                      `json:"aggregationTemporality"`
+}
+
+type otlpMetric struct {
+	Name        string         `json:"name"`
+	Description string         `json:"description,omitempty"`
+	Unit        string         `json:"unit,omitempty"`
+	Sum         *otlpSum       `json:"sum,omitempty"`
+	Histogram   *otlpHistogram `json:"histogram,omitempty"`
+}
+
+type otlpScope struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+}
+
+type otlpScopeMetrics struct {
+	Scope   otlpScope    `json:"scope"`
+	Metrics []otlpMetric `json:"metrics"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpResourceMetrics struct {
+	Resource     otlpResource       `json:"resource"`
+	ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+}
+
+type otlpExportMetricsServiceRequest struct {
+	ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+}
+
+// request returns the export request of the aggregated metrics at now.
+func (e *otlpExporter) request(now time.Time) otlpExportMetricsServiceRequest {
+	start, timestamp := strconv.FormatInt(e.start.UnixNano(), 10), strconv.FormatInt(now.UnixNano(), 10)
+	sum := &otlpSum{DataPoints: []otlpNumberDataPoint{}, AggregationTemporality: otlpCumulativeAggregationTemporality, IsMonotonic: true}
+	for _, series := range e.aggregator.snapshot() {
+		sum.DataPoints = append(sum.DataPoints, otlpNumberDataPoint{
+			Attributes:        otlpAttributes(series.labels),
+			StartTimeUnixNano: start,
+			TimeUnixNano:      timestamp,
+			AsInt:             strconv.FormatUint(series.count, 10),
+		})
+	}
+	return otlpExportMetricsServiceRequest{ResourceMetrics: []otlpResourceMetrics{{
+		Resource: otlpResource{Attributes: otlpAttributes(e.resource)},
+		ScopeMetrics: []otlpScopeMetrics{{
+			Scope: otlpScope{Name: otlpInstrumentationScope, Version: version},
+			Metrics: []otlpMetric{{
+				Name:        otlpResultsMetricName,
+				Description: "Results fired by the gateway, by event and result.",
+				Unit:        "{result}",
+				Sum:         sum,
+			}, {
+				Name:        otlpDurationMetricName,
+				Description: "Durations of the stages of gateway events.",
+				Unit:        "s",
+				Histogram:   otlpHistograms(e.aggregator.histogramSnapshot(e.aggregator.durations), start, timestamp),
+			}, {
+				Name:        otlpSizeMetricName,
+				Description: "Sizes of the messages of gateway events.",
+				Unit:        "By",
+				Histogram:   otlpHistograms(e.aggregator.histogramSnapshot(e.aggregator.sizes), start, timestamp),
+			}},
+		}},
+	}}}
+}
+
+// otlpHistograms returns the cumulative histogram of histograms.
+func otlpHistograms(histograms []histogramSeries, start, timestamp string) *otlpHistogram {
+	histogram := &otlpHistogram{DataPoints: []otlpHistogramDataPoint{}, AggregationTemporality: otlpCumulativeAggregationTemporality}
+	for _, series := range histograms {
+		counts := make([]string, 0, len(series.counts))
+		for _, count := range series.counts {
+			counts = append(counts, strconv.FormatUint(count, 10))
+		}
+		histogram.DataPoints = append(histogram.DataPoints, otlpHistogramDataPoint{
+			Attributes:        otlpAttributes(series.labels),
+			StartTimeUnixNano: start,
+			TimeUnixNano:      timestamp,
+			Count:             strconv.FormatUint(series.count, 10),
+			Sum:               series.sum,
+			BucketCounts:      counts,
+			ExplicitBounds:    series.bounds,
+		})
+	}
+	return histogram
+}
+
+// export pushes the aggregated metrics to the endpoint.
+func (e *otlpExporter) export() error {
+	body, err := json.Marshal(e.request(time.Now()))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, e.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for name, values := range e.headers {
+		req.Header[name] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("OTLP endpoint responded with %s", resp.Status)
+	}
+	return nil
+}
+
+// run exports the aggregated metrics every interval. Failed exports are logged, and the next export carries the
+// cumulative counts that were missed.
+func (e *otlpExporter) run() {
+	for range time.Tick(e.interval) {
+		if err := e.export(); err != nil {
+			log.Printf("Cannot export metrics to %s: %s", e.endpoint, err)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestOTLPExporter(t *testing.T) {
+	var exported otlpExportMetricsServiceRequest
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != otlpMetricsPath || r.Header.Get("Content-Type") != "application/json" || r.Header.Get("Api-Key") != "secret key" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if err := json.NewDecoder(r.Body).Decode(&exported); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer collector.Close()
+
+	t.Setenv(otelMetricsExporterVariable, "otlp")
+	t.Setenv(otelExporterEndpointVariable, collector.URL+"/")
+	t.Setenv(otelExporterHeadersVariable, "api-key=secret%20key")
+	t.Setenv(otelResourceAttributesVariable, "deployment.environment=prod,service.name=ignored")
+	t.Setenv(otelServiceNameVariable, "edge_gateway")
+	t.Setenv(otelMetricExportIntervalVariable, "5000")
+	aggregator := newMetricsAggregator()
+	exporter, err := newOTLPExporterFromEnvironment(aggregator)
+	if err != nil || exporter == nil {
+		t.Fatalf("Exporter was not configured (%v)", err)
+	}
+	if exporter.interval != 5*time.Second || exporter.client.Timeout != defaultOTLPTimeout {
+		t.Fatalf("Unexpected interval %s and timeout %s", exporter.interval, exporter.client.Timeout)
+	}
+
+	for i := 0; i < 3; i++ {
+		metrics := aggregator.Create(metricsEventGatewayRequest)
+		metrics.Tag(metricsTagKeyID, "1")
+		metrics.Fire(metricsResultSuccess)
+	}
+	aggregator.Create(metricsEventGatewayRequest).Duration(metricsStageDecapsulation, 200*time.Microsecond)
+	aggregator.Create(metricsEventGatewayRequest).Size(metricsSizeEncapsulatedResponse, 5000)
+	if err := exporter.export(); err != nil {
+		t.Fatal(err)
+	}
+
+	resource := map[string]string{}
+	for _, attribute := range exported.ResourceMetrics[0].Resource.Attributes {
+		resource[attribute.Key] = attribute.Value.StringValue
+	}
+	if resource["service.name"] != "edge_gateway" || resource["deployment.environment"] != "prod" {
+		t.Fatalf("Unexpected resource %v", resource)
+	}
+	metric := exported.ResourceMetrics[0].ScopeMetrics[0].Metrics[0]
+	if metric.Name != otlpResultsMetricName || metric.Sum == nil || !metric.Sum.IsMonotonic || len(metric.Sum.DataPoints) != 1 {
+		t.Fatalf("Unexpected metric %+v", metric)
+	}
+	point := metric.Sum.DataPoints[0]
+	attributes := map[string]string{}
+	for _, attribute := range point.Attributes {
+		attributes[attribute.Key] = attribute.Value.StringValue
+	}
+	if point.AsInt != "3" || attributes["event_name"] != metricsEventGatewayRequest || attributes["result"] != metricsResultSuccess || attributes[metricsTagKeyID] != "1" {
+		t.Fatalf("Unexpected data point %+v", point)
+	}
+
+	histogram := exported.ResourceMetrics[0].ScopeMetrics[0].Metrics[1]
+	if histogram.Name != otlpDurationMetricName || histogram.Histogram == nil || len(histogram.Histogram.DataPoints) != 1 {
+		t.Fatalf("Unexpected metric %+v", histogram)
+	}
+	durations := histogram.Histogram.DataPoints[0]
+	if durations.Count != "1" || len(durations.BucketCounts) != len(durationBuckets)+1 || durations.BucketCounts[1] != "1" {
+		t.Fatalf("Unexpected histogram data point %+v", durations)
+	}
+	histogram = exported.ResourceMetrics[0].ScopeMetrics[0].Metrics[2]
+	if histogram.Name != otlpSizeMetricName || histogram.Unit != "By" || histogram.Histogram == nil || len(histogram.Histogram.DataPoints) != 1 {
+		t.Fatalf("Unexpected metric %+v", histogram)
+	}
+	sizes := histogram.Histogram.DataPoints[0]
+	if sizes.Sum != 5000 || len(sizes.ExplicitBounds) != len(sizeBuckets) || sizes.BucketCounts[4] != "1" {
+		t.Fatalf("Unexpected histogram data point %+v", sizes)
+	}
+
+	t.Setenv(otelExporterProtocolVariable, "grpc")
+	if _, err := newOTLPExporterFromEnvironment(aggregator); err == nil {
+		t.Fatal("Expected an unsupported protocol to be rejected")
+	}
+	t.Setenv(otelMetricsExporterVariable, "none")
+	if exporter, err := newOTLPExporterFromEnvironment(aggregator); err != nil || exporter != nil {
+		t.Fatal("Expected no exporter to be configured")
+	}
+}
@@ -0,0 +1,209 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// Privacy Pass tokens (RFC 9577) of the publicly verifiable type (RFC 9578, Section 6) let relays prove
+// that a client was authorized by an issuer, without the gateway learning which client it was.
+const (
+	privateTokenScheme     = "PrivateToken"
+	privateTokenType       = 0x0002
+	privateTokenNonceSize  = 32
+	privateTokenDigestSize = 32
+	privateTokenKeyIDSize  = 32
+	privateTokenKeyBits    = 2048
+	privateTokenInputSize  = 2 + privateTokenNonceSize + privateTokenDigestSize + privateTokenKeyIDSize
+	privateTokenSize       = privateTokenInputSize + privateTokenKeyBits/8
+
+	defaultPrivacyPassReplayWindow = 24 * time.Hour
+)
+
+var (
+	oidRSAEncryption = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
+	oidRSASSAPSS     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 10}
+)
+
+// privacyPassVerifier verifies the token in the Authorization header of gateway requests against the
+// token keys of an issuer. Tokens are redeemed without a redemption context, so they are not bound to
+// the request, and a token is rejected if its nonce was already redeemed within the replay window.
+type privacyPassVerifier struct {
+	challenge []byte
+	digest    [sha256.Size]byte
+	keys      map[[sha256.Size]byte]*rsa.PublicKey
+	// tokenKeys are the encoded token keys, in the order of the token key configuration
+	tokenKeys    []string
+	replayWindow time.Duration
+	now          func() time.Time
+
+	mu sync.Mutex
+	// Redeemed nonces are kept for one to two replay windows, in the current and the previous generation
+	nonces, previousNonces map[[privateTokenNonceSize]byte]bool
+	rotated                time.Time
+}
+
+// newPrivacyPassVerifier accepts tokens for the TokenChallenge of issuerName signed with one of the
+// comma-separated base64url-encoded token keys, as served in the token-keys of the issuer directory.
+func newPrivacyPassVerifier(issuerName, tokenKeys string, replayWindow time.Duration) (*privacyPassVerifier, error) {
+	if issuerName == "" {
+		return nil, fmt.Errorf("Missing issuer name")
+	}
+	if replayWindow <= 0 {
+		replayWindow = defaultPrivacyPassReplayWindow
+	}
+	v := &privacyPassVerifier{
+		challenge:      marshalTokenChallenge(issuerName),
+		keys:           make(map[[sha256.Size]byte]*rsa.PublicKey),
+		replayWindow:   replayWindow,
+		now:            time.Now,
+		nonces:         make(map[[privateTokenNonceSize]byte]bool),
+		previousNonces: make(map[[privateTokenNonceSize]byte]bool),
+	}
+	v.digest = sha256.Sum256(v.challenge)
+	for _, encoded := range splitList(tokenKeys) {
+		der, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(encoded, "="))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid token key %q: %s", encoded, err)
+		}
+		key, err := parseTokenKey(der)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid token key %q: %s", encoded, err)
+		}
+		v.keys[sha256.Sum256(der)] = key
+		v.tokenKeys = append(v.tokenKeys, base64.RawURLEncoding.EncodeToString(der))
+	}
+	if len(v.keys) == 0 {
+		return nil, fmt.Errorf("Missing token keys")
+	}
+	return v, nil
+}
+
+// marshalTokenChallenge encodes the TokenChallenge of issuerName without redemption context and origin
+// info (RFC 9577, Section 2.1).
+func marshalTokenChallenge(issuerName string) []byte {
+	b := cryptobyte.NewBuilder(nil)
+	b.AddUint16(privateTokenType)
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes([]byte(issuerName))
+	})
+	b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {})
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {})
+	return b.BytesOrPanic()
+}
+
+// parseTokenKey parses the SubjectPublicKeyInfo of a token key, which issuers encode with the RSASSA-PSS
+// algorithm identifier that x509.ParsePKIXPublicKey does not support.
+func parseTokenKey(der []byte) (*rsa.PublicKey, error) {
+	var spki struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	if rest, err := asn1.Unmarshal(der, &spki); err != nil || len(rest) != 0 {
+		return nil, fmt.Errorf("Invalid SubjectPublicKeyInfo")
+	}
+	if !spki.Algorithm.Algorithm.Equal(oidRSASSAPSS) && !spki.Algorithm.Algorithm.Equal(oidRSAEncryption) {
+		return nil, fmt.Errorf("Unsupported algorithm %s", spki.Algorithm.Algorithm)
+	}
+	key, err := x509.ParsePKCS1PublicKey(spki.PublicKey.RightAlign())
+	if err != nil {
+		return nil, err
+	}
+	if key.N.BitLen() != privateTokenKeyBits {
+		return nil, fmt.Errorf("Token keys must have %d bits, not %d", privateTokenKeyBits, key.N.BitLen())
+	}
+	return key, nil
+}
+
+// parsePrivateTokenAuthorization returns the token of a PrivateToken Authorization header.
+func parsePrivateTokenAuthorization(authorization string) ([]byte, error) {
+	scheme, params := authorization, ""
+	if i := strings.IndexByte(authorization, ' '); i >= 0 {
+		scheme, params = authorization[:i], authorization[i+1:]
+	}
+	if !strings.EqualFold(scheme, privateTokenScheme) {
+		return nil, fmt.Errorf("Missing %s authorization", privateTokenScheme)
+	}
+	for _, param := range strings.Split(params, ",") {
+		name, value := strings.TrimSpace(param), ""
+		if i := strings.IndexByte(name, '='); i >= 0 {
+			name, value = strings.TrimSpace(name[:i]), strings.Trim(strings.TrimSpace(name[i+1:]), `"`)
+		}
+		if strings.EqualFold(name, "token") {
+			return base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "="))
+		}
+	}
+	return nil, fmt.Errorf("Missing token parameter")
+}
+
+// verify returns an error unless r is authorized with a valid token that was not redeemed before.
+func (v *privacyPassVerifier) verify(r *http.Request) error {
+	token, err := parsePrivateTokenAuthorization(r.Header.Get("Authorization"))
+	if err != nil {
+		return err
+	}
+	if len(token) != privateTokenSize || binary.BigEndian.Uint16(token) != privateTokenType {
+		return fmt.Errorf("Unsupported token")
+	}
+	var nonce [privateTokenNonceSize]byte
+	copy(nonce[:], token[2:])
+	if !bytes.Equal(token[2+privateTokenNonceSize:2+privateTokenNonceSize+privateTokenDigestSize], v.digest[:]) {
+		return fmt.Errorf("Token was issued for another challenge")
+	}
+	var keyID [sha256.Size]byte
+	copy(keyID[:], token[2+privateTokenNonceSize+privateTokenDigestSize:])
+	key, ok := v.keys[keyID]
+	if !ok {
+		return fmt.Errorf("Token was signed with an unknown key")
+	}
+	digest := sha512.Sum384(token[:privateTokenInputSize])
+	options := &rsa.PSSOptions{SaltLength: sha512.Size384, Hash: crypto.SHA384}
+	if err := rsa.VerifyPSS(key, crypto.SHA384, digest[:], token[privateTokenInputSize:], options); err != nil {
+		return fmt.Errorf("Invalid token signature")
+	}
+	return v.redeem(nonce)
+}
+
+// redeem records nonce as redeemed, or returns an error if it already was.
+func (v *privacyPassVerifier) redeem(nonce [privateTokenNonceSize]byte) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if now := v.now(); now.Sub(v.rotated) >= v.replayWindow {
+		v.previousNonces, v.nonces = v.nonces, make(map[[privateTokenNonceSize]byte]bool)
+		v.rotated = now
+	}
+	if v.nonces[nonce] || v.previousNonces[nonce] {
+		return fmt.Errorf("Token was already redeemed")
+	}
+	v.nonces[nonce] = true
+	return nil
+}
+
+// challengeHeader returns the WWW-Authenticate header of unauthorized responses, which challenges the
+// relay for a token of each token key.
+func (v *privacyPassVerifier) challengeHeader() string {
+	challenge := base64.RawURLEncoding.EncodeToString(v.challenge)
+	challenges := make([]string, 0, len(v.tokenKeys))
+	for _, tokenKey := range v.tokenKeys {
+		challenges = append(challenges, fmt.Sprintf(`%s challenge="%s", token-key="%s"`, privateTokenScheme, challenge, tokenKey))
+	}
+	return strings.Join(challenges, ", ")
+}
@@ -0,0 +1,110 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chris-wood/ohttp-go"
+)
+
+// issueToken returns a token for challenge signed with key. The signature of a blind RSA token is an
+// RSASSA-PSS signature of the token input, so it is computed directly.
+func issueToken(t *testing.T, key *rsa.PrivateKey, challenge []byte) string {
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := make([]byte, 2, privateTokenSize)
+	binary.BigEndian.PutUint16(token, privateTokenType)
+	nonce := make([]byte, privateTokenNonceSize)
+	rand.Read(nonce)
+	digest, keyID := sha256.Sum256(challenge), sha256.Sum256(der)
+	token = append(append(append(token, nonce...), digest[:]...), keyID[:]...)
+	input := sha512.Sum384(token)
+	signature, err := rsa.SignPSS(rand.Reader, key, crypto.SHA384, input[:], &rsa.PSSOptions{SaltLength: sha512.Size384, Hash: crypto.SHA384})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(append(token, signature...))
+}
+
+func TestPrivacyPassVerification(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, privateTokenKeyBits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	verifier, err := newPrivacyPassVerifier("issuer.example", base64.RawURLEncoding.EncodeToString(der), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gateway := createMockEchoGatewayServer(t)
+	gateway.tokenVerifier = verifier
+	handler := http.HandlerFunc(gateway.gatewayHandler)
+
+	post := func(authorization string) *httptest.ResponseRecorder {
+		req, _, err := ohttp.NewDefaultClient(gateway.keyring.Current()).EncapsulateRequest([]byte("hello"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		request := httptest.NewRequest(http.MethodPost, echoEndpoint, bytes.NewReader(req.Marshal()))
+		request.Header.Set("Content-Type", ohttpRequestContentType)
+		if authorization != "" {
+			request.Header.Set("Authorization", authorization)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, request)
+		return rr
+	}
+
+	token := issueToken(t, key, verifier.challenge)
+	if rr := post(`PrivateToken token="` + token + `"`); rr.Code != http.StatusOK {
+		t.Fatalf("Expected the token to be accepted, got %d", rr.Code)
+	}
+	otherKey, _ := rsa.GenerateKey(rand.Reader, privateTokenKeyBits)
+	for name, authorization := range map[string]string{
+		"missing":         "",
+		"replayed":        `PrivateToken token="` + token + `"`,
+		"other scheme":    "Bearer " + token,
+		"other challenge": `PrivateToken token="` + issueToken(t, key, marshalTokenChallenge("other.example")) + `"`,
+		"other key":       `PrivateToken token="` + issueToken(t, otherKey, verifier.challenge) + `"`,
+		"malformed":       `PrivateToken token="AAAA"`,
+	} {
+		rr := post(authorization)
+		if rr.Code != http.StatusUnauthorized {
+			t.Fatalf("Expected the %s token to be rejected, got %d", name, rr.Code)
+		}
+		if challenge := rr.Header().Get("WWW-Authenticate"); !strings.HasPrefix(challenge, `PrivateToken challenge="`) {
+			t.Fatalf("Unexpected challenge %q", challenge)
+		}
+	}
+
+	// Redeemed nonces are kept for at least one replay window, and forgotten after two
+	verifier.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	if rr := post(`PrivateToken token="` + token + `"`); rr.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected the token to be rejected within the replay window, got %d", rr.Code)
+	}
+	verifier.now = func() time.Time { return time.Now().Add(4 * time.Hour) }
+	if rr := post(`PrivateToken token="` + token + `"`); rr.Code != http.StatusOK {
+		t.Fatalf("Expected the token to be accepted again, got %d", rr.Code)
+	}
+
+	if _, err := newPrivacyPassVerifier("issuer.example", "", time.Hour); err == nil {
+		t.Fatal("Expected a verifier without token keys to be rejected")
+	}
+}
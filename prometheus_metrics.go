@@ -0,0 +1,84 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	adminMetricsEndpoint = "/metrics"
+
+	prometheusContentType = "text/plain; version=0.0.4; charset=utf-8"
+)
+
+// prometheusHandler serves the counted results, stage durations, and message sizes in the Prometheus text
+// exposition format.
+type prometheusHandler struct {
+	metricsName         string
+	durationMetricsName string
+	sizeMetricsName     string
+	aggregator          *metricsAggregator
+}
+
+func (h prometheusHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# HELP %s Results fired by the gateway, by event and result.\n", h.metricsName)
+	fmt.Fprintf(&b, "# TYPE %s counter\n", h.metricsName)
+	for _, series := range h.aggregator.snapshot() {
+		fmt.Fprintf(&b, "%s{%s} %d\n", h.metricsName, formatPrometheusLabels(series.labels), series.count)
+	}
+	writePrometheusHistograms(&b, h.durationMetricsName, "Durations of the stages of gateway events, in seconds.", h.aggregator.histogramSnapshot(h.aggregator.durations))
+	writePrometheusHistograms(&b, h.sizeMetricsName, "Sizes of the messages of gateway events, in bytes.", h.aggregator.histogramSnapshot(h.aggregator.sizes))
+
+	w.Header().Set("Content-Type", prometheusContentType)
+	w.Write([]byte(b.String()))
+}
+
+// writePrometheusHistograms writes the histograms of the metric name, whose buckets are cumulative in
+// Prometheus.
+func writePrometheusHistograms(b *strings.Builder, name, help string, histograms []histogramSeries) {
+	fmt.Fprintf(b, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(b, "# TYPE %s histogram\n", name)
+	for _, histogram := range histograms {
+		labels := formatPrometheusLabels(histogram.labels)
+		cumulative := uint64(0)
+		for i, bound := range histogram.bounds {
+			cumulative += histogram.counts[i]
+			fmt.Fprintf(b, "%s_bucket{%s,le=\"%s\"} %d\n", name, labels, strconv.FormatFloat(bound, 'g', -1, 64), cumulative)
+		}
+		fmt.Fprintf(b, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels, histogram.count)
+		fmt.Fprintf(b, "%s_sum{%s} %s\n", name, labels, strconv.FormatFloat(histogram.sum, 'g', -1, 64))
+		fmt.Fprintf(b, "%s_count{%s} %d\n", name, labels, histogram.count)
+	}
+}
+
+// formatPrometheusLabels formats labels sorted by name, with the characters of their names that Prometheus
+// does not allow replaced by underscores, and their values escaped.
+func formatPrometheusLabels(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	escaper := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	formatted := make([]string, 0, len(names))
+	for _, name := range names {
+		formatted = append(formatted, fmt.Sprintf(`%s="%s"`, prometheusLabelName(name), escaper.Replace(labels[name])))
+	}
+	return strings.Join(formatted, ",")
+}
+
+func prometheusLabelName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, name)
+}
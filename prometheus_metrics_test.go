@@ -0,0 +1,76 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPrometheusMetrics(t *testing.T) {
+	aggregator := newMetricsAggregator()
+	statsd := &MockMetricsFactory{}
+	factory := multiMetricsFactory{statsd, aggregator}
+
+	for i := 0; i < 2; i++ {
+		metrics := factory.Create(metricsEventGatewayRequest)
+		metrics.Tag(metricsTagKeyID, "1")
+		metrics.Fire(metricsResultSuccess)
+	}
+	metrics := factory.Create(metricsEventGatewayRequest)
+	metrics.Duration(metricsStageTargetFetch, 30*time.Millisecond)
+	metrics.Duration(metricsStageTargetFetch, 2*time.Second)
+	metrics.Size(metricsSizeInnerRequest, 100)
+	metrics = factory.Create(metricsEventTargetHealthCheck)
+	metrics.Tag("upstream", `app"a.internal`)
+	metrics.ResponseStatus(http.MethodGet, http.StatusOK)
+	if len(statsd.metrics) != 4 || !statsd.metrics[3].resultLabels["GET_response_status_200"] {
+		t.Fatal("Results were not fired to every factory")
+	}
+
+	admin := adminServer{token: "admin-token", keyring: createKeyring(t), metrics: prometheusHandler{metricsName: "ohttp_gateway_results_total", durationMetricsName: "ohttp_gateway_stage_duration_seconds", sizeMetricsName: "ohttp_gateway_message_size_bytes", aggregator: aggregator}}
+	handler := admin.mux()
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, adminMetricsEndpoint, nil))
+	if rr.Code != http.StatusUnauthorized {
+		t.Fatalf("Unauthenticated metrics request yielded %d", rr.Code)
+	}
+
+	request := httptest.NewRequest(http.MethodGet, adminMetricsEndpoint, nil)
+	request.Header.Set("Authorization", "Bearer admin-token")
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, request)
+	if rr.Code != http.StatusOK || rr.Header().Get("Content-Type") != prometheusContentType {
+		t.Fatalf("Metrics request yielded %d with content type %q", rr.Code, rr.Header().Get("Content-Type"))
+	}
+	for _, line := range []string{
+		"# TYPE ohttp_gateway_results_total counter",
+		`ohttp_gateway_results_total{event_name="gateway_request",key_id="1",result="success"} 2`,
+		`ohttp_gateway_results_total{event_name="target_health_check",result="GET_response_status_200",upstream="app\"a.internal"} 1`,
+		"# TYPE ohttp_gateway_stage_duration_seconds histogram",
+		`ohttp_gateway_stage_duration_seconds_bucket{event_name="gateway_request",stage="target_fetch",le="0.025"} 0`,
+		`ohttp_gateway_stage_duration_seconds_bucket{event_name="gateway_request",stage="target_fetch",le="0.05"} 1`,
+		`ohttp_gateway_stage_duration_seconds_bucket{event_name="gateway_request",stage="target_fetch",le="2.5"} 2`,
+		`ohttp_gateway_stage_duration_seconds_bucket{event_name="gateway_request",stage="target_fetch",le="+Inf"} 2`,
+		`ohttp_gateway_stage_duration_seconds_sum{event_name="gateway_request",stage="target_fetch"} 2.03`,
+		`ohttp_gateway_stage_duration_seconds_count{event_name="gateway_request",stage="target_fetch"} 2`,
+		"# TYPE ohttp_gateway_message_size_bytes histogram",
+		`ohttp_gateway_message_size_bytes_bucket{event_name="gateway_request",message="inner_request",le="64"} 0`,
+		`ohttp_gateway_message_size_bytes_bucket{event_name="gateway_request",message="inner_request",le="256"} 1`,
+		`ohttp_gateway_message_size_bytes_sum{event_name="gateway_request",message="inner_request"} 100`,
+	} {
+		if !strings.Contains(rr.Body.String(), line+"\n") {
+			t.Fatalf("Missing %q in metrics:\n%s", line, rr.Body.String())
+		}
+	}
+
+	rr = httptest.NewRecorder()
+	adminServer{token: "admin-token"}.mux().ServeHTTP(rr, request)
+	if rr.Code != http.StatusNotFound {
+		t.Fatalf("Expected no metrics endpoint without Prometheus metrics, got %d", rr.Code)
+	}
+}
@@ -10,6 +10,9 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/url"
+
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
 )
 
 var requestMethodMap = map[Request_Method]string{
@@ -139,3 +142,25 @@ func responseToProtoHTTP(targetResponse *http.Response) (*Response, error) {
 		Body:       responseContent,
 	}, nil
 }
+
+// padProtoResponse sets the Padding of response so that its marshalled length is padded like that of a
+// binary HTTP response. The padding field adds a tag and a length to the response, so the bucket is moved
+// to the next one if no length of the padding fills it exactly.
+func padProtoResponse(response *Response, padding responsePadding) {
+	if !padding.powerOfTwo && padding.blockSize <= 0 {
+		return
+	}
+	response.Padding = nil
+	size := proto.Size(response)
+	// Padding is field 4 of Response
+	tagSize := protowire.SizeTag(4)
+	for target := size + tagSize + 2; ; target++ {
+		target = len(padding.pad(make([]byte, target)))
+		for lengthSize := 1; lengthSize <= protowire.SizeVarint(uint64(target)); lengthSize++ {
+			if n := target - size - tagSize - lengthSize; n > 0 && protowire.SizeVarint(uint64(n)) == lengthSize {
+				response.Padding = make([]byte, n)
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,204 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const redisTimeout = 10 * time.Second
+
+// redisError is an error reply sent by the Redis server.
+type redisError string
+
+func (e redisError) Error() string {
+	return string(e)
+}
+
+// redisClient is a minimal Redis client speaking RESP2 over a single connection, which is re-established
+// after any network error.
+type redisClient struct {
+	address  string
+	username string
+	password string
+	db       int
+	useTLS   bool
+
+	mu     sync.Mutex
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// newRedisClient builds a client for the server of a URL of the form
+// redis[s]://[[<user>]:<password>@]<host>[:<port>][?db=<db>]. A user authenticates as a Redis 6 ACL user,
+// and a password alone as the default user.
+func newRedisClient(redisURL *url.URL) (*redisClient, error) {
+	client := &redisClient{
+		address: redisURL.Host,
+		useTLS:  redisURL.Scheme == "rediss",
+	}
+	if redisURL.Port() == "" {
+		client.address = redisURL.Host + ":" + defaultRedisPort
+	}
+	if password, ok := redisURL.User.Password(); ok {
+		client.username = redisURL.User.Username()
+		client.password = password
+	}
+	if db := redisURL.Query().Get("db"); db != "" {
+		var err error
+		if client.db, err = strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("Invalid Redis database %q", db)
+		}
+	}
+	return client, nil
+}
+
+func (c *redisClient) connect() error {
+	dialer := &net.Dialer{Timeout: redisTimeout}
+	var conn net.Conn
+	var err error
+	if c.useTLS {
+		host, _, _ := net.SplitHostPort(c.address)
+		conn, err = tls.DialWithDialer(dialer, "tcp", c.address, &tls.Config{ServerName: host})
+	} else {
+		conn, err = dialer.Dial("tcp", c.address)
+	}
+	if err != nil {
+		return err
+	}
+	c.conn = conn
+	c.reader = bufio.NewReader(conn)
+
+	if c.password != "" {
+		auth := []string{"AUTH", c.password}
+		if c.username != "" {
+			auth = []string{"AUTH", c.username, c.password}
+		}
+		if _, err := c.roundTrip(auth...); err != nil {
+			c.close()
+			return err
+		}
+	}
+	if c.db != 0 {
+		if _, err := c.roundTrip("SELECT", strconv.Itoa(c.db)); err != nil {
+			c.close()
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *redisClient) close() {
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn = nil
+		c.reader = nil
+	}
+}
+
+// Do sends a command and returns its reply: a string for simple strings, an int64 for integers, a
+// []byte (or nil) for bulk strings, and an []interface{} for arrays. Error replies are returned as a
+// redisError.
+func (c *redisClient) Do(args ...string) (interface{}, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conn == nil {
+		if err := c.connect(); err != nil {
+			return nil, err
+		}
+	}
+	reply, err := c.roundTrip(args...)
+	if _, ok := err.(redisError); err != nil && !ok {
+		c.close()
+	}
+	return reply, err
+}
+
+func (c *redisClient) roundTrip(args ...string) (interface{}, error) {
+	c.conn.SetDeadline(time.Now().Add(redisTimeout))
+	if err := writeRedisCommand(c.conn, args); err != nil {
+		return nil, err
+	}
+	return readRedisReply(c.reader)
+}
+
+func writeRedisCommand(w io.Writer, args []string) error {
+	buf := []byte(fmt.Sprintf("*%d\r\n", len(args)))
+	for _, arg := range args {
+		buf = append(buf, fmt.Sprintf("$%d\r\n", len(arg))...)
+		buf = append(buf, arg...)
+		buf = append(buf, "\r\n"...)
+	}
+	_, err := w.Write(buf)
+	return err
+}
+
+func readRedisLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return "", fmt.Errorf("Malformed Redis reply")
+	}
+	return line[:len(line)-2], nil
+}
+
+func readRedisReply(r *bufio.Reader) (interface{}, error) {
+	line, err := readRedisLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if line == "" {
+		return nil, fmt.Errorf("Malformed Redis reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		length, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if length < 0 {
+			return nil, nil
+		}
+		data := make([]byte, length+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		return data[:length], nil
+	case '*':
+		count, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if count < 0 {
+			return nil, nil
+		}
+		elements := make([]interface{}, count)
+		for i := range elements {
+			if elements[i], err = readRedisReply(r); err != nil {
+				return nil, err
+			}
+		}
+		return elements, nil
+	default:
+		return nil, fmt.Errorf("Unexpected Redis reply type %q", line[0])
+	}
+}
@@ -0,0 +1,337 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultRedisKeystoreKey = "ohttp-gateway-keys"
+	defaultRedisPort        = "6379"
+
+	// How often replicas sync keys from Redis and renew the leader lease
+	redisKeystorePollInterval = 10 * time.Second
+	redisLeaderLeaseTTL       = 3 * redisKeystorePollInterval
+)
+
+// redisRenewLeaseScript extends the leader lease only if it is still held by this replica.
+const redisRenewLeaseScript = `if redis.call("get", KEYS[1]) == ARGV[1] then return redis.call("pexpire", KEYS[1], ARGV[2]) else return 0 end`
+
+// redisSaveScript stores the snapshot in KEYS[1] and increments its version in KEYS[2] only if the
+// version is still ARGV[2], and returns the new version, or 0 if another replica saved first.
+const redisSaveScript = `if tonumber(redis.call("get", KEYS[2]) or "0") ~= tonumber(ARGV[2]) then return 0 end
+redis.call("set", KEYS[1], ARGV[1])
+return redis.call("incr", KEYS[2])`
+
+// errRedisKeystoreConflict is the error of a save that lost to a concurrent save by another replica.
+var errRedisKeystoreConflict = errors.New("Redis keystore was changed by another replica")
+
+// RedisKeystore shares encrypted keyring snapshots between gateway replicas through Redis, so every replica
+// serves the same key configs and can decapsulate requests encapsulated to keys rotated in by any other.
+// Replicas elect a leader with a lease in Redis, and only the leader performs scheduled rotations. Every
+// save is a compare-and-set on the version of the snapshot, so that a replica whose keys changed
+// concurrently with those of another, such as by an admin rotation, adopts the stored keys instead of
+// overwriting them.
+type RedisKeystore struct {
+	client     *redisClient
+	key        string
+	versionKey string
+	lockKey    string
+	replicaID  string
+	keystoreCipher
+
+	// saveMu serializes saves, which each expect the version of the previous one
+	saveMu   sync.Mutex
+	mu       sync.Mutex
+	leader   bool
+	lastSeen []byte
+	// lastDigest is the digest of the snapshot last read from or written to Redis. Snapshots are sealed
+	// with a fresh key and nonce, so changes are detected by the digest of the plaintext.
+	lastDigest [sha256.Size]byte
+	// version is the version of the snapshot last read from or written to Redis
+	version int64
+}
+
+// newRedisKeystore builds a RedisKeystore from a URL of the form
+// redis[s]://[[<user>]:<password>@]<host>[:<port>][/<key>][?db=<db>].
+func newRedisKeystore(rawURL string, cipher keystoreCipher) (*RedisKeystore, error) {
+	keystoreURL, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid Redis keystore URL: %s", err)
+	}
+	if keystoreURL.Hostname() == "" {
+		return nil, fmt.Errorf("Redis keystore URL is missing a host")
+	}
+
+	client, err := newRedisClient(keystoreURL)
+	if err != nil {
+		return nil, err
+	}
+
+	key := strings.Trim(keystoreURL.Path, "/")
+	if key == "" {
+		key = defaultRedisKeystoreKey
+	}
+
+	hostname, _ := os.Hostname()
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return nil, err
+	}
+
+	return &RedisKeystore{
+		client:         client,
+		key:            key,
+		versionKey:     key + ":version",
+		lockKey:        key + ":leader",
+		replicaID:      hostname + "-" + hex.EncodeToString(suffix),
+		keystoreCipher: cipher,
+	}, nil
+}
+
+// load returns the stored snapshot, or nil if there is none, and its version.
+func (s *RedisKeystore) load() ([]byte, int64, error) {
+	reply, err := s.client.Do("MGET", s.key, s.versionKey)
+	if err != nil {
+		return nil, 0, err
+	}
+	values, ok := reply.([]interface{})
+	if !ok || len(values) != 2 {
+		return nil, 0, fmt.Errorf("Unexpected Redis reply to MGET")
+	}
+	encoded, _ := values[0].([]byte)
+	version := int64(0)
+	if value, ok := values[1].([]byte); ok {
+		if version, err = strconv.ParseInt(string(value), 10, 64); err != nil {
+			return nil, 0, fmt.Errorf("Invalid Redis keystore version %q", value)
+		}
+	}
+	return encoded, version, nil
+}
+
+// compareAndSet stores encoded if the stored snapshot is still at version, and returns the new version,
+// or errRedisKeystoreConflict if another replica saved first.
+func (s *RedisKeystore) compareAndSet(encoded []byte, version int64) (int64, error) {
+	reply, err := s.client.Do("EVAL", redisSaveScript, "2", s.key, s.versionKey, string(encoded), strconv.FormatInt(version, 10))
+	if err != nil {
+		return 0, err
+	}
+	saved, _ := reply.(int64)
+	if saved == 0 {
+		return 0, errRedisKeystoreConflict
+	}
+	return saved, nil
+}
+
+// snapshotDigest returns the SHA-256 digest of the serialized snapshot.
+func snapshotDigest(snapshot storedKeyring) ([sha256.Size]byte, error) {
+	plaintext, err := json.Marshal(snapshot)
+	if err != nil {
+		return [sha256.Size]byte{}, err
+	}
+	defer zeroize(plaintext)
+	return sha256.Sum256(plaintext), nil
+}
+
+// Save encrypts snapshot and stores it in Redis, unless another replica changed the stored snapshot since
+// it was last read or written, in which case errRedisKeystoreConflict is returned.
+func (s *RedisKeystore) Save(snapshot storedKeyring) error {
+	s.saveMu.Lock()
+	defer s.saveMu.Unlock()
+	return s.save(snapshot)
+}
+
+func (s *RedisKeystore) save(snapshot storedKeyring) error {
+	digest, err := snapshotDigest(snapshot)
+	if err != nil {
+		zeroizeSnapshot(snapshot)
+		return err
+	}
+	encoded, err := s.seal(snapshot)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	version := s.version
+	s.mu.Unlock()
+	if version, err = s.compareAndSet(encoded, version); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.lastSeen = encoded
+	s.lastDigest = digest
+	s.version = version
+	s.mu.Unlock()
+	return nil
+}
+
+// saveChanged saves a snapshot of keyring unless it is the snapshot last read from or written to Redis,
+// such as the keys of a snapshot that was just restored. The snapshot is only taken once the previous save
+// is done, so that an older change can not be written over a newer one.
+func (s *RedisKeystore) saveChanged(keyring *RotatingKeyring) error {
+	s.saveMu.Lock()
+	defer s.saveMu.Unlock()
+	snapshot := keyring.Snapshot()
+	digest, err := snapshotDigest(snapshot)
+	if err != nil {
+		zeroizeSnapshot(snapshot)
+		return err
+	}
+	s.mu.Lock()
+	unchanged := digest == s.lastDigest
+	s.mu.Unlock()
+	if unchanged {
+		zeroizeSnapshot(snapshot)
+		return nil
+	}
+	return s.save(snapshot)
+}
+
+// Attach restores keyring from Redis, or stores its keys there if no replica has done so yet. It then
+// writes every local change back to Redis, and starts syncing changes made by other replicas. A local
+// change that conflicts with a concurrent change of another replica is discarded for the stored keys.
+func (s *RedisKeystore) Attach(keyring *RotatingKeyring) error {
+	encoded, version, err := s.load()
+	if err != nil {
+		return err
+	}
+	if encoded == nil {
+		if encoded, err = s.seal(keyring.Snapshot()); err != nil {
+			return err
+		}
+		// Another replica may store its keys first, in which case they win
+		version, err = s.compareAndSet(encoded, version)
+		if err == errRedisKeystoreConflict {
+			encoded, version, err = s.load()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err := s.restore(keyring, encoded, version); err != nil {
+		return err
+	}
+	log.Printf("Restored %d gateway keys from Redis keystore %s", len(keyring.Configs()), s.key)
+
+	keyring.OnChange(func() {
+		err := s.saveChanged(keyring)
+		if err == errRedisKeystoreConflict {
+			log.Printf("Redis keystore %s was changed by another replica, discarding the local key change", s.key)
+			s.sync(keyring)
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to save Redis keystore %s: %s", s.key, err)
+		}
+	})
+	keyring.SetRotationLeader(s.Leader)
+	s.elect()
+	go s.run(keyring)
+	return nil
+}
+
+func (s *RedisKeystore) restore(keyring *RotatingKeyring, encoded []byte, version int64) error {
+	snapshot, err := s.open(encoded)
+	if err != nil {
+		return err
+	}
+	digest, err := snapshotDigest(snapshot)
+	if err != nil {
+		zeroizeSnapshot(snapshot)
+		return err
+	}
+
+	// The snapshot is recorded before it is applied, so that the change notification of the restore does
+	// not write it back, while local changes made meanwhile still differ from it and are saved
+	s.mu.Lock()
+	previousSeen, previousDigest, previousVersion := s.lastSeen, s.lastDigest, s.version
+	s.lastSeen, s.lastDigest, s.version = encoded, digest, version
+	s.mu.Unlock()
+	err = keyring.Restore(snapshot)
+	zeroizeSnapshot(snapshot)
+	if err != nil {
+		s.mu.Lock()
+		if s.lastDigest == digest {
+			s.lastSeen, s.lastDigest, s.version = previousSeen, previousDigest, previousVersion
+		}
+		s.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// Leader reports whether this replica currently holds the leader lease.
+func (s *RedisKeystore) Leader() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.leader
+}
+
+// elect acquires or renews the leader lease.
+func (s *RedisKeystore) elect() {
+	ttl := strconv.FormatInt(redisLeaderLeaseTTL.Milliseconds(), 10)
+	reply, err := s.client.Do("SET", s.lockKey, s.replicaID, "NX", "PX", ttl)
+	leader := err == nil && reply != nil
+	if err == nil && !leader {
+		reply, err = s.client.Do("EVAL", redisRenewLeaseScript, "1", s.lockKey, s.replicaID, ttl)
+		renewed, _ := reply.(int64)
+		leader = err == nil && renewed == 1
+	}
+	if err != nil {
+		log.Printf("Failed to renew Redis keystore leader lease: %s", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if leader != s.leader {
+		log.Printf("Replica %s leader status changed to %v", s.replicaID, leader)
+	}
+	s.leader = leader
+}
+
+// sync applies the snapshot in Redis to keyring if another replica changed it.
+func (s *RedisKeystore) sync(keyring *RotatingKeyring) {
+	encoded, version, err := s.load()
+	if err != nil {
+		log.Printf("Failed to read Redis keystore %s: %s", s.key, err)
+		return
+	}
+
+	s.mu.Lock()
+	unchanged := encoded == nil || version == s.version && bytes.Equal(encoded, s.lastSeen)
+	s.mu.Unlock()
+	if unchanged {
+		return
+	}
+
+	if err := s.restore(keyring, encoded, version); err != nil {
+		log.Printf("Failed to apply Redis keystore %s: %s", s.key, err)
+		return
+	}
+	log.Printf("Synced gateway keys from Redis keystore %s, current key ID is now %d", s.key, keyring.Current().ID)
+}
+
+func (s *RedisKeystore) run(keyring *RotatingKeyring) {
+	ticker := time.NewTicker(redisKeystorePollInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.elect()
+		s.sync(keyring)
+	}
+}
@@ -0,0 +1,238 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bufio"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeRedis serves the subset of Redis commands used by RedisKeystore from memory.
+type fakeRedis struct {
+	mu     sync.Mutex
+	values map[string]string
+	// auth holds the arguments of the last AUTH command
+	auth []string
+}
+
+func startFakeRedis(t *testing.T) string {
+	address, _ := startFakeRedisServer(t)
+	return address
+}
+
+func startFakeRedisServer(t *testing.T) (string, *fakeRedis) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	server := &fakeRedis{values: map[string]string{}}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn)
+		}
+	}()
+	return listener.Addr().String(), server
+}
+
+func (s *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		reply, err := readRedisReply(reader)
+		if err != nil {
+			return
+		}
+		args := []string{}
+		for _, arg := range reply.([]interface{}) {
+			args = append(args, string(arg.([]byte)))
+		}
+		conn.Write([]byte(s.execute(args)))
+	}
+}
+
+func (s *fakeRedis) execute(args []string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	bulk := func(key string) string {
+		value, ok := s.values[key]
+		if !ok {
+			return "$-1\r\n"
+		}
+		return "$" + strconv.Itoa(len(value)) + "\r\n" + value + "\r\n"
+	}
+	switch strings.ToUpper(args[0]) {
+	case "AUTH":
+		s.auth = args[1:]
+		return "+OK\r\n"
+	case "GET":
+		return bulk(args[1])
+	case "MGET":
+		reply := "*" + strconv.Itoa(len(args)-1) + "\r\n"
+		for _, key := range args[1:] {
+			reply += bulk(key)
+		}
+		return reply
+	case "SET":
+		if _, ok := s.values[args[1]]; ok && len(args) > 3 && strings.ToUpper(args[3]) == "NX" {
+			return "$-1\r\n"
+		}
+		s.values[args[1]] = args[2]
+		return "+OK\r\n"
+	case "EVAL":
+		if args[1] == redisSaveScript {
+			version, _ := strconv.Atoi(s.values[args[4]])
+			if strconv.Itoa(version) != args[6] {
+				return ":0\r\n"
+			}
+			s.values[args[3]] = args[5]
+			s.values[args[4]] = strconv.Itoa(version + 1)
+			return ":" + strconv.Itoa(version+1) + "\r\n"
+		}
+		if s.values[args[3]] == args[4] {
+			return ":1\r\n"
+		}
+		return ":0\r\n"
+	default:
+		return "-ERR unknown command\r\n"
+	}
+}
+
+func TestRedisKeystoreSharesKeys(t *testing.T) {
+	address := startFakeRedis(t)
+	cipher := keystoreCipher{passphrase: []byte("correct horse battery staple")}
+
+	first, err := newRedisKeystore("redis://"+address+"/test-keys", cipher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := newRedisKeystore("redis://"+address+"/test-keys", cipher)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	firstKeyring := createKeyring(t)
+	if err := first.Attach(firstKeyring); err != nil {
+		t.Fatal(err)
+	}
+	// The second replica starts with its own random key, but adopts the shared one
+	secondKeyring := createKeyring(t)
+	if err := second.Attach(secondKeyring); err != nil {
+		t.Fatal(err)
+	}
+	if !secondKeyring.Current().IsEqual(firstKeyring.Current()) {
+		t.Fatal("Replicas serve different keys")
+	}
+
+	if !first.Leader() || second.Leader() {
+		t.Fatal("Expected exactly the first replica to lead")
+	}
+
+	retired := firstKeyring.Current()
+	current, err := firstKeyring.Rotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second.sync(secondKeyring)
+	if !secondKeyring.Current().IsEqual(current) {
+		t.Fatal("Rotation was not synced to the other replica")
+	}
+	if _, ok := secondKeyring.Gateway(retired.ID); !ok {
+		t.Fatal("Synced keyring lost the retired key")
+	}
+
+	// A local change made while a synced snapshot is restored is still written back
+	if _, err := firstKeyring.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	revoked := -1
+	secondKeyring.OnChange(func() {
+		if revoked < 0 {
+			revoked = int(secondKeyring.Current().ID)
+			if err := secondKeyring.Revoke(uint8(revoked)); err != nil {
+				t.Error(err)
+			}
+		}
+	})
+	second.sync(secondKeyring)
+	first.sync(firstKeyring)
+	if !firstKeyring.Revoked(uint8(revoked)) || !firstKeyring.Current().IsEqual(secondKeyring.Current()) {
+		t.Fatal("Revocation during a restore was not written to Redis")
+	}
+}
+
+func TestRedisKeystoreConcurrentChanges(t *testing.T) {
+	address := startFakeRedis(t)
+	cipher := keystoreCipher{passphrase: []byte("correct horse battery staple")}
+
+	first, err := newRedisKeystore("redis://"+address+"/test-keys", cipher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := newRedisKeystore("redis://"+address+"/test-keys", cipher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	firstKeyring, secondKeyring := createKeyring(t), createKeyring(t)
+	if err := first.Attach(firstKeyring); err != nil {
+		t.Fatal(err)
+	}
+	if err := second.Attach(secondKeyring); err != nil {
+		t.Fatal(err)
+	}
+
+	// Both replicas rotate before syncing, so they mint the same key ID from different seeds. The second
+	// save conflicts, and that replica adopts the stored key instead of overwriting it.
+	current, err := firstKeyring.Rotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := secondKeyring.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	if !secondKeyring.Current().IsEqual(current) {
+		t.Fatal("Conflicting rotation overwrote the stored keys")
+	}
+	first.sync(firstKeyring)
+	if !firstKeyring.Current().IsEqual(current) {
+		t.Fatal("Stored keys changed after a conflicting rotation")
+	}
+}
+
+func TestRedisClientAuthenticatesACLUser(t *testing.T) {
+	address, server := startFakeRedisServer(t)
+	for rawURL, auth := range map[string]string{
+		"redis://gateway:secret@" + address: "gateway secret",
+		"redis://:secret@" + address:        "secret",
+	} {
+		redisURL, err := url.Parse(rawURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client, err := newRedisClient(redisURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := client.Do("GET", "key"); err != nil {
+			t.Fatal(err)
+		}
+		server.mu.Lock()
+		sent := strings.Join(server.auth, " ")
+		server.mu.Unlock()
+		if sent != auth {
+			t.Fatalf("Expected AUTH %s, got AUTH %s", auth, sent)
+		}
+	}
+}
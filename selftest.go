@@ -0,0 +1,72 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+
+	"github.com/chris-wood/ohttp-go"
+)
+
+const selfTestMessageLength = 32
+
+// selfTest encapsulates a random request to every config served by keyring, decapsulates it with the
+// matching gateway and sends an encapsulated response back, so that a seed or ciphersuite that does not
+// yield a working key pair is caught before the gateway accepts traffic.
+func selfTest(keyring Keyring, requestLabel, responseLabel string) error {
+	for _, config := range keyring.Configs() {
+		if err := selfTestConfig(keyring, config, requestLabel, responseLabel); err != nil {
+			return fmt.Errorf("Key ID %d: %s", config.ID, err)
+		}
+	}
+	return nil
+}
+
+func selfTestConfig(keyring Keyring, config ohttp.PublicConfig, requestLabel, responseLabel string) error {
+	gateway, ok := keyring.Gateway(config.ID)
+	if !ok {
+		return fmt.Errorf("No gateway for served config")
+	}
+
+	message := make([]byte, selfTestMessageLength)
+	if _, err := rand.Read(message); err != nil {
+		return err
+	}
+
+	client := ohttp.NewCustomClient(config, requestLabel, responseLabel)
+	req, context, err := client.EncapsulateRequest(message)
+	if err != nil {
+		return fmt.Errorf("Encapsulating request failed: %s", err)
+	}
+	encapsulatedReq, err := ohttp.UnmarshalEncapsulatedRequest(req.Marshal())
+	if err != nil {
+		return err
+	}
+	decapsulated, gatewayContext, err := gateway.DecapsulateRequest(encapsulatedReq)
+	if err != nil {
+		return fmt.Errorf("Decapsulating request failed: %s", err)
+	}
+	if !bytes.Equal(decapsulated, message) {
+		return fmt.Errorf("Decapsulated request does not match")
+	}
+
+	resp, err := gatewayContext.EncapsulateResponse(message)
+	if err != nil {
+		return fmt.Errorf("Encapsulating response failed: %s", err)
+	}
+	encapsulatedResp, err := ohttp.UnmarshalEncapsulatedResponse(resp.Marshal())
+	if err != nil {
+		return err
+	}
+	response, err := context.DecapsulateResponse(encapsulatedResp)
+	if err != nil {
+		return fmt.Errorf("Decapsulating response failed: %s", err)
+	}
+	if !bytes.Equal(response, message) {
+		return fmt.Errorf("Decapsulated response does not match")
+	}
+	return nil
+}
@@ -0,0 +1,32 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"testing"
+
+	"github.com/chris-wood/ohttp-go"
+)
+
+func TestSelfTest(t *testing.T) {
+	keyring := createKeyring(t)
+	if _, err := keyring.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := selfTest(keyring, "message/bhttp request", "message/bhttp response"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSelfTestMismatchedLabels(t *testing.T) {
+	keyring, err := NewKeyring(FIXED_KEY_ID, defaultKeySuite, make([]byte, defaultSeedLength), func(config ohttp.PrivateConfig) ohttp.Gateway {
+		return ohttp.NewCustomGateway(config, "message/protohttp request", "message/protohttp response")
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := selfTest(keyring, "message/bhttp request", "message/bhttp response"); err == nil {
+		t.Fatal("Expected self-test with mismatched labels to fail")
+	}
+}
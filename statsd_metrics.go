@@ -9,15 +9,22 @@ import (
 )
 
 type StatsDMetrics struct {
-	serviceName string
-	metricsName string
-	eventName   string
-	startedAt   time.Time
-	client      statsd.ClientInterface
+	serviceName      string
+	metricsName      string
+	stageMetricsName string
+	sizeMetricsName  string
+	eventName        string
+	startedAt        time.Time
+	client           statsd.ClientInterface
+	tags             []string
 }
 
 func (s *StatsDMetrics) Fire(result string) {
-	tags := []string{fmt.Sprintf("event_name:%s", s.eventName), fmt.Sprintf("result:%s", result), fmt.Sprintf("service:%s", s.serviceName)}
+	tags := []string{fmt.Sprintf("event_name:%s", s.eventName), fmt.Sprintf("result:%s", result)}
+	if s.serviceName != "" {
+		tags = append(tags, fmt.Sprintf("service:%s", s.serviceName))
+	}
+	tags = append(tags, s.tags...)
 
 	err := s.client.TimeInMilliseconds(s.metricsName, float64(time.Since(s.startedAt).Milliseconds()), tags, 1)
 	if err != nil {
@@ -29,26 +36,69 @@ func (s *StatsDMetrics) ResponseStatus(prefix string, status int) {
 	s.Fire(fmt.Sprintf("%s_response_status_%d", prefix, status))
 }
 
-func createStatsDClient(host, port string, timeout int) (statsd.ClientInterface, error) {
+func (s *StatsDMetrics) Tag(name string, value string) {
+	s.tags = append(s.tags, fmt.Sprintf("%s:%s", name, value))
+}
+
+func (s *StatsDMetrics) Duration(stage string, duration time.Duration) {
+	tags := []string{fmt.Sprintf("event_name:%s", s.eventName), fmt.Sprintf("stage:%s", stage)}
+	if s.serviceName != "" {
+		tags = append(tags, fmt.Sprintf("service:%s", s.serviceName))
+	}
+	tags = append(tags, s.tags...)
+
+	err := s.client.TimeInMilliseconds(s.stageMetricsName, float64(duration)/float64(time.Millisecond), tags, 1)
+	if err != nil {
+		log.Printf("Cannot send metrics to statsd: %s", err)
+	}
+}
+
+func (s *StatsDMetrics) Size(message string, size int) {
+	tags := []string{fmt.Sprintf("event_name:%s", s.eventName), fmt.Sprintf("message:%s", message)}
+	if s.serviceName != "" {
+		tags = append(tags, fmt.Sprintf("service:%s", s.serviceName))
+	}
+	tags = append(tags, s.tags...)
+
+	err := s.client.Distribution(s.sizeMetricsName, float64(size), tags, 1)
+	if err != nil {
+		log.Printf("Cannot send metrics to statsd: %s", err)
+	}
+}
+
+// createStatsDClient creates a DogStatsD client that prefixes the names of metrics with prefix, if set, and
+// adds tags to every metric.
+func createStatsDClient(host, port string, timeout int, prefix string, tags []string) (statsd.ClientInterface, error) {
 	if host == "" || port == "" {
 		return &statsd.NoOpClient{}, nil
 	}
 
-	return statsd.New(host+":"+port, statsd.WithWriteTimeout(time.Duration(timeout)*time.Millisecond), statsd.WithoutTelemetry())
+	options := []statsd.Option{statsd.WithWriteTimeout(time.Duration(timeout) * time.Millisecond), statsd.WithoutTelemetry()}
+	if prefix != "" {
+		options = append(options, statsd.WithNamespace(prefix))
+	}
+	if len(tags) > 0 {
+		options = append(options, statsd.WithTags(tags))
+	}
+	return statsd.New(host+":"+port, options...)
 }
 
 type StatsDMetricsFactory struct {
-	serviceName string
-	metricsName string
-	client      statsd.ClientInterface
+	serviceName      string
+	metricsName      string
+	stageMetricsName string
+	sizeMetricsName  string
+	client           statsd.ClientInterface
 }
 
 func (f StatsDMetricsFactory) Create(eventName string) Metrics {
 	return &StatsDMetrics{
-		serviceName: f.serviceName,
-		metricsName: f.metricsName,
-		eventName:   eventName,
-		startedAt:   time.Now(),
-		client:      f.client,
+		serviceName:      f.serviceName,
+		metricsName:      f.metricsName,
+		stageMetricsName: f.stageMetricsName,
+		sizeMetricsName:  f.sizeMetricsName,
+		eventName:        eventName,
+		startedAt:        time.Now(),
+		client:           f.client,
 	}
 }
@@ -0,0 +1,49 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStatsDMetrics(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	host, port, _ := net.SplitHostPort(conn.LocalAddr().String())
+
+	client, err := createStatsDClient(host, port, 100, "edge", []string{"env:prod", "region:eu"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	factory := StatsDMetricsFactory{serviceName: "ohttp_gateway", metricsName: "ohttp_gateway_duration", client: client}
+	metrics := factory.Create(metricsEventGatewayRequest)
+	metrics.Tag(metricsTagKeyID, "1")
+	metrics.Fire(metricsResultSuccess)
+	if err := client.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	packet := make([]byte, 1024)
+	n, _, err := conn.ReadFrom(packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	message := string(packet[:n])
+	if !strings.HasPrefix(message, "edge.ohttp_gateway_duration:") {
+		t.Fatalf("Metric name was not prefixed: %q", message)
+	}
+	for _, tag := range []string{"env:prod", "region:eu", "event_name:gateway_request", "result:success", "service:ohttp_gateway", "key_id:1"} {
+		if !strings.Contains(message, tag) {
+			t.Fatalf("Missing tag %s in %q", tag, message)
+		}
+	}
+}
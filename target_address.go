@@ -0,0 +1,109 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+)
+
+// targetAddressForbiddenError is the dial error of a connection to an address that targets may not have.
+var targetAddressForbiddenError = errors.New("Target address forbidden")
+
+// privateNetworks are the loopback, link-local (including the cloud metadata service), private, and
+// shared address ranges that a target resolving to would give clients access to the gateway's network,
+// along with the benchmarking, multicast, and reserved ranges, and the NAT64 and 6to4 prefixes that
+// embed IPv4 addresses.
+var privateNetworks = []string{
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+	"::/128",
+	"::1/128",
+	"64:ff9b::/96",
+	"2002::/16",
+	"fc00::/7",
+	"fe80::/10",
+}
+
+func parseNetworks(networks []string) ([]*net.IPNet, error) {
+	parsed := []*net.IPNet{}
+	for _, network := range networks {
+		if network = strings.TrimSpace(network); network == "" {
+			continue
+		}
+		if !strings.Contains(network, "/") {
+			if ip := net.ParseIP(network); ip != nil && ip.To4() != nil {
+				network += "/32"
+			} else {
+				network += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(network)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid network %q: %s", network, err)
+		}
+		parsed = append(parsed, ipNet)
+	}
+	return parsed, nil
+}
+
+// targetAddressGuard rejects connections to private networks, except to those of allowed. It checks the
+// address being connected to, after name resolution, so a target name can not be rebound to a private
+// address after it was checked. The zero value allows every address.
+type targetAddressGuard struct {
+	blocked []*net.IPNet
+	allowed []*net.IPNet
+}
+
+// newTargetAddressGuard builds a guard that blocks private networks except the comma-separated allowed
+// networks, which are CIDR ranges or single addresses.
+func newTargetAddressGuard(allowed string) (targetAddressGuard, error) {
+	blocked, err := parseNetworks(privateNetworks)
+	if err != nil {
+		return targetAddressGuard{}, err
+	}
+	allowedNetworks, err := parseNetworks(strings.Split(allowed, ","))
+	if err != nil {
+		return targetAddressGuard{}, err
+	}
+	return targetAddressGuard{blocked: blocked, allowed: allowedNetworks}, nil
+}
+
+func (g targetAddressGuard) allows(ip net.IP) bool {
+	for _, network := range g.allowed {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	for _, network := range g.blocked {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// control is a net.Dialer Control function that fails dials to forbidden addresses.
+func (g targetAddressGuard) control(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !g.allows(ip) {
+		return targetAddressForbiddenError
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTargetAddressGuard(t *testing.T) {
+	guard, err := newTargetAddressGuard("10.1.0.0/16, 192.168.1.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for address, allowed := range map[string]bool{
+		"93.184.216.34":    true,
+		"2606:4700::1111":  true,
+		"10.1.2.3":         true,
+		"192.168.1.1":      true,
+		"10.2.0.1":         false,
+		"192.168.1.2":      false,
+		"127.0.0.1":        false,
+		"169.254.169.254":  false,
+		"::ffff:127.0.0.1": false,
+		"::1":              false,
+		"fd00:ec2::254":    false,
+		"100.100.100.200":  false,
+		"198.18.0.1":       false,
+		"224.0.0.1":        false,
+		"255.255.255.255":  false,
+		"64:ff9b::a00:1":   false,
+		"2002:7f00:1::":    false,
+	} {
+		if guard.allows(net.ParseIP(address)) != allowed {
+			t.Errorf("Expected %s to be allowed: %v", address, allowed)
+		}
+	}
+	if _, err := newTargetAddressGuard("10.0.0.0/33"); err == nil {
+		t.Fatal("Expected an invalid network to be rejected")
+	}
+}
+
+func TestTargetAddressForbidden(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer target.Close()
+
+	guard, err := newTargetAddressGuard("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := FilteredHttpRequestHandler{client: targetClientConfig{addressGuard: guard}.client()}
+	req, _ := http.NewRequest(http.MethodGet, target.URL, nil)
+	metrics := &MockMetrics{resultLabels: map[string]bool{}, tags: map[string]string{}}
+	if _, err := handler.Handle(req, metrics); err != GatewayTargetForbiddenError {
+		t.Fatalf("Expected a loopback target to be forbidden, got %v", err)
+	}
+	if !metrics.resultLabels[metricsResultTargetAddressForbidden] {
+		t.Fatalf("Expected the %s metric, got %v", metricsResultTargetAddressForbidden, metrics.resultLabels)
+	}
+
+	guard, _ = newTargetAddressGuard("127.0.0.0/8")
+	handler.client = targetClientConfig{addressGuard: guard}.client()
+	req, _ = http.NewRequest(http.MethodGet, target.URL, nil)
+	if _, err := handler.Handle(req, &MockMetrics{resultLabels: map[string]bool{}, tags: map[string]string{}}); err != nil {
+		t.Fatalf("Expected an allowed network to be reachable, got %v", err)
+	}
+}
+
+func TestTargetSSRFProtectionDefaults(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer target.Close()
+
+	reachable := func(client *http.Client) bool {
+		resp, err := client.Get(target.URL)
+		if err != nil {
+			return false
+		}
+		resp.Body.Close()
+		return true
+	}
+	// By default only the clients of proxy and DNS handlers, whose clients choose the target, are guarded
+	for protection, guarded := range map[string][3]bool{
+		"":      {false, true, true},
+		"true":  {true, true, true},
+		"false": {false, false, false},
+	} {
+		t.Setenv(targetSSRFProtectionVariable, protection)
+		config, err := targetClientConfigFromEnvironment()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, client := range []*http.Client{config.client(), config.forProxy().client(), config.dnsClient(time.Second)} {
+			if reachable(client) == guarded[i] {
+				t.Errorf("Expected client %d to be guarded with %s=%q: %v", i, targetSSRFProtectionVariable, protection, guarded[i])
+			}
+		}
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// awsSigningTransport is an http.RoundTripper that signs every target request with AWS Signature
+// Version 4 for service, such as "execute-api" for API Gateway or "lambda" for Lambda function URLs.
+// Each attempt of a retried or redirected request is signed anew.
+type awsSigningTransport struct {
+	transport   http.RoundTripper
+	credentials *awsCredentialChain
+	region      string
+	service     string
+	now         func() time.Time
+}
+
+func (t awsSigningTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	creds, err := t.credentials.Retrieve()
+	if err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+	var payload []byte
+	if req.Body != nil {
+		payload, err = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// A RoundTripper must not modify the request it is given
+	signed := req.Clone(req.Context())
+	if req.Body != nil {
+		signed.Body = ioutil.NopCloser(bytes.NewReader(payload))
+	}
+	signAWSRequest(signed, payload, creds, t.region, t.service, t.now())
+	return t.transport.RoundTrip(signed)
+}
+
+// signAWS makes the clients of c sign target requests for an AWS service, in the region of AWS_REGION,
+// with credentials from the standard AWS credential chain.
+func (c *targetClientConfig) signAWS(service string) error {
+	if c.awsRegion == "" {
+		region, err := awsRegion()
+		if err != nil {
+			return err
+		}
+		c.awsRegion = region
+	}
+	if c.awsCredentials == nil {
+		c.awsCredentials = newAWSCredentialChain()
+	}
+	c.awsService = service
+	return nil
+}
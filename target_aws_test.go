@@ -0,0 +1,84 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTargetClientSignsAWSRequests(t *testing.T) {
+	t.Setenv(awsRegionVariable, "us-east-1")
+	t.Setenv(awsAccessKeyIDVariable, "AKIDEXAMPLE")
+	t.Setenv(awsSecretAccessKeyVariable, "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY")
+	creds := awsCredentials{AccessKeyID: "AKIDEXAMPLE", SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"}
+	now := time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+
+	// The target verifies the signature by signing the request it received again
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		authorization := r.Header.Get("Authorization")
+		expected, err := http.NewRequest(r.Method, "http://"+r.Host+r.URL.RequestURI(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		signedHeaders := authorization[strings.Index(authorization, "SignedHeaders=")+len("SignedHeaders=") : strings.Index(authorization, ", Signature=")]
+		for _, name := range strings.Split(signedHeaders, ";") {
+			if name != "host" {
+				expected.Header.Set(name, r.Header.Get(name))
+			}
+		}
+		signAWSRequest(expected, body, creds, "us-east-1", "execute-api", now)
+		if authorization == "" || authorization != expected.Header.Get("Authorization") {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Write(body)
+	}))
+	defer target.Close()
+
+	config := targetClientConfig{}
+	if err := config.signAWS("execute-api"); err != nil {
+		t.Fatal(err)
+	}
+	client := config.client()
+	client.Transport = awsSigningTransport{
+		transport:   http.DefaultTransport,
+		credentials: config.awsCredentials,
+		region:      config.awsRegion,
+		service:     config.awsService,
+		now:         func() time.Time { return now },
+	}
+
+	req, err := http.NewRequest(http.MethodPost, target.URL+"/prod/items?b=2&a=1", bytes.NewReader([]byte("payload")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if body, _ := ioutil.ReadAll(resp.Body); resp.StatusCode != http.StatusOK || string(body) != "payload" {
+		t.Fatalf("Unexpected response %d %s", resp.StatusCode, body)
+	}
+	if req.Header.Get("Authorization") != "" {
+		t.Fatal("The signature was added to the original request")
+	}
+}
+
+func TestTargetClientAWSSigningRequiresRegion(t *testing.T) {
+	t.Setenv(awsRegionVariable, "")
+	t.Setenv(awsDefaultRegionVariable, "")
+	t.Setenv(targetAWSServiceVariable, "lambda")
+	if _, err := targetClientConfigFromEnvironment(); err == nil {
+		t.Fatal("Expected AWS signing without a region to be rejected")
+	}
+}
@@ -0,0 +1,291 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultTargetCacheSize = 64 << 20
+
+	metricsResultCacheHit  = "cache_hit"
+	metricsResultCacheMiss = "cache_miss"
+)
+
+// Statuses that are cacheable by default (RFC 9111, Section 3), given explicit freshness
+var cacheableStatuses = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusNoContent:            true,
+	http.StatusMultipleChoices:      true,
+	http.StatusMovedPermanently:     true,
+	http.StatusNotFound:             true,
+	http.StatusMethodNotAllowed:     true,
+	http.StatusGone:                 true,
+	http.StatusRequestURITooLong:    true,
+	http.StatusNotImplemented:       true,
+}
+
+// responseCache stores encoded target responses until they expire.
+type responseCache interface {
+	get(key string) ([]byte, bool)
+	set(key string, value []byte, ttl time.Duration)
+}
+
+// responseCacheFromEnvironment returns the cache selected by TARGET_CACHE, or nil if caching is disabled.
+// "memory" selects an in-memory LRU cache of TARGET_CACHE_SIZE bytes, and a redis:// or rediss:// URL a
+// cache shared by the gateway replicas.
+func responseCacheFromEnvironment() (responseCache, error) {
+	source := os.Getenv(targetCacheVariable)
+	switch {
+	case source == "":
+		return nil, nil
+	case source == "memory":
+		return newMemoryResponseCache(int(getUintEnv(targetCacheSizeVariable, defaultTargetCacheSize))), nil
+	case strings.HasPrefix(source, "redis://") || strings.HasPrefix(source, "rediss://"):
+		cacheURL, err := url.Parse(source)
+		if err != nil || cacheURL.Hostname() == "" {
+			return nil, fmt.Errorf("Invalid Redis cache URL %q", source)
+		}
+		client, err := newRedisClient(cacheURL)
+		if err != nil {
+			return nil, err
+		}
+		return redisResponseCache{client: client, prefix: strings.Trim(cacheURL.Path, "/") + ":"}, nil
+	default:
+		return nil, fmt.Errorf("Unsupported target cache %q", source)
+	}
+}
+
+// memoryResponseCache is an LRU responseCache that evicts the least recently used responses beyond its
+// size in bytes.
+type memoryResponseCache struct {
+	mu      sync.Mutex
+	size    int
+	used    int
+	order   *list.List
+	entries map[string]*list.Element
+	now     func() time.Time
+}
+
+type memoryCacheEntry struct {
+	key     string
+	value   []byte
+	expires time.Time
+}
+
+func newMemoryResponseCache(size int) *memoryResponseCache {
+	return &memoryResponseCache{size: size, order: list.New(), entries: map[string]*list.Element{}, now: time.Now}
+}
+
+func (c *memoryResponseCache) get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := element.Value.(*memoryCacheEntry)
+	if !c.now().Before(entry.expires) {
+		c.remove(element)
+		return nil, false
+	}
+	c.order.MoveToFront(element)
+	return entry.value, true
+}
+
+func (c *memoryResponseCache) set(key string, value []byte, ttl time.Duration) {
+	if len(value) > c.size {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.entries[key]; ok {
+		c.remove(element)
+	}
+	c.entries[key] = c.order.PushFront(&memoryCacheEntry{key: key, value: value, expires: c.now().Add(ttl)})
+	c.used += len(value)
+	for c.used > c.size {
+		c.remove(c.order.Back())
+	}
+}
+
+func (c *memoryResponseCache) remove(element *list.Element) {
+	entry := c.order.Remove(element).(*memoryCacheEntry)
+	delete(c.entries, entry.key)
+	c.used -= len(entry.value)
+}
+
+// redisResponseCache is a responseCache shared by gateway replicas, whose entries expire in Redis.
+type redisResponseCache struct {
+	client *redisClient
+	prefix string
+}
+
+func (c redisResponseCache) get(key string) ([]byte, bool) {
+	reply, err := c.client.Do("GET", c.prefix+key)
+	if err != nil {
+		log.Printf("Target cache lookup failed: %s", err)
+		return nil, false
+	}
+	value, ok := reply.([]byte)
+	return value, ok && value != nil
+}
+
+func (c redisResponseCache) set(key string, value []byte, ttl time.Duration) {
+	if _, err := c.client.Do("SET", c.prefix+key, string(value), "PX", strconv.FormatInt(ttl.Milliseconds(), 10)); err != nil {
+		log.Printf("Target cache update failed: %s", err)
+	}
+}
+
+// cachedResponse is the encoding of a target response in a responseCache.
+type cachedResponse struct {
+	Status int         `json:"status"`
+	Header http.Header `json:"header"`
+	Body   []byte      `json:"body"`
+	Stored time.Time   `json:"stored"`
+}
+
+// CachingHttpRequestHandler is an HttpRequestHandler that caches the target responses of GET and HEAD
+// requests that have explicit freshness and are not personalized. Cached responses are returned as if
+// sent by the target, so every client still receives a uniquely encapsulated response.
+type CachingHttpRequestHandler struct {
+	cache responseCache
+	// prefix separates the entries of handlers that share a cache
+	prefix      string
+	now         func() time.Time
+	httpHandler HttpRequestHandler
+}
+
+func newCachingHttpRequestHandler(cache responseCache, prefix string, httpHandler HttpRequestHandler) CachingHttpRequestHandler {
+	return CachingHttpRequestHandler{cache: cache, prefix: prefix, now: time.Now, httpHandler: httpHandler}
+}
+
+// cacheableRequest reports whether the response to req may be shared between clients. Requests with
+// credentials or cookies may be answered differently for each client.
+func cacheableRequest(req *http.Request) bool {
+	return (req.Method == http.MethodGet || req.Method == http.MethodHead) &&
+		req.Header.Get("Authorization") == "" && req.Header.Get("Cookie") == ""
+}
+
+func cacheControl(header http.Header) map[string]string {
+	directives := map[string]string{}
+	for _, value := range header.Values("Cache-Control") {
+		for _, directive := range strings.Split(value, ",") {
+			name, argument := strings.TrimSpace(directive), ""
+			if i := strings.Index(name, "="); i >= 0 {
+				name, argument = name[:i], strings.Trim(name[i+1:], `"`)
+			}
+			directives[strings.ToLower(name)] = argument
+		}
+	}
+	return directives
+}
+
+// cacheTTL returns how long a shared cache may store resp, or zero if it may not.
+func cacheTTL(resp *http.Response, now time.Time) time.Duration {
+	// Trailers are not stored, so responses that announce them are not cached either
+	if !cacheableStatuses[resp.StatusCode] || resp.Header.Get("Set-Cookie") != "" || resp.Header.Get("Vary") != "" || len(resp.Trailer) > 0 {
+		return 0
+	}
+	directives := cacheControl(resp.Header)
+	for _, directive := range []string{"no-store", "no-cache", "private"} {
+		if _, ok := directives[directive]; ok {
+			return 0
+		}
+	}
+	for _, directive := range []string{"s-maxage", "max-age"} {
+		if value, ok := directives[directive]; ok {
+			seconds, err := strconv.Atoi(value)
+			if err != nil || seconds <= 0 {
+				return 0
+			}
+			return time.Duration(seconds) * time.Second
+		}
+	}
+	if expires, err := http.ParseTime(resp.Header.Get("Expires")); err == nil {
+		if date, err := http.ParseTime(resp.Header.Get("Date")); err == nil {
+			now = date
+		}
+		return expires.Sub(now)
+	}
+	return 0
+}
+
+func (h CachingHttpRequestHandler) key(req *http.Request) string {
+	// Responses are decoded unless the request accepts their encoding, so it is part of the key
+	digest := sha256.Sum256([]byte(h.prefix + " " + req.Method + " " + req.URL.String() + " " + strings.Join(req.Header.Values("Accept-Encoding"), ",")))
+	return hex.EncodeToString(digest[:])
+}
+
+func (h CachingHttpRequestHandler) Handle(req *http.Request, metrics Metrics) (*http.Response, error) {
+	if !cacheableRequest(req) {
+		return h.httpHandler.Handle(req, metrics)
+	}
+	key := h.key(req)
+	if _, noCache := cacheControl(req.Header)["no-cache"]; !noCache {
+		if value, ok := h.cache.get(key); ok {
+			var cached cachedResponse
+			if err := json.Unmarshal(value, &cached); err == nil {
+				metrics.Fire(metricsResultCacheHit)
+				metrics.Fire(metricsResultSuccess)
+				return h.response(req, cached), nil
+			}
+		}
+	}
+	metrics.Fire(metricsResultCacheMiss)
+
+	resp, err := h.httpHandler.Handle(req, metrics)
+	if err != nil {
+		return nil, err
+	}
+	now := h.now()
+	if ttl := cacheTTL(resp, now); ttl > 0 {
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+		if value, err := json.Marshal(cachedResponse{Status: resp.StatusCode, Header: resp.Header, Body: body, Stored: now}); err == nil {
+			h.cache.set(key, value, ttl)
+		}
+	}
+	return resp, nil
+}
+
+// response rebuilds a cached response, with its Age (RFC 9111, Section 5.1).
+func (h CachingHttpRequestHandler) response(req *http.Request, cached cachedResponse) *http.Response {
+	header := cached.Header.Clone()
+	if header == nil {
+		header = http.Header{}
+	}
+	header.Set("Age", strconv.Itoa(int(h.now().Sub(cached.Stored).Seconds())))
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", cached.Status, http.StatusText(cached.Status)),
+		StatusCode:    cached.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(bytes.NewReader(cached.Body)),
+		ContentLength: int64(len(cached.Body)),
+		Request:       req,
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCachingHttpRequestHandler(t *testing.T) {
+	requests := 0
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Cache-Control", r.URL.Query().Get("cache-control"))
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer target.Close()
+	handler := newCachingHttpRequestHandler(newMemoryResponseCache(defaultTargetCacheSize), "/gateway", FilteredHttpRequestHandler{client: &http.Client{}})
+
+	get := func(method, path string, header http.Header) (*http.Response, *MockMetrics) {
+		req, err := http.NewRequest(method, target.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		metrics := &MockMetrics{resultLabels: map[string]bool{}, tags: map[string]string{}}
+		resp, err := handler.Handle(req, metrics)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp, metrics
+	}
+
+	get(http.MethodGet, "/cached?cache-control=max-age=60", nil)
+	resp, metrics := get(http.MethodGet, "/cached?cache-control=max-age=60", nil)
+	body, _ := ioutil.ReadAll(resp.Body)
+	if requests != 1 || !metrics.resultLabels[metricsResultCacheHit] || string(body) != "/cached" || resp.Header.Get("Age") == "" {
+		t.Fatalf("Expected a cache hit, got %d target requests and %q", requests, body)
+	}
+
+	for _, request := range []struct {
+		method string
+		path   string
+		header http.Header
+	}{
+		{http.MethodPost, "/post?cache-control=max-age=60", nil},
+		{http.MethodGet, "/private?cache-control=private,max-age=60", nil},
+		{http.MethodGet, "/no-store?cache-control=no-store", nil},
+		{http.MethodGet, "/cookie?cache-control=max-age=60", http.Header{"Cookie": {"session=1"}}},
+	} {
+		requests = 0
+		get(request.method, request.path, request.header)
+		get(request.method, request.path, request.header)
+		if requests != 2 {
+			t.Errorf("%s %s was cached", request.method, request.path)
+		}
+	}
+
+	// A no-cache request revalidates by fetching the response again
+	requests = 0
+	get(http.MethodGet, "/cached?cache-control=max-age=60", http.Header{"Cache-Control": {"no-cache"}})
+	if requests != 1 {
+		t.Fatal("A no-cache request was answered from the cache")
+	}
+}
+
+func TestCacheTTL(t *testing.T) {
+	now := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, test := range []struct {
+		status int
+		header http.Header
+		ttl    time.Duration
+	}{
+		{http.StatusOK, http.Header{"Cache-Control": {"public, max-age=30"}}, 30 * time.Second},
+		{http.StatusOK, http.Header{"Cache-Control": {"max-age=30, s-maxage=10"}}, 10 * time.Second},
+		{http.StatusOK, http.Header{"Expires": {now.Add(time.Minute).Format(http.TimeFormat)}}, time.Minute},
+		{http.StatusOK, http.Header{}, 0},
+		{http.StatusOK, http.Header{"Cache-Control": {"max-age=30"}, "Vary": {"Accept-Language"}}, 0},
+		{http.StatusOK, http.Header{"Cache-Control": {"max-age=30"}, "Set-Cookie": {"session=1"}}, 0},
+		{http.StatusInternalServerError, http.Header{"Cache-Control": {"max-age=30"}}, 0},
+	} {
+		if ttl := cacheTTL(&http.Response{StatusCode: test.status, Header: test.header}, now); ttl != test.ttl {
+			t.Errorf("Response %d %v cached for %s, expected %s", test.status, test.header, ttl, test.ttl)
+		}
+	}
+}
+
+func TestMemoryResponseCacheEviction(t *testing.T) {
+	cache := newMemoryResponseCache(10)
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+
+	cache.set("a", []byte("12345"), time.Minute)
+	cache.set("b", []byte("12345"), time.Second)
+	cache.get("a")
+	cache.set("c", []byte("12345"), time.Minute)
+	if _, ok := cache.get("b"); ok {
+		t.Fatal("The least recently used entry was not evicted")
+	}
+	if _, ok := cache.get("a"); !ok {
+		t.Fatal("A recently used entry was evicted")
+	}
+	now = now.Add(time.Minute)
+	if _, ok := cache.get("c"); ok {
+		t.Fatal("An expired entry was returned")
+	}
+}
+
+func TestRedisResponseCache(t *testing.T) {
+	address := startFakeRedis(t)
+	t.Setenv(targetCacheVariable, "redis://"+address+"/responses")
+	cache, err := responseCacheFromEnvironment()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.set("key", []byte("value"), time.Minute)
+	if value, ok := cache.get("key"); !ok || string(value) != "value" {
+		t.Fatalf("Unexpected cached value %q", value)
+	}
+	if _, ok := cache.get("missing"); ok {
+		t.Fatal("Unexpected cache hit")
+	}
+
+	t.Setenv(targetCacheVariable, "memcached://cache.internal")
+	if _, err := responseCacheFromEnvironment(); err == nil {
+		t.Fatal("Expected an unsupported cache to be rejected")
+	}
+}
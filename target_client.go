@@ -0,0 +1,271 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Target client timeout defaults, which bound how long a slow or unresponsive target can hold a request
+const (
+	defaultTargetDialTimeout           = 5 * time.Second
+	defaultTargetTLSHandshakeTimeout   = 5 * time.Second
+	defaultTargetResponseHeaderTimeout = 15 * time.Second
+	defaultTargetRequestTimeout        = 30 * time.Second
+)
+
+// Target connection pool defaults, which match those of http.DefaultTransport
+const (
+	defaultTargetMaxIdleConns        = 100
+	defaultTargetMaxIdleConnsPerHost = http.DefaultMaxIdleConnsPerHost
+	defaultTargetIdleConnTimeout     = 90 * time.Second
+)
+
+// targetClientConfig configures the HTTP client used to fetch target resources.
+type targetClientConfig struct {
+	dialTimeout           time.Duration
+	tlsHandshakeTimeout   time.Duration
+	responseHeaderTimeout time.Duration
+	requestTimeout        time.Duration
+
+	maxIdleConns        int
+	maxIdleConnsPerHost int
+	maxConnsPerHost     int
+	idleConnTimeout     time.Duration
+
+	// unixSockets maps target hosts to the Unix socket paths their connections are dialed to.
+	unixSockets map[string]string
+
+	// egressProxy is the HTTP, HTTPS, or SOCKS5 proxy that target connections are routed through, with
+	// credentials in its user info, or nil for the proxy of the HTTP_PROXY and HTTPS_PROXY variables.
+	egressProxy *url.URL
+
+	// resolver resolves target host names, or is nil for the system resolver.
+	resolver *net.Resolver
+
+	// addressGuard rejects target connections to private networks.
+	addressGuard targetAddressGuard
+	// proxyAddressGuard replaces an unset addressGuard for "proxy" and "dns" handlers, whose clients
+	// choose the target, so that they are guarded unless SSRF protection is turned off.
+	proxyAddressGuard targetAddressGuard
+
+	// tls configures TLS connections to targets, or is nil for the default configuration. It is loaded
+	// from tlsSettings, which handlers with their own TLS settings override.
+	tls         *tls.Config
+	tlsSettings targetTLSConfig
+
+	// protocol is one of the target protocols, which defaults to negotiating HTTP/2
+	protocol string
+
+	// awsService, if set, is the AWS service that target requests are signed for with SigV4.
+	awsService     string
+	awsRegion      string
+	awsCredentials *awsCredentialChain
+}
+
+// parseEgressProxy parses the URL of an egress proxy, which must be one of the proxy schemes supported
+// by http.Transport.
+func parseEgressProxy(rawURL string) (*url.URL, error) {
+	if rawURL == "" {
+		return nil, nil
+	}
+	proxyURL, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid egress proxy URL: %s", err)
+	}
+	switch proxyURL.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("Unsupported egress proxy scheme %q", proxyURL.Scheme)
+	}
+	if proxyURL.Host == "" {
+		return nil, fmt.Errorf("Egress proxy URL %s has no host", proxyURL.Redacted())
+	}
+	return proxyURL, nil
+}
+
+// parseUnixSockets parses a comma-separated list of <host>=<socket path> pairs.
+func parseUnixSockets(sockets string) (map[string]string, error) {
+	mapping := map[string]string{}
+	for _, entry := range strings.Split(sockets, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, "=", 2)
+		host, path := strings.ToLower(strings.TrimSpace(parts[0])), ""
+		if len(parts) == 2 {
+			path = strings.TrimSpace(parts[1])
+		}
+		if host == "" || path == "" {
+			return nil, fmt.Errorf("Invalid Unix socket target %q, expected <host>=<socket path>", entry)
+		}
+		mapping[host] = path
+	}
+	return mapping, nil
+}
+
+func targetClientConfigFromEnvironment() (targetClientConfig, error) {
+	unixSockets, err := parseUnixSockets(os.Getenv(targetUnixSocketsVariable))
+	if err != nil {
+		return targetClientConfig{}, err
+	}
+	egressProxy, err := parseEgressProxy(os.Getenv(egressProxyURLVariable))
+	if err != nil {
+		return targetClientConfig{}, err
+	}
+	dialTimeout := getDurationEnv(targetDialTimeoutVariable, defaultTargetDialTimeout)
+	resolver, err := newTargetResolver(os.Getenv(targetResolverVariable), dialTimeout)
+	if err != nil {
+		return targetClientConfig{}, err
+	}
+	protocol := os.Getenv(targetProtocolVariable)
+	if err := validateTargetProtocol(protocol); err != nil {
+		return targetClientConfig{}, err
+	}
+	tlsSettings := targetTLSConfigFromEnvironment()
+	tlsConfig, err := tlsSettings.load()
+	if err != nil {
+		return targetClientConfig{}, err
+	}
+	// Fixed targets are only guarded on request, since they are commonly on private networks
+	proxyAddressGuard, addressGuard := targetAddressGuard{}, targetAddressGuard{}
+	if getBoolEnv(targetSSRFProtectionVariable, true) {
+		if proxyAddressGuard, err = newTargetAddressGuard(os.Getenv(targetAllowedNetworksVariable)); err != nil {
+			return targetClientConfig{}, err
+		}
+		if getBoolEnv(targetSSRFProtectionVariable, false) {
+			addressGuard = proxyAddressGuard
+		}
+	}
+	config := targetClientConfig{
+		dialTimeout:           dialTimeout,
+		tlsHandshakeTimeout:   getDurationEnv(targetTLSHandshakeTimeoutVariable, defaultTargetTLSHandshakeTimeout),
+		responseHeaderTimeout: getDurationEnv(targetResponseHeaderTimeoutVariable, defaultTargetResponseHeaderTimeout),
+		requestTimeout:        getDurationEnv(targetRequestTimeoutVariable, defaultTargetRequestTimeout),
+
+		maxIdleConns:        int(getUintEnv(targetMaxIdleConnsVariable, defaultTargetMaxIdleConns)),
+		maxIdleConnsPerHost: int(getUintEnv(targetMaxIdleConnsPerHostVariable, defaultTargetMaxIdleConnsPerHost)),
+		maxConnsPerHost:     int(getUintEnv(targetMaxConnsPerHostVariable, 0)),
+		idleConnTimeout:     getDurationEnv(targetIdleConnTimeoutVariable, defaultTargetIdleConnTimeout),
+
+		unixSockets: unixSockets,
+		egressProxy: egressProxy,
+		resolver:    resolver,
+
+		addressGuard:      addressGuard,
+		proxyAddressGuard: proxyAddressGuard,
+		tls:               tlsConfig,
+		tlsSettings:       tlsSettings,
+		protocol:          protocol,
+	}
+	if service := os.Getenv(targetAWSServiceVariable); service != "" {
+		if err := config.signAWS(service); err != nil {
+			return targetClientConfig{}, err
+		}
+	}
+	return config, nil
+}
+
+// forProxy returns the configuration of the target clients of "proxy" handlers, which are guarded by
+// proxyAddressGuard unless addressGuard already applies.
+func (c targetClientConfig) forProxy() targetClientConfig {
+	if c.addressGuard.blocked == nil {
+		c.addressGuard = c.proxyAddressGuard
+	}
+	return c
+}
+
+// dnsClient builds the HTTP client of "dns" handlers, which only shares the address guard of "proxy"
+// handlers with the target clients.
+func (c targetClientConfig) dnsClient(timeout time.Duration) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if guard := c.forProxy().addressGuard; guard.blocked != nil {
+		dialer := &net.Dialer{Timeout: timeout, KeepAlive: 30 * time.Second, Control: guard.control}
+		transport.DialContext = dialer.DialContext
+	}
+	return &http.Client{Timeout: timeout, Transport: transport}
+}
+
+// client builds an HTTP client with the configured timeouts and connection pool. The request timeout
+// covers the whole exchange, including reading the response body. Requests to hosts mapped to a Unix
+// socket are sent over it, with their URL and Host header unchanged, and never through a proxy. Other
+// requests are sent through the egress proxy, if configured. The address guard applies to every
+// connection but those to Unix sockets and the egress proxy. Requests are signed last, if an AWS service
+// is configured.
+func (c targetClientConfig) client() *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   c.dialTimeout,
+		KeepAlive: 30 * time.Second,
+		Resolver:  c.resolver,
+	}
+	guardedDialer := *dialer
+	if c.addressGuard.blocked != nil {
+		guardedDialer.Control = c.addressGuard.control
+	}
+	proxyAddr := ""
+	if c.egressProxy != nil {
+		proxyAddr = strings.ToLower(c.egressProxy.Host)
+		if c.egressProxy.Port() == "" {
+			proxyAddr = net.JoinHostPort(strings.ToLower(c.egressProxy.Hostname()), map[string]string{
+				"http": "80", "https": "443", "socks5": "1080", "socks5h": "1080",
+			}[c.egressProxy.Scheme])
+		}
+	}
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = addr
+		}
+		if path, ok := c.unixSockets[strings.ToLower(host)]; ok {
+			return dialer.DialContext(ctx, "unix", path)
+		}
+		if strings.ToLower(addr) == proxyAddr {
+			return dialer.DialContext(ctx, network, addr)
+		}
+		return guardedDialer.DialContext(ctx, network, addr)
+	}
+	proxy := func(req *http.Request) (*url.URL, error) {
+		if _, ok := c.unixSockets[strings.ToLower(req.URL.Hostname())]; ok {
+			return nil, nil
+		}
+		if c.egressProxy != nil {
+			return c.egressProxy, nil
+		}
+		return http.ProxyFromEnvironment(req)
+	}
+	// The transport adds its ALPN protocols to its TLS config, which is shared with the clients of handlers
+	tlsConfig := c.tls.Clone()
+	transport := &http.Transport{
+		Proxy:                 proxy,
+		DialContext:           dial,
+		TLSClientConfig:       tlsConfig,
+		ForceAttemptHTTP2:     true,
+		TLSHandshakeTimeout:   c.tlsHandshakeTimeout,
+		ResponseHeaderTimeout: c.responseHeaderTimeout,
+		ExpectContinueTimeout: 1 * time.Second,
+		MaxIdleConns:          c.maxIdleConns,
+		MaxIdleConnsPerHost:   c.maxIdleConnsPerHost,
+		MaxConnsPerHost:       c.maxConnsPerHost,
+		IdleConnTimeout:       c.idleConnTimeout,
+	}
+	roundTripper := configureTargetProtocol(transport, c.protocol)
+	if c.awsService != "" {
+		roundTripper = awsSigningTransport{
+			transport:   roundTripper,
+			credentials: c.awsCredentials,
+			region:      c.awsRegion,
+			service:     c.awsService,
+			now:         time.Now,
+		}
+	}
+	return &http.Client{Transport: roundTripper, Timeout: c.requestTimeout}
+}
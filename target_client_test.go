@@ -0,0 +1,116 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTargetClientResponseHeaderTimeout(t *testing.T) {
+	release := make(chan struct{})
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer target.Close()
+	defer close(release)
+
+	client := targetClientConfig{
+		dialTimeout:           time.Second,
+		tlsHandshakeTimeout:   time.Second,
+		responseHeaderTimeout: 50 * time.Millisecond,
+		requestTimeout:        5 * time.Second,
+	}.client()
+	start := time.Now()
+	if _, err := client.Get(target.URL); err == nil {
+		t.Fatal("Expected a slow target to time out")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Timed out after %s, expected the response header timeout", elapsed)
+	}
+}
+
+func TestTargetClientConnectionPool(t *testing.T) {
+	t.Setenv(targetMaxIdleConnsPerHostVariable, "64")
+	t.Setenv(targetMaxConnsPerHostVariable, "128")
+
+	config, err := targetClientConfigFromEnvironment()
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport := config.client().Transport.(*http.Transport)
+	if transport.MaxIdleConns != defaultTargetMaxIdleConns || transport.IdleConnTimeout != defaultTargetIdleConnTimeout {
+		t.Fatalf("Unexpected pool defaults %d %s", transport.MaxIdleConns, transport.IdleConnTimeout)
+	}
+	if transport.MaxIdleConnsPerHost != 64 || transport.MaxConnsPerHost != 128 {
+		t.Fatalf("Unexpected per-host limits %d %d", transport.MaxIdleConnsPerHost, transport.MaxConnsPerHost)
+	}
+}
+
+func TestTargetClientUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.sock")
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Skipf("Unix sockets are not supported: %s", err)
+	}
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("sidecar " + r.Host + r.URL.Path))
+	})}
+	go server.Serve(listener)
+	defer server.Close()
+
+	unixSockets, err := parseUnixSockets("app.internal=" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := targetClientConfig{unixSockets: unixSockets}.client().Get("http://app.internal/path")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if body, _ := ioutil.ReadAll(resp.Body); string(body) != "sidecar app.internal/path" {
+		t.Fatalf("Unexpected response %s", body)
+	}
+
+	if _, err := parseUnixSockets("app.internal"); err == nil {
+		t.Fatal("Expected an entry without a socket path to be rejected")
+	}
+}
+
+func TestTargetClientEgressProxy(t *testing.T) {
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Proxy-Authorization") != "Basic "+base64.StdEncoding.EncodeToString([]byte("gateway:secret")) {
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+		w.Write([]byte("proxied " + r.URL.String()))
+	}))
+	defer proxy.Close()
+
+	proxyURL, err := parseEgressProxy(strings.Replace(proxy.URL, "http://", "http://gateway:secret@", 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := targetClientConfig{egressProxy: proxyURL}.client().Get("http://target.example/path")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if body, _ := ioutil.ReadAll(resp.Body); string(body) != "proxied http://target.example/path" {
+		t.Fatalf("Unexpected response %d %s", resp.StatusCode, body)
+	}
+
+	for _, rawURL := range []string{"ftp://proxy.example", "socks5://"} {
+		if _, err := parseEgressProxy(rawURL); err == nil {
+			t.Errorf("Expected egress proxy %s to be rejected", rawURL)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Injected credentials are fetched again from their source after this long, so rotated secrets are used
+// without restarting the gateway.
+const defaultTargetCredentialRefreshInterval = time.Minute
+
+// newSecretSource returns a function that fetches the secret of source, which is one of env:<variable>,
+// file:///path/to/secret, vault://<path>#<field>, or gcp-secret://projects/<project>/secrets/<secret>.
+func newSecretSource(source string) (func() (string, error), error) {
+	if strings.HasPrefix(source, "env:") {
+		name := strings.TrimPrefix(source, "env:")
+		return func() (string, error) {
+			value := os.Getenv(name)
+			if value == "" {
+				return "", fmt.Errorf("%s is not set", name)
+			}
+			return value, nil
+		}, nil
+	}
+	sourceURL, err := url.Parse(source)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid secret source %q: %s", source, err)
+	}
+	switch sourceURL.Scheme {
+	case "file":
+		if sourceURL.Path == "" {
+			return nil, fmt.Errorf("File secret source is missing a path")
+		}
+		return func() (string, error) {
+			contents, err := ioutil.ReadFile(sourceURL.Path)
+			return strings.TrimSpace(string(contents)), err
+		}, nil
+	case "vault":
+		provider, err := newVaultKeyProvider(sourceURL)
+		if err != nil {
+			return nil, err
+		}
+		return provider.readField, nil
+	case "gcp-secret":
+		provider, err := newGCPSecretKeyProvider(sourceURL)
+		if err != nil {
+			return nil, err
+		}
+		return func() (string, error) {
+			payload, _, err := provider.access(provider.version)
+			return strings.TrimSpace(string(payload)), err
+		}, nil
+	default:
+		return nil, fmt.Errorf("Unsupported secret source scheme: %s", sourceURL.Scheme)
+	}
+}
+
+// targetCredential is a header set on the target requests of a handler, whose value is a secret that
+// clients never see, so that targets can authenticate gateway traffic. A value the client set for the
+// header is replaced.
+type targetCredential struct {
+	header  string
+	prefix  string
+	fetch   func() (string, error)
+	refresh time.Duration
+	now     func() time.Time
+
+	mu      sync.Mutex
+	value   string
+	fetched time.Time
+}
+
+// newTargetCredential fetches the secret of source once, so that a misconfigured credential fails at
+// startup instead of on the first request.
+func newTargetCredential(header, prefix, source string) (*targetCredential, error) {
+	fetch, err := newSecretSource(source)
+	if err != nil {
+		return nil, err
+	}
+	credential := &targetCredential{
+		header:  header,
+		prefix:  prefix,
+		fetch:   fetch,
+		refresh: defaultTargetCredentialRefreshInterval,
+		now:     time.Now,
+	}
+	if credential.value, err = fetch(); err != nil {
+		return nil, err
+	}
+	credential.fetched = credential.now()
+	return credential, nil
+}
+
+// current returns the secret, fetching it again if it is older than the refresh interval. If that fails,
+// the previous secret is used until the next refresh.
+func (c *targetCredential) current() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if now := c.now(); now.Sub(c.fetched) >= c.refresh {
+		if value, err := c.fetch(); err != nil {
+			log.Printf("Failed to refresh the %s credential: %s", c.header, err)
+		} else {
+			c.value = value
+		}
+		c.fetched = now
+	}
+	return c.value
+}
+
+func injectCredentials(req *http.Request, credentials []*targetCredential) {
+	for _, credential := range credentials {
+		req.Header.Set(credential.header, credential.prefix+credential.current())
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTargetCredentialsInjected(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("Authorization") + "|" + r.Header.Get("X-Api-Key")))
+	}))
+	defer target.Close()
+
+	t.Setenv("TEST_TARGET_TOKEN", "gateway-token")
+	keyFile := filepath.Join(t.TempDir(), "api-key")
+	if err := ioutil.WriteFile(keyFile, []byte("gateway-key\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	token, err := newTargetCredential("Authorization", "Bearer ", "env:TEST_TARGET_TOKEN")
+	if err != nil {
+		t.Fatal(err)
+	}
+	apiKey, err := newTargetCredential("X-Api-Key", "", "file://"+keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := FilteredHttpRequestHandler{client: &http.Client{}, credentials: []*targetCredential{token, apiKey}}
+
+	req, err := http.NewRequest(http.MethodGet, target.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer forged")
+	resp, err := handler.Handle(req, &MockMetrics{resultLabels: map[string]bool{}, tags: map[string]string{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if body, _ := ioutil.ReadAll(resp.Body); string(body) != "Bearer gateway-token|gateway-key" {
+		t.Fatalf("Target received credentials %q", body)
+	}
+}
+
+func TestTargetCredentialRefresh(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token")
+	if err := ioutil.WriteFile(path, []byte("first"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	credential, err := newTargetCredential("Authorization", "Bearer ", "file://"+path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	credential.now = func() time.Time { return now }
+
+	if err := ioutil.WriteFile(path, []byte("second"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if value := credential.current(); value != "first" {
+		t.Fatalf("Credential refreshed early to %q", value)
+	}
+	now = now.Add(defaultTargetCredentialRefreshInterval)
+	if value := credential.current(); value != "second" {
+		t.Fatalf("Credential not refreshed, got %q", value)
+	}
+
+	// The previous secret is kept while the source fails
+	os.Remove(path)
+	now = now.Add(defaultTargetCredentialRefreshInterval)
+	if value := credential.current(); value != "second" {
+		t.Fatalf("Credential lost after a failed refresh, got %q", value)
+	}
+}
+
+func TestTargetCredentialInvalidSource(t *testing.T) {
+	t.Setenv("TEST_TARGET_TOKEN", "")
+	for _, source := range []string{"env:TEST_TARGET_TOKEN", "plain-secret", "file://" + filepath.Join(t.TempDir(), "missing")} {
+		if _, err := newTargetCredential("Authorization", "Bearer ", source); err == nil {
+			t.Errorf("Expected secret source %q to be rejected", source)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// parseCoding returns the lowercase name and the quality value of an Accept-Encoding element.
+func parseCoding(coding string) (string, float64) {
+	params := strings.Split(coding, ";")
+	q := 1.0
+	for _, param := range params[1:] {
+		param = strings.TrimSpace(param)
+		if strings.HasPrefix(param, "q=") {
+			q, _ = strconv.ParseFloat(strings.TrimPrefix(param, "q="), 64)
+		}
+	}
+	return strings.ToLower(strings.TrimSpace(params[0])), q
+}
+
+// acceptedEncodings maps the content codings listed in an Accept-Encoding header to their quality values.
+type acceptedEncodings map[string]float64
+
+// acceptedEncodingsOf returns the content codings that the Accept-Encoding header of req lists. A request
+// without the header only accepts identity, since the transport already decodes the gzip responses it asked
+// for on the client's behalf.
+func acceptedEncodingsOf(req *http.Request) acceptedEncodings {
+	accepted := acceptedEncodings{}
+	for _, value := range req.Header.Values("Accept-Encoding") {
+		for _, coding := range strings.Split(value, ",") {
+			if name, q := parseCoding(coding); name != "" {
+				accepted[name] = q
+			}
+		}
+	}
+	return accepted
+}
+
+// accepts reports whether coding is acceptable. A coding listed with q=0 is not, even if "*" is listed.
+func (a acceptedEncodings) accepts(coding string) bool {
+	if coding == "x-gzip" {
+		if _, ok := a[coding]; !ok {
+			coding = "gzip"
+		}
+	}
+	if q, ok := a[coding]; ok {
+		return q > 0
+	}
+	return a["*"] > 0
+}
+
+// offerDecodableEncodings removes the content codings that decodeTargetResponse can not decode, which is
+// br, from the Accept-Encoding header of req before it is sent to the target, and refuses them explicitly
+// if the header accepts any coding, so that targets never send a response that the gateway could not
+// decode for a client that does not accept it.
+func offerDecodableEncodings(req *http.Request) {
+	values := req.Header.Values("Accept-Encoding")
+	if len(values) == 0 {
+		return
+	}
+	offered := []string{}
+	for _, value := range values {
+		for _, coding := range strings.Split(value, ",") {
+			if name, _ := parseCoding(coding); name != "" && name != "br" {
+				offered = append(offered, strings.TrimSpace(coding))
+			}
+		}
+	}
+	if len(offered) == 0 {
+		req.Header.Del("Accept-Encoding")
+		return
+	}
+	if _, ok := acceptedEncodingsOf(req)["*"]; ok {
+		offered = append(offered, "br;q=0")
+	}
+	req.Header.Set("Accept-Encoding", strings.Join(offered, ", "))
+}
+
+// decodeTargetResponse passes a target response through intact if the inner request accepts all of its
+// content codings. Otherwise it decodes the body, so that the client never receives an encoding it did
+// not ask for. Only gzip and deflate can be decoded; other codings, which targets are not offered by
+// offerDecodableEncodings, fail with GatewayTargetResponseEncodingError.
+func decodeTargetResponse(req *http.Request, resp *http.Response, metrics Metrics) error {
+	codings := []string{}
+	for _, value := range resp.Header.Values("Content-Encoding") {
+		for _, coding := range strings.Split(value, ",") {
+			if coding = strings.ToLower(strings.TrimSpace(coding)); coding != "" && coding != "identity" {
+				codings = append(codings, coding)
+			}
+		}
+	}
+	if len(codings) == 0 || req.Method == http.MethodHead || resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusNotModified {
+		return nil
+	}
+	accepted := acceptedEncodingsOf(req)
+	passThrough := true
+	for _, coding := range codings {
+		passThrough = passThrough && accepted.accepts(coding)
+	}
+	if passThrough {
+		return nil
+	}
+
+	body := resp.Body
+	closers := []io.Closer{resp.Body}
+	// Codings are listed in the order they were applied, so they are decoded in reverse
+	for i := len(codings) - 1; i >= 0; i-- {
+		var decoder io.ReadCloser
+		var err error
+		switch codings[i] {
+		case "gzip", "x-gzip":
+			decoder, err = gzip.NewReader(body)
+		case "deflate":
+			decoder, err = zlib.NewReader(body)
+		default:
+			resp.Body.Close()
+			metrics.Fire(metricsResultTargetBadEncoding)
+			return GatewayTargetResponseEncodingError
+		}
+		if err != nil {
+			resp.Body.Close()
+			metrics.Fire(metricsResultTargetRequestFailed)
+			return err
+		}
+		body = decoder
+		closers = append(closers, decoder)
+	}
+	resp.Body = decodedBody{Reader: body, closers: closers}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	resp.Uncompressed = true
+	return nil
+}
+
+type decodedBody struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (b decodedBody) Close() error {
+	var err error
+	for i := len(b.closers) - 1; i >= 0; i-- {
+		if closeErr := b.closers[i].Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
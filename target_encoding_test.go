@@ -0,0 +1,89 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDecodeTargetResponse(t *testing.T) {
+	compressed := new(bytes.Buffer)
+	writer := gzip.NewWriter(compressed)
+	writer.Write([]byte("decoded body"))
+	writer.Close()
+	offered := ""
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		offered = r.Header.Get("Accept-Encoding")
+		coding := r.URL.Query().Get("coding")
+		w.Header().Set("Content-Encoding", coding)
+		if coding == "gzip" {
+			w.Write(compressed.Bytes())
+		} else {
+			w.Write([]byte("opaque"))
+		}
+	}))
+	defer target.Close()
+	handler := FilteredHttpRequestHandler{client: &http.Client{}, maxResponseSize: defaultMaxTargetResponseSize}
+
+	get := func(coding, acceptEncoding string) (*http.Response, *MockMetrics, error) {
+		req, err := http.NewRequest(http.MethodGet, target.URL+"?coding="+coding, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		metrics := &MockMetrics{resultLabels: map[string]bool{}, tags: map[string]string{}}
+		resp, err := handler.Handle(req, metrics)
+		return resp, metrics, err
+	}
+
+	// An accepted coding is passed through intact
+	resp, _, err := get("gzip", "gzip, br")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body, _ := ioutil.ReadAll(resp.Body); resp.Header.Get("Content-Encoding") != "gzip" || !bytes.Equal(body, compressed.Bytes()) {
+		t.Fatalf("Accepted encoding was not passed through, got %q", resp.Header.Get("Content-Encoding"))
+	}
+
+	// Codings that can not be decoded are not offered to the target
+	for acceptEncoding, expected := range map[string]string{
+		"gzip, br":        "gzip",
+		"br;q=1, deflate": "deflate",
+		"*":               "*, br;q=0",
+		"br":              "gzip",
+	} {
+		if _, _, err = get("identity", acceptEncoding); err != nil {
+			t.Fatal(err)
+		}
+		if offered != expected {
+			t.Fatalf("Accept-Encoding %q was forwarded as %q", acceptEncoding, offered)
+		}
+	}
+
+	// Other codings are decoded, including those refused explicitly next to "*"
+	for _, acceptEncoding := range []string{"br", "gzip;q=0, identity", "gzip;q=0, *"} {
+		resp, _, err = get("gzip", acceptEncoding)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		if resp.Header.Get("Content-Encoding") != "" || resp.Header.Get("Content-Length") != "" || string(body) != "decoded body" {
+			t.Fatalf("Unexpected response %v %q for Accept-Encoding %q", resp.Header, body, acceptEncoding)
+		}
+	}
+
+	// Codings that can not be decoded fail instead of reaching the client
+	_, metrics, err := get("br", "gzip")
+	if err != GatewayTargetResponseEncodingError || !metrics.resultLabels[metricsResultTargetBadEncoding] {
+		t.Fatalf("Expected an unsupported encoding error, got %v", err)
+	}
+	if status := payloadErrorToPayloadStatusCode(err); status != http.StatusBadGateway {
+		t.Fatalf("Unsupported encoding yielded %d", status)
+	}
+}
@@ -0,0 +1,239 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// Latencies of the most recent target requests that the hedging threshold is computed from
+	hedgeLatencySamples = 1000
+	// Requests are not hedged until this many latencies are observed
+	hedgeMinSamples = 100
+	// The hedging threshold is computed again after this many observations
+	hedgeThresholdRefresh = 50
+	// Requests are never hedged sooner than this
+	defaultHedgeMinDelay = 10 * time.Millisecond
+
+	metricsResultRequestHedged = "request_hedged"
+)
+
+// latencyTracker keeps a window of recent target request latencies, and their percentile.
+type latencyTracker struct {
+	mu          sync.Mutex
+	samples     []time.Duration
+	next        int
+	percentile  float64
+	threshold   time.Duration
+	sinceUpdate int
+}
+
+func newLatencyTracker(percentile float64) *latencyTracker {
+	return &latencyTracker{percentile: percentile}
+}
+
+func (t *latencyTracker) observe(latency time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.samples) < hedgeLatencySamples {
+		t.samples = append(t.samples, latency)
+	} else {
+		t.samples[t.next] = latency
+		t.next = (t.next + 1) % hedgeLatencySamples
+	}
+	if t.sinceUpdate++; t.sinceUpdate >= hedgeThresholdRefresh || t.threshold == 0 && len(t.samples) >= hedgeMinSamples {
+		sorted := append([]time.Duration{}, t.samples...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		t.threshold = sorted[int(float64(len(sorted)-1)*t.percentile/100)]
+		t.sinceUpdate = 0
+	}
+}
+
+// delay returns the latency percentile, or false while too few latencies are known.
+func (t *latencyTracker) delay() (time.Duration, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.threshold, len(t.samples) >= hedgeMinSamples
+}
+
+// hedgePolicy sends a second attempt of an idempotent target request that has not completed within
+// the latency percentile of recent requests, and returns the first response, to cut the tail latency
+// of a slow target replica. The zero value never hedges.
+type hedgePolicy struct {
+	percentile float64
+	minDelay   time.Duration
+	latencies  *latencyTracker
+}
+
+func hedgePolicyFromEnvironment() hedgePolicy {
+	return hedgePolicy{
+		percentile: float64(getUintEnv(targetHedgePercentileVariable, 0)),
+		minDelay:   getDurationEnv(targetHedgeMinDelayVariable, defaultHedgeMinDelay),
+	}
+}
+
+// forHandler returns the policy with its own latencies, replacing the percentile if it is set, so that
+// the latencies of different targets are not mixed.
+func (p hedgePolicy) forHandler(percentile float64) hedgePolicy {
+	if percentile > 0 {
+		p.percentile = percentile
+	}
+	p.latencies = nil
+	if p.percentile > 0 && p.percentile < 100 {
+		p.latencies = newLatencyTracker(p.percentile)
+	}
+	return p
+}
+
+type hedgeResult struct {
+	attempt int
+	resp    *http.Response
+	err     error
+}
+
+// do sends req with send, hedging it once if it is slow. The attempt that loses is cancelled.
+func (p hedgePolicy) do(req *http.Request, metrics Metrics, send func(*http.Request, Metrics) (*http.Response, error)) (*http.Response, error) {
+	if p.latencies == nil || !idempotentMethod(req.Method) {
+		return send(req, metrics)
+	}
+	delay, ok := p.latencies.delay()
+	if !ok {
+		start := time.Now()
+		resp, err := send(req, metrics)
+		if err == nil {
+			p.latencies.observe(time.Since(start))
+		}
+		return resp, err
+	}
+	if delay < p.minDelay {
+		delay = p.minDelay
+	}
+	if err := bufferRequestBody(req); err != nil {
+		return nil, err
+	}
+
+	// Both attempts fire their metrics concurrently, and each result is counted once
+	attemptMetrics := &syncOnceMetrics{Metrics: metrics, fired: map[string]bool{}}
+	results := make(chan hedgeResult, 2)
+	cancels := []context.CancelFunc{}
+	start := time.Now()
+	launch := func(attempt *http.Request, cancel context.CancelFunc) {
+		i := len(cancels)
+		cancels = append(cancels, cancel)
+		go func() {
+			resp, err := send(attempt, attemptMetrics)
+			results <- hedgeResult{attempt: i, resp: resp, err: err}
+		}()
+	}
+	ctx, cancel := context.WithCancel(req.Context())
+	launch(req.WithContext(ctx), cancel)
+	pending := 1
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	hedge := timer.C
+	var lastErr error
+	for {
+		select {
+		case <-hedge:
+			hedge = nil
+			ctx, cancel := context.WithCancel(req.Context())
+			attempt := req.Clone(ctx)
+			if req.GetBody != nil {
+				body, err := req.GetBody()
+				if err != nil {
+					cancel()
+					continue
+				}
+				attempt.Body = body
+			}
+			attemptMetrics.Fire(metricsResultRequestHedged)
+			launch(attempt, cancel)
+			pending++
+		case result := <-results:
+			pending--
+			if result.err != nil {
+				cancels[result.attempt]()
+				lastErr = result.err
+				if pending > 0 {
+					continue
+				}
+				return nil, lastErr
+			}
+			p.latencies.observe(time.Since(start))
+			for i, cancel := range cancels {
+				if i != result.attempt {
+					cancel()
+				}
+			}
+			if pending > 0 {
+				go func() {
+					if loser := <-results; loser.resp != nil {
+						loser.resp.Body.Close()
+					}
+				}()
+			}
+			// The winning attempt is cancelled once its body is read
+			result.resp.Body = cancelOnClose{ReadCloser: result.resp.Body, cancel: cancels[result.attempt]}
+			return result.resp, nil
+		}
+	}
+}
+
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
+
+// syncOnceMetrics fires each result at most once, and can be used concurrently.
+type syncOnceMetrics struct {
+	Metrics
+	mu    sync.Mutex
+	fired map[string]bool
+}
+
+func (m *syncOnceMetrics) Fire(result string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.fired[result] {
+		m.fired[result] = true
+		m.Metrics.Fire(result)
+	}
+}
+
+func (m *syncOnceMetrics) ResponseStatus(prefix string, status int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.Metrics.ResponseStatus(prefix, status)
+}
+
+func (m *syncOnceMetrics) Tag(name string, value string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.Metrics.Tag(name, value)
+}
+
+func (m *syncOnceMetrics) Duration(stage string, duration time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.Metrics.Duration(stage, duration)
+}
+
+func (m *syncOnceMetrics) Size(message string, size int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.Metrics.Size(message, size)
+}
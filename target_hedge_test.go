@@ -0,0 +1,89 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLatencyTrackerPercentile(t *testing.T) {
+	tracker := newLatencyTracker(90)
+	for i := 1; i < hedgeMinSamples; i++ {
+		tracker.observe(time.Duration(i) * time.Millisecond)
+	}
+	if _, ok := tracker.delay(); ok {
+		t.Fatal("Expected no delay before enough latencies are observed")
+	}
+	tracker.observe(hedgeMinSamples * time.Millisecond)
+	if delay, ok := tracker.delay(); !ok || delay != 90*time.Millisecond {
+		t.Fatalf("Unexpected p90 delay %s", delay)
+	}
+}
+
+func TestHedgePolicy(t *testing.T) {
+	var requests int32
+	cancelled := make(chan struct{}, 1)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The first request stalls until it is cancelled
+		if atomic.AddInt32(&requests, 1) == 1 {
+			select {
+			case <-r.Context().Done():
+				cancelled <- struct{}{}
+			case <-time.After(5 * time.Second):
+			}
+			return
+		}
+		w.Write([]byte("hedged"))
+	}))
+	defer target.Close()
+
+	policy := hedgePolicy{minDelay: 10 * time.Millisecond}.forHandler(95)
+	for i := 0; i < hedgeMinSamples; i++ {
+		policy.latencies.observe(time.Millisecond)
+	}
+	client := &http.Client{}
+	send := func(req *http.Request, metrics Metrics) (*http.Response, error) {
+		return client.Do(req)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, target.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics := &MockMetrics{resultLabels: map[string]bool{}, tags: map[string]string{}}
+	start := time.Now()
+	resp, err := policy.do(req, metrics, send)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "hedged" || time.Since(start) > 2*time.Second {
+		t.Fatalf("Unexpected response %q after %s", body, time.Since(start))
+	}
+	if !metrics.resultLabels[metricsResultRequestHedged] {
+		t.Fatal("Missing request_hedged result")
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(2 * time.Second):
+		t.Fatal("The slow attempt was not cancelled")
+	}
+
+	// Requests that are not idempotent are never hedged
+	atomic.StoreInt32(&requests, 1)
+	post, _ := http.NewRequest(http.MethodPost, target.URL, nil)
+	metrics = &MockMetrics{resultLabels: map[string]bool{}, tags: map[string]string{}}
+	if resp, err := policy.do(post, metrics, send); err == nil {
+		resp.Body.Close()
+	}
+	if metrics.resultLabels[metricsResultRequestHedged] || atomic.LoadInt32(&requests) != 2 {
+		t.Fatal("A POST request was hedged")
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// targetPattern matches the targets of outbound requests. An empty scheme matches any scheme, an empty
+// port matches only the default port of the request's scheme, and a host starting with "*." matches any
+// subdomain of the rest of the host.
+type targetPattern struct {
+	scheme string
+	host   string
+	port   string
+}
+
+func parseTargetPattern(entry string) targetPattern {
+	pattern := targetPattern{}
+	if i := strings.Index(entry, "://"); i >= 0 {
+		pattern.scheme, entry = entry[:i], entry[i+3:]
+	}
+	entry = strings.TrimSuffix(entry, "/")
+	if host, port, err := net.SplitHostPort(entry); err == nil {
+		pattern.host, pattern.port = host, port
+	} else {
+		pattern.host = entry
+	}
+	pattern.host = strings.TrimSuffix(pattern.host, ".")
+	return pattern
+}
+
+func (p targetPattern) matches(scheme, host, port string) bool {
+	if p.scheme != "" && p.scheme != scheme {
+		return false
+	}
+	if p.port == "" {
+		if port != "" && !(scheme == "https" && port == "443") && !(scheme == "http" && port == "80") {
+			return false
+		}
+	} else if p.port != port {
+		return false
+	}
+	if strings.HasPrefix(p.host, "*.") {
+		return strings.HasSuffix(host, p.host[1:])
+	}
+	return p.host == host
+}
+
+// targetList is a set of target patterns, used as an allowlist or a denylist. Entries are host names,
+// optionally preceded by a scheme (e.g., "https://") and followed by a port, and may start with "*." to
+// match any subdomain.
+type targetList []targetPattern
+
+func newTargetList(targets string) targetList {
+	list := targetList{}
+	for _, target := range strings.Split(targets, ",") {
+		if target = strings.ToLower(strings.TrimSpace(target)); target != "" {
+			list = append(list, parseTargetPattern(target))
+		}
+	}
+	return list
+}
+
+// matches reports whether a request with the given scheme and authority matches any entry.
+func (l targetList) matches(scheme, authority string) bool {
+	host, port, err := net.SplitHostPort(authority)
+	if err != nil {
+		host, port = authority, ""
+	}
+	scheme = strings.ToLower(scheme)
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, pattern := range l {
+		if pattern.matches(scheme, host, port) {
+			return true
+		}
+	}
+	return false
+}
+
+// targetDenied checks a request's Host and URL authority against a denylist, which takes precedence over
+// any allowlist. Denied requests are always logged, since they usually point at a client probing internal
+// endpoints or using a retired origin.
+func targetDenied(denylist targetList, req *http.Request, metrics Metrics) bool {
+	if !denylist.matches(req.URL.Scheme, req.Host) && !denylist.matches(req.URL.Scheme, req.URL.Host) {
+		return false
+	}
+	metrics.Fire(metricsResultTargetRequestDenied)
+	log.Printf("TargetDeniedError: %s, %s", req.Host, req.URL)
+	return true
+}
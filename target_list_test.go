@@ -0,0 +1,51 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestTargetList(t *testing.T) {
+	allowlist := newTargetList("api.example.com, *.cdn.example, internal.example:8443, http://legacy.example:8080")
+	for _, test := range []struct {
+		scheme    string
+		authority string
+		allowed   bool
+	}{
+		{"https", "api.example.com", true},
+		{"https", "API.example.com:443", true},
+		{"https", "api.example.com:8443", false},
+		{"http", "api.example.com:443", false},
+		{"https", "img.cdn.example", true},
+		{"https", "cdn.example", false},
+		{"https", "evilcdn.example", false},
+		{"https", "internal.example:8443", true},
+		{"https", "internal.example", false},
+		{"https", "other.example", false},
+		{"http", "legacy.example:8080", true},
+		{"https", "legacy.example:8080", false},
+	} {
+		if allowed := allowlist.matches(test.scheme, test.authority); allowed != test.allowed {
+			t.Errorf("%s://%s: expected allowed=%v", test.scheme, test.authority, test.allowed)
+		}
+	}
+}
+
+func TestTargetDenylist(t *testing.T) {
+	handler := FilteredHttpRequestHandler{
+		client:         &http.Client{},
+		allowedOrigins: newTargetList("*.example"),
+		deniedOrigins:  newTargetList("metadata.example"),
+	}
+	req, _ := http.NewRequest(http.MethodGet, "https://metadata.example/latest", nil)
+	metrics := &MockMetrics{resultLabels: map[string]bool{}, tags: map[string]string{}}
+	if _, err := handler.Handle(req, metrics); err != GatewayTargetForbiddenError {
+		t.Fatalf("Expected denied target to be rejected, got %v", err)
+	}
+	if !metrics.resultLabels[metricsResultTargetRequestDenied] || metrics.resultLabels[metricsResultTargetRequestForbidden] {
+		t.Fatalf("Expected only the %s metric, got %v", metricsResultTargetRequestDenied, metrics.resultLabels)
+	}
+}
@@ -0,0 +1,63 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+)
+
+// Protocols of target connections
+const (
+	// targetProtocolAuto negotiates HTTP/2 with ALPN where the target supports it, and HTTP/1.1 otherwise
+	targetProtocolAuto  = "auto"
+	targetProtocolHTTP1 = "http1"
+	targetProtocolH2    = "h2"
+	targetProtocolH3    = "h3"
+)
+
+func validateTargetProtocol(protocol string) error {
+	switch protocol {
+	case "", targetProtocolAuto, targetProtocolHTTP1, targetProtocolH2:
+		return nil
+	case targetProtocolH3:
+		// HTTP/3 requires a QUIC implementation, which the standard library and the vendored modules do
+		// not provide. Fail loudly instead of silently falling back to TCP.
+		return fmt.Errorf("HTTP/3 target connections are not supported by this build")
+	default:
+		return fmt.Errorf("Unknown target protocol %q", protocol)
+	}
+}
+
+// configureTargetProtocol restricts transport to protocol, and returns the round tripper that enforces it.
+func configureTargetProtocol(transport *http.Transport, protocol string) http.RoundTripper {
+	switch protocol {
+	case targetProtocolHTTP1:
+		// A non-nil empty map disables HTTP/2
+		transport.ForceAttemptHTTP2 = false
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	case targetProtocolH2:
+		return http2OnlyTransport{transport: transport}
+	}
+	return transport
+}
+
+// http2OnlyTransport rejects the responses of targets that did not negotiate HTTP/2. The standard
+// library always offers HTTP/1.1 as well, so the protocol can only be checked once it is negotiated.
+type http2OnlyTransport struct {
+	transport http.RoundTripper
+}
+
+func (t http2OnlyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.ProtoMajor != 2 {
+		resp.Body.Close()
+		return nil, fmt.Errorf("Target %s did not negotiate HTTP/2", req.URL.Host)
+	}
+	return resp, nil
+}
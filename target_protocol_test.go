@@ -0,0 +1,58 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTargetClientProtocol(t *testing.T) {
+	h2Target := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	h2Target.EnableHTTP2 = true
+	h2Target.StartTLS()
+	defer h2Target.Close()
+	http1Target := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer http1Target.Close()
+
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(h2Target.Certificate())
+	rootCAs.AddCert(http1Target.Certificate())
+	tlsConfig := &tls.Config{RootCAs: rootCAs}
+	get := func(protocol, url string) (int, error) {
+		resp, err := targetClientConfig{tls: tlsConfig, protocol: protocol}.client().Get(url)
+		if err != nil {
+			return 0, err
+		}
+		resp.Body.Close()
+		return resp.ProtoMajor, nil
+	}
+
+	for _, test := range []struct {
+		protocol string
+		url      string
+		major    int
+	}{
+		{"", h2Target.URL, 2},
+		{targetProtocolAuto, http1Target.URL, 1},
+		{targetProtocolHTTP1, h2Target.URL, 1},
+		{targetProtocolH2, h2Target.URL, 2},
+	} {
+		if major, err := get(test.protocol, test.url); err != nil || major != test.major {
+			t.Errorf("Protocol %q negotiated HTTP/%d (%v), expected HTTP/%d", test.protocol, major, err, test.major)
+		}
+	}
+	if _, err := get(targetProtocolH2, http1Target.URL); err == nil {
+		t.Fatal("Expected a target without HTTP/2 to be rejected")
+	}
+
+	for _, protocol := range []string{targetProtocolH3, "spdy"} {
+		if err := validateTargetProtocol(protocol); err == nil {
+			t.Errorf("Expected protocol %q to be rejected", protocol)
+		}
+	}
+}
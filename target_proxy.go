@@ -0,0 +1,81 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+)
+
+// TargetProxyHttpRequestHandler is an HttpRequestHandler that forwards decapsulated requests to any
+// target on its allowlist, which turns the gateway into a general-purpose OHTTP target proxy. Unlike
+// FilteredHttpRequestHandler, it always requires an allowlist, so it can not be used as an open proxy.
+type TargetProxyHttpRequestHandler struct {
+	client             *http.Client
+	retry              retryPolicy
+	hedge              hedgePolicy
+	breaker            *circuitBreaker
+	allowlist          targetList
+	denylist           targetList
+	scrubber           headerScrubber
+	redirects          redirectPolicy
+	credentials        []*targetCredential
+	maxResponseSize    int64
+	allowHTTP          bool
+	logForbiddenErrors bool
+}
+
+// Handle validates the request's scheme and authority against the denylist and allowlist, and forwards
+// the request without its hop-by-hop and identifying headers.
+func (h TargetProxyHttpRequestHandler) Handle(req *http.Request, metrics Metrics) (*http.Response, error) {
+	if targetDenied(h.denylist, req, metrics) {
+		return nil, GatewayTargetForbiddenError
+	}
+	scheme := req.URL.Scheme
+	if !(scheme == "https" || scheme == "http" && h.allowHTTP) || !h.allowlist.matches(scheme, req.URL.Host) {
+		metrics.Fire(metricsResultTargetRequestForbidden)
+		if h.logForbiddenErrors {
+			log.Printf("TargetForbiddenError: %s://%s", scheme, req.URL.Host)
+		}
+		return nil, GatewayTargetForbiddenError
+	}
+
+	h.scrubber.scrub(req)
+	offerDecodableEncodings(req)
+	injectCredentials(req, h.credentials)
+	req = traceInformationalResponses(req, h.scrubber)
+	req.Host = req.URL.Host
+	req.RequestURI = ""
+
+	client := h.redirects.client(h.client, metrics, func(redirect *http.Request) bool {
+		scheme := redirect.URL.Scheme
+		return (scheme == "https" || scheme == "http" && h.allowHTTP) &&
+			!h.denylist.matches(scheme, redirect.URL.Host) && h.allowlist.matches(scheme, redirect.URL.Host)
+	})
+	resp, err := h.breaker.do(req, metrics, func() (*http.Response, error) {
+		return h.hedge.do(req, metrics, func(attempt *http.Request, metrics Metrics) (*http.Response, error) {
+			return h.retry.do(client, attempt, metrics)
+		})
+	})
+	if err == GatewayTargetUnavailableError {
+		return nil, err
+	} else if errors.Is(err, targetAddressForbiddenError) {
+		metrics.Fire(metricsResultTargetAddressForbidden)
+		return nil, GatewayTargetForbiddenError
+	} else if err != nil {
+		metrics.Fire(metricsResultTargetRequestFailed)
+		return nil, err
+	}
+
+	if err := decodeTargetResponse(req, resp, metrics); err != nil {
+		return nil, err
+	}
+	if err := limitTargetResponse(resp, h.maxResponseSize, metrics); err != nil {
+		return nil, err
+	}
+	h.scrubber.scrubResponse(resp)
+	metrics.Fire(metricsResultSuccess)
+	return resp, nil
+}
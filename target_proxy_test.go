@@ -0,0 +1,57 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestTargetProxyHandler(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Proxy-Authorization") != "" || r.Header.Get("X-Hop") != "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte("proxied " + r.URL.Path))
+	}))
+	defer target.Close()
+	targetURL, _ := url.Parse(target.URL)
+
+	handler := TargetProxyHttpRequestHandler{
+		client:    &http.Client{},
+		allowlist: newTargetList(targetURL.Host),
+		allowHTTP: true,
+	}
+	proxy := func(rawURL string) (*http.Response, error) {
+		req, _ := http.NewRequest(http.MethodGet, rawURL, nil)
+		req.Header.Set("Connection", "X-Hop")
+		req.Header.Set("X-Hop", "1")
+		req.Header.Set("Proxy-Authorization", "secret")
+		metrics := &MockMetricsFactory{}
+		return handler.Handle(req, metrics.Create(metricsEventGatewayRequest))
+	}
+
+	resp, err := proxy(target.URL + "/path")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || !bytes.Equal(body, []byte("proxied /path")) {
+		t.Fatalf("Unexpected proxied response %d %s", resp.StatusCode, body)
+	}
+
+	if _, err := proxy("http://forbidden.example/path"); err != GatewayTargetForbiddenError {
+		t.Fatalf("Expected forbidden target to be rejected, got %v", err)
+	}
+
+	handler.allowHTTP = false
+	if _, err := proxy(target.URL + "/path"); err != GatewayTargetForbiddenError {
+		t.Fatalf("Expected http target to be rejected, got %v", err)
+	}
+}
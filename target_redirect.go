@@ -0,0 +1,65 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+)
+
+// Redirect policies of TARGET_REDIRECT_POLICY
+const (
+	redirectPolicyFollow = "follow"
+	redirectPolicyReturn = "return"
+
+	defaultTargetMaxRedirects = 10
+)
+
+// redirectPolicy decides whether target redirects are followed by the gateway, or returned in the
+// encapsulated response for the client to follow. Followed redirects must pass the same denylist and
+// allowlist checks as the request, and a redirect that does not is returned instead. The zero value
+// follows up to defaultTargetMaxRedirects redirects.
+type redirectPolicy struct {
+	returnRedirects bool
+	maxRedirects    int
+}
+
+func redirectPolicyFromEnvironment() (redirectPolicy, error) {
+	policy := redirectPolicy{maxRedirects: int(getUintEnv(targetMaxRedirectsVariable, defaultTargetMaxRedirects))}
+	switch mode := os.Getenv(targetRedirectPolicyVariable); mode {
+	case "", redirectPolicyFollow:
+	case redirectPolicyReturn:
+		policy.returnRedirects = true
+	default:
+		return redirectPolicy{}, fmt.Errorf("Unknown redirect policy %q", mode)
+	}
+	return policy, nil
+}
+
+// client returns a copy of client, sharing its transport, that applies the policy to redirects, where
+// allowed reports whether a redirected request may be sent.
+func (p redirectPolicy) client(client *http.Client, metrics Metrics, allowed func(*http.Request) bool) *http.Client {
+	maxRedirects := p.maxRedirects
+	if maxRedirects == 0 {
+		maxRedirects = defaultTargetMaxRedirects
+	}
+	redirectClient := *client
+	redirectClient.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if p.returnRedirects {
+			return http.ErrUseLastResponse
+		}
+		if len(via) >= maxRedirects {
+			return fmt.Errorf("Stopped after %d redirects", maxRedirects)
+		}
+		if !allowed(req) {
+			metrics.Fire(metricsResultTargetRedirectForbidden)
+			log.Printf("TargetRedirectForbidden: %s", req.URL)
+			return http.ErrUseLastResponse
+		}
+		return nil
+	}
+	return &redirectClient
+}
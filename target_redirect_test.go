@@ -0,0 +1,60 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestTargetRedirectPolicy(t *testing.T) {
+	external := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	defer external.Close()
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/internal":
+			http.Redirect(w, r, "/final", http.StatusFound)
+		case "/external":
+			http.Redirect(w, r, external.URL+"/final", http.StatusFound)
+		default:
+			w.WriteHeader(http.StatusOK)
+		}
+	}))
+	defer target.Close()
+	targetURL, _ := url.Parse(target.URL)
+
+	for _, test := range []struct {
+		policy redirectPolicy
+		path   string
+		status int
+	}{
+		{redirectPolicy{}, "/internal", http.StatusOK},
+		{redirectPolicy{}, "/external", http.StatusFound},
+		{redirectPolicy{returnRedirects: true}, "/internal", http.StatusFound},
+	} {
+		handler := FilteredHttpRequestHandler{
+			client:         &http.Client{},
+			allowedOrigins: newTargetList(targetURL.Host),
+			redirects:      test.policy,
+		}
+		req, _ := http.NewRequest(http.MethodGet, target.URL+test.path, nil)
+		metrics := &MockMetricsFactory{}
+		resp, err := handler.Handle(req, metrics.Create(metricsEventGatewayRequest))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != test.status {
+			t.Errorf("Redirect of %s with %+v: expected %d, got %d", test.path, test.policy, test.status, resp.StatusCode)
+		}
+	}
+
+	t.Setenv(targetRedirectPolicyVariable, "sometimes")
+	if _, err := redirectPolicyFromEnvironment(); err == nil {
+		t.Fatal("Expected an unknown redirect policy to be rejected")
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// newTargetResolver builds the resolver of target host names, which sends queries to a DNS server
+// address, with port 53 by default, or to a DoH resolver URL. An empty resolver selects the system
+// resolver. The host name of a DoH resolver URL is itself resolved by the system resolver.
+func newTargetResolver(resolver string, timeout time.Duration) (*net.Resolver, error) {
+	if resolver == "" {
+		return nil, nil
+	}
+	if strings.HasPrefix(resolver, "https://") {
+		return dohResolver(DNSAppHandler{client: &http.Client{Timeout: timeout}, resolverURL: resolver}), nil
+	}
+
+	if _, _, err := net.SplitHostPort(resolver); err != nil {
+		resolver = net.JoinHostPort(resolver, "53")
+	}
+	host, _, err := net.SplitHostPort(resolver)
+	if err != nil || net.ParseIP(host) == nil {
+		return nil, errors.New("Target resolver must be an IP address, with an optional port, or a DoH URL")
+	}
+	dialer := &net.Dialer{Timeout: timeout}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, resolver)
+		},
+	}, nil
+}
+
+// dohResolver returns a resolver that sends its queries to the DoH resolver of doh.
+func dohResolver(doh DNSAppHandler) *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return &dohConn{doh: doh}, nil
+		},
+	}
+}
+
+// dohConn is a stream connection to a DoH resolver for net.Resolver, which writes DNS queries prefixed
+// with their two-byte length (RFC 1035, Section 4.2.2) and reads the responses in the same framing.
+type dohConn struct {
+	doh      DNSAppHandler
+	query    bytes.Buffer
+	response bytes.Buffer
+}
+
+func (c *dohConn) Write(p []byte) (int, error) {
+	return c.query.Write(p)
+}
+
+func (c *dohConn) Read(p []byte) (int, error) {
+	if c.response.Len() == 0 {
+		if c.query.Len() < 2 {
+			return 0, errors.New("No DNS query was written")
+		}
+		length := int(binary.BigEndian.Uint16(c.query.Next(2)))
+		query := c.query.Next(length)
+		if len(query) != length || length < dnsHeaderLength {
+			return 0, errors.New("Incomplete DNS query")
+		}
+		response, err := c.doh.resolve(query)
+		if err != nil {
+			return 0, err
+		}
+		binary.Write(&c.response, binary.BigEndian, uint16(len(response)))
+		c.response.Write(response)
+	}
+	return c.response.Read(p)
+}
+
+func (c *dohConn) Close() error                       { return nil }
+func (c *dohConn) LocalAddr() net.Addr                { return &net.TCPAddr{} }
+func (c *dohConn) RemoteAddr() net.Addr               { return &net.TCPAddr{} }
+func (c *dohConn) SetDeadline(t time.Time) error      { return nil }
+func (c *dohConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *dohConn) SetWriteDeadline(t time.Time) error { return nil }
@@ -0,0 +1,70 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// answerA answers an A query with 192.0.2.1, and any other query with no records.
+func answerA(query []byte) []byte {
+	end := dnsHeaderLength
+	for query[end] != 0 {
+		end += int(query[end]) + 1
+	}
+	question := query[dnsHeaderLength : end+5]
+
+	response := new(bytes.Buffer)
+	response.Write(query[:2])
+	response.Write([]byte{0x81, 0x80, 0, 1})
+	if binary.BigEndian.Uint16(question[len(question)-4:]) != 1 {
+		response.Write([]byte{0, 0, 0, 0, 0, 0})
+		response.Write(question)
+		return response.Bytes()
+	}
+	response.Write([]byte{0, 1, 0, 0, 0, 0})
+	response.Write(question)
+	response.Write([]byte{0xC0, 0x0C, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4, 192, 0, 2, 1})
+	return response.Bytes()
+}
+
+func TestTargetResolverDoH(t *testing.T) {
+	resolver := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("Content-Type", dnsMessageContentType)
+		w.Write(answerA(query))
+	}))
+	defer resolver.Close()
+
+	if _, err := newTargetResolver(resolver.URL, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	doh := dohResolver(DNSAppHandler{client: resolver.Client(), resolverURL: resolver.URL})
+	ips, err := doh.LookupIP(context.Background(), "ip4", "target.example.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ips) != 1 || !ips[0].Equal(net.ParseIP("192.0.2.1")) {
+		t.Fatalf("Unexpected addresses %v", ips)
+	}
+}
+
+func TestTargetResolverAddress(t *testing.T) {
+	for _, resolver := range []string{"192.0.2.53", "192.0.2.53:5353", "[2001:db8::53]:53"} {
+		if _, err := newTargetResolver(resolver, time.Second); err != nil {
+			t.Errorf("Resolver %s: %s", resolver, err)
+		}
+	}
+	if _, err := newTargetResolver("dns.example", time.Second); err == nil {
+		t.Fatal("Expected a resolver host name to be rejected")
+	}
+}
@@ -0,0 +1,37 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+// limitTargetResponse reads the body of a target response into memory, failing with
+// GatewayTargetResponseTooLargeError as soon as it exceeds maxSize bytes, so that a target can not make
+// the gateway buffer an unbounded response for encapsulation. A maxSize of 0 disables the limit.
+func limitTargetResponse(resp *http.Response, maxSize int64, metrics Metrics) error {
+	if maxSize <= 0 {
+		return nil
+	}
+	defer resp.Body.Close()
+	if resp.ContentLength > maxSize {
+		metrics.Fire(metricsResultTargetResponseTooLarge)
+		return GatewayTargetResponseTooLargeError
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxSize+1))
+	if err != nil {
+		metrics.Fire(metricsResultTargetRequestFailed)
+		return err
+	}
+	if int64(len(body)) > maxSize {
+		metrics.Fire(metricsResultTargetResponseTooLarge)
+		return GatewayTargetResponseTooLargeError
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	return nil
+}
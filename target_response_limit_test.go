@@ -0,0 +1,58 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strconv"
+	"testing"
+
+	"github.com/chris-wood/ohttp-go"
+)
+
+func TestTargetResponseLimit(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Responses to /chunked/<size> are sent without a Content-Length
+		size, _ := strconv.Atoi(path.Base(r.URL.Path))
+		if path.Dir(r.URL.Path) == "/chunked" {
+			w.(http.Flusher).Flush()
+		}
+		w.Write(bytes.Repeat([]byte("a"), size))
+	}))
+	defer target.Close()
+
+	handler := FilteredHttpRequestHandler{client: &http.Client{}, maxResponseSize: 100}
+	for _, test := range []struct {
+		path string
+		err  error
+	}{
+		{"/100", nil},
+		{"/101", GatewayTargetResponseTooLargeError},
+		{"/chunked/100", nil},
+		{"/chunked/101", GatewayTargetResponseTooLargeError},
+	} {
+		req, _ := http.NewRequest(http.MethodGet, target.URL+test.path, nil)
+		metrics := &MockMetricsFactory{}
+		if _, err := handler.Handle(req, metrics.Create(metricsEventGatewayRequest)); err != test.err {
+			t.Errorf("Response for %s: expected %v, got %v", test.path, test.err, err)
+		}
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, target.URL+"/101", nil)
+	binaryRequest, err := (*ohttp.BinaryRequest)(req).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics := &MockMetricsFactory{}
+	binaryResponse, err := BinaryHTTPAppHandler{httpHandler: handler}.Handle(binaryRequest, metrics.Create(metricsEventGatewayRequest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, _, _ := readBinaryResponseTrailer(t, binaryResponse); status != http.StatusBadGateway {
+		t.Fatalf("Expected %d for a too large response, got %d", http.StatusBadGateway, status)
+	}
+}
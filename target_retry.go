@@ -0,0 +1,136 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Prefix of the metric fired for each retried attempt, followed by the attempt number
+	metricsResultTargetRetryPrefix = "request_retry_"
+
+	defaultTargetRetryBackoff    = 100 * time.Millisecond
+	defaultTargetRetryMaxBackoff = 2 * time.Second
+	defaultTargetRetryStatuses   = "502,503,504"
+)
+
+// retryPolicy retries idempotent target requests that fail with a network error or a retryable status,
+// waiting an exponentially increasing backoff between attempts. The zero value sends a single attempt.
+type retryPolicy struct {
+	maxAttempts        int
+	backoff            time.Duration
+	maxBackoff         time.Duration
+	statuses           map[int]bool
+	retryNetworkErrors bool
+}
+
+func retryPolicyFromEnvironment() retryPolicy {
+	policy := retryPolicy{
+		maxAttempts:        int(getUintEnv(targetRetryMaxAttemptsVariable, 1)),
+		backoff:            getDurationEnv(targetRetryBackoffVariable, defaultTargetRetryBackoff),
+		maxBackoff:         getDurationEnv(targetRetryMaxBackoffVariable, defaultTargetRetryMaxBackoff),
+		statuses:           map[int]bool{},
+		retryNetworkErrors: getBoolEnv(targetRetryNetworkErrorsVariable, true),
+	}
+	statuses := os.Getenv(targetRetryStatusesVariable)
+	if statuses == "" {
+		statuses = defaultTargetRetryStatuses
+	}
+	for _, status := range strings.Split(statuses, ",") {
+		if code, err := strconv.Atoi(strings.TrimSpace(status)); err == nil {
+			policy.statuses[code] = true
+		}
+	}
+	return policy
+}
+
+// idempotentMethod reports whether a request with method can be safely sent more than once (RFC 9110,
+// Section 9.2.2).
+func idempotentMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	default:
+		return false
+	}
+}
+
+// backoffFor returns the time to wait before the given retried attempt, starting at 2.
+func (p retryPolicy) backoffFor(attempt int) time.Duration {
+	backoff := p.backoff
+	for i := 2; i < attempt && backoff < p.maxBackoff; i++ {
+		backoff *= 2
+	}
+	if p.maxBackoff > 0 && backoff > p.maxBackoff {
+		backoff = p.maxBackoff
+	}
+	return backoff
+}
+
+// bufferRequestBody reads the body of req, if it can not be read again yet, so that it can be sent more
+// than once.
+func bufferRequestBody(req *http.Request) error {
+	if req.Body == nil || req.GetBody != nil {
+		return nil
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return err
+	}
+	req.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(body)), nil
+	}
+	req.Body, _ = req.GetBody()
+	return nil
+}
+
+// do sends req with client, retrying it according to the policy. The last attempt's response or error is
+// returned, and every retried attempt is counted with its own metric.
+func (p retryPolicy) do(client *http.Client, req *http.Request, metrics Metrics) (*http.Response, error) {
+	if p.maxAttempts <= 1 || !idempotentMethod(req.Method) {
+		return client.Do(req)
+	}
+	if err := bufferRequestBody(req); err != nil {
+		return nil, err
+	}
+
+	for attempt := 1; ; attempt++ {
+		if attempt > 1 {
+			metrics.Fire(metricsResultTargetRetryPrefix + strconv.Itoa(attempt))
+			if req.GetBody != nil {
+				body, err := req.GetBody()
+				if err != nil {
+					return nil, err
+				}
+				req.Body = body
+			}
+		}
+
+		resp, err := client.Do(req)
+		retry := err != nil && p.retryNetworkErrors && !errors.Is(err, targetAddressForbiddenError) ||
+			err == nil && p.statuses[resp.StatusCode]
+		if !retry || attempt >= p.maxAttempts {
+			return resp, err
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+
+		select {
+		case <-time.After(p.backoffFor(attempt + 1)):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicy(t *testing.T) {
+	attempts := 0
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		body, _ := ioutil.ReadAll(r.Body)
+		if attempts < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write(body)
+	}))
+	defer target.Close()
+
+	policy := retryPolicy{
+		maxAttempts: 3,
+		backoff:     time.Millisecond,
+		maxBackoff:  2 * time.Millisecond,
+		statuses:    map[int]bool{http.StatusServiceUnavailable: true},
+	}
+	metrics := &MockMetrics{resultLabels: map[string]bool{}, tags: map[string]string{}}
+	req, _ := http.NewRequest(http.MethodPut, target.URL, bytes.NewReader([]byte("payload")))
+	resp, err := policy.do(target.Client(), req, metrics)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || !bytes.Equal(body, []byte("payload")) || attempts != 3 {
+		t.Fatalf("Unexpected response %d %s after %d attempts", resp.StatusCode, body, attempts)
+	}
+	if !metrics.resultLabels[metricsResultTargetRetryPrefix+"2"] || !metrics.resultLabels[metricsResultTargetRetryPrefix+"3"] {
+		t.Fatalf("Expected per-attempt metrics, got %v", metrics.resultLabels)
+	}
+
+	// Requests that are not idempotent are never retried
+	attempts = 0
+	req, _ = http.NewRequest(http.MethodPost, target.URL, nil)
+	resp, err = policy.do(target.Client(), req, metrics)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusServiceUnavailable || attempts != 1 {
+		t.Fatalf("Unexpected response %d after %d attempts", resp.StatusCode, attempts)
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	policy := retryPolicy{backoff: 100 * time.Millisecond, maxBackoff: time.Second}
+	for attempt, expected := range map[int]time.Duration{2: 100 * time.Millisecond, 3: 200 * time.Millisecond, 4: 400 * time.Millisecond, 6: time.Second} {
+		if backoff := policy.backoffFor(attempt); backoff != expected {
+			t.Errorf("Attempt %d: expected backoff %s, got %s", attempt, expected, backoff)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	// Shadow requests that take longer than this, or the handler timeout, are cancelled
+	defaultShadowTimeout = 30 * time.Second
+	// Requests are not mirrored while this many shadow requests are pending, so a slow shadow target can
+	// not exhaust the gateway's resources
+	maxPendingShadowRequests = 100
+
+	metricsResultShadowMirrored = "shadow_mirrored"
+	metricsResultShadowDropped  = "shadow_dropped"
+)
+
+// ShadowHttpRequestHandler is an HttpRequestHandler that passes requests to the next handler, and mirrors
+// a percentage of them to a shadow target in the background. Shadow responses are discarded, and shadow
+// requests are sent without retries or circuit breaking, so the shadow target never affects clients.
+type ShadowHttpRequestHandler struct {
+	target  *url.URL
+	percent float64
+	timeout time.Duration
+	pending chan struct{}
+	// permits, if not nil, selects the requests that may be mirrored, so that requests that the next
+	// handler rejects are not
+	permits func(req *http.Request) bool
+
+	client      *http.Client
+	scrubber    headerScrubber
+	credentials []*targetCredential
+	httpHandler HttpRequestHandler
+}
+
+func newShadowHttpRequestHandler(target *url.URL, percent float64, timeout time.Duration, sender FilteredHttpRequestHandler, httpHandler HttpRequestHandler) ShadowHttpRequestHandler {
+	if timeout == 0 {
+		timeout = defaultShadowTimeout
+	}
+	return ShadowHttpRequestHandler{
+		target:      target,
+		percent:     percent,
+		timeout:     timeout,
+		pending:     make(chan struct{}, maxPendingShadowRequests),
+		client:      sender.client,
+		scrubber:    sender.scrubber,
+		credentials: sender.credentials,
+		httpHandler: httpHandler,
+	}
+}
+
+func (h ShadowHttpRequestHandler) Handle(req *http.Request, metrics Metrics) (*http.Response, error) {
+	if h.permits != nil && !h.permits(req) || rand.Float64()*100 >= h.percent {
+		return h.httpHandler.Handle(req, metrics)
+	}
+	select {
+	case h.pending <- struct{}{}:
+	default:
+		metrics.Fire(metricsResultShadowDropped)
+		return h.httpHandler.Handle(req, metrics)
+	}
+
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			<-h.pending
+			return nil, err
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+
+	// The shadow request outlives the client request, so it is not bound to its context
+	ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+	shadow := req.Clone(ctx)
+	shadow.URL = upstreamURL(h.target, req.URL)
+	shadow.Host = h.target.Host
+	if body != nil {
+		shadow.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	h.scrubber.scrub(shadow)
+	injectCredentials(shadow, h.credentials)
+	metrics.Fire(metricsResultShadowMirrored)
+	go func() {
+		defer func() { <-h.pending }()
+		defer cancel()
+		if resp, err := h.client.Do(shadow); err == nil {
+			resp.Body.Close()
+		}
+	}()
+
+	return h.httpHandler.Handle(req, metrics)
+}
@@ -0,0 +1,131 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestShadowHttpRequestHandler(t *testing.T) {
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write(append([]byte("primary "), body...))
+	}))
+	defer primary.Close()
+	mirrored := make(chan string, 1)
+	release := make(chan struct{})
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mirrored <- r.Method + " " + r.URL.Path + " " + string(body)
+		<-release
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer shadow.Close()
+	defer close(release)
+
+	shadowURL, _ := url.Parse(shadow.URL + "/v2")
+	sender := FilteredHttpRequestHandler{client: &http.Client{}}
+	handler := newShadowHttpRequestHandler(shadowURL, 100, 0, sender, sender)
+
+	req, err := http.NewRequest(http.MethodPost, primary.URL+"/items", bytes.NewReader([]byte("body")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics := &MockMetrics{resultLabels: map[string]bool{}, tags: map[string]string{}}
+	// The slow shadow target does not delay the primary response
+	resp, err := handler.Handle(req, metrics)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if body, _ := ioutil.ReadAll(resp.Body); string(body) != "primary body" {
+		t.Fatalf("Unexpected primary response %q", body)
+	}
+	if !metrics.resultLabels[metricsResultShadowMirrored] {
+		t.Fatal("Missing shadow_mirrored result")
+	}
+	select {
+	case request := <-mirrored:
+		if request != "POST /v2/items body" {
+			t.Fatalf("Unexpected shadow request %q", request)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("The request was not mirrored")
+	}
+}
+
+func TestShadowHttpRequestHandlerSampling(t *testing.T) {
+	shadowURL, _ := url.Parse("http://shadow.invalid")
+	handler := newShadowHttpRequestHandler(shadowURL, 0.0001, 0, FilteredHttpRequestHandler{}, ForbiddenCheckHttpRequestHandler{forbidden: "app.internal"})
+	for i := 0; i < 100; i++ {
+		metrics := &MockMetrics{resultLabels: map[string]bool{}, tags: map[string]string{}}
+		req, _ := http.NewRequest(http.MethodGet, "http://app.internal", nil)
+		handler.Handle(req, metrics)
+		if metrics.resultLabels[metricsResultShadowMirrored] {
+			t.Fatal("Mirrored more requests than the shadow percent")
+		}
+	}
+
+	factory := handlerFactory{newAppHandler: func(httpHandler HttpRequestHandler) AppContentHandler {
+		return BinaryHTTPAppHandler{httpHandler: httpHandler}
+	}}
+	if _, err := factory.build(handlerConfig{Path: "/gateway-app", Type: handlerTypeTarget, ShadowTarget: "https://shadow.internal"}); err == nil {
+		t.Fatal("Expected a shadow target without a shadow percent to be rejected")
+	}
+}
+
+func TestShadowHttpRequestHandlerSkipsForbiddenRequests(t *testing.T) {
+	t.Setenv("SHADOW_TEST_TOKEN", "secret")
+	mirrored := make(chan string, 1)
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mirrored <- r.Header.Get("Authorization")
+	}))
+	defer shadow.Close()
+
+	factory := handlerFactory{
+		keyring: createKeyring(t),
+		newAppHandler: func(httpHandler HttpRequestHandler) AppContentHandler {
+			return BinaryHTTPAppHandler{httpHandler: httpHandler}
+		},
+		targetHandler: FilteredHttpRequestHandler{client: &http.Client{}},
+	}
+	handler, err := factory.build(handlerConfig{
+		Path:           "/gateway-app",
+		Type:           handlerTypeTarget,
+		AllowedOrigins: []string{"app.example"},
+		DeniedOrigins:  []string{"denied.example"},
+		BearerToken:    "env:SHADOW_TEST_TOKEN",
+		ShadowTarget:   shadow.URL,
+		ShadowPercent:  100,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpHandler := handler.(DefaultEncapsulationHandler).appHandler.(BinaryHTTPAppHandler).httpHandler
+
+	for _, target := range []string{"https://other.example/items", "https://denied.example/items"} {
+		req, err := http.NewRequest(http.MethodGet, target, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		metrics := &MockMetrics{resultLabels: map[string]bool{}, tags: map[string]string{}}
+		if _, err := httpHandler.Handle(req, metrics); err != GatewayTargetForbiddenError {
+			t.Fatalf("Expected %s to be forbidden, got %v", target, err)
+		}
+		if metrics.resultLabels[metricsResultShadowMirrored] {
+			t.Fatalf("Forbidden request to %s was mirrored", target)
+		}
+	}
+	select {
+	case authorization := <-mirrored:
+		t.Fatalf("Forbidden request was mirrored with credentials %q", authorization)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
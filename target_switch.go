@@ -0,0 +1,113 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+)
+
+const (
+	adminSwitchTargetEndpoint   = "/admin/switch-target"
+	adminRollbackTargetEndpoint = "/admin/rollback-target"
+)
+
+// targetSwitch holds the active target of a handler, which the admin API switches for blue/green
+// cutovers. The previously active target is kept, so a cutover can be rolled back instantly.
+type targetSwitch struct {
+	mu       sync.RWMutex
+	active   *url.URL
+	previous *url.URL
+}
+
+func newTargetSwitch(target *url.URL) *targetSwitch {
+	return &targetSwitch{active: target}
+}
+
+func (s *targetSwitch) current() *url.URL {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.active
+}
+
+// set makes target the active target, and returns the previously active one.
+func (s *targetSwitch) set(target *url.URL) *url.URL {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.previous, s.active = s.active, target
+	return s.previous
+}
+
+// rollback makes the previously active target active again, so that a second rollback undoes the first.
+func (s *targetSwitch) rollback() (*url.URL, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.previous == nil {
+		return nil, errors.New("No previous target to roll back to")
+	}
+	s.previous, s.active = s.active, s.previous
+	return s.active, nil
+}
+
+// targetSwitchFor returns the switch of the handler at the path query parameter.
+func (s adminServer) targetSwitchFor(w http.ResponseWriter, r *http.Request) (string, *targetSwitch, bool) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return "", nil, false
+	}
+	path := r.URL.Query().Get("path")
+	targetSwitch, ok := s.targetSwitches[path]
+	if !ok {
+		http.Error(w, fmt.Sprintf("No handler with a switchable target at %q", path), http.StatusNotFound)
+		return "", nil, false
+	}
+	return path, targetSwitch, true
+}
+
+// switchTargetHandler makes the URL of the target query parameter the active target of the handler at
+// the path query parameter.
+func (s adminServer) switchTargetHandler(w http.ResponseWriter, r *http.Request) {
+	path, targetSwitch, ok := s.targetSwitchFor(w, r)
+	if !ok {
+		return
+	}
+	target, err := parseTargetURL(r.URL.Query().Get("target"), path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	previous := targetSwitch.set(target)
+	log.Printf("Switched the target of %s from %s to %s from admin endpoint", path, previous, target)
+
+	writeJSON(w, map[string]interface{}{
+		"path":            path,
+		"target":          target.String(),
+		"previous_target": previous.String(),
+	})
+}
+
+// rollbackTargetHandler makes the previously active target of the handler at the path query parameter
+// active again.
+func (s adminServer) rollbackTargetHandler(w http.ResponseWriter, r *http.Request) {
+	path, targetSwitch, ok := s.targetSwitchFor(w, r)
+	if !ok {
+		return
+	}
+	target, err := targetSwitch.rollback()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	log.Printf("Rolled back the target of %s to %s from admin endpoint", path, target)
+
+	writeJSON(w, map[string]interface{}{
+		"path":   path,
+		"target": target.String(),
+	})
+}
@@ -0,0 +1,170 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// targetTLSConfig configures the TLS connections to targets.
+type targetTLSConfig struct {
+	// certFile and keyFile are the PEM files of the client certificate presented to targets that request one.
+	certFile string
+	keyFile  string
+	// caFile is a PEM bundle of the CA certificates that target certificates are verified with, instead
+	// of the system roots.
+	caFile string
+	// minVersion is the minimum TLS version, "1.0" to "1.3".
+	minVersion string
+	// pins are base64 SHA-256 digests of SubjectPublicKeyInfo, one of which must be the key of a
+	// certificate of the target's chain.
+	pins []string
+}
+
+func targetTLSConfigFromEnvironment() targetTLSConfig {
+	return targetTLSConfig{
+		certFile:   os.Getenv(targetClientCertVariable),
+		keyFile:    os.Getenv(targetClientKeyVariable),
+		caFile:     os.Getenv(targetCABundleVariable),
+		minVersion: os.Getenv(targetTLSMinVersionVariable),
+		pins:       splitList(os.Getenv(targetTLSPinsVariable)),
+	}
+}
+
+func splitList(list string) []string {
+	values := []string{}
+	for _, value := range strings.Split(list, ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// override returns c with the settings that are set in o.
+func (c targetTLSConfig) override(o targetTLSConfig) targetTLSConfig {
+	if o.certFile != "" || o.keyFile != "" {
+		c.certFile, c.keyFile = o.certFile, o.keyFile
+	}
+	if o.caFile != "" {
+		c.caFile = o.caFile
+	}
+	if o.minVersion != "" {
+		c.minVersion = o.minVersion
+	}
+	if len(o.pins) > 0 {
+		c.pins = o.pins
+	}
+	return c
+}
+
+func (c targetTLSConfig) isDefault() bool {
+	return c.certFile == "" && c.keyFile == "" && c.caFile == "" && c.minVersion == "" && len(c.pins) == 0
+}
+
+// load builds the tls.Config of target connections, or nil for the default one.
+func (c targetTLSConfig) load() (*tls.Config, error) {
+	if c.isDefault() {
+		return nil, nil
+	}
+	config := &tls.Config{}
+	if c.certFile != "" || c.keyFile != "" {
+		if c.certFile == "" || c.keyFile == "" {
+			return nil, errors.New("A target client certificate requires both a certificate and a key file")
+		}
+		certificate := &clientCertificate{certFile: c.certFile, keyFile: c.keyFile}
+		if _, err := certificate.get(nil); err != nil {
+			return nil, err
+		}
+		config.GetClientCertificate = certificate.get
+	}
+	if c.caFile != "" {
+		bundle, err := ioutil.ReadFile(c.caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(bundle) {
+			return nil, fmt.Errorf("No CA certificates in %s", c.caFile)
+		}
+	}
+	if c.minVersion != "" {
+		version, ok := tlsVersions[c.minVersion]
+		if !ok {
+			return nil, fmt.Errorf("Invalid minimum TLS version %q", c.minVersion)
+		}
+		config.MinVersion = version
+	}
+	if len(c.pins) > 0 {
+		pins := map[string]bool{}
+		for _, pin := range c.pins {
+			if digest, err := base64.StdEncoding.DecodeString(pin); err != nil || len(digest) != sha256.Size {
+				return nil, fmt.Errorf("Invalid SPKI pin %q", pin)
+			}
+			pins[pin] = true
+		}
+		config.VerifyConnection = func(state tls.ConnectionState) error {
+			for _, certificate := range state.PeerCertificates {
+				digest := sha256.Sum256(certificate.RawSubjectPublicKeyInfo)
+				if pins[base64.StdEncoding.EncodeToString(digest[:])] {
+					return nil
+				}
+			}
+			return fmt.Errorf("No pinned key in the certificate chain of %s", state.ServerName)
+		}
+	}
+	return config, nil
+}
+
+// clientCertificate loads a client certificate from its files, and reloads it when the certificate file
+// changes, so that certificates can be rotated without restarting the gateway.
+type clientCertificate struct {
+	certFile string
+	keyFile  string
+
+	mu          sync.Mutex
+	certificate *tls.Certificate
+	modTime     time.Time
+}
+
+func (c *clientCertificate) get(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	info, err := os.Stat(c.certFile)
+	if err != nil {
+		if c.certificate != nil {
+			return c.certificate, nil
+		}
+		return nil, err
+	}
+	if c.certificate == nil || !info.ModTime().Equal(c.modTime) {
+		certificate, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+		if err != nil {
+			if c.certificate != nil {
+				// The key file may not be updated yet
+				return c.certificate, nil
+			}
+			return nil, err
+		}
+		c.certificate, c.modTime = &certificate, info.ModTime()
+	}
+	return c.certificate, nil
+}
@@ -0,0 +1,189 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeClientCertificate writes a self-signed client certificate for commonName to certFile and keyFile.
+func writeClientCertificate(t *testing.T, certFile, keyFile, commonName string) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     []string{commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certificate
+}
+
+func TestTargetClientCertificate(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "client.pem"), filepath.Join(dir, "client-key.pem")
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(writeClientCertificate(t, certFile, keyFile, "gateway"))
+
+	target := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	target.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	target.StartTLS()
+	defer target.Close()
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(target.Certificate())
+
+	if _, err := (targetClientConfig{tls: &tls.Config{RootCAs: rootCAs}}).client().Get(target.URL); err == nil {
+		t.Fatal("Expected the target to require a client certificate")
+	}
+
+	tlsConfig, err := targetTLSConfig{certFile: certFile, keyFile: keyFile}.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsConfig.RootCAs = rootCAs
+	client := targetClientConfig{tls: tlsConfig}.client()
+	get := func() string {
+		resp, err := client.Get(target.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return string(body)
+	}
+	if name := get(); name != "gateway" {
+		t.Fatalf("Target authenticated %q", name)
+	}
+
+	// A rotated certificate is presented on new connections
+	clientCAs.AddCert(writeClientCertificate(t, certFile, keyFile, "gateway-rotated"))
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(certFile, later, later); err != nil {
+		t.Fatal(err)
+	}
+	client.CloseIdleConnections()
+	if name := get(); name != "gateway-rotated" {
+		t.Fatalf("Target authenticated %q after rotation", name)
+	}
+}
+
+func TestTargetTLSConfigRequiresKey(t *testing.T) {
+	if _, err := (targetTLSConfig{certFile: "client.pem"}).load(); err == nil {
+		t.Fatal("Expected a client certificate without a key to be rejected")
+	}
+	if config, err := (targetTLSConfig{}).load(); err != nil || config != nil {
+		t.Fatalf("Unexpected default TLS config %v %v", config, err)
+	}
+}
+
+func TestTargetTLSConfigCABundleAndPins(t *testing.T) {
+	target := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer target.Close()
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: target.Certificate().Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256(target.Certificate().RawSubjectPublicKeyInfo)
+	pin := base64.StdEncoding.EncodeToString(digest[:])
+	otherPin := base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))
+
+	get := func(settings targetTLSConfig) error {
+		tlsConfig, err := settings.load()
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := targetClientConfig{tls: tlsConfig}.client().Get(target.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+	if err := get(targetTLSConfig{minVersion: "1.2"}); err == nil {
+		t.Fatal("Expected a target of a private CA to be rejected without the CA bundle")
+	}
+	if err := get(targetTLSConfig{caFile: caFile}); err != nil {
+		t.Fatalf("Target of the CA bundle rejected: %s", err)
+	}
+	if err := get(targetTLSConfig{caFile: caFile, pins: []string{otherPin, pin}}); err != nil {
+		t.Fatalf("Target of a pinned key rejected: %s", err)
+	}
+	if err := get(targetTLSConfig{caFile: caFile, pins: []string{otherPin}}); err == nil {
+		t.Fatal("Expected a target without a pinned key to be rejected")
+	}
+}
+
+func TestTargetTLSConfigMinVersion(t *testing.T) {
+	target := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	target.TLS = &tls.Config{MaxVersion: tls.VersionTLS12}
+	target.StartTLS()
+	defer target.Close()
+
+	tlsConfig, err := targetTLSConfig{minVersion: "1.3"}.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsConfig.RootCAs = x509.NewCertPool()
+	tlsConfig.RootCAs.AddCert(target.Certificate())
+	if _, err := (targetClientConfig{tls: tlsConfig}).client().Get(target.URL); err == nil {
+		t.Fatal("Expected a TLS 1.2 target to be rejected")
+	}
+
+	for _, settings := range []targetTLSConfig{{minVersion: "1.4"}, {pins: []string{"not-a-digest"}}} {
+		if _, err := settings.load(); err == nil {
+			t.Fatalf("Expected %+v to be rejected", settings)
+		}
+	}
+}
+
+func TestTargetTLSConfigOverride(t *testing.T) {
+	base := targetTLSConfig{certFile: "gateway.pem", keyFile: "gateway-key.pem", minVersion: "1.2"}
+	settings := base.override(targetTLSConfig{caFile: "ca.pem", minVersion: "1.3"})
+	if settings.certFile != "gateway.pem" || settings.caFile != "ca.pem" || settings.minVersion != "1.3" {
+		t.Fatalf("Unexpected settings %+v", settings)
+	}
+}
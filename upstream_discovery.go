@@ -0,0 +1,193 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultDiscoveryInterval = 30 * time.Second
+	defaultConsulAddress     = "127.0.0.1:8500"
+
+	// Consul agent address and ACL token, as for the Consul CLI
+	consulAddressEnvironmentVariable = "CONSUL_HTTP_ADDR"
+	consulTokenEnvironmentVariable   = "CONSUL_HTTP_TOKEN"
+)
+
+// upstreamDiscovery finds the current upstreams of a pool, with their weights.
+type upstreamDiscovery interface {
+	discover(ctx context.Context) ([]*url.URL, []int, error)
+}
+
+// newUpstreamDiscovery parses a discovery source, which is "srv:<name>" for the targets of a DNS SRV
+// record, or "consul:<service>" for the passing instances of a Consul service. Discovered targets are
+// reached with scheme.
+func newUpstreamDiscovery(source, scheme string, resolver *net.Resolver) (upstreamDiscovery, error) {
+	if scheme == "" {
+		scheme = "https"
+	}
+	if scheme != "https" && scheme != "http" {
+		return nil, fmt.Errorf("Invalid discovery scheme %q", scheme)
+	}
+	parts := strings.SplitN(source, ":", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return nil, fmt.Errorf("Invalid discovery source %q", source)
+	}
+	switch parts[0] {
+	case "srv":
+		if resolver == nil {
+			resolver = net.DefaultResolver
+		}
+		return srvDiscovery{name: parts[1], scheme: scheme, resolver: resolver}, nil
+	case "consul":
+		address := os.Getenv(consulAddressEnvironmentVariable)
+		if address == "" {
+			address = defaultConsulAddress
+		}
+		if !strings.Contains(address, "://") {
+			address = "http://" + address
+		}
+		return consulDiscovery{
+			address: strings.TrimSuffix(address, "/"),
+			token:   os.Getenv(consulTokenEnvironmentVariable),
+			service: parts[1],
+			scheme:  scheme,
+			client:  &http.Client{Timeout: 5 * time.Second},
+		}, nil
+	default:
+		return nil, fmt.Errorf("Unknown discovery source %q", source)
+	}
+}
+
+// srvDiscovery discovers the targets of the lowest priority of a DNS SRV record (RFC 2782), weighted by
+// their SRV weights.
+type srvDiscovery struct {
+	name     string
+	scheme   string
+	resolver *net.Resolver
+}
+
+func (d srvDiscovery) discover(ctx context.Context) ([]*url.URL, []int, error) {
+	_, records, err := d.resolver.LookupSRV(ctx, "", "", d.name)
+	if err != nil {
+		return nil, nil, err
+	}
+	sort.SliceStable(records, func(i, j int) bool { return records[i].Priority < records[j].Priority })
+	targets, weights := []*url.URL{}, []int{}
+	for _, record := range records {
+		if record.Priority != records[0].Priority || record.Target == "." {
+			continue
+		}
+		host := net.JoinHostPort(strings.TrimSuffix(record.Target, "."), strconv.Itoa(int(record.Port)))
+		targets = append(targets, &url.URL{Scheme: d.scheme, Host: host})
+		weights = append(weights, int(record.Weight))
+	}
+	return targets, weights, nil
+}
+
+// consulDiscovery discovers the instances of a Consul service that pass their health checks, weighted by
+// their passing weights.
+type consulDiscovery struct {
+	address string
+	token   string
+	service string
+	scheme  string
+	client  *http.Client
+}
+
+type consulServiceEntry struct {
+	Node struct {
+		Address string
+	}
+	Service struct {
+		Address string
+		Port    int
+		Weights struct {
+			Passing int
+		}
+	}
+}
+
+func (d consulDiscovery) discover(ctx context.Context) ([]*url.URL, []int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, d.address+"/v1/health/service/"+url.PathEscape(d.service)+"?passing=true", nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if d.token != "" {
+		req.Header.Set("X-Consul-Token", d.token)
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("Consul returned %s for service %s", resp.Status, d.service)
+	}
+	var entries []consulServiceEntry
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, nil, err
+	}
+
+	targets, weights := []*url.URL{}, []int{}
+	for _, entry := range entries {
+		address := entry.Service.Address
+		if address == "" {
+			address = entry.Node.Address
+		}
+		targets = append(targets, &url.URL{Scheme: d.scheme, Host: net.JoinHostPort(address, strconv.Itoa(entry.Service.Port))})
+		weights = append(weights, entry.Service.Weights.Passing)
+	}
+	return targets, weights, nil
+}
+
+// setUpstreams replaces the upstreams of the pool, keeping the state of those that remain.
+func (p *upstreamPool) setUpstreams(targets []*url.URL, weights []int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	existing := map[string]*upstream{}
+	for _, u := range p.upstreams {
+		existing[u.target.String()] = u
+	}
+	upstreams := []*upstream{}
+	for _, u := range newUpstreamPool(targets, weights, p.balance).upstreams {
+		if previous, ok := existing[u.target.String()]; ok {
+			previous.weight = u.weight
+			u = previous
+		}
+		upstreams = append(upstreams, u)
+	}
+	p.upstreams = upstreams
+}
+
+// runDiscovery refreshes the upstreams of the pool every discovery interval. The upstreams are kept when
+// discovery fails or finds none, so that an outage of the discovery source does not take the handler down.
+func (p *upstreamPool) runDiscovery() {
+	interval := p.discoveryInterval
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		targets, weights, err := p.discovery.discover(ctx)
+		cancel()
+		if err != nil {
+			log.Printf("Upstream discovery failed: %s", err)
+		} else if len(targets) == 0 {
+			log.Printf("Upstream discovery found no targets, keeping the previous upstreams")
+		} else {
+			p.setUpstreams(targets, weights)
+		}
+		time.Sleep(interval)
+	}
+}
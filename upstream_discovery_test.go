@@ -0,0 +1,69 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestConsulDiscovery(t *testing.T) {
+	consul := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/health/service/app" || r.URL.Query().Get("passing") != "true" || r.Header.Get("X-Consul-Token") != "token" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`[
+			{"Node": {"Address": "10.0.0.1"}, "Service": {"Address": "", "Port": 8443, "Weights": {"Passing": 3}}},
+			{"Node": {"Address": "10.0.0.2"}, "Service": {"Address": "10.1.0.2", "Port": 8443, "Weights": {"Passing": 1}}}
+		]`))
+	}))
+	defer consul.Close()
+	t.Setenv(consulAddressEnvironmentVariable, consul.URL)
+	t.Setenv(consulTokenEnvironmentVariable, "token")
+
+	discovery, err := newUpstreamDiscovery("consul:app", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	targets, weights, err := discovery.discover(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(targets) != 2 || targets[0].String() != "https://10.0.0.1:8443" || targets[1].String() != "https://10.1.0.2:8443" || weights[0] != 3 {
+		t.Fatalf("Unexpected discovered targets %v %v", targets, weights)
+	}
+
+	for _, source := range []string{"consul:", "zookeeper:app", "app"} {
+		if _, err := newUpstreamDiscovery(source, "", nil); err == nil {
+			t.Errorf("Expected discovery source %q to be rejected", source)
+		}
+	}
+}
+
+func TestUpstreamPoolSetUpstreams(t *testing.T) {
+	a, _ := url.Parse("https://a.example")
+	b, _ := url.Parse("https://b.example")
+	c, _ := url.Parse("https://c.example")
+
+	pool := newUpstreamPool(nil, nil, balanceFailover)
+	handler := UpstreamHttpRequestHandler{pool: pool, httpHandler: ForbiddenCheckHttpRequestHandler{}}
+	req, _ := http.NewRequest(http.MethodGet, "https://app.example/", nil)
+	if _, err := handler.Handle(req, &MockMetrics{resultLabels: map[string]bool{}, tags: map[string]string{}}); err != GatewayTargetUnavailableError {
+		t.Fatalf("Expected a pool without upstreams to be unavailable, got %v", err)
+	}
+
+	pool.setUpstreams([]*url.URL{a, b}, nil)
+	failed := pool.order()[0]
+	pool.begin(failed)
+	pool.record(failed, true)
+	pool.setUpstreams([]*url.URL{a, c}, []int{1, 2})
+	order := pool.order()
+	if len(order) != 2 || order[0].target.Host != "c.example" || order[1] != failed {
+		t.Fatalf("Expected the failure of a.example to be kept, got %s, %s", order[0].target.Host, order[1].target.Host)
+	}
+}
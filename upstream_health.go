@@ -0,0 +1,135 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+)
+
+const (
+	defaultHealthCheckInterval = 10 * time.Second
+
+	metricsEventTargetHealthCheck = "target_health_check"
+	metricsResultTargetHealthy    = "healthy"
+	metricsResultTargetUnhealthy  = "unhealthy"
+	metricsTagTarget              = "target"
+)
+
+// upstreamHealthCheck probes each upstream of a pool every interval, with a request to path relative to
+// its base URL. An upstream that fails to respond or responds with a 4xx or 5xx status is taken out of
+// rotation until a probe succeeds again.
+type upstreamHealthCheck struct {
+	method   string
+	path     string
+	interval time.Duration
+
+	// client replaces the gateway's target client for the probes, if the handler has its own
+	client *http.Client
+}
+
+// probe sends a health check to u, and reports whether it is up.
+func (c upstreamHealthCheck) probe(client *http.Client, u *upstream) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), c.interval)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, c.method, upstreamURL(u.target, &url.URL{Path: c.path}).String(), nil)
+	if err != nil {
+		return false
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode < 400
+}
+
+// checkHealth probes every upstream of the pool once, and counts the result of each with a metric tagged
+// with the upstream host.
+func (p *upstreamPool) checkHealth(client *http.Client, metricsFactory MetricsFactory) {
+	p.mu.Lock()
+	upstreams := append([]*upstream{}, p.upstreams...)
+	p.mu.Unlock()
+	if p.healthCheck.client != nil {
+		client = p.healthCheck.client
+	}
+	for _, u := range upstreams {
+		up := p.healthCheck.probe(client, u)
+		p.mu.Lock()
+		changed := u.down == up
+		u.down = !up
+		p.mu.Unlock()
+		if changed {
+			log.Printf("Upstream %s is %s", u.target, map[bool]string{true: "up", false: "down"}[up])
+		}
+
+		metrics := metricsFactory.Create(metricsEventTargetHealthCheck)
+		metrics.Tag(metricsTagTarget, u.target.Host)
+		if up {
+			metrics.Fire(metricsResultTargetHealthy)
+		} else {
+			metrics.Fire(metricsResultTargetUnhealthy)
+		}
+	}
+}
+
+// runHealthChecks checks the health of the pool's upstreams every health check interval.
+func (p *upstreamPool) runHealthChecks(client *http.Client, metricsFactory MetricsFactory) {
+	for {
+		p.checkHealth(client, metricsFactory)
+		time.Sleep(p.healthCheck.interval)
+	}
+}
+
+// ready reports whether a request can be sent to an upstream that passed its last health check, and
+// returns the health of each upstream.
+func (p *upstreamPool) ready() (bool, map[string]bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	ready := false
+	health := map[string]bool{}
+	for _, u := range p.upstreams {
+		health[u.target.String()] = !u.down
+		ready = ready || !u.down
+	}
+	return ready, health
+}
+
+// readyHandler reports whether every endpoint with actively checked upstreams has one that is up, with
+// a HTTP 503 Service Unavailable return code otherwise, and lists the health of each upstream.
+func (s gatewayServer) readyHandler(w http.ResponseWriter, r *http.Request) {
+	paths := []string{}
+	for path := range s.upstreamPools {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	ready := true
+	report := ""
+	for _, path := range paths {
+		pool := s.upstreamPools[path]
+		if pool.healthCheck == nil {
+			continue
+		}
+		poolReady, health := pool.ready()
+		ready = ready && poolReady
+		targets := []string{}
+		for target := range health {
+			targets = append(targets, target)
+		}
+		sort.Strings(targets)
+		for _, target := range targets {
+			report += fmt.Sprintf("%s %s %s\n", path, target, map[bool]string{true: "up", false: "down"}[health[target]])
+		}
+	}
+	if !ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	fmt.Fprint(w, report)
+}
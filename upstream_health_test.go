@@ -0,0 +1,52 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestUpstreamHealthCheck(t *testing.T) {
+	healthy := true
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodHead || r.URL.Path != "/v1/healthz" || !healthy {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer target.Close()
+	targetURL, _ := url.Parse(target.URL + "/v1")
+	other, _ := url.Parse("https://other.example")
+
+	pool := newUpstreamPool([]*url.URL{targetURL, other}, nil, balanceFailover)
+	pool.healthCheck = &upstreamHealthCheck{method: http.MethodHead, path: "/healthz", interval: time.Second}
+	server := gatewayServer{upstreamPools: map[string]*upstreamPool{"/gateway-app": pool}}
+	ready := func() int {
+		rr := httptest.NewRecorder()
+		server.readyHandler(rr, httptest.NewRequest(http.MethodGet, readyEndpoint, nil))
+		return rr.Code
+	}
+
+	// other.example does not resolve, so the target is the only upstream in rotation
+	metricsFactory := &MockMetricsFactory{}
+	pool.checkHealth(target.Client(), metricsFactory)
+	if order := pool.order(); order[0].target != targetURL || !order[1].down {
+		t.Fatalf("Expected the unreachable upstream to be taken out of rotation")
+	}
+	if status := ready(); status != http.StatusOK {
+		t.Fatalf("Expected ready with a healthy upstream, got %d", status)
+	}
+
+	healthy = false
+	pool.checkHealth(target.Client(), metricsFactory)
+	if status := ready(); status != http.StatusServiceUnavailable {
+		t.Fatalf("Expected not ready without healthy upstreams, got %d", status)
+	}
+	if !metricsFactory.metrics[0].resultLabels[metricsResultTargetHealthy] || metricsFactory.metrics[0].tags[metricsTagTarget] != targetURL.Host {
+		t.Fatalf("Expected a tagged health check metric, got %+v", metricsFactory.metrics[0])
+	}
+}
@@ -0,0 +1,239 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// Time after a failure during which an upstream is tried after the healthy ones
+	defaultUpstreamFailureCooldown = 30 * time.Second
+
+	metricsResultTargetFailoverPrefix = "target_failover_"
+)
+
+// Balancing strategies of an upstreamPool, which choose the upstream a request is sent to first
+const (
+	balanceFailover     = "failover"
+	balanceRoundRobin   = "round_robin"
+	balanceLeastPending = "least_pending"
+)
+
+// upstream is a target base URL of an upstreamPool, with its weight, pending requests, and recent failures.
+type upstream struct {
+	target      *url.URL
+	weight      int
+	failures    int
+	lastFailure time.Time
+
+	pending       int
+	currentWeight int
+
+	// down is set by health checks while the upstream fails them
+	down bool
+}
+
+func (u *upstream) healthy(now time.Time, cooldown time.Duration) bool {
+	return !u.down && (u.failures == 0 || now.Sub(u.lastFailure) >= cooldown)
+}
+
+// upstreamPool is the set of target base URLs that the requests of a handler are sent to. The balancing
+// strategy picks the first upstream of each request among the healthy ones: "failover" always picks the
+// first in configuration order, "round_robin" picks each in proportion to its weight, and "least_pending"
+// picks the one with the fewest pending requests relative to its weight.
+type upstreamPool struct {
+	balance     string
+	cooldown    time.Duration
+	now         func() time.Time
+	healthCheck *upstreamHealthCheck
+
+	discovery         upstreamDiscovery
+	discoveryInterval time.Duration
+
+	mu        sync.Mutex
+	upstreams []*upstream
+}
+
+// newUpstreamPool creates a pool of targets, with weights of 1 unless weights are given for every target.
+func newUpstreamPool(targets []*url.URL, weights []int, balance string) *upstreamPool {
+	pool := &upstreamPool{balance: balance, cooldown: defaultUpstreamFailureCooldown, now: time.Now}
+	for i, target := range targets {
+		weight := 1
+		if len(weights) == len(targets) && weights[i] > 0 {
+			weight = weights[i]
+		}
+		pool.upstreams = append(pool.upstreams, &upstream{target: target, weight: weight})
+	}
+	return pool
+}
+
+// order returns the upstreams in the order they are tried: the healthy ones in configuration order,
+// starting with the pick of the balancing strategy, followed by those that failed recently, with the
+// fewest failures first.
+func (p *upstreamPool) order() []*upstream {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := p.now()
+	ordered := append([]*upstream{}, p.upstreams...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		healthyI, healthyJ := ordered[i].healthy(now, p.cooldown), ordered[j].healthy(now, p.cooldown)
+		if healthyI != healthyJ {
+			return healthyI
+		}
+		return !healthyI && ordered[i].failures < ordered[j].failures
+	})
+
+	healthy := 0
+	for healthy < len(ordered) && ordered[healthy].healthy(now, p.cooldown) {
+		healthy++
+	}
+	if first := p.pick(ordered[:healthy]); first > 0 {
+		picked := ordered[first]
+		copy(ordered[1:first+1], ordered[:first])
+		ordered[0] = picked
+	}
+	return ordered
+}
+
+// pick returns the index of the upstream among candidates that the balancing strategy sends the next
+// request to. Round robin is the smooth weighted round robin of nginx, which interleaves the picks of
+// upstreams with different weights.
+func (p *upstreamPool) pick(candidates []*upstream) int {
+	if len(candidates) == 0 {
+		return 0
+	}
+	best := 0
+	switch p.balance {
+	case balanceRoundRobin:
+		total := 0
+		for i, u := range candidates {
+			u.currentWeight += u.weight
+			total += u.weight
+			if u.currentWeight > candidates[best].currentWeight {
+				best = i
+			}
+		}
+		candidates[best].currentWeight -= total
+	case balanceLeastPending:
+		for i, u := range candidates {
+			// pending/weight < best pending/weight
+			if u.pending*candidates[best].weight < candidates[best].pending*u.weight {
+				best = i
+			}
+		}
+	}
+	return best
+}
+
+func (p *upstreamPool) begin(u *upstream) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	u.pending++
+}
+
+func (p *upstreamPool) record(u *upstream, failed bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	u.pending--
+	if !failed {
+		u.failures = 0
+		return
+	}
+	u.failures++
+	u.lastFailure = p.now()
+}
+
+// upstreamURL returns the URL of req at target, whose path, if any, prefixes the request path.
+func upstreamURL(target *url.URL, req *url.URL) *url.URL {
+	u := *req
+	u.Scheme = target.Scheme
+	u.Host = target.Host
+	if target.Path != "" && target.Path != "/" {
+		u.Path = path.Join(target.Path, req.Path)
+		u.RawPath = ""
+	}
+	return &u
+}
+
+// onceMetrics fires each result at most once, so that a request sent to several upstreams is counted once
+// for each of its outcomes.
+type onceMetrics struct {
+	Metrics
+	fired map[string]bool
+}
+
+func (m onceMetrics) Fire(result string) {
+	if !m.fired[result] {
+		m.fired[result] = true
+		m.Metrics.Fire(result)
+	}
+}
+
+// UpstreamHttpRequestHandler is an HttpRequestHandler that sends each request to the upstreams of its
+// pool in turn, failing over to the next upstream on network errors, open circuits, and 5xx responses.
+// Requests forbidden by the next handler are not retried on other upstreams.
+type UpstreamHttpRequestHandler struct {
+	pool        *upstreamPool
+	httpHandler HttpRequestHandler
+}
+
+func (h UpstreamHttpRequestHandler) Handle(req *http.Request, metrics Metrics) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		if body, err = ioutil.ReadAll(req.Body); err != nil {
+			return nil, err
+		}
+		req.Body.Close()
+	}
+
+	metrics = onceMetrics{Metrics: metrics, fired: map[string]bool{}}
+	upstreams := h.pool.order()
+	if len(upstreams) == 0 {
+		// No upstream was discovered yet
+		return nil, GatewayTargetUnavailableError
+	}
+	var resp *http.Response
+	var err error
+	for i, u := range upstreams {
+		if i > 0 {
+			metrics.Fire(metricsResultTargetFailoverPrefix + strconv.Itoa(i))
+		}
+		attempt := req.Clone(req.Context())
+		attempt.URL = upstreamURL(u.target, req.URL)
+		attempt.Host = u.target.Host
+		if body != nil {
+			attempt.Body = ioutil.NopCloser(bytes.NewReader(body))
+			attempt.GetBody = func() (io.ReadCloser, error) {
+				return ioutil.NopCloser(bytes.NewReader(body)), nil
+			}
+		}
+
+		h.pool.begin(u)
+		resp, err = h.httpHandler.Handle(attempt, metrics)
+		if err == GatewayTargetForbiddenError {
+			h.pool.record(u, false)
+			return nil, err
+		}
+		failed := err != nil || resp.StatusCode/100 == 5
+		h.pool.record(u, failed)
+		if !failed || i == len(upstreams)-1 {
+			break
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+	}
+	return resp, err
+}
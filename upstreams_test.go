@@ -0,0 +1,80 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestUpstreamFailover(t *testing.T) {
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write(append([]byte(r.URL.Path+" "), body...))
+	}))
+	defer up.Close()
+	downURL, _ := url.Parse(down.URL)
+	upURL, _ := url.Parse(up.URL + "/v1")
+
+	pool := newUpstreamPool([]*url.URL{downURL, upURL}, nil, balanceFailover)
+	handler := UpstreamHttpRequestHandler{pool: pool, httpHandler: FilteredHttpRequestHandler{client: &http.Client{}}}
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest(http.MethodPost, "https://app.example/items", bytes.NewReader([]byte("body")))
+		metrics := &MockMetrics{resultLabels: map[string]bool{}, tags: map[string]string{}}
+		resp, err := handler.Handle(req, metrics)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if body, _ := ioutil.ReadAll(resp.Body); !bytes.Equal(body, []byte("/v1/items body")) {
+			t.Fatalf("Unexpected upstream response %d %s", resp.StatusCode, body)
+		}
+		// The failed upstream is tried last once it failed
+		if failedOver := metrics.resultLabels[metricsResultTargetFailoverPrefix+"1"]; failedOver != (i == 0) {
+			t.Fatalf("Request %d failed over: %v", i, failedOver)
+		}
+	}
+
+	forbidden := UpstreamHttpRequestHandler{pool: pool, httpHandler: ForbiddenCheckHttpRequestHandler{forbidden: upURL.Host}}
+	req, _ := http.NewRequest(http.MethodGet, "https://app.example/items", nil)
+	if _, err := forbidden.Handle(req, &MockMetrics{resultLabels: map[string]bool{}, tags: map[string]string{}}); err != GatewayTargetForbiddenError {
+		t.Fatalf("Expected forbidden requests not to fail over, got %v", err)
+	}
+}
+
+func TestUpstreamBalancing(t *testing.T) {
+	a, _ := url.Parse("https://a.example")
+	b, _ := url.Parse("https://b.example")
+
+	pool := newUpstreamPool([]*url.URL{a, b}, []int{3, 1}, balanceRoundRobin)
+	picks := map[string]int{}
+	sequence := ""
+	for i := 0; i < 8; i++ {
+		host := pool.order()[0].target.Host
+		picks[host]++
+		sequence += host[:1]
+	}
+	if picks["a.example"] != 6 || picks["b.example"] != 2 || sequence != "aabaaaba" {
+		t.Fatalf("Unexpected weighted round robin picks %s", sequence)
+	}
+
+	pool = newUpstreamPool([]*url.URL{a, b}, []int{2, 1}, balanceLeastPending)
+	sequence = ""
+	for i := 0; i < 3; i++ {
+		next := pool.order()[0]
+		pool.begin(next)
+		sequence += next.target.Host[:1]
+	}
+	// With a pending request each, a has fewer pending requests relative to its weight
+	if sequence != "aba" {
+		t.Fatalf("Unexpected least pending picks %s", sequence)
+	}
+}
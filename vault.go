@@ -0,0 +1,176 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	defaultVaultSeedField = "seed"
+
+	// Retry interval used when a Vault token renewal fails
+	vaultRenewRetryInterval = 30 * time.Second
+
+	metricsEventVaultTokenRenewal    = "vault_token_renewal"
+	metricsResultVaultTokenRenewed   = "renewed"
+	metricsResultVaultRenewalFailed  = "renewal_failed"
+	metricsResultVaultTokenForbidden = "token_forbidden"
+)
+
+// vaultStatusError is returned for Vault responses with a status other than 200.
+type vaultStatusError struct {
+	method string
+	path   string
+	status int
+}
+
+func (e vaultStatusError) Error() string {
+	return fmt.Sprintf("Vault %s %s failed with status %d", e.method, e.path, e.status)
+}
+
+// VaultKeyProvider is a KeyProvider that reads the hex-encoded seed from a HashiCorp Vault secret.
+// Both the KV version 1 and version 2 secret engines are supported.
+type VaultKeyProvider struct {
+	address string
+	token   string
+	path    string
+	field   string
+	client  *http.Client
+}
+
+// newVaultKeyProvider builds a VaultKeyProvider from a key source of the form vault://<path>#<field>,
+// e.g. vault://secret/data/ohttp-gateway#seed. The Vault server and token are read from VAULT_ADDR
+// and VAULT_TOKEN.
+func newVaultKeyProvider(source *url.URL) (*VaultKeyProvider, error) {
+	address := os.Getenv(vaultAddressEnvironmentVariable)
+	if address == "" {
+		return nil, fmt.Errorf("%s must be set to use a Vault key source", vaultAddressEnvironmentVariable)
+	}
+	token := os.Getenv(vaultTokenEnvironmentVariable)
+	if token == "" {
+		return nil, fmt.Errorf("%s must be set to use a Vault key source", vaultTokenEnvironmentVariable)
+	}
+
+	path := strings.Trim(source.Host+source.Path, "/")
+	if path == "" {
+		return nil, fmt.Errorf("Vault key source is missing a secret path")
+	}
+	field := source.Fragment
+	if field == "" {
+		field = defaultVaultSeedField
+	}
+
+	return &VaultKeyProvider{
+		address: strings.TrimSuffix(address, "/"),
+		token:   token,
+		path:    path,
+		field:   field,
+		client:  keyProviderHTTPClient,
+	}, nil
+}
+
+func (p *VaultKeyProvider) Name() string {
+	return "vault"
+}
+
+func (p *VaultKeyProvider) do(method, path string, result interface{}) error {
+	req, err := http.NewRequest(method, fmt.Sprintf("%s/v1/%s", p.address, path), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Vault-Token", p.token)
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return vaultStatusError{method: method, path: path, status: resp.StatusCode}
+	}
+
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+// Seed reads the secret and decodes the configured field as a hex-encoded seed.
+func (p *VaultKeyProvider) Seed() ([]byte, error) {
+	seedHex, err := p.readField()
+	if err != nil {
+		return nil, err
+	}
+	return hex.DecodeString(seedHex)
+}
+
+// readField reads the secret and returns the configured field.
+func (p *VaultKeyProvider) readField() (string, error) {
+	var secret struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := p.do(http.MethodGet, p.path, &secret); err != nil {
+		return "", err
+	}
+
+	// KV version 2 nests the secret's fields in a second data object
+	data := secret.Data
+	if nested, ok := data["data"].(map[string]interface{}); ok {
+		data = nested
+	}
+
+	value, ok := data[p.field].(string)
+	if !ok {
+		return "", fmt.Errorf("Vault secret %s has no string field %q", p.path, p.field)
+	}
+	return value, nil
+}
+
+// renewToken renews the provider's token and returns its new lease duration. A zero duration means
+// the token does not expire.
+func (p *VaultKeyProvider) renewToken() (time.Duration, bool, error) {
+	var renewal struct {
+		Auth struct {
+			LeaseDuration int  `json:"lease_duration"`
+			Renewable     bool `json:"renewable"`
+		} `json:"auth"`
+	}
+	if err := p.do(http.MethodPost, "auth/token/renew-self", &renewal); err != nil {
+		return 0, false, err
+	}
+	return time.Duration(renewal.Auth.LeaseDuration) * time.Second, renewal.Auth.Renewable, nil
+}
+
+// KeepTokenAlive renews the provider's token at half its lease duration for as long as the token is
+// renewable, counting each renewal with a vault_token_renewal metric. Failed renewals are retried; while
+// they fail the gateway keeps using its current key. A token that Vault rejects with 403, because it was
+// revoked or has expired, can not be renewed again, so renewal stops with a token_forbidden result.
+func (p *VaultKeyProvider) KeepTokenAlive(metricsFactory MetricsFactory) {
+	for {
+		lease, renewable, err := p.renewToken()
+		metrics := metricsFactory.Create(metricsEventVaultTokenRenewal)
+		if statusErr, ok := err.(vaultStatusError); ok && statusErr.status == http.StatusForbidden {
+			metrics.Fire(metricsResultVaultTokenForbidden)
+			log.Printf("Vault rejected the token, no longer renewing it and keeping the current key: %s", err)
+			return
+		}
+		if err != nil {
+			metrics.Fire(metricsResultVaultRenewalFailed)
+			log.Printf("Failed to renew Vault token: %s", err)
+			time.Sleep(vaultRenewRetryInterval)
+			continue
+		}
+		metrics.Fire(metricsResultVaultTokenRenewed)
+		if !renewable || lease == 0 {
+			return
+		}
+		time.Sleep(lease / 2)
+	}
+}
@@ -0,0 +1,147 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestVaultKeyProviderSeed(t *testing.T) {
+	secrets := map[string]string{
+		// KV version 1
+		"/v1/kv/gateway": `{"data": {"seed": "cafe"}}`,
+		// KV version 2
+		"/v1/secret/data/gateway": `{"data": {"data": {"key": "f00d"}, "metadata": {"version": 3}}}`,
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "test-token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		secret, ok := secrets[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		fmt.Fprint(w, secret)
+	}))
+	defer server.Close()
+
+	t.Setenv(vaultAddressEnvironmentVariable, server.URL)
+	t.Setenv(vaultTokenEnvironmentVariable, "test-token")
+
+	for source, expected := range map[string][]byte{
+		"vault://kv/gateway":              {0xCA, 0xFE},
+		"vault://secret/data/gateway#key": {0xF0, 0x0D},
+	} {
+		sourceURL, err := url.Parse(source)
+		if err != nil {
+			t.Fatal(err)
+		}
+		provider, err := newVaultKeyProvider(sourceURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		seed, err := provider.Seed()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(seed, expected) {
+			t.Fatalf("Seed from %s is %x, expected %x", source, seed, expected)
+		}
+	}
+}
+
+func TestLoadSeedFallsBackToEnvironment(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	t.Setenv(vaultAddressEnvironmentVariable, server.URL)
+	t.Setenv(vaultTokenEnvironmentVariable, "test-token")
+	t.Setenv(secretSeedEnvironmentVariable, "beef")
+
+	sourceURL, err := url.Parse("vault://kv/gateway")
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider, err := newVaultKeyProvider(sourceURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seed, err := loadSeed(provider)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(seed, []byte{0xBE, 0xEF}) {
+		t.Fatalf("Expected fallback seed, got %x", seed)
+	}
+}
+
+func TestLoadSeedFailsWithoutEnvironmentSeed(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	t.Setenv(vaultAddressEnvironmentVariable, server.URL)
+	t.Setenv(vaultTokenEnvironmentVariable, "test-token")
+	t.Setenv(secretSeedEnvironmentVariable, "")
+
+	sourceURL, err := url.Parse("vault://kv/gateway")
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider, err := newVaultKeyProvider(sourceURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A random seed would serve a key that no other replica shares
+	if seed, err := loadSeed(provider); err == nil {
+		t.Fatalf("Expected the provider error, got seed %x", seed)
+	}
+}
+
+func TestVaultKeepTokenAliveStopsForRejectedToken(t *testing.T) {
+	renewals := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/auth/token/renew-self" || r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		renewals++
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, `{"errors": ["permission denied"]}`)
+	}))
+	defer server.Close()
+
+	provider := &VaultKeyProvider{address: server.URL, token: "revoked-token", client: server.Client()}
+	metricsFactory := &MockMetricsFactory{}
+	done := make(chan struct{})
+	go func() {
+		provider.KeepTokenAlive(metricsFactory)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Renewal of a rejected token was retried")
+	}
+
+	if renewals != 1 || len(metricsFactory.metrics) != 1 {
+		t.Fatalf("Expected a single renewal, got %d", renewals)
+	}
+	if metrics := metricsFactory.metrics[0]; metrics.eventName != metricsEventVaultTokenRenewal || !metrics.resultLabels[metricsResultVaultTokenForbidden] {
+		t.Fatalf("Unexpected renewal metrics %v", metrics.resultLabels)
+	}
+}
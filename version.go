@@ -0,0 +1,34 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"runtime"
+)
+
+// version is set at build time with -ldflags "-X main.version=<version>".
+var version = "dev"
+
+type versionInfo struct {
+	Version   string `json:"version"`
+	GoVersion string `json:"go_version"`
+	FIPS      bool   `json:"fips"`
+}
+
+func currentVersionInfo() versionInfo {
+	return versionInfo{
+		Version:   version,
+		GoVersion: runtime.Version(),
+		FIPS:      fipsMode(),
+	}
+}
+
+func (s gatewayServer) versionHandler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("%s Handling %s\n", r.Method, r.URL.Path)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(currentVersionInfo())
+}
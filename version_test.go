@@ -0,0 +1,31 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+)
+
+func TestVersionHandler(t *testing.T) {
+	handler := http.HandlerFunc(gatewayServer{}.versionHandler)
+
+	request := httptest.NewRequest(http.MethodGet, versionEndpoint, nil)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, request)
+
+	if status := rr.Result().StatusCode; status != http.StatusOK {
+		t.Fatal(status)
+	}
+	var info versionInfo
+	if err := json.NewDecoder(rr.Body).Decode(&info); err != nil {
+		t.Fatal(err)
+	}
+	if info.GoVersion != runtime.Version() || info.FIPS != fipsMode() {
+		t.Fatalf("Unexpected version info %+v", info)
+	}
+}